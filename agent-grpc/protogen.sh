@@ -0,0 +1,5 @@
+#!/bin/bash
+
+protoc -I=. -I=$GOPATH/src -I=$GOPATH/src/github.com/gogo/protobuf/protobuf --gogofast_out=plugins=grpc:. agent.proto
+# the package is built with -tags grpc only
+sed -i '1i //go:build grpc\n// +build grpc\n' agent.pb.go
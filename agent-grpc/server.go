@@ -0,0 +1,125 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build grpc
+// +build grpc
+
+// Package agent-grpc exposes a TCPAgent as a gRPC service, for driving a
+// consensus node from other languages. It's built with -tags grpc only, so
+// the agent can be used without gRPC. The service is defined in agent.proto.
+package agentgrpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/Sperax/bdls/agent-tcp"
+	"github.com/Sperax/bdls/crypto/blake2b"
+	proto "github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements AgentServer on a TCPAgent
+type Server struct {
+	agent *agent.TCPAgent
+}
+
+// NewServer creates a Server backed by the agent
+func NewServer(a *agent.TCPAgent) *Server { return &Server{agent: a} }
+
+// Register registers the Agent service of a on s
+func Register(s *grpc.Server, a *agent.TCPAgent) { RegisterAgentServer(s, NewServer(a)) }
+
+// Propose proposes a state at the next height, see TCPAgent.Propose, the
+// height replied is the one following the latest decided height.
+func (s *Server) Propose(ctx context.Context, req *ProposeRequest) (*ProposeReply, error) {
+	height, _, _ := s.agent.GetLatestState()
+	if err := s.agent.Propose(req.State); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &ProposeReply{Height: height + 1}, nil
+}
+
+// Subscribe streams decisions from req.FromHeight until the agent closes,
+// or the client cancels, see TCPAgent.ExportTo.
+func (s *Server) Subscribe(req *SubscribeRequest, stream Agent_SubscribeServer) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() { pw.CloseWithError(s.agent.ExportTo(pw, req.FromHeight)) }()
+
+	// unblock the reader on cancellation
+	ctx := stream.Context()
+	go func() {
+		<-ctx.Done()
+		pr.CloseWithError(ctx.Err())
+	}()
+
+	for {
+		decision, err := agent.ReadDecision(pr)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return exportError(err)
+		}
+
+		proof, err := proto.Marshal(decision.Proof)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		err = stream.Send(&ConfirmedState{Height: decision.Height, Round: decision.Round, State: decision.State, Proof: proof})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CurrentState returns the latest decided height, round and the hash of the
+// state.
+func (s *Server) CurrentState(ctx context.Context, req *CurrentStateRequest) (*CurrentStateReply, error) {
+	height, round, state := s.agent.GetLatestState()
+	hash := blake2b.Sum256(state)
+	return &CurrentStateReply{Height: height, Round: round, Hash: hash[:]}, nil
+}
+
+// exportError converts an error of ExportTo to a gRPC status
+func exportError(err error) error {
+	switch err {
+	case agent.ErrAgentClosed:
+		return status.Error(codes.Unavailable, err.Error())
+	case agent.ErrExportLagged:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,119 @@
+//go:build grpc
+// +build grpc
+
+package agentgrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sperax/bdls"
+	"github.com/Sperax/bdls/agent-tcp"
+	"github.com/Sperax/bdls/crypto/blake2b"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// createTestAgents creates n connected agents of a quorum
+func createTestAgents(t *testing.T, n int) ([]*agent.TCPAgent, []*ecdsa.PublicKey) {
+	var keys []*ecdsa.PrivateKey
+	var pubkeys []*ecdsa.PublicKey
+	var coords []bdls.Identity
+	for i := 0; i < n; i++ {
+		privateKey, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		pubkeys = append(pubkeys, &privateKey.PublicKey)
+		coords = append(coords, bdls.DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+
+	agents := make([]*agent.TCPAgent, n)
+	for i := range keys {
+		config := new(bdls.Config)
+		config.Epoch = time.Now()
+		config.PrivateKey = keys[i]
+		config.Participants = coords
+		config.StateCompare = func(a bdls.State, b bdls.State) int { return bytes.Compare(a, b) }
+		config.StateValidate = func(a bdls.State) bool { return true }
+
+		consensus, err := bdls.NewConsensus(config)
+		assert.Nil(t, err)
+		consensus.SetLatency(10 * time.Millisecond)
+		agents[i] = agent.NewSealedTCPAgent(consensus, keys[i])
+	}
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			c1, c2 := net.Pipe()
+			p1 := agent.NewTCPPeer(c1, agents[i])
+			p2 := agent.NewTCPPeer(c2, agents[j])
+			assert.True(t, agents[i].AddPeer(p1))
+			assert.True(t, agents[j].AddPeer(p2))
+			p1.InitiatePublicKeyAuthentication()
+			p2.InitiatePublicKeyAuthentication()
+		}
+	}
+	for _, a := range agents {
+		a.Start()
+	}
+	return agents, pubkeys
+}
+
+func TestAgentService(t *testing.T) {
+	agents, participants := createTestAgents(t, 4)
+	defer func() {
+		for _, a := range agents {
+			a.Close()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	Register(s, agents[0])
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := NewAgentClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &SubscribeRequest{FromHeight: 1})
+	assert.Nil(t, err)
+
+	// propose via the service, and directly on the other agents
+	reply, err := client.Propose(ctx, &ProposeRequest{State: []byte("state")})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), reply.Height)
+	for _, a := range agents[1:] {
+		assert.Nil(t, a.Propose([]byte("state")))
+	}
+
+	decision, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), decision.Height)
+	assert.Nil(t, bdls.VerifyDecision(participants, bdls.S256Curve, decision.Height, decision.State, decision.Proof))
+
+	current, err := client.CurrentState(ctx, &CurrentStateRequest{})
+	assert.Nil(t, err)
+	hash := blake2b.Sum256(decision.State)
+	assert.Equal(t, decision.Height, current.Height)
+	assert.Equal(t, hash[:], current.Hash)
+
+	// the stream ends with the agent
+	agents[0].Close()
+	for {
+		if _, err := stream.Recv(); err != nil {
+			assert.NotEqual(t, context.DeadlineExceeded, ctx.Err())
+			break
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// buffers are pooled in power of 2 sizes from 2^minBufferBits to 2^maxBufferBits
+	minBufferBits = 9  // 512B
+	maxBufferBits = 25 // 32MB
+)
+
+// bufferPools holds *[]byte of capacity 2^(minBufferBits+i) in bufferPools[i]
+var bufferPools [maxBufferBits - minBufferBits + 1]sync.Pool
+
+// bufferBucket returns the index of the smallest pool fitting size, -1 if
+// the size is too large to be pooled
+func bufferBucket(size int) int {
+	if size <= 1<<minBufferBits {
+		return 0
+	}
+
+	b := bits.Len(uint(size-1)) - minBufferBits
+	if b >= len(bufferPools) {
+		return -1
+	}
+	return b
+}
+
+// getBuffer returns a buffer of length size, the buffer should be returned
+// with putBuffer when no reference is retained.
+func getBuffer(size int) *[]byte {
+	b := bufferBucket(size)
+	if b < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+
+	if v := bufferPools[b].Get(); v != nil {
+		buf := v.(*[]byte)
+		*buf = (*buf)[:size]
+		return buf
+	}
+
+	buf := make([]byte, size, 1<<(minBufferBits+b))
+	return &buf
+}
+
+// putBuffer returns a buffer from getBuffer to pools
+func putBuffer(buf *[]byte) {
+	c := cap(*buf)
+	// only buffers with exact bucket size are accepted
+	b := bufferBucket(c)
+	if b < 0 || c != 1<<(minBufferBits+b) {
+		return
+	}
+	bufferPools[b].Put(buf)
+}
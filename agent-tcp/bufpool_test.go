@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, size := range []int{1, 512, 513, 1024, 4097, 1 << maxBufferBits} {
+		buf := getBuffer(size)
+		assert.Equal(t, size, len(*buf))
+		assert.True(t, cap(*buf) >= size)
+		assert.Equal(t, 0, cap(*buf)&(cap(*buf)-1), "capacity must be power of 2")
+		putBuffer(buf)
+	}
+
+	// oversized buffers are not pooled
+	assert.Equal(t, -1, bufferBucket(1<<maxBufferBits+1))
+	buf := getBuffer(1<<maxBufferBits + 1)
+	assert.Equal(t, 1<<maxBufferBits+1, len(*buf))
+	putBuffer(buf)
+
+	// foreign buffers with non-bucket capacity are rejected
+	foreign := make([]byte, 1000)
+	putBuffer(&foreign)
+}
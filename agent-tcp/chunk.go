@@ -0,0 +1,268 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Sperax/bdls/crypto/blake2b"
+)
+
+// maximum number of messages being reassembled from a peer at the same time
+const maxReassemblies = 4
+
+// room for the envelopes of a chunk in a frame
+const chunkOverhead = 128
+
+// SetChunkSize enables chunked transfer of consensus messages larger than
+// size bytes, they will be split into STATE_CHUNK messages of at most size
+// bytes, and interleaved with other messages, so a large state won't
+// monopolize the connection. 0 disables chunked transfer, which is the
+// default, all peers must understand STATE_CHUNK before enabling it.
+// Messages exceeding a frame are sent in chunks regardless.
+func (agent *TCPAgent) SetChunkSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	atomic.StoreInt64(&agent.chunkSize, int64(size))
+}
+
+// getChunkSize returns the chunk size of outgoing messages, 0 for disabled
+func (agent *TCPAgent) getChunkSize() int { return int(atomic.LoadInt64(&agent.chunkSize)) }
+
+// SetMaxChunkedLength limits the size of a consensus message reassembled
+// from chunks, the peer sending a larger message is disconnected. Messages
+// larger than DefaultMaxChunkedLength must be allowed explicitly, the limit
+// never exceeds the chunk budget, see SetChunkBudget. 0 for
+// DefaultMaxChunkedLength.
+func (agent *TCPAgent) SetMaxChunkedLength(size int) {
+	if size < 0 {
+		size = 0
+	}
+	atomic.StoreInt64(&agent.maxChunked, int64(size))
+}
+
+// getMaxChunkedLength returns the maximum size of a reassembled message
+func (agent *TCPAgent) getMaxChunkedLength() int {
+	size := atomic.LoadInt64(&agent.maxChunked)
+	if size <= 0 {
+		size = DefaultMaxChunkedLength
+	}
+	if budget := agent.getChunkBudget(); size > budget {
+		size = budget
+	}
+	return int(size)
+}
+
+// SetChunkBudget limits the total size of messages being reassembled from
+// chunks across all peers, a chunk exceeding the budget disconnects its
+// sender. 0 for DefaultChunkBudget.
+func (agent *TCPAgent) SetChunkBudget(size int) {
+	if size < 0 {
+		size = 0
+	}
+	atomic.StoreInt64(&agent.chunkBudget, int64(size))
+}
+
+// getChunkBudget returns the total size of messages being reassembled
+func (agent *TCPAgent) getChunkBudget() int64 {
+	if size := atomic.LoadInt64(&agent.chunkBudget); size > 0 {
+		return size
+	}
+	return DefaultChunkBudget
+}
+
+// reserveChunk accounts n bytes of a chunk against the budget, returns false
+// if the budget is exhausted.
+func (agent *TCPAgent) reserveChunk(n int) bool {
+	if atomic.AddInt64(&agent.chunkBytes, int64(n)) > agent.getChunkBudget() {
+		atomic.AddInt64(&agent.chunkBytes, -int64(n))
+		return false
+	}
+	return true
+}
+
+// releaseChunk returns n bytes to the budget
+func (agent *TCPAgent) releaseChunk(n int) { atomic.AddInt64(&agent.chunkBytes, -int64(n)) }
+
+// getMaxFrame returns the maximum size of a frame
+func (agent *TCPAgent) getMaxFrame() int {
+	if size := atomic.LoadInt64(&agent.maxFrame); size > 0 {
+		return int(size)
+	}
+	return MaxMessageLength
+}
+
+// chunkSizeOf returns the chunk size to split a consensus message of length
+// bytes with, 0 if it's sent as a whole. Messages exceeding a frame are always
+// split, even if chunked transfer is disabled.
+func chunkSizeOf(length int, chunkSize int, maxFrame int) int {
+	if chunkSize <= 0 || chunkSize > maxFrame-chunkOverhead {
+		if length <= maxFrame-chunkOverhead {
+			return 0
+		}
+		chunkSize = maxFrame - chunkOverhead
+	}
+
+	if length <= chunkSize {
+		return 0
+	}
+	return chunkSize
+}
+
+// outChunk is a chunk of an outgoing consensus message
+type outChunk struct {
+	chainID ChainID
+	chunk   StateChunk
+}
+
+// splitChunks splits a consensus message into chunks of at most size bytes,
+// the chunks refer to the message without copying.
+func splitChunks(cm chainMessage, size int) []outChunk {
+	hash := blake2b.Sum256(cm.bts)
+	total := (len(cm.bts) + size - 1) / size
+	chunks := make([]outChunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(cm.bts) {
+			end = len(cm.bts)
+		}
+
+		var oc outChunk
+		oc.chainID = cm.chainID
+		oc.chunk.Hash = hash[:]
+		oc.chunk.Index = uint32(i)
+		oc.chunk.Total = uint32(total)
+		oc.chunk.Data = cm.bts[i*size : end]
+		chunks = append(chunks, oc)
+	}
+	return chunks
+}
+
+// chunkKey identifies a message being reassembled
+type chunkKey struct {
+	chainID ChainID
+	hash    [blake2b.Size256]byte
+}
+
+// reassembly is an incoming consensus message being received in chunks
+type reassembly struct {
+	total   uint32
+	parts   map[uint32][]byte
+	size    int
+	updated time.Time // the time the latest chunk was received
+}
+
+// handleStateChunk collects a chunk of a large consensus message, the message
+// is returned once all of its chunks have been received and the hash matches,
+// otherwise nil is returned. Chunks are only accepted from authenticated peers.
+func (p *TCPPeer) handleStateChunk(chainID ChainID, chunk *StateChunk) ([]byte, error) {
+	if chunk.Total == 0 || chunk.Index >= chunk.Total || len(chunk.Data) == 0 || len(chunk.Hash) != blake2b.Size256 {
+		return nil, ErrStateChunk
+	}
+
+	key := chunkKey{chainID: chainID}
+	copy(key.hash[:], chunk.Hash)
+
+	p.Lock()
+	defer p.Unlock()
+	if p.peerAuthStatus != peerAuthenticated {
+		return nil, ErrStateChunkUnauthenticated
+	}
+	select {
+	case <-p.die: // reassemblies have been released
+		return nil, ErrPeerGoodbye
+	default:
+	}
+
+	now := time.Now()
+	p.expireReassemblies(now)
+	r, ok := p.reassemblies[key]
+	if !ok {
+		if len(p.reassemblies) >= maxReassemblies {
+			return nil, ErrStateChunk
+		}
+		r = &reassembly{total: chunk.Total, parts: make(map[uint32][]byte)}
+		p.reassemblies[key] = r
+	}
+
+	if r.total != chunk.Total || r.parts[chunk.Index] != nil {
+		return nil, ErrStateChunk
+	}
+
+	if r.size+len(chunk.Data) > p.agent.getMaxChunkedLength() {
+		return nil, ErrMessageLengthExceed
+	}
+	if !p.agent.reserveChunk(len(chunk.Data)) {
+		return nil, ErrChunkBudget
+	}
+	r.size += len(chunk.Data)
+	r.parts[chunk.Index] = chunk.Data
+	r.updated = now
+	if uint32(len(r.parts)) < r.total {
+		return nil, nil
+	}
+
+	// all chunks received
+	delete(p.reassemblies, key)
+	p.agent.releaseChunk(r.size)
+	bts := make([]byte, 0, r.size)
+	for i := uint32(0); i < r.total; i++ {
+		bts = append(bts, r.parts[i]...)
+	}
+
+	if blake2b.Sum256(bts) != key.hash {
+		return nil, ErrStateChunkHash
+	}
+	return bts, nil
+}
+
+// expireReassemblies drops the reassemblies which have received no chunk for
+// a read timeout, the caller must hold the peer lock.
+func (p *TCPPeer) expireReassemblies(now time.Time) {
+	timeout := p.agent.getReadTimeout()
+	for key, r := range p.reassemblies {
+		if now.Sub(r.updated) >= timeout {
+			delete(p.reassemblies, key)
+			p.agent.releaseChunk(r.size)
+		}
+	}
+}
+
+// releaseReassemblies drops all reassemblies of a closing peer, the caller
+// must hold the peer lock.
+func (p *TCPPeer) releaseReassemblies() {
+	for key, r := range p.reassemblies {
+		delete(p.reassemblies, key)
+		p.agent.releaseChunk(r.size)
+	}
+}
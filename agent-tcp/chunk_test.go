@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rateConn limits the write throughput of a connection
+type rateConn struct {
+	net.Conn
+	bytesPerSecond int
+}
+
+func (c *rateConn) Write(p []byte) (int, error) {
+	<-time.After(time.Duration(len(p)) * time.Second / time.Duration(c.bytesPerSecond))
+	return c.Conn.Write(p)
+}
+
+func TestStateChunkReassembly(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agents[0])
+	defer p.Close()
+
+	data := make([]byte, 1000)
+	_, err := io.ReadFull(rand.Reader, data)
+	assert.Nil(t, err)
+	chunks := splitChunks(chainMessage{0, data}, 64)
+	assert.Len(t, chunks, 16)
+
+	// unauthenticated
+	_, err = p.handleStateChunk(0, &chunks[0].chunk)
+	assert.Equal(t, ErrStateChunkUnauthenticated, err)
+	p.peerAuthStatus = peerAuthenticated
+
+	// out of order
+	for i := len(chunks) - 1; i > 0; i-- {
+		bts, err := p.handleStateChunk(0, &chunks[i].chunk)
+		assert.Nil(t, err)
+		assert.Nil(t, bts)
+	}
+
+	// duplicated
+	_, err = p.handleStateChunk(0, &chunks[1].chunk)
+	assert.Equal(t, ErrStateChunk, err)
+
+	bts, err := p.handleStateChunk(0, &chunks[0].chunk)
+	assert.Nil(t, err)
+	assert.Equal(t, data, bts)
+
+	// tampered
+	chunks = splitChunks(chainMessage{0, data}, 64)
+	chunks[3].chunk.Data = append([]byte(nil), chunks[3].chunk.Data...)
+	chunks[3].chunk.Data[0]++
+	for i := range chunks[:len(chunks)-1] {
+		_, err := p.handleStateChunk(0, &chunks[i].chunk)
+		assert.Nil(t, err)
+	}
+	_, err = p.handleStateChunk(0, &chunks[len(chunks)-1].chunk)
+	assert.Equal(t, ErrStateChunkHash, err)
+
+	// malformed
+	malformed := chunks[0].chunk
+	malformed.Index = malformed.Total
+	_, err = p.handleStateChunk(0, &malformed)
+	assert.Equal(t, ErrStateChunk, err)
+
+	// exceeding the total size
+	agents[0].SetMaxChunkedLength(len(data) - 1)
+	chunks = splitChunks(chainMessage{1, data}, 64)
+	for i := range chunks[:len(chunks)-1] {
+		_, err := p.handleStateChunk(1, &chunks[i].chunk)
+		assert.Nil(t, err)
+	}
+	_, err = p.handleStateChunk(1, &chunks[len(chunks)-1].chunk)
+	assert.Equal(t, ErrMessageLengthExceed, err)
+	agents[0].SetMaxChunkedLength(0)
+
+	// idle reassemblies expire and return their bytes to the budget
+	p.Lock()
+	for _, r := range p.reassemblies {
+		r.updated = r.updated.Add(-agents[0].getReadTimeout())
+	}
+	p.expireReassemblies(time.Now())
+	assert.Len(t, p.reassemblies, 0)
+	p.Unlock()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&agents[0].chunkBytes))
+
+	// exceeding the total budget across reassemblies
+	agents[0].SetChunkBudget(len(data) + len(data)/2)
+	for i := range chunks[:len(chunks)-1] {
+		_, err := p.handleStateChunk(1, &chunks[i].chunk)
+		assert.Nil(t, err)
+	}
+	chunks = splitChunks(chainMessage{2, data}, 64)
+	for i := range chunks[:8] {
+		_, err := p.handleStateChunk(2, &chunks[i].chunk)
+		assert.Nil(t, err)
+	}
+	_, err = p.handleStateChunk(2, &chunks[8].chunk)
+	assert.Equal(t, ErrChunkBudget, err)
+
+	// released on close
+	p.Close()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&agents[0].chunkBytes))
+}
+
+func TestChunkSizeOf(t *testing.T) {
+	// disabled, within a frame
+	assert.Equal(t, 0, chunkSizeOf(1000, 0, 4096))
+	// disabled, exceeding a frame
+	assert.Equal(t, 4096-chunkOverhead, chunkSizeOf(5000, 0, 4096))
+	// enabled
+	assert.Equal(t, 0, chunkSizeOf(100, 256, 4096))
+	assert.Equal(t, 256, chunkSizeOf(1000, 256, 4096))
+	// chunks can't exceed a frame
+	assert.Equal(t, 4096-chunkOverhead, chunkSizeOf(10000, 8192, 4096))
+}
+
+func TestMaxChunkedLength(t *testing.T) {
+	agent := new(TCPAgent)
+	assert.Equal(t, MaxMessageLength, agent.getMaxChunkedLength())
+
+	// raised by the caller
+	agent.SetMaxChunkedLength(2 * MaxMessageLength)
+	assert.Equal(t, 2*MaxMessageLength, agent.getMaxChunkedLength())
+
+	// bounded by the total budget
+	agent.SetChunkBudget(MaxMessageLength)
+	assert.Equal(t, MaxMessageLength, agent.getMaxChunkedLength())
+	agent.SetMaxChunkedLength(0)
+	agent.SetChunkBudget(1024)
+	assert.Equal(t, 1024, agent.getMaxChunkedLength())
+}
+
+func TestOversizedState(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 50*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	// a 256KB state over 64KB frames, chunked transfer is not enabled
+	for _, agent := range agents {
+		agent.maxFrame = 64 * 1024
+	}
+	connectTestAgents(t, agents)
+	for _, agent := range agents {
+		agent.Start()
+	}
+
+	state := make([]byte, 256*1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	for _, agent := range agents {
+		assert.Nil(t, agent.Propose(state))
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, agent := range agents {
+		for {
+			height, _, decided := agent.GetLatestState()
+			if height >= 1 {
+				assert.True(t, bytes.Equal(state, decided))
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for the oversized state to be decided")
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestChunkedTransfer(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	agents[0].SetChunkSize(256 * 1024)
+
+	// 20MB over a 50MB/s link
+	c1, c2 := net.Pipe()
+	sender := NewTCPPeer(&rateConn{Conn: c1, bytesPerSecond: 50 * 1024 * 1024}, agents[0])
+	defer sender.Close()
+	receiver := NewTCPPeer(c2, agents[1])
+	defer receiver.Close()
+
+	// chunks are only accepted from an authenticated sender
+	assert.Nil(t, sender.InitiatePublicKeyAuthentication())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		receiver.Lock()
+		status := receiver.peerAuthStatus
+		receiver.Unlock()
+		if status == peerAuthenticated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("authentication timeout")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	state := make([]byte, 20*1024*1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.Send(state))
+
+	// votes during the transfer
+	<-time.After(50 * time.Millisecond)
+	vote := []byte("vote")
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sender.Send(vote))
+		<-time.After(10 * time.Millisecond)
+	}
+
+	deadline = time.Now().Add(30 * time.Second)
+	for {
+		agents[1].Lock()
+		received := append([]peerMessage(nil), agents[1].consensusMessages...)
+		agents[1].Unlock()
+
+		if len(received) == 6 {
+			// votes were not blocked by the large state
+			for i := 0; i < 5; i++ {
+				assert.Equal(t, vote, received[i].bts)
+			}
+			assert.True(t, bytes.Equal(state, received[5].bts))
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("chunked transfer timeout, received:", len(received))
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+}
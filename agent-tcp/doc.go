@@ -1,3 +1,11 @@
 // Package agent-tcp implements a TCP based agent to participate in consensus
-// Challenge-Response scheme has been adopted to do interactive authentication
+// Challenge-Response scheme has been adopted to do interactive authentication,
+// the response is bound to the ephemeral keys of both sides of the connection.
+//
+// Decisions are delivered to the persist hook, the event sink and ExportTo
+// in strictly increasing order of heights, a height is never delivered twice.
+// An agent decides heights one by one while it's in sync, an agent behind the
+// others may jump to the latest height by a <decide> message, then the heights
+// in between are skipped, as the consensus core retains the latest decision
+// only.
 package agent
@@ -0,0 +1,148 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maximum number of distinct drop reasons counted, decoding errors may
+	// vary with the content of malformed messages
+	maxDropReasons = 64
+	// the reason counting the drops beyond maxDropReasons
+	dropReasonOther = "other"
+)
+
+// dropLog samples the logging of consensus messages rejected by consensus
+// core, like replayed, stale or unknown-key messages. The first of every N
+// drops of each reason is logged, and the drops by reason since the last
+// summary are logged at most once per interval, on the next drop or update.
+type dropLog struct {
+	every    int64
+	interval time.Duration
+	logf     func(format string, v ...interface{})
+
+	total       map[string]int64 // drops by reason since the log was set
+	window      map[string]int64 // drops by reason since the last summary
+	lastSummary time.Time
+}
+
+// SetDropLog enables sampled logging of consensus messages dropped by consensus
+// core, 1 in every drops of each reason is logged, with a summary of drops by
+// reason every interval. logf defaults to log.Printf if nil, every less than 1
+// disables logging of each drop, interval 0 disables the summary. The drops are
+// counted regardless, see DroppedMessages.
+func (agent *TCPAgent) SetDropLog(every int, interval time.Duration, logf func(format string, v ...interface{})) {
+	if logf == nil {
+		logf = log.Printf
+	}
+
+	agent.Lock()
+	defer agent.Unlock()
+	agent.dropLog.every = int64(every)
+	agent.dropLog.interval = interval
+	agent.dropLog.logf = logf
+}
+
+// DroppedMessages returns the number of consensus messages from peers dropped
+// by consensus core, by the error text returned from it.
+func (agent *TCPAgent) DroppedMessages() map[string]int64 {
+	agent.Lock()
+	defer agent.Unlock()
+	drops := make(map[string]int64)
+	for reason, count := range agent.dropLog.total {
+		drops[reason] = count
+	}
+	return drops
+}
+
+// record counts a dropped message, and logs it or the summary if due
+func (l *dropLog) record(err error, from string, now time.Time) {
+	if l.total == nil {
+		l.total = make(map[string]int64)
+		l.window = make(map[string]int64)
+		l.lastSummary = now
+	}
+
+	reason := err.Error()
+	if _, ok := l.total[reason]; !ok && len(l.total) >= maxDropReasons {
+		reason = dropReasonOther
+	}
+	l.total[reason]++
+	l.window[reason]++
+	if l.logf == nil {
+		return
+	}
+
+	if count := l.total[reason]; l.every > 0 && (count-1)%l.every == 0 {
+		l.logf("dropped message from %v: %v (%v dropped)", from, reason, count)
+	}
+
+	l.flush(now)
+}
+
+// flush logs the summary of drops if due, a quiet window is not logged
+func (l *dropLog) flush(now time.Time) {
+	if l.logf == nil || l.interval <= 0 || len(l.window) == 0 {
+		return
+	}
+
+	if now.Sub(l.lastSummary) >= l.interval {
+		l.logf("dropped messages in %v: %v", now.Sub(l.lastSummary).Round(time.Millisecond), l.summary())
+		l.window = make(map[string]int64)
+		l.lastSummary = now
+	}
+}
+
+// summary formats the drops in window, the most frequent reason first
+func (l *dropLog) summary() string {
+	var reasons []string
+	for reason := range l.window {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if l.window[reasons[i]] != l.window[reasons[j]] {
+			return l.window[reasons[i]] > l.window[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+
+	var fields []string
+	for _, reason := range reasons {
+		fields = append(fields, fmt.Sprintf("%q=%v", reason, l.window[reason]))
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sperax/bdls"
+	proto "github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// logCollector collects formatted log lines
+type logCollector struct {
+	lines []string
+	sync.Mutex
+}
+
+func (c *logCollector) logf(format string, v ...interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.lines = append(c.lines, fmt.Sprintf(format, v...))
+}
+
+// count returns the number of lines with the prefix
+func (c *logCollector) count(prefix string) int {
+	c.Lock()
+	defer c.Unlock()
+	var n int
+	for _, line := range c.lines {
+		if strings.HasPrefix(line, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDropLogSampling(t *testing.T) {
+	var collector logCollector
+	l := dropLog{every: 100, interval: time.Second, logf: collector.logf}
+
+	// 10 seconds of flood, 1000 drops per second
+	errStale := errors.New("stale")
+	errReplay := errors.New("replay")
+	base := time.Now()
+	for i := 0; i < 10000; i++ {
+		now := base.Add(time.Duration(i) * time.Millisecond)
+		if i%4 == 0 {
+			l.record(errStale, "peer", now)
+		} else {
+			l.record(errReplay, "peer", now)
+		}
+	}
+
+	assert.Equal(t, int64(2500), l.total["stale"])
+	assert.Equal(t, int64(7500), l.total["replay"])
+	assert.Equal(t, 25+75, collector.count("dropped message from"))
+	assert.Equal(t, 9, collector.count("dropped messages in"))
+
+	// the summaries and the pending window add up to the total
+	var replays, stales int64
+	for _, line := range collector.lines {
+		var replay, stale int64
+		if _, err := fmt.Sscanf(line, `dropped messages in 1s: "replay"=%d "stale"=%d`, &replay, &stale); err == nil {
+			assert.Equal(t, int64(750), replay)
+			replays += replay
+			stales += stale
+		}
+	}
+	assert.Equal(t, l.total["replay"], replays+l.window["replay"])
+	assert.Equal(t, l.total["stale"], stales+l.window["stale"])
+
+	// distinct reasons are bounded
+	for i := 0; i < 2*maxDropReasons; i++ {
+		l.record(fmt.Errorf("malformed %v", i), "peer", base)
+	}
+	assert.Equal(t, maxDropReasons+1, len(l.total))
+	assert.Equal(t, int64(maxDropReasons+2), l.total[dropReasonOther])
+}
+
+func TestDroppedMessages(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	agent := agents[0]
+	defer agent.Close()
+	agent.Start()
+
+	var collector logCollector
+	agent.SetDropLog(50, time.Hour, collector.logf)
+
+	// messages of another version, and from unknown participants
+	mismatched, err := proto.Marshal(&bdls.SignedProto{})
+	assert.Nil(t, err)
+	unknown, err := proto.Marshal(&bdls.SignedProto{Version: bdls.ProtocolVersion})
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		agent.handleConsensusMessage(nil, mismatched)
+		agent.handleConsensusMessage(nil, unknown)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(agent.DroppedMessages()) < 2 || agent.DroppedMessages()[bdls.ErrMessageUnknownParticipant.Error()] < 1000 {
+		if time.Now().After(deadline) {
+			t.Fatal("drops not counted:", agent.DroppedMessages())
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, map[string]int64{
+		bdls.ErrProtocolVersionMismatch.Error():   1000,
+		bdls.ErrMessageUnknownParticipant.Error(): 1000,
+	}, agent.DroppedMessages())
+	assert.Equal(t, 40, collector.count("dropped message from unknown"))
+
+	// the summary is flushed by the update loop without further drops
+	agent.SetDropLog(50, 10*time.Millisecond, collector.logf)
+	deadline = time.Now().Add(5 * time.Second)
+	for collector.count("dropped messages in") < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("summary not flushed")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	// a quiet window is not logged
+	<-time.After(100 * time.Millisecond)
+	assert.Equal(t, 1, collector.count("dropped messages in"))
+}
@@ -35,9 +35,26 @@ import "errors"
 var (
 	ErrLocalKeyAuthInit             = errors.New("incorrect state for local KeyAuthInitmessage")
 	ErrKeyNotOnCurve                = errors.New("the public key is not on curve")
+	ErrKeyMalformed                 = errors.New("the public key has an axis longer than 32 bytes")
 	ErrPeerKeyAuthInit              = errors.New("incorrect state for peer KeyAuthInit message")
 	ErrPeerKeyAuthChallenge         = errors.New("incorrect state for peer KeyAuthChallenge message")
 	ErrPeerKeyAuthChallengeResponse = errors.New("incorrect state for peer KeyAuthChallengeResponse message")
 	ErrPeerAuthenticatedFailed      = errors.New("public key authentication failed for peer")
+	ErrKeyAuthRejected              = errors.New("the peer has rejected our public key authentication")
 	ErrMessageLengthExceed          = errors.New("message size exceeded maximum")
+	ErrAgentClosed                  = errors.New("the agent has been closed")
+	ErrAgentNotStarted              = errors.New("the agent has not started")
+	ErrPeerGoodbye                  = errors.New("the peer has closed the connection")
+	ErrReloadConfig                 = errors.New("the reloaded config contains negative durations")
+	ErrStateChunk                   = errors.New("malformed state chunk")
+	ErrStateChunkUnauthenticated    = errors.New("state chunk from an unauthenticated peer")
+	ErrChunkBudget                  = errors.New("the total size of messages being reassembled exceeds the budget")
+	ErrStateChunkHash               = errors.New("the hash of reassembled state chunks mismatch")
+	ErrStaleTick                    = errors.New("the ticked height has been decided")
+	ErrExportLagged                 = errors.New("the export writer is too slow to keep up with consensus")
+	ErrExportRecord                 = errors.New("the exported record is not a <decide> message")
+	ErrExportUnavailable            = errors.New("the decisions below the latest height are not retained")
+	ErrMultiplexedNoChain           = errors.New("no chain to multiplex")
+	ErrMultiplexedKey               = errors.New("multiplexed chains must share the same private key")
+	ErrFrameMAC                     = errors.New("the frame from the authenticated peer has an invalid MAC")
 )
@@ -0,0 +1,204 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/Sperax/bdls"
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// exporter is a live subscriber of decisions from ExportTo
+type exporter struct {
+	from uint64                 // the lowest height to export
+	ch   chan *bdls.SignedProto // <decide> messages awaiting to be written
+}
+
+// ExportTo streams decisions from fromHeight to w, as the <decide> messages
+// of heights, each prefixed with its length in 4 bytes little endian, the
+// same framing as the wire protocol, use ReadDecision to read them back.
+//
+// The latest decision retained by the consensus core is written first, then
+// it follows live decisions until the agent closes, when nil is returned.
+// ErrExportUnavailable is returned if fromHeight is below the latest decision,
+// the history is not retained.
+// Heights synced by <decide> messages may be skipped. Errors of w are
+// returned without affecting consensus, and ErrExportLagged is returned if
+// w is too slow to keep up with consensus.
+func (agent *TCPAgent) ExportTo(w io.Writer, fromHeight uint64) error {
+	e := &exporter{from: fromHeight, ch: make(chan *bdls.SignedProto, maxPendingEvents)}
+
+	agent.Lock()
+	select {
+	case <-agent.die:
+		agent.Unlock()
+		return ErrAgentClosed
+	default:
+	}
+	// the latest decision, if it has been processed by the agent, is the
+	// lowest height retained
+	height, _, _ := agent.consensus.CurrentState()
+	proof := agent.consensus.CurrentProof()
+	retained := height + 1
+	if proof != nil && height == agent.latestHeight {
+		retained = height
+	}
+	if height > 0 && fromHeight < retained {
+		agent.Unlock()
+		return ErrExportUnavailable
+	}
+	if retained == height && height >= fromHeight {
+		e.ch <- proof
+	}
+	agent.exporters = append(agent.exporters, e)
+	agent.Unlock()
+	defer agent.removeExporter(e)
+
+	for {
+		select {
+		case proof, ok := <-e.ch:
+			if !ok {
+				return ErrExportLagged
+			}
+			if err := writeDecision(w, proof); err != nil {
+				return err
+			}
+		case <-agent.die:
+			// flush the decisions before closing
+			for {
+				select {
+				case proof, ok := <-e.ch:
+					if !ok {
+						return ErrExportLagged
+					}
+					if err := writeDecision(w, proof); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// removeExporter removes an exporter if it's still subscribed
+func (agent *TCPAgent) removeExporter(e *exporter) {
+	agent.Lock()
+	defer agent.Unlock()
+	for k := range agent.exporters {
+		if agent.exporters[k] == e {
+			copy(agent.exporters[k:], agent.exporters[k+1:])
+			agent.exporters = agent.exporters[:len(agent.exporters)-1]
+			return
+		}
+	}
+}
+
+// exportDecision passes the decision at height to exporters, a lagging
+// exporter is unsubscribed, must be called with agent lock held.
+func (agent *TCPAgent) exportDecision(height uint64, proof *bdls.SignedProto) {
+	if proof == nil {
+		return
+	}
+
+	exporters := agent.exporters[:0]
+	for _, e := range agent.exporters {
+		if height < e.from {
+			exporters = append(exporters, e)
+			continue
+		}
+
+		select {
+		case e.ch <- proof:
+			exporters = append(exporters, e)
+		default:
+			close(e.ch)
+		}
+	}
+	agent.exporters = exporters
+}
+
+// writeDecision writes a length prefixed <decide> message to w
+func writeDecision(w io.Writer, proof *bdls.SignedProto) error {
+	bts, err := proto.Marshal(proof)
+	if err != nil {
+		return err
+	}
+
+	var length [MessageLength]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(bts)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(bts)
+	return err
+}
+
+// ReadDecision reads a decision written by ExportTo from r, io.EOF will be
+// returned at the end of the stream. The <decide> message is decoded but
+// not verified, use bdls.VerifyDecision to check it against participants.
+func ReadDecision(r io.Reader) (*ConfirmedState, error) {
+	var length [MessageLength]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(length[:])
+	if size > MaxMessageLength {
+		return nil, ErrMessageLengthExceed
+	}
+
+	bts := make([]byte, size)
+	if _, err := io.ReadFull(r, bts); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	proof := new(bdls.SignedProto)
+	if err := proto.Unmarshal(bts, proof); err != nil {
+		return nil, err
+	}
+
+	m, err := bdls.DecodeMessage(proof.Message)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != bdls.MessageType_Decide {
+		return nil, ErrExportRecord
+	}
+
+	return &ConfirmedState{Height: m.Height, Round: m.Round, State: m.State, Proof: proof}, nil
+}
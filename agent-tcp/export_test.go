@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Sperax/bdls"
+	proto "github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// failWriter fails all writes
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestExportTo(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	agents := newTestAgents(t, keys, 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	connectTestAgents(t, agents)
+	for _, agent := range agents {
+		agent.Start()
+	}
+
+	buf := new(syncBuffer)
+	exported := make(chan error, 1)
+	go func() { exported <- agents[0].ExportTo(buf, 2) }()
+
+	// a failing writer doesn't affect consensus
+	failed := make(chan error, 1)
+	go func() { failed <- agents[1].ExportTo(failWriter{}, 0) }()
+
+	decideHeight(t, agents, 1)
+	decideHeight(t, agents, 2)
+	decideHeight(t, agents, 3)
+	assert.NotNil(t, <-failed)
+
+	// wait for the agent to process the latest height
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		height, _ := agents[0].DecidedAt()
+		if height >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for height 3")
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+	// the decisions below the latest height are not retained
+	assert.Equal(t, ErrExportUnavailable, agents[0].ExportTo(buf, 2))
+
+	agents[0].Close()
+	assert.Nil(t, <-exported)
+
+	var participants []*ecdsa.PublicKey
+	for _, key := range keys {
+		participants = append(participants, &key.PublicKey)
+	}
+
+	buf.Lock()
+	r := bytes.NewReader(buf.buf.Bytes())
+	buf.Unlock()
+	var heights []uint64
+	for {
+		decision, err := ReadDecision(r)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		bts, err := proto.Marshal(decision.Proof)
+		assert.Nil(t, err)
+		assert.Nil(t, bdls.VerifyDecision(participants, bdls.S256Curve, decision.Height, decision.State, bts))
+		heights = append(heights, decision.Height)
+	}
+	assert.Equal(t, []uint64{2, 3}, heights)
+
+	// exporting on a closed agent
+	assert.Equal(t, ErrAgentClosed, agents[0].ExportTo(buf, 0))
+}
@@ -31,6 +31,12 @@ const (
 	CommandType_KEY_AUTH_CHALLENGE       CommandType = 2
 	CommandType_KEY_AUTH_CHALLENGE_REPLY CommandType = 3
 	CommandType_CONSENSUS                CommandType = 4
+	// the peer is closing the connection
+	CommandType_GOODBYE CommandType = 5
+	// a chunk of a large CONSENSUS message
+	CommandType_STATE_CHUNK CommandType = 6
+	// the public key authentication of the peer has failed
+	CommandType_KEY_AUTH_FAILED CommandType = 7
 )
 
 var CommandType_name = map[int32]string{
@@ -39,6 +45,9 @@ var CommandType_name = map[int32]string{
 	2: "KEY_AUTH_CHALLENGE",
 	3: "KEY_AUTH_CHALLENGE_REPLY",
 	4: "CONSENSUS",
+	5: "GOODBYE",
+	6: "STATE_CHUNK",
+	7: "KEY_AUTH_FAILED",
 }
 
 var CommandType_value = map[string]int32{
@@ -47,6 +56,9 @@ var CommandType_value = map[string]int32{
 	"KEY_AUTH_CHALLENGE":       2,
 	"KEY_AUTH_CHALLENGE_REPLY": 3,
 	"CONSENSUS":                4,
+	"GOODBYE":                  5,
+	"STATE_CHUNK":              6,
+	"KEY_AUTH_FAILED":          7,
 }
 
 func (x CommandType) String() string {
@@ -57,13 +69,48 @@ func (CommandType) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_878fa4887b90140c, []int{0}
 }
 
+// KeyAuthFailureReason tells the initiator why its authentication failed
+type KeyAuthFailureReason int32
+
+const (
+	// no failure has been reported
+	KeyAuthFailureReason_NONE KeyAuthFailureReason = 0
+	// the challenge reply has a mismatched HMAC
+	KeyAuthFailureReason_HMAC_MISMATCH KeyAuthFailureReason = 1
+	// the announced public key is malformed or not on curve
+	KeyAuthFailureReason_KEY_MALFORMED KeyAuthFailureReason = 2
+)
+
+var KeyAuthFailureReason_name = map[int32]string{
+	0: "NONE",
+	1: "HMAC_MISMATCH",
+	2: "KEY_MALFORMED",
+}
+
+var KeyAuthFailureReason_value = map[string]int32{
+	"NONE":          0,
+	"HMAC_MISMATCH": 1,
+	"KEY_MALFORMED": 2,
+}
+
+func (x KeyAuthFailureReason) String() string {
+	return proto.EnumName(KeyAuthFailureReason_name, int32(x))
+}
+
+func (KeyAuthFailureReason) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_878fa4887b90140c, []int{1}
+}
+
 // Gossip defines a stream based protocol
 type Gossip struct {
-	Command              CommandType `protobuf:"varint,1,opt,name=Command,proto3,enum=agent.CommandType" json:"Command,omitempty"`
-	Message              []byte      `protobuf:"bytes,2,opt,name=Message,proto3" json:"Message,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
-	XXX_unrecognized     []byte      `json:"-"`
-	XXX_sizecache        int32       `json:"-"`
+	Command CommandType `protobuf:"varint,1,opt,name=Command,proto3,enum=agent.CommandType" json:"Command,omitempty"`
+	Message []byte      `protobuf:"bytes,2,opt,name=Message,proto3" json:"Message,omitempty"`
+	// ChainID identifies the consensus instance of a CONSENSUS message
+	// on a multiplexed connection, 0 for the default instance.
+	ChainID              uint64   `protobuf:"varint,3,opt,name=ChainID,proto3" json:"ChainID,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Gossip) Reset()         { *m = Gossip{} }
@@ -113,10 +160,96 @@ func (m *Gossip) GetMessage() []byte {
 	return nil
 }
 
+func (m *Gossip) GetChainID() uint64 {
+	if m != nil {
+		return m.ChainID
+	}
+	return 0
+}
+
+// StateChunk carries a part of a large CONSENSUS message, the chunks are sent
+// in sequence, and reassembled by the receiver.
+type StateChunk struct {
+	// blake2b-256 hash of the whole message
+	Hash []byte `protobuf:"bytes,1,opt,name=Hash,proto3" json:"Hash,omitempty"`
+	// index of this chunk, starts from 0
+	Index uint32 `protobuf:"varint,2,opt,name=Index,proto3" json:"Index,omitempty"`
+	// total number of chunks of the message
+	Total                uint32   `protobuf:"varint,3,opt,name=Total,proto3" json:"Total,omitempty"`
+	Data                 []byte   `protobuf:"bytes,4,opt,name=Data,proto3" json:"Data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StateChunk) Reset()         { *m = StateChunk{} }
+func (m *StateChunk) String() string { return proto.CompactTextString(m) }
+func (*StateChunk) ProtoMessage()    {}
+func (*StateChunk) Descriptor() ([]byte, []int) {
+	return fileDescriptor_878fa4887b90140c, []int{1}
+}
+func (m *StateChunk) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *StateChunk) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_StateChunk.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *StateChunk) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StateChunk.Merge(m, src)
+}
+func (m *StateChunk) XXX_Size() int {
+	return m.Size()
+}
+func (m *StateChunk) XXX_DiscardUnknown() {
+	xxx_messageInfo_StateChunk.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StateChunk proto.InternalMessageInfo
+
+func (m *StateChunk) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *StateChunk) GetIndex() uint32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *StateChunk) GetTotal() uint32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
+func (m *StateChunk) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
 type KeyAuthInit struct {
 	// client public key
-	X                    []byte   `protobuf:"bytes,1,opt,name=X,proto3" json:"X,omitempty"`
-	Y                    []byte   `protobuf:"bytes,2,opt,name=Y,proto3" json:"Y,omitempty"`
+	X []byte `protobuf:"bytes,1,opt,name=X,proto3" json:"X,omitempty"`
+	Y []byte `protobuf:"bytes,2,opt,name=Y,proto3" json:"Y,omitempty"`
+	// client ephermal publickey of this connection, for channel binding
+	EphemeralX           []byte   `protobuf:"bytes,3,opt,name=EphemeralX,proto3" json:"EphemeralX,omitempty"`
+	EphemeralY           []byte   `protobuf:"bytes,4,opt,name=EphemeralY,proto3" json:"EphemeralY,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -126,7 +259,7 @@ func (m *KeyAuthInit) Reset()         { *m = KeyAuthInit{} }
 func (m *KeyAuthInit) String() string { return proto.CompactTextString(m) }
 func (*KeyAuthInit) ProtoMessage()    {}
 func (*KeyAuthInit) Descriptor() ([]byte, []int) {
-	return fileDescriptor_878fa4887b90140c, []int{1}
+	return fileDescriptor_878fa4887b90140c, []int{2}
 }
 func (m *KeyAuthInit) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -169,6 +302,20 @@ func (m *KeyAuthInit) GetY() []byte {
 	return nil
 }
 
+func (m *KeyAuthInit) GetEphemeralX() []byte {
+	if m != nil {
+		return m.EphemeralX
+	}
+	return nil
+}
+
+func (m *KeyAuthInit) GetEphemeralY() []byte {
+	if m != nil {
+		return m.EphemeralY
+	}
+	return nil
+}
+
 type KeyAuthChallenge struct {
 	// server ephermal publickey for client authentication
 	X []byte `protobuf:"bytes,1,opt,name=X,proto3" json:"X,omitempty"`
@@ -184,7 +331,7 @@ func (m *KeyAuthChallenge) Reset()         { *m = KeyAuthChallenge{} }
 func (m *KeyAuthChallenge) String() string { return proto.CompactTextString(m) }
 func (*KeyAuthChallenge) ProtoMessage()    {}
 func (*KeyAuthChallenge) Descriptor() ([]byte, []int) {
-	return fileDescriptor_878fa4887b90140c, []int{2}
+	return fileDescriptor_878fa4887b90140c, []int{3}
 }
 func (m *KeyAuthChallenge) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -245,7 +392,7 @@ func (m *KeyAuthChallengeReply) Reset()         { *m = KeyAuthChallengeReply{} }
 func (m *KeyAuthChallengeReply) String() string { return proto.CompactTextString(m) }
 func (*KeyAuthChallengeReply) ProtoMessage()    {}
 func (*KeyAuthChallengeReply) Descriptor() ([]byte, []int) {
-	return fileDescriptor_878fa4887b90140c, []int{3}
+	return fileDescriptor_878fa4887b90140c, []int{4}
 }
 func (m *KeyAuthChallengeReply) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -281,36 +428,99 @@ func (m *KeyAuthChallengeReply) GetHMAC() []byte {
 	return nil
 }
 
+// KeyAuthFailed is sent by the challenger before dropping the connection
+type KeyAuthFailed struct {
+	Reason               KeyAuthFailureReason `protobuf:"varint,1,opt,name=Reason,proto3,enum=agent.KeyAuthFailureReason" json:"Reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *KeyAuthFailed) Reset()         { *m = KeyAuthFailed{} }
+func (m *KeyAuthFailed) String() string { return proto.CompactTextString(m) }
+func (*KeyAuthFailed) ProtoMessage()    {}
+func (*KeyAuthFailed) Descriptor() ([]byte, []int) {
+	return fileDescriptor_878fa4887b90140c, []int{5}
+}
+func (m *KeyAuthFailed) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *KeyAuthFailed) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_KeyAuthFailed.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *KeyAuthFailed) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyAuthFailed.Merge(m, src)
+}
+func (m *KeyAuthFailed) XXX_Size() int {
+	return m.Size()
+}
+func (m *KeyAuthFailed) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyAuthFailed.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyAuthFailed proto.InternalMessageInfo
+
+func (m *KeyAuthFailed) GetReason() KeyAuthFailureReason {
+	if m != nil {
+		return m.Reason
+	}
+	return KeyAuthFailureReason_NONE
+}
+
 func init() {
 	proto.RegisterEnum("agent.CommandType", CommandType_name, CommandType_value)
+	proto.RegisterEnum("agent.KeyAuthFailureReason", KeyAuthFailureReason_name, KeyAuthFailureReason_value)
 	proto.RegisterType((*Gossip)(nil), "agent.Gossip")
+	proto.RegisterType((*StateChunk)(nil), "agent.StateChunk")
 	proto.RegisterType((*KeyAuthInit)(nil), "agent.KeyAuthInit")
 	proto.RegisterType((*KeyAuthChallenge)(nil), "agent.KeyAuthChallenge")
 	proto.RegisterType((*KeyAuthChallengeReply)(nil), "agent.KeyAuthChallengeReply")
+	proto.RegisterType((*KeyAuthFailed)(nil), "agent.KeyAuthFailed")
 }
 
 func init() { proto.RegisterFile("gossip.proto", fileDescriptor_878fa4887b90140c) }
 
 var fileDescriptor_878fa4887b90140c = []byte{
-	// 285 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x91, 0xcd, 0x6a, 0x83, 0x50,
-	0x10, 0x85, 0x7b, 0x63, 0x1a, 0xc9, 0xc4, 0x94, 0xdb, 0x81, 0x16, 0x17, 0x41, 0x82, 0xab, 0xf4,
-	0x07, 0x17, 0xed, 0x13, 0x58, 0x91, 0x28, 0x31, 0x46, 0xd4, 0x40, 0x5c, 0x89, 0xa5, 0x17, 0x13,
-	0x30, 0x2a, 0xd5, 0x2e, 0x7c, 0xc3, 0x2e, 0xfb, 0x08, 0xc5, 0x27, 0x29, 0xbd, 0x98, 0xb4, 0xb4,
-	0x90, 0xdd, 0x9c, 0x8f, 0x6f, 0x0e, 0x0c, 0x03, 0x52, 0x5a, 0x54, 0xd5, 0xae, 0xd4, 0xca, 0xd7,
-	0xa2, 0x2e, 0xf0, 0x3c, 0x49, 0x59, 0x5e, 0xab, 0x1e, 0x0c, 0xe6, 0x1c, 0xe3, 0x3d, 0x88, 0x46,
-	0xb1, 0xdf, 0x27, 0xf9, 0x8b, 0x4c, 0xa6, 0x64, 0x76, 0xf1, 0x80, 0x1a, 0x57, 0xb4, 0x8e, 0x86,
-	0x4d, 0xc9, 0xfc, 0x83, 0x82, 0x32, 0x88, 0x4b, 0x56, 0x55, 0x49, 0xca, 0xe4, 0xde, 0x94, 0xcc,
-	0x24, 0xff, 0x10, 0xd5, 0x1b, 0x18, 0x2d, 0x58, 0xa3, 0xbf, 0xd5, 0x5b, 0x3b, 0xdf, 0xd5, 0x28,
-	0x01, 0xd9, 0xf0, 0x42, 0xc9, 0x27, 0x9b, 0xef, 0x14, 0x75, 0x0b, 0x24, 0x52, 0x1d, 0xa0, 0x9d,
-	0x6a, 0x6c, 0x93, 0x2c, 0x63, 0x79, 0xca, 0x4e, 0xf9, 0x38, 0x81, 0xe1, 0x51, 0x94, 0x05, 0x4e,
-	0x7f, 0x80, 0x7a, 0x07, 0x57, 0x7f, 0xdb, 0x7c, 0x56, 0x66, 0x0d, 0x22, 0xf4, 0xad, 0xa5, 0x6e,
-	0x74, 0xad, 0x7c, 0xbe, 0xcd, 0x61, 0xf4, 0xeb, 0x2e, 0x14, 0x41, 0x70, 0x57, 0x1e, 0x3d, 0xc3,
-	0x4b, 0x18, 0x2f, 0xcc, 0x28, 0xd6, 0xd7, 0xa1, 0x15, 0xdb, 0xae, 0x1d, 0x52, 0x82, 0xd7, 0x80,
-	0x47, 0x64, 0x58, 0xba, 0xe3, 0x98, 0xee, 0xdc, 0xa4, 0x3d, 0x9c, 0x80, 0xfc, 0x9f, 0xc7, 0xbe,
-	0xe9, 0x39, 0x11, 0x15, 0x70, 0x0c, 0x43, 0x63, 0xe5, 0x06, 0xa6, 0x1b, 0xac, 0x03, 0xda, 0x7f,
-	0x92, 0xde, 0x5b, 0x85, 0x7c, 0xb4, 0x0a, 0xf9, 0x6c, 0x15, 0xf2, 0x3c, 0xe0, 0x3f, 0x78, 0xfc,
-	0x0a, 0x00, 0x00, 0xff, 0xff, 0x96, 0x66, 0x6e, 0x1f, 0x93, 0x01, 0x00, 0x00,
+	// 479 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x53, 0x4b, 0x8e, 0xda, 0x40,
+	0x10, 0x4d, 0xf3, 0xcd, 0x14, 0x26, 0xd3, 0xe9, 0x4c, 0x22, 0x4b, 0x19, 0x21, 0xe4, 0x15, 0x9a,
+	0x44, 0x2c, 0x32, 0x27, 0xf0, 0xd8, 0x0d, 0x58, 0xf8, 0x33, 0x6a, 0x1b, 0x09, 0xaf, 0x48, 0x47,
+	0xb4, 0x30, 0x89, 0xb1, 0x11, 0x36, 0x52, 0x38, 0x4e, 0x6e, 0x93, 0x65, 0x8e, 0x10, 0x71, 0x92,
+	0xc8, 0x76, 0x43, 0xc8, 0x47, 0xb3, 0xeb, 0xf7, 0xea, 0xd5, 0x7b, 0xe5, 0x2a, 0x19, 0x94, 0x55,
+	0x9a, 0x65, 0xeb, 0xed, 0x70, 0xbb, 0x4b, 0xf3, 0x94, 0x34, 0xf9, 0x4a, 0x24, 0xb9, 0xf6, 0x19,
+	0x5a, 0xe3, 0x92, 0x26, 0xef, 0xa1, 0x6d, 0xa4, 0x9b, 0x0d, 0x4f, 0x96, 0x2a, 0xea, 0xa3, 0xc1,
+	0x8b, 0x0f, 0x64, 0x58, 0x4a, 0x86, 0x92, 0x0d, 0x0e, 0x5b, 0xc1, 0x4e, 0x12, 0xa2, 0x42, 0xdb,
+	0x11, 0x59, 0xc6, 0x57, 0x42, 0xad, 0xf5, 0xd1, 0x40, 0x61, 0x27, 0x58, 0x54, 0x8c, 0x88, 0xaf,
+	0x13, 0xcb, 0x54, 0xeb, 0x7d, 0x34, 0x68, 0xb0, 0x13, 0xd4, 0x3e, 0x02, 0xf8, 0x39, 0xcf, 0x85,
+	0x11, 0xed, 0x93, 0x2f, 0x84, 0x40, 0x63, 0xc2, 0xb3, 0xa8, 0x0c, 0x53, 0x58, 0xf9, 0x26, 0x37,
+	0xd0, 0xb4, 0x92, 0xa5, 0xf8, 0x5a, 0x7a, 0x76, 0x59, 0x05, 0x0a, 0x36, 0x48, 0x73, 0x1e, 0x97,
+	0x7e, 0x5d, 0x56, 0x81, 0xa2, 0xdf, 0xe4, 0x39, 0x57, 0x1b, 0x55, 0x7f, 0xf1, 0xd6, 0xd6, 0xd0,
+	0x99, 0x8a, 0x83, 0xbe, 0xcf, 0x23, 0x2b, 0x59, 0xe7, 0x44, 0x01, 0x34, 0x97, 0xfe, 0x68, 0x5e,
+	0xa0, 0x50, 0x0e, 0x8b, 0x42, 0xd2, 0x03, 0xa0, 0xdb, 0x48, 0x6c, 0xc4, 0x8e, 0xc7, 0xf3, 0xd2,
+	0x59, 0x61, 0x17, 0xcc, 0x1f, 0xf5, 0x50, 0x86, 0x5c, 0x30, 0x9a, 0x0d, 0x58, 0x46, 0x19, 0x11,
+	0x8f, 0x63, 0x91, 0xac, 0xc4, 0x93, 0x79, 0xb7, 0x70, 0x75, 0x16, 0xca, 0xb8, 0xdf, 0x84, 0xf6,
+	0x0e, 0x5e, 0xff, 0xed, 0xc6, 0xc4, 0x36, 0x3e, 0x94, 0x5b, 0x72, 0x74, 0xe3, 0xbc, 0x25, 0x47,
+	0x37, 0x34, 0x13, 0xba, 0x52, 0x3c, 0xe2, 0xeb, 0x58, 0x2c, 0xc9, 0x3d, 0xb4, 0x98, 0xe0, 0x59,
+	0x9a, 0xc8, 0xcb, 0xbd, 0x95, 0x97, 0xbb, 0x50, 0xed, 0x77, 0xa2, 0x92, 0x30, 0x29, 0xbd, 0xfb,
+	0x86, 0xa0, 0x73, 0x71, 0x5a, 0xd2, 0x86, 0xba, 0xeb, 0x3d, 0xe2, 0x67, 0xe4, 0x25, 0x74, 0xa7,
+	0x34, 0x5c, 0xe8, 0xb3, 0x60, 0xb2, 0xb0, 0x5c, 0x2b, 0xc0, 0x88, 0xbc, 0x01, 0x72, 0xa6, 0x8c,
+	0x89, 0x6e, 0xdb, 0xd4, 0x1d, 0x53, 0x5c, 0x23, 0xb7, 0xa0, 0xfe, 0xcb, 0x2f, 0x18, 0x7d, 0xb4,
+	0x43, 0x5c, 0x27, 0x5d, 0xb8, 0x32, 0x3c, 0xd7, 0xa7, 0xae, 0x3f, 0xf3, 0x71, 0x83, 0x74, 0xa0,
+	0x3d, 0xf6, 0x3c, 0xf3, 0x21, 0xa4, 0xb8, 0x49, 0xae, 0xa1, 0xe3, 0x07, 0x7a, 0x40, 0x17, 0xc6,
+	0x64, 0xe6, 0x4e, 0x71, 0x8b, 0xbc, 0x82, 0xeb, 0xb3, 0xd5, 0x48, 0xb7, 0x6c, 0x6a, 0xe2, 0xf6,
+	0xdd, 0x08, 0x6e, 0xfe, 0xf7, 0x0d, 0xe4, 0x39, 0x34, 0x5c, 0xcf, 0xa5, 0xd5, 0xb0, 0xc5, 0x4e,
+	0x16, 0x8e, 0xe5, 0x3b, 0x7a, 0x60, 0x4c, 0x30, 0x3a, 0xcd, 0xef, 0xe8, 0xf6, 0xc8, 0x63, 0x0e,
+	0x35, 0x71, 0xed, 0x41, 0xf9, 0x7e, 0xec, 0xa1, 0x1f, 0xc7, 0x1e, 0xfa, 0x79, 0xec, 0xa1, 0x4f,
+	0xad, 0xf2, 0x0f, 0xb8, 0xff, 0x35, 0x00, 0x39, 0x22, 0x59, 0x07, 0x11, 0x03, 0x00, 0x00,
 }
 
 func (m *Gossip) Marshal() (dAtA []byte, err error) {
@@ -337,6 +547,11 @@ func (m *Gossip) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.ChainID != 0 {
+		i = encodeVarintGossip(dAtA, i, uint64(m.ChainID))
+		i--
+		dAtA[i] = 0x18
+	}
 	if len(m.Message) > 0 {
 		i -= len(m.Message)
 		copy(dAtA[i:], m.Message)
@@ -352,6 +567,57 @@ func (m *Gossip) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *StateChunk) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *StateChunk) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *StateChunk) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if len(m.Data) > 0 {
+		i -= len(m.Data)
+		copy(dAtA[i:], m.Data)
+		i = encodeVarintGossip(dAtA, i, uint64(len(m.Data)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if m.Total != 0 {
+		i = encodeVarintGossip(dAtA, i, uint64(m.Total))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Index != 0 {
+		i = encodeVarintGossip(dAtA, i, uint64(m.Index))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Hash) > 0 {
+		i -= len(m.Hash)
+		copy(dAtA[i:], m.Hash)
+		i = encodeVarintGossip(dAtA, i, uint64(len(m.Hash)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *KeyAuthInit) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -376,6 +642,20 @@ func (m *KeyAuthInit) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.EphemeralY) > 0 {
+		i -= len(m.EphemeralY)
+		copy(dAtA[i:], m.EphemeralY)
+		i = encodeVarintGossip(dAtA, i, uint64(len(m.EphemeralY)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if len(m.EphemeralX) > 0 {
+		i -= len(m.EphemeralX)
+		copy(dAtA[i:], m.EphemeralX)
+		i = encodeVarintGossip(dAtA, i, uint64(len(m.EphemeralX)))
+		i--
+		dAtA[i] = 0x1a
+	}
 	if len(m.Y) > 0 {
 		i -= len(m.Y)
 		copy(dAtA[i:], m.Y)
@@ -475,6 +755,38 @@ func (m *KeyAuthChallengeReply) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *KeyAuthFailed) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *KeyAuthFailed) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *KeyAuthFailed) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.Reason != 0 {
+		i = encodeVarintGossip(dAtA, i, uint64(m.Reason))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintGossip(dAtA []byte, offset int, v uint64) int {
 	offset -= sovGossip(v)
 	base := offset
@@ -499,6 +811,35 @@ func (m *Gossip) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovGossip(uint64(l))
 	}
+	if m.ChainID != 0 {
+		n += 1 + sovGossip(uint64(m.ChainID))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *StateChunk) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Hash)
+	if l > 0 {
+		n += 1 + l + sovGossip(uint64(l))
+	}
+	if m.Index != 0 {
+		n += 1 + sovGossip(uint64(m.Index))
+	}
+	if m.Total != 0 {
+		n += 1 + sovGossip(uint64(m.Total))
+	}
+	l = len(m.Data)
+	if l > 0 {
+		n += 1 + l + sovGossip(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -519,6 +860,14 @@ func (m *KeyAuthInit) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovGossip(uint64(l))
 	}
+	l = len(m.EphemeralX)
+	if l > 0 {
+		n += 1 + l + sovGossip(uint64(l))
+	}
+	l = len(m.EphemeralY)
+	if l > 0 {
+		n += 1 + l + sovGossip(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -565,6 +914,21 @@ func (m *KeyAuthChallengeReply) Size() (n int) {
 	return n
 }
 
+func (m *KeyAuthFailed) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Reason != 0 {
+		n += 1 + sovGossip(uint64(m.Reason))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
 func sovGossip(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -653,6 +1017,185 @@ func (m *Gossip) Unmarshal(dAtA []byte) error {
 				m.Message = []byte{}
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChainID", wireType)
+			}
+			m.ChainID = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ChainID |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipGossip(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *StateChunk) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowGossip
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: StateChunk: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: StateChunk: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hash", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthGossip
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hash = append(m.Hash[:0], dAtA[iNdEx:postIndex]...)
+			if m.Hash == nil {
+				m.Hash = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Index", wireType)
+			}
+			m.Index = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Index |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Total", wireType)
+			}
+			m.Total = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Total |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Data", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthGossip
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Data = append(m.Data[:0], dAtA[iNdEx:postIndex]...)
+			if m.Data == nil {
+				m.Data = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipGossip(dAtA[iNdEx:])
@@ -775,6 +1318,74 @@ func (m *KeyAuthInit) Unmarshal(dAtA []byte) error {
 				m.Y = []byte{}
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EphemeralX", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthGossip
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EphemeralX = append(m.EphemeralX[:0], dAtA[iNdEx:postIndex]...)
+			if m.EphemeralX == nil {
+				m.EphemeralX = []byte{}
+			}
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EphemeralY", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthGossip
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EphemeralY = append(m.EphemeralY[:0], dAtA[iNdEx:postIndex]...)
+			if m.EphemeralY == nil {
+				m.EphemeralY = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipGossip(dAtA[iNdEx:])
@@ -1044,6 +1655,79 @@ func (m *KeyAuthChallengeReply) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *KeyAuthFailed) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowGossip
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: KeyAuthFailed: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: KeyAuthFailed: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Reason", wireType)
+			}
+			m.Reason = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowGossip
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Reason |= KeyAuthFailureReason(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipGossip(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthGossip
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipGossip(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
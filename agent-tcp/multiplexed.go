@@ -0,0 +1,159 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/Sperax/bdls"
+)
+
+// MultiplexedAgent runs the consensus instances of several chains over one
+// set of connections, each connection is owned by the agent of the lowest
+// chain id, and the agents of other chains are attached to it, see
+// TCPPeer.Attach.
+type MultiplexedAgent struct {
+	listener net.Listener
+	chainIDs []ChainID // sorted chain ids, chainIDs[0] owns the connections
+	agents   map[ChainID]*TCPAgent
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewMultiplexedAgent creates sealed agents for the chains in configs, all
+// configs must share the same private key, as connections are authenticated
+// once. If listener is not nil, incoming connections are accepted and carry
+// all chains. Call Start after connecting peers with AddConn.
+func NewMultiplexedAgent(listener net.Listener, configs map[ChainID]*bdls.Config) (*MultiplexedAgent, error) {
+	if len(configs) == 0 {
+		return nil, ErrMultiplexedNoChain
+	}
+
+	m := new(MultiplexedAgent)
+	m.listener = listener
+	m.agents = make(map[ChainID]*TCPAgent)
+	m.die = make(chan struct{})
+	for chainID := range configs {
+		m.chainIDs = append(m.chainIDs, chainID)
+	}
+	sort.Slice(m.chainIDs, func(i, j int) bool { return m.chainIDs[i] < m.chainIDs[j] })
+
+	key := configs[m.chainIDs[0]].PrivateKey
+	for _, chainID := range m.chainIDs {
+		config := configs[chainID]
+		if config.PrivateKey == nil || key == nil ||
+			config.PrivateKey.X.Cmp(key.X) != 0 || config.PrivateKey.Y.Cmp(key.Y) != 0 {
+			return nil, ErrMultiplexedKey
+		}
+	}
+
+	for _, chainID := range m.chainIDs {
+		consensus, err := bdls.NewConsensus(configs[chainID])
+		if err != nil {
+			return nil, err
+		}
+		m.agents[chainID] = NewSealedTCPAgentWithChainID(consensus, key, chainID)
+	}
+
+	if listener != nil {
+		go m.acceptLoop()
+	}
+	return m, nil
+}
+
+// acceptLoop adds incoming connections until the listener is closed
+func (m *MultiplexedAgent) acceptLoop() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.die:
+			default:
+				log.Println("accept:", err)
+			}
+			return
+		}
+		m.AddConn(conn)
+	}
+}
+
+// Agent returns the agent of the chain, or nil if the chain is not configured
+func (m *MultiplexedAgent) Agent(chainID ChainID) *TCPAgent { return m.agents[chainID] }
+
+// AddConn adds a connection carrying all chains, and initiates public key
+// authentication on it. Returns false, with the connection closed, if the
+// agent has been closed, or the connection can't be added.
+func (m *MultiplexedAgent) AddConn(conn net.Conn) bool {
+	owner := m.agents[m.chainIDs[0]]
+	p := NewTCPPeer(conn, owner)
+	if !owner.AddPeer(p) {
+		p.Close()
+		return false
+	}
+
+	for _, chainID := range m.chainIDs[1:] {
+		if !p.Attach(m.agents[chainID]) {
+			p.Close()
+			return false
+		}
+	}
+
+	if err := p.InitiatePublicKeyAuthentication(); err != nil {
+		p.Close()
+		return false
+	}
+	return true
+}
+
+// Start starts the agents of all chains
+func (m *MultiplexedAgent) Start() {
+	for _, chainID := range m.chainIDs {
+		m.agents[chainID].Start()
+	}
+}
+
+// Close stops accepting connections, and closes the agents of all chains
+func (m *MultiplexedAgent) Close() {
+	m.dieOnce.Do(func() {
+		close(m.die)
+		if m.listener != nil {
+			m.listener.Close()
+		}
+		// attached chains first, the connections are owned by chainIDs[0]
+		for k := len(m.chainIDs) - 1; k >= 0; k-- {
+			m.agents[m.chainIDs[k]].Close()
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sperax/bdls"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiplexedAgent(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	var coords []bdls.Identity
+	for _, privateKey := range participants {
+		coords = append(coords, bdls.DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+
+	epoch := time.Now()
+	nodes := make([]*MultiplexedAgent, len(participants))
+	for i := range participants {
+		configs := make(map[ChainID]*bdls.Config)
+		for _, chainID := range []ChainID{0, 1} {
+			config := new(bdls.Config)
+			config.Epoch = epoch
+			config.PrivateKey = participants[i]
+			config.Participants = coords
+			config.StateCompare = func(a bdls.State, b bdls.State) int { return bytes.Compare(a, b) }
+			config.StateValidate = func(a bdls.State) bool { return true }
+			configs[chainID] = config
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		nodes[i], err = NewMultiplexedAgent(listener, configs)
+		assert.Nil(t, err)
+		defer nodes[i].Close()
+	}
+
+	// one connection between each pair of nodes
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			conn, err := net.Dial("tcp", nodes[j].listener.Addr().String())
+			assert.Nil(t, err)
+			assert.True(t, nodes[i].AddConn(conn))
+		}
+	}
+
+	// wait for all connections to be accepted and authenticated
+	deadline := time.Now().Add(5 * time.Second)
+	authenticated := func(agent *TCPAgent) int {
+		agent.Lock()
+		peers := agent.peers
+		agent.Unlock()
+		n := 0
+		for _, p := range peers {
+			if p.GetPublicKey() != nil {
+				n++
+			}
+		}
+		return n
+	}
+	for _, node := range nodes {
+		for authenticated(node.Agent(0)) < len(nodes)-1 {
+			if time.Now().After(deadline) {
+				t.Fatal("authentication timeout")
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+
+	var chainA, chainB []*TCPAgent
+	for _, node := range nodes {
+		assert.Nil(t, node.Agent(0).Reload(PartialConfig{Latency: 50 * time.Millisecond}))
+		assert.Nil(t, node.Agent(1).Reload(PartialConfig{Latency: 50 * time.Millisecond}))
+		chainA = append(chainA, node.Agent(0))
+		chainB = append(chainB, node.Agent(1))
+		node.Start()
+	}
+
+	// both chains advance independently over the same connections
+	decideHeight(t, chainA, 1)
+	decideHeight(t, chainB, 1)
+	decideHeight(t, chainB, 2)
+	for i := range nodes {
+		heightA, _, stateA := chainA[i].GetLatestState()
+		heightB, _, stateB := chainB[i].GetLatestState()
+		assert.Equal(t, uint64(1), heightA)
+		assert.Equal(t, uint64(2), heightB)
+		assert.NotEqual(t, stateA, stateB)
+	}
+
+	// chains must share the private key
+	_, err := NewMultiplexedAgent(nil, map[ChainID]*bdls.Config{
+		0: {PrivateKey: participants[0]},
+		1: {PrivateKey: participants[1]},
+	})
+	assert.Equal(t, ErrMultiplexedKey, err)
+	_, err = NewMultiplexedAgent(nil, nil)
+	assert.Equal(t, ErrMultiplexedNoChain, err)
+}
@@ -0,0 +1,158 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"crypto/ecdsa"
+	"sort"
+	"time"
+
+	"github.com/Sperax/bdls"
+)
+
+const (
+	// the write latency at which a peer's score halves
+	scoreLatencyUnit = 100 * time.Millisecond
+	// the weight of the latest write in the moving average of latency
+	scoreLatencyWeight = 8
+	// peers scored below this value can be evicted for new peers at the limit
+	evictScore = 0.5
+)
+
+// peerScore tracks how reliable a peer is, from the validity of consensus
+// messages received, and the latency of writes to it.
+type peerScore struct {
+	valid   int64         // valid consensus messages received
+	invalid int64         // forged or malformed consensus messages received
+	latency time.Duration // moving average of frame write latency
+}
+
+// recordWrite records the duration of a frame write
+func (s *peerScore) recordWrite(d time.Duration) {
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency += (d - s.latency) / scoreLatencyWeight
+}
+
+// recordMessage records the result of consensus core on a received message,
+// only messages proven to be forged or malformed are invalid, outdated
+// messages are common and neutral.
+func (s *peerScore) recordMessage(err error) {
+	switch err {
+	case nil:
+		s.valid++
+	case bdls.ErrMessageSignature, bdls.ErrMessageUnknownParticipant, bdls.ErrProtocolVersionMismatch,
+		bdls.ErrMessageIsEmpty, bdls.ErrMessageUnknownMessageType, bdls.ErrMessageTooManyProofs:
+		s.invalid++
+	}
+}
+
+// value returns the score in (0, 1], a new peer starts from 1.
+func (s *peerScore) value() float64 {
+	validity := float64(s.valid+1) / float64(s.valid+s.invalid+1)
+	return validity / (1 + float64(s.latency)/float64(scoreLatencyUnit))
+}
+
+// Score implements bdls.PeerScorer, consensus sends to peers with higher score first.
+func (p *TCPPeer) Score() float64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.score.value()
+}
+
+// Score implements bdls.PeerScorer
+func (cp *chainPeer) Score() float64 { return cp.peer.Score() }
+
+// PeerInfo describes a connected peer and its score
+type PeerInfo struct {
+	RemoteAddr      string
+	PublicKey       *ecdsa.PublicKey // nil if not authenticated
+	Score           float64
+	ValidMessages   int64
+	InvalidMessages int64
+	WriteLatency    time.Duration
+}
+
+// PeerInfo returns the information of all peers, ordered by score descending
+func (agent *TCPAgent) PeerInfo() []PeerInfo {
+	agent.Lock()
+	peers := append([]*TCPPeer(nil), agent.peers...)
+	agent.Unlock()
+
+	infos := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		info := PeerInfo{RemoteAddr: p.RemoteAddr().String(), PublicKey: p.GetPublicKey()}
+		p.Lock()
+		info.Score = p.score.value()
+		info.ValidMessages = p.score.valid
+		info.InvalidMessages = p.score.invalid
+		info.WriteLatency = p.score.latency
+		p.Unlock()
+		infos = append(infos, info)
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Score > infos[j].Score })
+	return infos
+}
+
+// SetMaxPeers limits the number of peers of this agent, 0 for unlimited. At
+// the limit, a new peer replaces the lowest scored peer if its score is
+// below 0.5, otherwise the new peer is rejected.
+func (agent *TCPAgent) SetMaxPeers(n int) {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.maxPeers = n
+}
+
+// evictPeer removes the lowest scored peer to make room for a new peer,
+// returns false if all peers are scored well. The agent must be locked.
+func (agent *TCPAgent) evictPeer() bool {
+	worst := -1
+	worstScore := evictScore
+	for k := range agent.peers {
+		if score := agent.peers[k].Score(); score < worstScore {
+			worst, worstScore = k, score
+		}
+	}
+
+	if worst == -1 {
+		return false
+	}
+
+	p := agent.peers[worst]
+	copy(agent.peers[worst:], agent.peers[worst+1:])
+	agent.peers = agent.peers[:len(agent.peers)-1]
+	agent.consensus.Leave(p.RemoteAddr())
+	go p.Close()
+	return true
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sperax/bdls"
+	proto "github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowConn delays every write
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	<-time.After(c.delay)
+	return c.Conn.Write(p)
+}
+
+func TestPeerScore(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	decideHeight(t, agents, 1)
+
+	agent := agents[0]
+	agent.Lock()
+	good, invalid := agent.peers[0], agent.peers[1]
+	agent.Unlock()
+
+	// a peer relaying forged messages from a non-participant
+	forger, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	sp := new(bdls.SignedProto)
+	sp.Sign(&bdls.Message{Type: bdls.MessageType_RoundChange, Height: 2, State: []byte("forged")}, forger)
+	forged, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		agent.handleConsensusMessage(invalid, forged)
+	}
+
+	// a peer reading slowly
+	c1, c2 := net.Pipe()
+	go io.Copy(ioutil.Discard, c2)
+	slow := NewTCPPeer(&slowConn{Conn: c1, delay: 100 * time.Millisecond}, agent)
+	assert.True(t, agent.AddPeer(slow))
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, slow.Send([]byte("slow")))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for invalid.Score() >= evictScore || slow.Score() == 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("scores have not been updated")
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+
+	assert.True(t, good.Score() > slow.Score())
+	assert.True(t, good.Score() > invalid.Score())
+
+	infos := agent.PeerInfo()
+	assert.Len(t, infos, 4)
+	assert.NotEqual(t, slow.RemoteAddr().String(), infos[0].RemoteAddr)
+	assert.Equal(t, slow.RemoteAddr().String(), infos[2].RemoteAddr)
+	assert.Equal(t, invalid.RemoteAddr().String(), infos[3].RemoteAddr)
+	assert.Equal(t, int64(50), infos[3].InvalidMessages)
+
+	// at the limit, the lowest scored peers are evicted for new peers
+	agent.SetMaxPeers(4)
+	for _, evicted := range []*TCPPeer{invalid, slow} {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		assert.True(t, agent.AddPeer(NewTCPPeer(c1, agent)))
+		for _, info := range agent.PeerInfo() {
+			assert.NotEqual(t, evicted.RemoteAddr().String(), info.RemoteAddr)
+		}
+	}
+
+	// all peers are scored well, new peers are rejected
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	p := NewTCPPeer(c3, agent)
+	assert.False(t, agent.AddPeer(p))
+	p.Close()
+}
@@ -0,0 +1,85 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/Sperax/bdls"
+	"github.com/Sperax/bdls/crypto/blake2b"
+)
+
+// size of the MAC appended to frames after authentication
+const frameMACSize = 32
+
+// frameMAC authenticates the frames in one direction of a connection with the
+// session key of the authentication, the frame sequence is covered by the MAC,
+// so injected, replayed, reordered or dropped frames are detected.
+type frameMAC struct {
+	key []byte
+	seq uint64
+}
+
+// sum returns the MAC of the next frame
+func (m *frameMAC) sum(payload []byte) []byte {
+	h, err := blake2b.New256(m.key)
+	if err != nil {
+		panic(err)
+	}
+
+	var seq [8]byte
+	binary.LittleEndian.PutUint64(seq[:], m.seq)
+	h.Write(seq[:])
+	h.Write(payload)
+	m.seq++
+	return h.Sum(nil)
+}
+
+// sessionKey derives the key of the frames sent by an authenticated peer,
+// from the channel binding, the ECDH of the peer's static key with the
+// challenger's ephemeral key, and the ECDH of both ephemeral keys, only the
+// two ends of the connection can derive it, a relay cannot.
+func sessionKey(binding []byte, static *big.Int, ephemeral *big.Int) []byte {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	h.Write(binding)
+	for _, secret := range []*big.Int{static, ephemeral} {
+		var axis [bdls.SizeAxis]byte
+		bts := secret.Bytes()
+		copy(axis[len(axis)-len(bts):], bts)
+		h.Write(axis[:])
+	}
+	return h.Sum(nil)
+}
@@ -35,12 +35,15 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	fmt "fmt"
 	io "io"
 	"log"
-	"math/big"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -53,17 +56,45 @@ import (
 const (
 	// Frame format:
 	// |MessageLength(4bytes)| Message(MessageLength) ... |
+	// the last 32 bytes of Message are the MAC of the frame once the sender
+	// has authenticated, see frameMAC.
 	MessageLength = 4
 
 	// Message max length(32MB)
 	MaxMessageLength = 32 * 1024 * 1024
+	// the default maximum size of a consensus message reassembled from
+	// chunks(32MB), see SetMaxChunkedLength
+	DefaultMaxChunkedLength = MaxMessageLength
+	// the default total size of messages being reassembled from chunks
+	// across all peers(128MB), see SetChunkBudget
+	DefaultChunkBudget = 4 * MaxMessageLength
 
 	// timeout for a unresponsive connection
 	defaultReadTimeout  = 60 * time.Second
 	defaultWriteTimeout = 60 * time.Second
+	// a peer is closed if a write has not completed in this many write timeouts
+	writeStuckFactor = 2
+	// interval of heartbeats on idle connections
+	defaultHeartbeatInterval = 20 * time.Second
 
 	// challengeSize
 	challengeSize = 1024
+
+	// maximum buffered decide events awaiting to be written to event sink
+	maxPendingEvents = 128
+
+	// number of recent heights whose decision digests are kept
+	maxDigests = 1024
+
+	// maximum time to send GOODBYE on closing
+	goodbyeTimeout = 200 * time.Millisecond
+
+	// interval of the update loop
+	updateInterval = 20 * time.Millisecond
+	// the update loop is restarted if it has not ticked for this duration
+	defaultWatchdogTimeout = 5 * time.Second
+	// the agent is reported stalled after this many consecutive stuck checks
+	stallChecks = 3
 )
 
 // authenticationState is the authentication status for both peer
@@ -91,31 +122,542 @@ const (
 	localChallengeAccepted
 )
 
+// ChainID identifies a consensus instance on a multiplexed connection
+type ChainID uint64
+
 // A TCPAgent binds consensus core to a TCPAgent object, which may have multiple TCPPeer
 type TCPAgent struct {
+	// 64-bit aligned for atomic access on 32-bit platforms
+	readTimeout  int64 // read timeout of peers in nanoseconds, 0 for default
+	writeTimeout int64 // write timeout of peers in nanoseconds, 0 for default
+	heartbeat    int64 // heartbeat interval of peers in nanoseconds, 0 for default
+	chunkSize    int64 // chunk size of large consensus messages, 0 for disabled
+	maxChunked   int64 // maximum size of a message reassembled from chunks, 0 for default
+	chunkBudget  int64 // total size of messages being reassembled from all peers, 0 for default
+	chunkBytes   int64 // total size of messages being reassembled from all peers
+	maxFrame     int64 // maximum size of a frame, 0 for MaxMessageLength, for testing
+
 	consensus           *bdls.Consensus   // the consensus core
+	chainID             ChainID           // the consensus instance id of this agent
 	privateKey          *ecdsa.PrivateKey // a private key to sign messages
 	peers               []*TCPPeer        // connected peers
-	consensusMessages   [][]byte          // all consensus message awaiting to be processed
+	maxPeers            int               // maximum number of peers, 0 for unlimited
+	consensusMessages   []peerMessage     // all consensus message awaiting to be processed
 	chConsensusMessages chan struct{}     // notification of new consensus message
 
+	latestHeight uint64           // latest height observed from consensus core
+	decidedAt    time.Time        // the time latestHeight was first observed as decided
+	digestBase   uint64           // the height decision digests start from
+	digestRoot   uint64           // the height the decision digest chain starts from
+	digests      [][]byte         // digests[i] is the decision digest at digestBase+1+i, at most maxDigests
+	eventSink    io.Writer        // the writer for decide events
+	chEvents     chan DecideEvent // decide events awaiting to be written
+
+	persistHook   func(ConfirmedState) error // called synchronously before a height is processed
+	persistPolicy PersistPolicy              // what to do if persistHook fails
+	persistHalted bool                       // set to true if the agent halts on a failed persist
+	persistFailed *ConfirmedState            // the height awaiting to be persisted again
+	exporters     []*exporter                // live subscribers of ExportTo
+	dropLog       dropLog                    // counts and samples messages dropped by consensus core
+
+	chProposals     chan bdls.State // states fed by application
+	proposeOnce     sync.Once       // ProposeChannel() guard
+	pendingProposal bdls.State      // the latest state awaiting to be proposed
+	proposedHeight  uint64          // the height at which pendingProposal was last proposed
+	proposed        bool            // set to true if a state from chProposals has been proposed
+
+	started   bool      // set to true if the agent has started processing
+	startOnce sync.Once // Start() guard
+	loopsOnce sync.Once // goroutines guard
+
+	externalTick    bool            // Update is driven by Tick() instead of the update loop
+	updateGen       uint64          // generation of the update loop, stale loops exit
+	lastTick        time.Time       // the latest time the update loop ran
+	watchdogTimeout time.Duration   // restart the update loop if it stalls for this duration
+	watchdogStop    chan struct{}   // closed to stop the running watchdog, nil if not running
+	onStall         func(time.Time) // callback on update loop restart, with the last tick
+	chStalled       chan struct{}   // closed if the agent lock is stuck, see Stalled
+	stalled         bool            // set to true if chStalled has been closed
+	stuckChecks     int             // consecutive watchdog checks finding the agent lock stuck
+	stallMu         sync.Mutex      // guards chStalled, stalled and stuckChecks
+
 	die        chan struct{} // tcp agent closing
 	dieOnce    sync.Once
 	sync.Mutex // fields lock
 }
 
-// NewTCPAgent initiate a TCPAgent which talks consensus protocol with peers
+// NewTCPAgent initiate a TCPAgent which talks consensus protocol with peers,
+// the agent starts immediately, use NewSealedTCPAgent to register callbacks
+// like event sink before any message is processed.
 func NewTCPAgent(consensus *bdls.Consensus, privateKey *ecdsa.PrivateKey) *TCPAgent {
+	return NewTCPAgentWithChainID(consensus, privateKey, 0)
+}
+
+// NewTCPAgentWithChainID initiate a TCPAgent for the consensus instance
+// identified by chainID, agents with different chain ids can share
+// connections via TCPPeer.Attach.
+func NewTCPAgentWithChainID(consensus *bdls.Consensus, privateKey *ecdsa.PrivateKey, chainID ChainID) *TCPAgent {
+	agent := NewSealedTCPAgentWithChainID(consensus, privateKey, chainID)
+	agent.started = true
+	agent.startLoops()
+	return agent
+}
+
+// NewSealedTCPAgent initiate a TCPAgent in stopped state, incoming consensus
+// messages will be queued and no Update will be performed until Start() is
+// called, so peers can be wired up before time-driven transitions begin.
+func NewSealedTCPAgent(consensus *bdls.Consensus, privateKey *ecdsa.PrivateKey) *TCPAgent {
+	return NewSealedTCPAgentWithChainID(consensus, privateKey, 0)
+}
+
+// NewSealedTCPAgentWithChainID initiate a sealed TCPAgent for the consensus
+// instance identified by chainID.
+func NewSealedTCPAgentWithChainID(consensus *bdls.Consensus, privateKey *ecdsa.PrivateKey, chainID ChainID) *TCPAgent {
 	agent := new(TCPAgent)
 	agent.consensus = consensus
+	agent.chainID = chainID
 	agent.privateKey = privateKey
 	agent.die = make(chan struct{})
 	agent.chConsensusMessages = make(chan struct{}, 1)
-	go agent.inputConsensusMessage()
+	agent.chEvents = make(chan DecideEvent, maxPendingEvents)
+	agent.latestHeight, _, _ = consensus.CurrentState()
+	agent.digestBase = agent.latestHeight
+	agent.digestRoot = agent.latestHeight
+	agent.watchdogTimeout = defaultWatchdogTimeout
+	agent.chStalled = make(chan struct{})
 	return agent
 }
 
-// AddPeer adds a peer to this agent
+// Start begins processing consensus messages and the update loop of this agent,
+// for a sealed agent, it should be called after peers have been added.
+// Start replaces calling Update() manually, and only the first call takes effect.
+func (agent *TCPAgent) Start() {
+	agent.startOnce.Do(func() {
+		agent.Lock()
+		agent.started = true
+		agent.Unlock()
+
+		agent.startLoops()
+		agent.Update()
+	})
+}
+
+// startLoops starts message processing goroutines once
+func (agent *TCPAgent) startLoops() {
+	agent.loopsOnce.Do(func() {
+		go agent.inputConsensusMessage()
+		go agent.eventLoop()
+		agent.Lock()
+		agent.startWatchdog()
+		agent.Unlock()
+	})
+}
+
+// startWatchdog stops the running watchdog if any, and starts a new one with
+// the current timeout, must be called with agent lock held.
+func (agent *TCPAgent) startWatchdog() {
+	if agent.watchdogStop != nil {
+		close(agent.watchdogStop)
+	}
+	agent.watchdogStop = make(chan struct{})
+	if agent.watchdogTimeout > 0 {
+		go agent.watchdog(agent.watchdogTimeout, agent.watchdogStop)
+	}
+}
+
+// SetWatchdog sets the duration the update loop may stall before it's restarted,
+// onStall will be called if not nil on restart with the time of the last tick,
+// so the operator can be alerted. The default timeout is 5 seconds, the new
+// timeout takes effect immediately, 0 disables the watchdog.
+func (agent *TCPAgent) SetWatchdog(timeout time.Duration, onStall func(lastTick time.Time)) {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.watchdogTimeout = timeout
+	agent.onStall = onStall
+	if agent.watchdogStop != nil {
+		agent.startWatchdog()
+	}
+}
+
+// Stalled returns a channel closed when the watchdog finds the agent lock
+// held longer than the watchdog timeout in stallChecks consecutive checks,
+// ie. consensus Update or a callback is stuck, the update loop can't be
+// restarted in this case. The stall is cleared once the lock is released,
+// call Stalled again to watch for the next one.
+func (agent *TCPAgent) Stalled() <-chan struct{} {
+	agent.stallMu.Lock()
+	defer agent.stallMu.Unlock()
+	return agent.chStalled
+}
+
+// checkStuck records the result of a watchdog check of the agent lock, the
+// agent is reported stalled after stallChecks consecutive stuck checks, and
+// cleared on the first check finding the lock free.
+func (agent *TCPAgent) checkStuck(stuck bool) {
+	agent.stallMu.Lock()
+	defer agent.stallMu.Unlock()
+	if !stuck {
+		agent.stuckChecks = 0
+		if agent.stalled {
+			log.Println("agent lock released, stall cleared")
+			agent.chStalled = make(chan struct{})
+			agent.stalled = false
+		}
+		return
+	}
+
+	agent.stuckChecks++
+	if agent.stuckChecks >= stallChecks && !agent.stalled {
+		close(agent.chStalled)
+		agent.stalled = true
+	}
+}
+
+// Alive returns false if the agent has been closed, found stalled, or the
+// update loop has not ticked within the watchdog timeout. A stuck agent lock
+// is reported as not alive after the default watchdog timeout.
+func (agent *TCPAgent) Alive() bool {
+	if agent.closed() {
+		return false
+	}
+
+	agent.stallMu.Lock()
+	stalled := agent.stalled
+	agent.stallMu.Unlock()
+	if stalled {
+		return false
+	}
+
+	if !agent.lockWithin(defaultWatchdogTimeout) {
+		return false
+	}
+	defer agent.Unlock()
+	if !agent.started || agent.externalTick || agent.lastTick.IsZero() {
+		return true
+	}
+	return time.Since(agent.lastTick) < agent.watchdogTimeout
+}
+
+// watchdog supervises the update loop, time-driven progress of consensus stops
+// silently if the update loop dies, the watchdog restarts it. It runs until
+// stop is closed, ie. replaced by another watchdog with a new timeout.
+func (agent *TCPAgent) watchdog(timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-agent.die:
+			return
+		}
+
+		// a loop stuck in Update holds the lock
+		if !agent.lockWithin(timeout) {
+			log.Println("agent lock held for", timeout, "update loop is stuck")
+			agent.checkStuck(true)
+			continue
+		}
+		agent.checkStuck(false)
+
+		// replaced while waiting for the lock
+		select {
+		case <-stop:
+			agent.Unlock()
+			return
+		default:
+		}
+
+		if !agent.started || agent.externalTick || agent.lastTick.IsZero() || time.Since(agent.lastTick) < agent.watchdogTimeout {
+			agent.Unlock()
+			continue
+		}
+
+		// abandon the stalled loop, and start a new one
+		lastTick := agent.lastTick
+		onStall := agent.onStall
+		agent.updateGen++
+		gen := agent.updateGen
+		agent.Unlock()
+
+		log.Println("update loop stalled since", lastTick, "restarting")
+		if onStall != nil {
+			onStall(lastTick)
+		}
+		agent.update(gen)
+	}
+}
+
+// lockWithin acquires the agent lock in d, or returns false, the lock will be
+// released in background once acquired if it's abandoned.
+func (agent *TCPAgent) lockWithin(d time.Duration) bool {
+	acquired := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		agent.Lock()
+		select {
+		case acquired <- struct{}{}:
+		case <-abandoned:
+			agent.Unlock()
+		}
+	}()
+
+	select {
+	case <-acquired:
+		return true
+	case <-time.After(d):
+		close(abandoned)
+		return false
+	}
+}
+
+// DecideEvent is the JSON object written to event sink for each confirmed state,
+// in strictly increasing order of heights
+type DecideEvent struct {
+	Height    uint64    `json:"height"`
+	Round     uint64    `json:"round"`
+	StateHash string    `json:"state_hash"`
+	Timestamp time.Time `json:"timestamp"`
+	Signers   int       `json:"signers"`
+}
+
+// ConfirmedState is a decided state passed to the persist hook, in strictly
+// increasing order of heights
+type ConfirmedState struct {
+	Height uint64
+	Round  uint64
+	State  bdls.State
+	Proof  *bdls.SignedProto // the <decide> message of the height
+}
+
+// PersistPolicy defines how the agent reacts to a failed persist hook
+type PersistPolicy int
+
+const (
+	// PersistRetry keeps the height unprocessed, and the hook will be called
+	// again on the next update with the same height, until it succeeds.
+	PersistRetry PersistPolicy = iota
+	// PersistHalt closes the agent.
+	PersistHalt
+)
+
+// SetPersistHook sets a hook to persist each confirmed state, it's called
+// synchronously with the agent lock held, before the height is processed,
+// ie. before DecidedAt, decide events and proposing at the next height.
+// Heights are passed in increasing order, a failed height is passed again
+// with PersistRetry, heights synced by <decide> messages or decided while
+// retrying may be skipped. Set to nil to disable.
+func (agent *TCPAgent) SetPersistHook(hook func(ConfirmedState) error, policy PersistPolicy) {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.persistHook = hook
+	agent.persistPolicy = policy
+}
+
+// SetEventSink sets a writer to receive decide events as JSON objects, one per
+// line. Events are buffered, and will be dropped if the writer is too slow to
+// keep up with consensus. Set to nil to disable.
+func (agent *TCPAgent) SetEventSink(w io.Writer) {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.eventSink = w
+}
+
+// ProposeChannel returns a channel for the application to feed candidate
+// states, the latest state received is proposed whenever a new height opens,
+// earlier states not yet proposed are discarded. This decouples the rate of
+// state production from the rate of consensus.
+func (agent *TCPAgent) ProposeChannel() chan<- bdls.State {
+	agent.proposeOnce.Do(func() {
+		agent.chProposals = make(chan bdls.State)
+		go agent.proposeLoop()
+	})
+	return agent.chProposals
+}
+
+// proposeLoop receives states from ProposeChannel
+func (agent *TCPAgent) proposeLoop() {
+	for {
+		select {
+		case s := <-agent.chProposals:
+			agent.Lock()
+			agent.pendingProposal = s
+			agent.proposePending()
+			agent.Unlock()
+		case <-agent.die:
+			return
+		}
+	}
+}
+
+// proposePending proposes the pending state if nothing has been proposed from
+// ProposeChannel at the current height, must be called with agent lock held.
+func (agent *TCPAgent) proposePending() {
+	if agent.pendingProposal == nil {
+		return
+	}
+
+	if agent.proposed && agent.proposedHeight == agent.latestHeight {
+		return
+	}
+
+	if err := agent.consensus.Propose(agent.pendingProposal); err != nil {
+		log.Println("propose:", err)
+	}
+	agent.pendingProposal = nil
+	agent.proposedHeight = agent.latestHeight
+	agent.proposed = true
+}
+
+// checkDecide emits a decide event if consensus core has moved to a new height,
+// must be called with agent lock held.
+func (agent *TCPAgent) checkDecide(now time.Time) {
+	// heights are processed once and in order, see the package doc
+	if agent.persistHalted {
+		return
+	}
+
+	// a height failed to persist is retried before any later height
+	confirmed := agent.persistFailed
+	if confirmed == nil {
+		height, round, state := agent.consensus.CurrentState()
+		if height <= agent.latestHeight {
+			return
+		}
+		confirmed = &ConfirmedState{Height: height, Round: round, State: state, Proof: agent.consensus.CurrentProof()}
+	}
+	height, round, state, proof := confirmed.Height, confirmed.Round, confirmed.State, confirmed.Proof
+
+	// persist the state before the height is processed
+	if agent.persistHook != nil {
+		if err := agent.persistHook(*confirmed); err != nil {
+			log.Println("persist height:", height, err)
+			if agent.persistPolicy == PersistHalt {
+				agent.persistHalted = true
+				go agent.Close()
+			} else {
+				agent.persistFailed = confirmed
+			}
+			return
+		}
+	}
+	agent.persistFailed = nil
+
+	agent.latestHeight = height
+	agent.decidedAt = now
+	hash := agent.consensus.StateHash(state)
+	agent.updateDigest(height, hash)
+
+	agent.exportDecision(height, proof)
+
+	// a new height has opened
+	agent.proposePending()
+
+	if agent.eventSink == nil {
+		return
+	}
+
+	event := DecideEvent{
+		Height:    height,
+		Round:     round,
+		StateHash: hex.EncodeToString(hash[:]),
+		Timestamp: now,
+	}
+
+	// count the <commit> proofs in <decide> message
+	if proof != nil {
+		if m, err := bdls.DecodeMessage(proof.Message); err == nil {
+			event.Signers = len(m.Proof)
+		}
+	}
+
+	select {
+	case agent.chEvents <- event:
+	default:
+		log.Println("decide event dropped at height:", height)
+	}
+}
+
+// updateDigest extends the decision digest with the state decided at height,
+// the chain restarts from the height after a skipped one, e.g. synced by
+// <decide>, only the latest maxDigests digests are kept.
+func (agent *TCPAgent) updateDigest(height uint64, hash bdls.StateHash) {
+	next := agent.digestBase + uint64(len(agent.digests)) + 1
+	if height < next {
+		return
+	} else if height > next {
+		agent.digestBase = height - 1
+		agent.digestRoot = height - 1
+		agent.digests = nil
+	}
+
+	var prev []byte
+	if len(agent.digests) > 0 {
+		prev = agent.digests[len(agent.digests)-1]
+	}
+
+	var h [8]byte
+	binary.LittleEndian.PutUint64(h[:], height)
+	digest := blake2b.Sum256(append(append(append([]byte(nil), prev...), h[:]...), hash[:]...))
+	if len(agent.digests) >= maxDigests {
+		copy(agent.digests, agent.digests[1:])
+		agent.digests = agent.digests[:len(agent.digests)-1]
+		agent.digestBase++
+	}
+	agent.digests = append(agent.digests, digest[:])
+}
+
+// DecisionDigest returns a rolling blake2b-256 digest over the state hashes
+// decided from the starting height of the chain up to the given height,
+// digest(h) = blake2b(digest(h-1) + height_64bit(h) + StateHash(h)).
+// The chain starts from the starting height of the agent, and restarts after
+// a skipped height, see DigestRoot. Agents whose chains start from the same
+// height with the same digest have agreed on identical history. Nil will be
+// returned if the height is not within the latest maxDigests heights.
+func (agent *TCPAgent) DecisionDigest(upToHeight uint64) []byte {
+	agent.Lock()
+	defer agent.Unlock()
+	if upToHeight <= agent.digestBase || upToHeight > agent.digestBase+uint64(len(agent.digests)) {
+		return nil
+	}
+	return agent.digests[upToHeight-agent.digestBase-1]
+}
+
+// DigestRoot returns the height the decision digest chain starts from
+func (agent *TCPAgent) DigestRoot() uint64 {
+	agent.Lock()
+	defer agent.Unlock()
+	return agent.digestRoot
+}
+
+// eventLoop writes decide events to event sink
+func (agent *TCPAgent) eventLoop() {
+	for {
+		select {
+		case event := <-agent.chEvents:
+			agent.Lock()
+			sink := agent.eventSink
+			agent.Unlock()
+
+			if sink != nil {
+				bts, err := json.Marshal(event)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				sink.Write(append(bts, '\n'))
+			}
+		case <-agent.die:
+			return
+		}
+	}
+}
+
+// AddPeer adds a peer to this agent, returns false if the agent has closed
+// or the peer cannot join consensus core, in which case the peer will not
+// be registered, and it's caller's responsibility to close the peer.
 func (agent *TCPAgent) AddPeer(p *TCPPeer) bool {
 	agent.Lock()
 	defer agent.Unlock()
@@ -124,74 +666,339 @@ func (agent *TCPAgent) AddPeer(p *TCPPeer) bool {
 	case <-agent.die:
 		return false
 	default:
+		if agent.maxPeers > 0 && len(agent.peers) >= agent.maxPeers && !agent.evictPeer() {
+			return false
+		}
+		if !agent.consensus.Join(p) {
+			return false
+		}
 		agent.peers = append(agent.peers, p)
-		return agent.consensus.Join(p)
+		return true
 	}
 }
 
-// RemovePeer removes a TCPPeer from this agent
+// RemovePeer removes a TCPPeer from this agent, the peer is matched by
+// itself, or by the canonical form of its address, see canonicalAddr.
 func (agent *TCPAgent) RemovePeer(p *TCPPeer) bool {
 	agent.Lock()
 	defer agent.Unlock()
 
-	peerAddress := p.RemoteAddr().String()
-	for k := range agent.peers {
-		if agent.peers[k].RemoteAddr().String() == peerAddress {
+	peerAddress := canonicalAddr(p.RemoteAddr())
+	for k, added := range agent.peers {
+		if added == p || canonicalAddr(added.RemoteAddr()) == peerAddress {
 			copy(agent.peers[k:], agent.peers[k+1:])
 			agent.peers = agent.peers[:len(agent.peers)-1]
-			return agent.consensus.Leave(p.RemoteAddr())
+			// leave with the address joined
+			return agent.consensus.Leave(added.RemoteAddr())
 		}
 	}
 	return false
 }
 
-// Close stops all activities on this agent
+// canonicalAddr returns the canonical form of a host:port address, IPs are
+// formatted canonically along with their IPv6 zones, and hostnames are
+// lowercased without the trailing dot. Hostnames are not resolved.
+func canonicalAddr(addr net.Addr) string {
+	s := addr.String()
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return s
+	}
+
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Close stops all activities on this agent, it must be called explicitly,
+// as the agent is never closed implicitly on garbage collection.
+//
+// The shutdown is ordered so the consensus core never messages a dead socket:
+// the update loop and message processing stop first, then all peers are
+// removed from consensus core, and the connections are closed at last.
 func (agent *TCPAgent) Close() {
+	var peers []*TCPPeer
 	agent.Lock()
-	defer agent.Unlock()
-
 	agent.dieOnce.Do(func() {
+		// stop the update loop, Tick and message processing, which
+		// check agent.die with the lock held
 		close(agent.die)
-		// close all peers
-		for k := range agent.peers {
-			agent.peers[k].Close()
+
+		// remove all peers from consensus core, including attached ones
+		for _, p := range agent.consensus.Peers() {
+			agent.consensus.Leave(p.RemoteAddr())
 		}
+		peers = agent.peers
+		agent.peers = nil
 	})
+	agent.Unlock()
+
+	// close the transport
+	for _, p := range peers {
+		p.Close()
+	}
+}
+
+// PartialConfig contains the settings of an agent which can be changed at
+// runtime without dropping connections, zero values keep the current ones.
+// Structural settings like participants, keys and epoch are not included,
+// they require a restart, or bdls.Consensus.ChangeParticipants.
+type PartialConfig struct {
+	ReadTimeout     time.Duration // timeout for an unresponsive peer to send
+	WriteTimeout    time.Duration // timeout for an unresponsive peer to receive
+	Heartbeat       time.Duration // interval of heartbeats on idle connections
+	Latency         time.Duration // expected latency of consensus messages
+	WatchdogTimeout time.Duration // see SetWatchdog
 }
 
-// Update is the consensus updater
+// Reload applies the non-zero settings in cfg, the timeouts take effect on
+// the next read or write of peers. ErrReloadConfig will be returned if any
+// setting is negative, and nothing will be changed.
+func (agent *TCPAgent) Reload(cfg PartialConfig) error {
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.Heartbeat < 0 || cfg.Latency < 0 || cfg.WatchdogTimeout < 0 {
+		return ErrReloadConfig
+	}
+
+	agent.Lock()
+	defer agent.Unlock()
+	if cfg.ReadTimeout > 0 {
+		atomic.StoreInt64(&agent.readTimeout, int64(cfg.ReadTimeout))
+	}
+	if cfg.WriteTimeout > 0 {
+		atomic.StoreInt64(&agent.writeTimeout, int64(cfg.WriteTimeout))
+	}
+	if cfg.Heartbeat > 0 {
+		atomic.StoreInt64(&agent.heartbeat, int64(cfg.Heartbeat))
+	}
+	if cfg.Latency > 0 {
+		agent.consensus.SetLatency(cfg.Latency)
+	}
+	if cfg.WatchdogTimeout > 0 {
+		agent.watchdogTimeout = cfg.WatchdogTimeout
+		if agent.watchdogStop != nil {
+			agent.startWatchdog()
+		}
+	}
+	return nil
+}
+
+// getReadTimeout returns the read timeout for peers
+func (agent *TCPAgent) getReadTimeout() time.Duration {
+	if timeout := atomic.LoadInt64(&agent.readTimeout); timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return defaultReadTimeout
+}
+
+// getWriteTimeout returns the write timeout for peers
+func (agent *TCPAgent) getWriteTimeout() time.Duration {
+	if timeout := atomic.LoadInt64(&agent.writeTimeout); timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return defaultWriteTimeout
+}
+
+// getHeartbeat returns the heartbeat interval for peers
+func (agent *TCPAgent) getHeartbeat() time.Duration {
+	if interval := atomic.LoadInt64(&agent.heartbeat); interval > 0 {
+		return time.Duration(interval)
+	}
+	return defaultHeartbeatInterval
+}
+
+// Update is the consensus updater, it does nothing if the agent has not started.
 func (agent *TCPAgent) Update() {
+	agent.Lock()
+	gen := agent.updateGen
+	agent.Unlock()
+	agent.update(gen)
+}
+
+// SetExternalTick drives the consensus timing by Tick() from the application
+// instead of the internal update loop, it must be called before Start().
+//
+// Safety is not affected, as consensus never relies on time for safety. But
+// liveness does: round change timeouts and retransmissions only advance on
+// ticks, so the application should keep ticking the undecided height, ie. at
+// the block interval, until it's decided, a height with no ticks may stall
+// forever. Messages from peers are still processed as they arrive, a height
+// can be decided between ticks.
+func (agent *TCPAgent) SetExternalTick() {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.externalTick = true
+}
+
+// Tick signals it's time to produce the height, it updates consensus core as
+// the update loop does. ErrStaleTick will be returned if the height has been
+// decided, and Tick does nothing if the agent has not started.
+func (agent *TCPAgent) Tick(height uint64) error {
+	agent.Lock()
+	defer agent.Unlock()
+
+	if agent.closed() {
+		return ErrAgentClosed
+	}
+
+	if height <= agent.latestHeight {
+		return ErrStaleTick
+	}
+
+	if !agent.started {
+		return nil
+	}
+
+	now := time.Now()
+	agent.consensus.Update(now)
+	agent.checkDecide(now)
+	agent.dropLog.flush(now)
+	agent.lastTick = now
+	return nil
+}
+
+// update runs the update loop of the given generation, it exits if the loop
+// has been replaced by watchdog or driven by Tick().
+func (agent *TCPAgent) update(gen uint64) {
 	agent.Lock()
 	defer agent.Unlock()
 
+	if !agent.started || agent.externalTick || gen != agent.updateGen {
+		return
+	}
+
 	select {
 	case <-agent.die:
 	default:
 		// call consensus update
-		agent.consensus.Update(time.Now())
-		timer.SystemTimedSched.Put(agent.Update, time.Now().Add(20*time.Millisecond))
+		now := time.Now()
+		agent.consensus.Update(now)
+		agent.checkDecide(now)
+		agent.dropLog.flush(now)
+		agent.lastTick = now
+		timer.SystemTimedSched.Put(func() { agent.update(gen) }, now.Add(updateInterval))
 	}
 }
 
-// Propose a state, awaiting to be finalized at next height.
-func (agent *TCPAgent) Propose(s bdls.State) {
+// Propose a state, awaiting to be finalized at next height, returns
+// ErrAgentClosed if the agent has been closed.
+func (agent *TCPAgent) Propose(s bdls.State) error {
+	agent.Lock()
+	defer agent.Unlock()
+	if agent.closed() {
+		return ErrAgentClosed
+	}
+	return agent.consensus.Propose(s)
+}
+
+// closed returns true if the agent has been closed
+func (agent *TCPAgent) closed() bool {
+	select {
+	case <-agent.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reset reinitializes the consensus core to a new genesis, see bdls.Consensus.Reset
+// for the safety caveats.
+func (agent *TCPAgent) Reset(height uint64, state bdls.State) {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.consensus.Reset(height, state)
+	agent.latestHeight = height
+	agent.decidedAt = time.Time{}
+	agent.digestBase = height
+	agent.digestRoot = height
+	agent.digests = nil
+	agent.persistFailed = nil
+	agent.pendingProposal = nil
+	agent.proposed = false
+}
+
+// GetLatestState returns latest state
+func (agent *TCPAgent) GetLatestState() (height uint64, round uint64, data bdls.State) {
+	agent.Lock()
+	defer agent.Unlock()
+	return agent.consensus.CurrentState()
+}
+
+// HasQuorumConnectivity returns true if enough participants are connected and
+// authenticated (plus this node) to possibly reach consensus, proposing
+// without it is futile until more peers join.
+func (agent *TCPAgent) HasQuorumConnectivity() bool {
+	agent.Lock()
+	defer agent.Unlock()
+	return agent.consensus.HasQuorumConnectivity()
+}
+
+// Metrics returns the message counters of consensus core, see bdls.Consensus.Metrics
+func (agent *TCPAgent) Metrics() bdls.Metrics {
+	agent.Lock()
+	defer agent.Unlock()
+	return agent.consensus.Metrics()
+}
+
+// DecidedAt returns the latest decided height, and the time it was first
+// observed as decided by this agent, the same as DecideEvent.Timestamp.
+// The time is zero if no height has been decided since the agent started.
+func (agent *TCPAgent) DecidedAt() (height uint64, at time.Time) {
 	agent.Lock()
 	defer agent.Unlock()
-	agent.consensus.Propose(s)
+	return agent.latestHeight, agent.decidedAt
 }
 
-// GetLatestState returns latest state
-func (agent *TCPAgent) GetLatestState() (height uint64, round uint64, data bdls.State) {
+// Voters returns the identities which have voted at the given height & round
+func (agent *TCPAgent) Voters(height uint64, round uint64) []bdls.Identity {
 	agent.Lock()
 	defer agent.Unlock()
-	return agent.consensus.CurrentState()
+	return agent.consensus.Voters(height, round)
+}
+
+// leave removes an attached chain peer from consensus core
+func (agent *TCPAgent) leave(cp *chainPeer) {
+	agent.Lock()
+	defer agent.Unlock()
+	agent.consensus.Leave(cp.RemoteAddr())
+}
+
+// ChainID returns the consensus instance id of this agent
+func (agent *TCPAgent) ChainID() ChainID { return agent.chainID }
+
+// peerMessage is a received consensus message along with the peer it came from
+type peerMessage struct {
+	peer *TCPPeer
+	bts  []byte
+}
+
+// from returns the remote address of the peer the message came from
+func (msg peerMessage) from() string {
+	if msg.peer == nil {
+		return "unknown"
+	}
+	return msg.peer.RemoteAddr().String()
 }
 
 // handleConsensusMessage will be called if TCPPeer received a consensus message
-func (agent *TCPAgent) handleConsensusMessage(bts []byte) {
+func (agent *TCPAgent) handleConsensusMessage(p *TCPPeer, bts []byte) {
 	agent.Lock()
 	defer agent.Unlock()
-	agent.consensusMessages = append(agent.consensusMessages, bts)
+	if agent.closed() {
+		return
+	}
+	agent.consensusMessages = append(agent.consensusMessages, peerMessage{p, bts})
 	agent.notifyConsensus()
 }
 
@@ -211,9 +1018,33 @@ func (agent *TCPAgent) inputConsensusMessage() {
 			msgs := agent.consensusMessages
 			agent.consensusMessages = nil
 
+			// the agent may have been closed while waiting for the lock
+			if agent.closed() {
+				agent.Unlock()
+				return
+			}
+
+			// verify the signatures of queued messages concurrently
+			batch := make([][]byte, len(msgs))
+			for k := range msgs {
+				batch[k] = msgs[k].bts
+			}
+			agent.consensus.Preverify(batch)
+
 			for _, msg := range msgs {
-				agent.consensus.ReceiveMessage(msg, time.Now())
+				now := time.Now()
+				err := agent.consensus.ReceiveMessage(msg.bts, now)
+				if msg.peer != nil {
+					msg.peer.Lock()
+					msg.peer.score.recordMessage(err)
+					msg.peer.Unlock()
+				}
+				if err != nil {
+					agent.dropLog.record(err, msg.from(), now)
+				}
+				agent.checkDecide(now)
 			}
+			agent.consensus.Preverify(nil)
 			agent.Unlock()
 		case <-agent.die:
 			return
@@ -221,6 +1052,39 @@ func (agent *TCPAgent) inputConsensusMessage() {
 	}
 }
 
+// ReceiveMessages processes a batch of consensus messages, such as a replayed
+// trace or a burst of messages, under a single lock, and returns the errors
+// per message. Signatures are verified by Config.VerifyConcurrency goroutines.
+// All messages fail with ErrAgentClosed if the agent has been closed, or
+// ErrAgentNotStarted if the agent has not started.
+func (agent *TCPAgent) ReceiveMessages(batch [][]byte) []error {
+	agent.Lock()
+	defer agent.Unlock()
+
+	errs := make([]error, len(batch))
+	var err error
+	if agent.closed() {
+		err = ErrAgentClosed
+	} else if !agent.started {
+		err = ErrAgentNotStarted
+	}
+	if err != nil {
+		for k := range errs {
+			errs[k] = err
+		}
+		return errs
+	}
+
+	agent.consensus.Preverify(batch)
+	defer agent.consensus.Preverify(nil)
+	for k := range batch {
+		now := time.Now()
+		errs[k] = agent.consensus.ReceiveMessage(batch[k], now)
+		agent.checkDecide(now)
+	}
+	return errs
+}
+
 // fake address for Pipe
 type fakeAddress string
 
@@ -229,6 +1093,9 @@ func (f fakeAddress) String() string { return string(f) }
 
 // TCPPeer represents a peer(endpoint) related to a tcp connection
 type TCPPeer struct {
+	// 64-bit aligned for atomic access on 32-bit platforms
+	writeStart int64 // the time the ongoing frame write began in unix nanoseconds, 0 if idle
+
 	agent          *TCPAgent           // the agent it belongs to
 	conn           net.Conn            // the connection to this peer
 	peerAuthStatus authenticationState // peer authentication status
@@ -237,29 +1104,82 @@ type TCPPeer struct {
 
 	// local authentication status
 	localAuthState authenticationState
+	// the ephemeral key sent in KeyAuthInit, binds authentication to this connection
+	ephemeral *ecdsa.PrivateKey
+	// the reason of the peer rejecting our authentication
+	keyAuthFailure KeyAuthFailureReason
 
 	// the HMAC of the challenge text if peer has requested key authentication
 	hmac []byte
+	// the MAC of frames from the peer once its challenge reply is verified
+	pendingRecvMAC *frameMAC
+	// verifies the frames from the peer after it has authenticated, used by readLoop
+	recvMAC *frameMAC
+	// MACs the frames to the peer after our challenge reply is written, guarded by wmu
+	sendMAC *frameMAC
+
+	// reliability of this peer
+	score peerScore
 
 	// message queues and their notifications
-	consensusMessages  [][]byte      // all pending outgoing consensus messages to this peer
-	chConsensusMessage chan struct{} // notification on new consensus data
+	consensusMessages  []chainMessage // all pending outgoing consensus messages to this peer
+	chConsensusMessage chan struct{}  // notification on new consensus data
+
+	// other consensus instances attached to this connection
+	chains map[ChainID]*chainPeer
+
+	// large consensus messages being received in chunks
+	reassemblies map[chunkKey]*reassembly
 
 	// agent messages
-	agentMessages  [][]byte      // all pending outgoing agent messages to this peer.
-	chAgentMessage chan struct{} // notification on new agent exchange messages
+	agentMessages  []agentMessage // all pending outgoing agent messages to this peer.
+	chAgentMessage chan struct{}  // notification on new agent exchange messages
 
 	// peer closing signal
-	die     chan struct{}
-	dieOnce sync.Once
+	die        chan struct{}
+	dieOnce    sync.Once
+	closing    int32      // set to 1 atomically when Close() begins
+	writeStuck int32      // set to 1 atomically when a frame write is found stuck
+	wmu        sync.Mutex // serializes frame writes to conn
 
 	// mutex for all fields
 	sync.Mutex
 }
 
+// agentMessage is an outgoing agent message, the frames after it are
+// authenticated by sendMAC if not nil
+type agentMessage struct {
+	bts     []byte
+	sendMAC *frameMAC
+}
+
+// chainMessage is an outgoing consensus message along with its chain id
+type chainMessage struct {
+	chainID ChainID
+	bts     []byte
+}
+
+// chainPeer is the view of a TCPPeer for an attached consensus instance,
+// it tags outgoing messages with the chain id of the instance.
+type chainPeer struct {
+	peer  *TCPPeer
+	agent *TCPAgent
+}
+
+// GetPublicKey implements PeerInterface, returns the public key of the underlying peer
+func (cp *chainPeer) GetPublicKey() *ecdsa.PublicKey { return cp.peer.GetPublicKey() }
+
+// RemoteAddr implements PeerInterface, returns the address of the underlying peer
+func (cp *chainPeer) RemoteAddr() net.Addr { return cp.peer.RemoteAddr() }
+
+// Send implements PeerInterface, to send message to the attached instance of this peer
+func (cp *chainPeer) Send(out []byte) error { return cp.peer.send(cp.agent.chainID, out) }
+
 // NewTCPPeer creates a TCPPeer with protocol over this connection
 func NewTCPPeer(conn net.Conn, agent *TCPAgent) *TCPPeer {
 	p := new(TCPPeer)
+	p.chains = make(map[ChainID]*chainPeer)
+	p.reassemblies = make(map[chunkKey]*reassembly)
 	p.chConsensusMessage = make(chan struct{}, 1)
 	p.chAgentMessage = make(chan struct{}, 1)
 	p.conn = conn
@@ -268,6 +1188,7 @@ func NewTCPPeer(conn net.Conn, agent *TCPAgent) *TCPPeer {
 	// we start readLoop & sendLoop for each connection
 	go p.readLoop()
 	go p.sendLoop()
+	go p.writeWatchdog()
 	return p
 }
 
@@ -292,14 +1213,42 @@ func (p *TCPPeer) RemoteAddr() net.Addr {
 }
 
 // Send implements PeerInterface, to send message to this peer
-func (p *TCPPeer) Send(out []byte) error {
+func (p *TCPPeer) Send(out []byte) error { return p.send(p.agent.chainID, out) }
+
+// send enqueues a consensus message of the given chain to this peer
+func (p *TCPPeer) send(chainID ChainID, out []byte) error {
 	p.Lock()
 	defer p.Unlock()
-	p.consensusMessages = append(p.consensusMessages, out)
+	p.consensusMessages = append(p.consensusMessages, chainMessage{chainID, out})
 	p.notifyConsensusMessage()
 	return nil
 }
 
+// Attach multiplexes another consensus instance over this connection, messages
+// are tagged with agent's chain id, and demultiplexed to the agent with the
+// same chain id on the other side. The agent must have the same private key
+// with the agent which created this peer, as the connection is authenticated
+// only once. Returns false if the chain id has already been attached.
+func (p *TCPPeer) Attach(agent *TCPAgent) bool {
+	if agent.privateKey.PublicKey.X.Cmp(p.agent.privateKey.PublicKey.X) != 0 ||
+		agent.privateKey.PublicKey.Y.Cmp(p.agent.privateKey.PublicKey.Y) != 0 {
+		return false
+	}
+
+	p.Lock()
+	if agent.chainID == p.agent.chainID || p.chains[agent.chainID] != nil {
+		p.Unlock()
+		return false
+	}
+	cp := &chainPeer{peer: p, agent: agent}
+	p.chains[agent.chainID] = cp
+	p.Unlock()
+
+	agent.Lock()
+	defer agent.Unlock()
+	return agent.consensus.Join(cp)
+}
+
 // notifyConsensusMessage notifies goroutines there're messages pending to send
 func (p *TCPPeer) notifyConsensusMessage() {
 	select {
@@ -308,6 +1257,23 @@ func (p *TCPPeer) notifyConsensusMessage() {
 	}
 }
 
+// enqueueAgentMessage queues an internal message to send, the same size limit
+// of consensus messages applies, p.Lock() must be held.
+func (p *TCPPeer) enqueueAgentMessage(out []byte) error {
+	return p.enqueueAgentMessageMAC(out, nil)
+}
+
+// enqueueAgentMessageMAC enqueues an agent message, the frames written after
+// it are authenticated by sendMAC if not nil.
+func (p *TCPPeer) enqueueAgentMessageMAC(out []byte, sendMAC *frameMAC) error {
+	if len(out) > p.agent.getMaxFrame() {
+		return ErrMessageLengthExceed
+	}
+	p.agentMessages = append(p.agentMessages, agentMessage{out, sendMAC})
+	p.notifyAgentMessage()
+	return nil
+}
+
 // notifyAgentMessage, notifies goroutines there're agent messages pending to send
 func (p *TCPPeer) notifyAgentMessage() {
 	select {
@@ -316,13 +1282,72 @@ func (p *TCPPeer) notifyAgentMessage() {
 	}
 }
 
-// Close terminates connection to this peer
+// Close terminates connection to this peer, the remote peer will be notified
+// with a GOODBYE message if the connection is still writable.
 func (p *TCPPeer) Close() {
 	p.dieOnce.Do(func() {
+		p.sendGoodbye()
 		p.conn.Close()
 		close(p.die)
 	})
 	go p.agent.RemovePeer(p)
+
+	p.Lock()
+	for _, cp := range p.chains {
+		go cp.agent.leave(cp)
+	}
+	p.releaseReassemblies()
+	p.Unlock()
+}
+
+// sendGoodbye notifies the remote peer to remove this peer promptly, errors
+// are ignored as the connection may have broken already.
+func (p *TCPPeer) sendGoodbye() {
+	atomic.StoreInt32(&p.closing, 1)
+	// the stuck write holds the connection
+	if atomic.LoadInt32(&p.writeStuck) == 1 {
+		return
+	}
+	// unblock the pending write
+	p.conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+
+	out, err := proto.Marshal(&Gossip{Command: CommandType_GOODBYE})
+	if err != nil {
+		panic(err)
+	}
+	p.writeFrame(make([]byte, MessageLength), out, goodbyeTimeout)
+}
+
+// sendKeyAuthFailed tells the peer why its public key authentication failed
+// before the connection is dropped, errors are ignored as in sendGoodbye.
+func (p *TCPPeer) sendKeyAuthFailed(err error) {
+	var reason KeyAuthFailureReason
+	switch err {
+	case ErrPeerAuthenticatedFailed:
+		reason = KeyAuthFailureReason_HMAC_MISMATCH
+	case ErrKeyMalformed, ErrKeyNotOnCurve:
+		reason = KeyAuthFailureReason_KEY_MALFORMED
+	default:
+		return
+	}
+
+	bts, err := proto.Marshal(&KeyAuthFailed{Reason: reason})
+	if err != nil {
+		panic(err)
+	}
+	out, err := proto.Marshal(&Gossip{Command: CommandType_KEY_AUTH_FAILED, Message: bts})
+	if err != nil {
+		panic(err)
+	}
+	p.writeFrame(make([]byte, MessageLength), out, goodbyeTimeout)
+}
+
+// KeyAuthFailure returns the reason the peer reported for rejecting our
+// public key authentication, or KeyAuthFailureReason_NONE.
+func (p *TCPPeer) KeyAuthFailure() KeyAuthFailureReason {
+	p.Lock()
+	defer p.Unlock()
+	return p.keyAuthFailure
 }
 
 // InitiatePublicKeyAuthentication will initate a procedure to convince
@@ -331,9 +1356,18 @@ func (p *TCPPeer) InitiatePublicKeyAuthentication() error {
 	p.Lock()
 	defer p.Unlock()
 	if p.localAuthState == localNotAuthenticated {
+		// create ephermal key for channel binding
+		ephemeral, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		p.ephemeral = ephemeral
+
 		auth := KeyAuthInit{}
 		auth.X = p.agent.privateKey.PublicKey.X.Bytes()
 		auth.Y = p.agent.privateKey.PublicKey.Y.Bytes()
+		auth.EphemeralX = ephemeral.PublicKey.X.Bytes()
+		auth.EphemeralY = ephemeral.PublicKey.Y.Bytes()
 
 		// proto marshal
 		bts, err := proto.Marshal(&auth)
@@ -349,8 +1383,9 @@ func (p *TCPPeer) InitiatePublicKeyAuthentication() error {
 		}
 
 		// enqueue
-		p.agentMessages = append(p.agentMessages, out)
-		p.notifyAgentMessage()
+		if err := p.enqueueAgentMessage(out); err != nil {
+			return err
+		}
 		p.localAuthState = localAuthKeySent
 		return nil
 	} else {
@@ -362,6 +1397,9 @@ func (p *TCPPeer) InitiatePublicKeyAuthentication() error {
 func (p *TCPPeer) handleGossip(msg *Gossip) error {
 	switch msg.Command {
 	case CommandType_NOP: // NOP can be used for connection keepalive
+		p.Lock()
+		p.expireReassemblies(time.Now())
+		p.Unlock()
 	case CommandType_KEY_AUTH_INIT:
 		// this peer initated it's publickey authentication
 		var m KeyAuthInit
@@ -372,6 +1410,7 @@ func (p *TCPPeer) handleGossip(msg *Gossip) error {
 
 		err = p.handleKeyAuthInit(&m)
 		if err != nil {
+			p.sendKeyAuthFailed(err)
 			return err
 		}
 	case CommandType_KEY_AUTH_CHALLENGE:
@@ -396,19 +1435,69 @@ func (p *TCPPeer) handleGossip(msg *Gossip) error {
 		}
 
 		err = p.handleKeyAuthChallengeReply(&m)
+		if err != nil {
+			p.sendKeyAuthFailed(err)
+			return err
+		}
+
+	case CommandType_KEY_AUTH_FAILED:
+		// this peer has rejected our public key authentication
+		var m KeyAuthFailed
+		err := proto.Unmarshal(msg.Message, &m)
 		if err != nil {
 			return err
 		}
 
+		p.Lock()
+		p.keyAuthFailure = m.Reason
+		p.Unlock()
+		return ErrKeyAuthRejected
+
+	case CommandType_GOODBYE:
+		// the peer is closing the connection
+		return ErrPeerGoodbye
 	case CommandType_CONSENSUS:
 		// received a consensus message from this peer
-		p.agent.handleConsensusMessage(msg.Message)
+		p.dispatchConsensusMessage(ChainID(msg.ChainID), msg.Message)
+	case CommandType_STATE_CHUNK:
+		// received a chunk of a large consensus message from this peer
+		var m StateChunk
+		err := proto.Unmarshal(msg.Message, &m)
+		if err != nil {
+			return err
+		}
+
+		bts, err := p.handleStateChunk(ChainID(msg.ChainID), &m)
+		if err != nil {
+			return err
+		}
+
+		if bts != nil {
+			p.dispatchConsensusMessage(ChainID(msg.ChainID), bts)
+		}
 	default:
 		panic(msg)
 	}
 	return nil
 }
 
+// dispatchConsensusMessage demultiplexes a consensus message to the consensus
+// instance by chain id
+func (p *TCPPeer) dispatchConsensusMessage(chainID ChainID, bts []byte) {
+	if chainID == p.agent.chainID {
+		p.agent.handleConsensusMessage(p, bts)
+		return
+	}
+
+	p.Lock()
+	cp := p.chains[chainID]
+	p.Unlock()
+	// messages of the instances we don't run are ignored
+	if cp != nil {
+		cp.agent.handleConsensusMessage(p, bts)
+	}
+}
+
 // peer initiated key authentication
 func (p *TCPPeer) handleKeyAuthInit(authKey *KeyAuthInit) error {
 	p.Lock()
@@ -416,13 +1505,19 @@ func (p *TCPPeer) handleKeyAuthInit(authKey *KeyAuthInit) error {
 	// only when in init status, authentication process cannot rollback
 	// to prevent from malicious re-authentication DoS
 	if p.peerAuthStatus == peerNotAuthenticated {
-		peerPublicKey := &ecdsa.PublicKey{Curve: bdls.S256Curve, X: big.NewInt(0).SetBytes(authKey.X), Y: big.NewInt(0).SetBytes(authKey.Y)}
+		// length & on curve test
+		peerPublicKey, err := unmarshalPublicKey(authKey.X, authKey.Y)
+		if err != nil {
+			p.peerAuthStatus = peerAuthenticatedFailed
+			return err
+		}
 
-		// on curve test
-		if !bdls.S256Curve.IsOnCurve(peerPublicKey.X, peerPublicKey.Y) {
+		peerEphemeral, err := unmarshalPublicKey(authKey.EphemeralX, authKey.EphemeralY)
+		if err != nil {
 			p.peerAuthStatus = peerAuthenticatedFailed
-			return ErrKeyNotOnCurve
+			return err
 		}
+
 		// temporarily stored announced key
 		p.peerPublicKey = peerPublicKey
 
@@ -449,8 +1544,15 @@ func (p *TCPPeer) handleKeyAuthInit(authKey *KeyAuthInit) error {
 		if err != nil {
 			panic(err)
 		}
+		binding, err := channelBinding(peerEphemeral, &ephemeral.PublicKey)
+		if err != nil {
+			p.peerAuthStatus = peerAuthenticatedFailed
+			return err
+		}
+		hmac.Write(binding)
 		hmac.Write(challenge.Challenge)
 		p.hmac = hmac.Sum(nil)
+		p.pendingRecvMAC = &frameMAC{key: sessionKey(binding, secret, ECDH(peerEphemeral, ephemeral))}
 
 		// proto marshal
 		bts, err := proto.Marshal(&challenge)
@@ -466,8 +1568,9 @@ func (p *TCPPeer) handleKeyAuthInit(authKey *KeyAuthInit) error {
 		}
 
 		// enqueue
-		p.agentMessages = append(p.agentMessages, out)
-		p.notifyAgentMessage()
+		if err := p.enqueueAgentMessage(out); err != nil {
+			return err
+		}
 
 		// state shift
 		p.peerAuthStatus = peerAuthkeyReceived
@@ -483,7 +1586,10 @@ func (p *TCPPeer) handleKeyAuthChallenge(challenge *KeyAuthChallenge) error {
 	defer p.Unlock()
 	if p.localAuthState == localAuthKeySent {
 		// use ECDH to recover shared-key
-		pubkey := &ecdsa.PublicKey{Curve: bdls.S256Curve, X: big.NewInt(0).SetBytes(challenge.X), Y: big.NewInt(0).SetBytes(challenge.Y)}
+		pubkey, err := unmarshalPublicKey(challenge.X, challenge.Y)
+		if err != nil {
+			return err
+		}
 		// derive secret with my private key
 		secret := ECDH(pubkey, p.agent.privateKey)
 
@@ -493,8 +1599,14 @@ func (p *TCPPeer) handleKeyAuthChallenge(challenge *KeyAuthChallenge) error {
 		if err != nil {
 			panic(err)
 		}
+		binding, err := channelBinding(&p.ephemeral.PublicKey, pubkey)
+		if err != nil {
+			return err
+		}
+		hmac.Write(binding)
 		hmac.Write(challenge.Challenge)
 		response.HMAC = hmac.Sum(nil)
+		sendMAC := &frameMAC{key: sessionKey(binding, secret, ECDH(pubkey, p.ephemeral))}
 
 		// proto marshal
 		bts, err := proto.Marshal(&response)
@@ -509,9 +1621,10 @@ func (p *TCPPeer) handleKeyAuthChallenge(challenge *KeyAuthChallenge) error {
 			panic(err)
 		}
 
-		// enqueue
-		p.agentMessages = append(p.agentMessages, out)
-		p.notifyAgentMessage()
+		// enqueue, the frames after the reply are authenticated
+		if err := p.enqueueAgentMessageMAC(out, sendMAC); err != nil {
+			return err
+		}
 
 		// state shift
 		p.localAuthState = localChallengeAccepted
@@ -521,6 +1634,44 @@ func (p *TCPPeer) handleKeyAuthChallenge(challenge *KeyAuthChallenge) error {
 	}
 }
 
+// unmarshalPublicKey builds a public key from peer supplied axes in big-endian,
+// axes longer than bdls.SizeAxis are rejected even with leading zeros, so a
+// public key has only one encoding, the point must be on the curve.
+func unmarshalPublicKey(x []byte, y []byte) (*ecdsa.PublicKey, error) {
+	var X, Y bdls.PubKeyAxis
+	if X.Unmarshal(x) != nil || Y.Unmarshal(y) != nil {
+		return nil, ErrKeyMalformed
+	}
+
+	var coord bdls.Coordinate
+	copy(coord[:bdls.SizeAxis], X[:])
+	copy(coord[bdls.SizeAxis:], Y[:])
+	pubkey, err := bdls.CoordinateToPubKey(coord, bdls.S256Curve)
+	if err != nil {
+		return nil, ErrKeyNotOnCurve
+	}
+	return pubkey, nil
+}
+
+// channelBinding returns the hash of both ephemeral public keys of a connection,
+// the challenge reply is bound to it, so a relay which substitutes the ephemeral
+// key in KeyAuthInit cannot reuse the reply from another connection.
+func channelBinding(initiator *ecdsa.PublicKey, challenger *ecdsa.PublicKey) ([]byte, error) {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, pubkey := range []*ecdsa.PublicKey{initiator, challenger} {
+		coord, err := bdls.PubKeyToCoordinate(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(coord[:])
+	}
+	return h.Sum(nil), nil
+}
+
 // handle key authentication challenge reply
 func (p *TCPPeer) handleKeyAuthChallengeReply(response *KeyAuthChallengeReply) error {
 	p.Lock()
@@ -528,6 +1679,8 @@ func (p *TCPPeer) handleKeyAuthChallengeReply(response *KeyAuthChallengeReply) e
 	if p.peerAuthStatus == peerAuthkeyReceived {
 		if subtle.ConstantTimeCompare(p.hmac, response.HMAC) == 1 {
 			p.hmac = nil
+			p.recvMAC = p.pendingRecvMAC
+			p.pendingRecvMAC = nil
 			p.peerAuthStatus = peerAuthenticated
 			return nil
 		} else {
@@ -539,6 +1692,20 @@ func (p *TCPPeer) handleKeyAuthChallengeReply(response *KeyAuthChallengeReply) e
 	}
 }
 
+// readTimeout returns the read timeout of this peer, an authenticated peer
+// may idle for an extra heartbeat interval, as it's kept alive by heartbeats,
+// a dead one is still dropped.
+func (p *TCPPeer) readTimeout() time.Duration {
+	timeout := p.agent.getReadTimeout()
+	p.Lock()
+	authenticated := p.peerAuthStatus == peerAuthenticated
+	p.Unlock()
+	if authenticated {
+		timeout += p.agent.getHeartbeat()
+	}
+	return timeout
+}
+
 // readLoop keeps reading messages from peer
 func (p *TCPPeer) readLoop() {
 	defer p.Close()
@@ -550,16 +1717,17 @@ func (p *TCPPeer) readLoop() {
 			return
 		default:
 			// read message size
-			p.conn.SetReadDeadline(time.Now().Add(defaultReadTimeout))
+			p.conn.SetReadDeadline(time.Now().Add(p.readTimeout()))
 			_, err := io.ReadFull(p.conn, msgLength)
 			if err != nil {
 				return
 			}
 
-			// check length
+			// check length, before allocating anything for the message,
+			// an oversized length is a protocol violation
 			length := binary.LittleEndian.Uint32(msgLength)
-			if length > MaxMessageLength {
-				log.Println(err)
+			if int64(length) > int64(p.maxRecvFrame()) {
+				log.Println(ErrMessageLengthExceed, length)
 				return
 			}
 
@@ -569,23 +1737,36 @@ func (p *TCPPeer) readLoop() {
 			}
 
 			// read message bytes
-			p.conn.SetReadDeadline(time.Now().Add(defaultReadTimeout))
-			bts := make([]byte, length)
-			_, err = io.ReadFull(p.conn, bts)
+			p.conn.SetReadDeadline(time.Now().Add(p.readTimeout()))
+			bts := getBuffer(int(length))
+			_, err = io.ReadFull(p.conn, *bts)
+			if err != nil {
+				putBuffer(bts)
+				return
+			}
+
+			// frames from an authenticated peer carry a MAC
+			payload, err := p.verifyFrame(*bts)
 			if err != nil {
+				putBuffer(bts)
+				log.Println(err)
 				return
 			}
 
-			// unmarshal bytes to message
+			// unmarshal bytes to message, the bytes fields are copied
+			// by Unmarshal, so the buffer can be reused right after.
 			var gossip Gossip
-			err = proto.Unmarshal(bts, &gossip)
+			err = proto.Unmarshal(payload, &gossip)
+			putBuffer(bts)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
 			err = p.handleGossip(&gossip)
-			if err != nil {
+			if err == ErrPeerGoodbye {
+				return
+			} else if err != nil {
 				log.Println(err)
 				return
 			}
@@ -593,76 +1774,234 @@ func (p *TCPPeer) readLoop() {
 	}
 }
 
-// sendLoop keeps sending consensus message to this peer
+// sendLoop keeps sending consensus message to this peer, agent messages
+// like authentication are prioritized over consensus messages.
 func (p *TCPPeer) sendLoop() {
 	defer p.Close()
 
-	var pending [][]byte
-	var msg Gossip
-	msg.Command = CommandType_CONSENSUS
+	var pendingConsensus []chainMessage
+	var chunks []outChunk // chunks of large messages awaiting to be sent
 	msgLength := make([]byte, MessageLength)
 
 	for {
-		select {
-		case <-p.chConsensusMessage:
-			p.Lock()
-			pending = p.consensusMessages
-			p.consensusMessages = nil
-			p.Unlock()
-
-			for _, bts := range pending {
-				// we need to encapsulate consensus messages
-				msg.Message = bts
-				out, err := proto.Marshal(&msg)
-				if err != nil {
-					panic(err)
-				}
-
-				if len(out) > MaxMessageLength {
-					panic("maximum message size exceeded")
-				}
-
-				binary.LittleEndian.PutUint32(msgLength, uint32(len(out)))
-				p.conn.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
-				// write length
-				_, err = p.conn.Write(msgLength)
-				if err != nil {
+		// wait for new messages only if no chunks are in flight, a
+		// heartbeat is sent if there's nothing to send for a while
+		if len(chunks) == 0 {
+			heartbeat := time.NewTimer(p.agent.getHeartbeat())
+			select {
+			case <-p.chConsensusMessage:
+			case <-p.chAgentMessage:
+			case <-heartbeat.C:
+				// an empty NOP encodes to a zero length frame, which is invalid
+				if err := p.writeGossip(msgLength, &Gossip{Command: CommandType_NOP, Message: []byte{0}}); err != nil {
 					log.Println(err)
 					return
 				}
+			case <-p.die:
+				heartbeat.Stop()
+				return
+			}
+			heartbeat.Stop()
+		} else {
+			select {
+			case <-p.die:
+				return
+			default:
+			}
+		}
 
-				// write message
-				_, err = p.conn.Write(out)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+		if err := p.flushAgentMessages(msgLength); err != nil {
+			log.Println(err)
+			return
+		}
+
+		p.Lock()
+		pendingConsensus = p.consensusMessages
+		p.consensusMessages = nil
+		p.Unlock()
+
+		chunkSize := p.agent.getChunkSize()
+		maxFrame := p.agent.getMaxFrame()
+		for _, cm := range pendingConsensus {
+			// large messages are sent in chunks, one at a time in
+			// between other messages
+			if size := chunkSizeOf(len(cm.bts), chunkSize, maxFrame); size > 0 {
+				chunks = append(chunks, splitChunks(cm, size)...)
+				continue
 			}
-		case <-p.chAgentMessage:
-			p.Lock()
-			pending = p.agentMessages
-			p.agentMessages = nil
-			p.Unlock()
-
-			for _, bts := range pending {
-				binary.LittleEndian.PutUint32(msgLength, uint32(len(bts)))
-				// write length
-				_, err := p.conn.Write(msgLength)
-				if err != nil {
-					log.Println(err)
-					return
-				}
 
-				// write message
-				_, err = p.conn.Write(bts)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+			// agent messages must not be starved by a large backlog
+			// of consensus messages
+			if err := p.flushAgentMessages(msgLength); err != nil {
+				log.Println(err)
+				return
+			}
+
+			// we need to encapsulate consensus messages
+			msg := Gossip{Command: CommandType_CONSENSUS, Message: cm.bts, ChainID: uint64(cm.chainID)}
+			if err := p.writeGossip(msgLength, &msg); err != nil {
+				log.Println(err)
+				return
 			}
+		}
+
+		if len(chunks) > 0 {
+			bts, err := chunks[0].chunk.Marshal()
+			if err != nil {
+				panic(err)
+			}
+
+			msg := Gossip{Command: CommandType_STATE_CHUNK, Message: bts, ChainID: uint64(chunks[0].chainID)}
+			if err := p.writeGossip(msgLength, &msg); err != nil {
+				log.Println(err)
+				return
+			}
+			chunks[0] = outChunk{}
+			chunks = chunks[1:]
+		}
+	}
+}
 
+// writeWatchdog closes the peer if a frame write has not completed in
+// writeStuckFactor write timeouts, ie. conn.Write ignores the deadline, as
+// readLoop may keep a peer alive while nothing can be sent to it.
+func (p *TCPPeer) writeWatchdog() {
+	for {
+		timeout := p.agent.getWriteTimeout()
+		select {
+		case <-time.After(timeout / 2):
 		case <-p.die:
 			return
 		}
+
+		start := atomic.LoadInt64(&p.writeStart)
+		if start == 0 || time.Since(time.Unix(0, start)) < writeStuckFactor*timeout {
+			continue
+		}
+
+		log.Println("write stuck since", time.Unix(0, start), "closing peer")
+		atomic.StoreInt32(&p.writeStuck, 1)
+		p.Close()
+		return
+	}
+}
+
+// writeGossip encodes and writes a message to the connection
+func (p *TCPPeer) writeGossip(msgLength []byte, msg *Gossip) error {
+	out := getBuffer(msg.Size())
+	defer putBuffer(out)
+	_, err := msg.MarshalTo(*out)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(*out) > p.agent.getMaxFrame() {
+		panic("maximum message size exceeded")
+	}
+
+	start := time.Now()
+	err = p.writeFrame(msgLength, *out, p.agent.getWriteTimeout())
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.score.recordWrite(time.Since(start))
+	p.Unlock()
+	return nil
+}
+
+// flushAgentMessages writes all pending agent messages to the connection
+func (p *TCPPeer) flushAgentMessages(msgLength []byte) error {
+	p.Lock()
+	pending := p.agentMessages
+	p.agentMessages = nil
+	p.Unlock()
+
+	for _, m := range pending {
+		if err := p.writeFrameMAC(msgLength, m.bts, p.agent.getWriteTimeout(), m.sendMAC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxRecvFrame returns the maximum size of a frame from the peer, including
+// the MAC if the peer has authenticated.
+func (p *TCPPeer) maxRecvFrame() int {
+	p.Lock()
+	defer p.Unlock()
+	if p.recvMAC != nil {
+		return p.agent.getMaxFrame() + frameMACSize
+	}
+	return p.agent.getMaxFrame()
+}
+
+// verifyFrame verifies and strips the MAC of a frame if the peer has
+// authenticated, and returns the payload.
+func (p *TCPPeer) verifyFrame(frame []byte) ([]byte, error) {
+	p.Lock()
+	recvMAC := p.recvMAC
+	p.Unlock()
+	if recvMAC == nil {
+		return frame, nil
+	}
+
+	if len(frame) <= frameMACSize {
+		return nil, ErrFrameMAC
+	}
+	payload := frame[:len(frame)-frameMACSize]
+	if subtle.ConstantTimeCompare(recvMAC.sum(payload), frame[len(payload):]) != 1 {
+		return nil, ErrFrameMAC
+	}
+	return payload, nil
+}
+
+// writeFrame writes a length prefixed message to conn, with a MAC if we have
+// authenticated to the peer.
+func (p *TCPPeer) writeFrame(msgLength []byte, bts []byte, timeout time.Duration) error {
+	return p.writeFrameMAC(msgLength, bts, timeout, nil)
+}
+
+// writeFrameMAC writes a frame, and authenticates the frames after it with
+// next if not nil.
+func (p *TCPPeer) writeFrameMAC(msgLength []byte, bts []byte, timeout time.Duration, next *frameMAC) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	atomic.StoreInt64(&p.writeStart, time.Now().UnixNano())
+	defer atomic.StoreInt64(&p.writeStart, 0)
+
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	// don't block Close() with a long deadline
+	if timeout > goodbyeTimeout && atomic.LoadInt32(&p.closing) == 1 {
+		p.conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	}
+
+	var mac []byte
+	if p.sendMAC != nil {
+		mac = p.sendMAC.sum(bts)
+	}
+
+	binary.LittleEndian.PutUint32(msgLength, uint32(len(bts)+len(mac)))
+	// write length
+	_, err := p.conn.Write(msgLength)
+	if err != nil {
+		return err
+	}
+
+	// write message
+	if _, err = p.conn.Write(bts); err != nil {
+		return err
+	}
+
+	if mac != nil {
+		if _, err = p.conn.Write(mac); err != nil {
+			return err
+		}
+	}
+
+	if next != nil {
+		p.sendMAC = next
 	}
+	return nil
 }
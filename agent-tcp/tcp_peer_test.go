@@ -6,18 +6,27 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	io "io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Sperax/bdls"
 	"github.com/Sperax/bdls/crypto/blake2b"
 	"github.com/davecgh/go-spew/spew"
+	proto "github.com/gogo/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -216,3 +225,1698 @@ func testConsensus(t *testing.T, param *testParam) {
 
 	t.Logf("consensus stopped at height:%v for %v peers %v participants", param.stopHeight, param.numPeers, param.numParticipants)
 }
+
+// createTestAgents creates n fully connected and authenticated agents starting
+// at the given height, the agents keep running across heights until closed.
+func createTestAgents(t *testing.T, n int, height uint64, latency time.Duration) []*TCPAgent {
+	participants := createTestKeys(t, n)
+	agents := newTestAgents(t, participants, height, latency, 0)
+	connectTestAgents(t, agents)
+	for i := 0; i < n; i++ {
+		agents[i].Start()
+	}
+	return agents
+}
+
+// createTestKeys generates n private keys for participants
+func createTestKeys(t testing.TB, n int) []*ecdsa.PrivateKey {
+	var participants []*ecdsa.PrivateKey
+	for i := 0; i < n; i++ {
+		privateKey, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		participants = append(participants, privateKey)
+	}
+	return participants
+}
+
+// newTestAgents creates unconnected sealed agents for the given participants
+func newTestAgents(t testing.TB, participants []*ecdsa.PrivateKey, height uint64, latency time.Duration, chainID ChainID) []*TCPAgent {
+	var coords []bdls.Identity
+	for _, privateKey := range participants {
+		coords = append(coords, bdls.DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+
+	epoch := time.Now()
+	agents := make([]*TCPAgent, len(participants))
+	for i := range participants {
+		config := new(bdls.Config)
+		config.Epoch = epoch
+		config.CurrentHeight = height
+		config.PrivateKey = participants[i]
+		config.Participants = coords
+		config.StateCompare = func(a bdls.State, b bdls.State) int { return bytes.Compare(a, b) }
+		config.StateValidate = func(a bdls.State) bool { return true }
+
+		consensus, err := bdls.NewConsensus(config)
+		assert.Nil(t, err)
+		consensus.SetLatency(latency)
+		agents[i] = NewSealedTCPAgentWithChainID(consensus, participants[i], chainID)
+	}
+	return agents
+}
+
+// connectTestAgents establishes a full mesh between agents, and waits
+// for authentication to complete
+func connectTestAgents(t *testing.T, agents []*TCPAgent) {
+	var peers []*TCPPeer
+	for i := 0; i < len(agents); i++ {
+		for j := i + 1; j < len(agents); j++ {
+			c1, c2 := net.Pipe()
+			p1 := NewTCPPeer(c1, agents[i])
+			p2 := NewTCPPeer(c2, agents[j])
+			assert.True(t, agents[i].AddPeer(p1))
+			assert.True(t, agents[j].AddPeer(p2))
+			peers = append(peers, p1, p2)
+		}
+	}
+
+	for _, p := range peers {
+		p.InitiatePublicKeyAuthentication()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, p := range peers {
+		for {
+			p.Lock()
+			done := p.localAuthState == localChallengeAccepted && p.peerAuthStatus == peerAuthenticated
+			p.Unlock()
+			if done {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("authentication timeout")
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+}
+
+// decideHeight proposes random states on all agents and waits until all of them
+// have confirmed the given height
+func decideHeight(t *testing.T, agents []*TCPAgent, height uint64) {
+	proposeTestStates(t, agents)
+	waitTestHeight(t, agents, height)
+}
+
+// proposeTestStates proposes a random state on each agent
+func proposeTestStates(t *testing.T, agents []*TCPAgent) {
+	for _, agent := range agents {
+		data := make([]byte, 1024)
+		io.ReadFull(rand.Reader, data)
+		assert.Nil(t, agent.Propose(data))
+	}
+}
+
+// waitTestHeight waits until all agents have confirmed the given height
+func waitTestHeight(t *testing.T, agents []*TCPAgent, height uint64) {
+	deadline := time.Now().Add(30 * time.Second)
+	for _, agent := range agents {
+		for {
+			newHeight, _, _ := agent.GetLatestState()
+			if newHeight >= height {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for height %v", height)
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestEventSink(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 50*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	sink := new(syncBuffer)
+	agents[0].SetEventSink(sink)
+
+	const numHeights = 3
+	for h := uint64(1); h <= numHeights; h++ {
+		decideHeight(t, agents, h)
+	}
+
+	// wait for event writer
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = strings.Split(strings.TrimSpace(sink.String()), "\n")
+		if len(lines) >= numHeights {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, numHeights, len(lines))
+	for k, line := range lines {
+		var fields map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &fields))
+		for _, key := range []string{"height", "round", "state_hash", "timestamp", "signers"} {
+			assert.Contains(t, fields, key)
+		}
+
+		var event DecideEvent
+		assert.Nil(t, json.Unmarshal([]byte(line), &event))
+		assert.Equal(t, uint64(k+1), event.Height)
+		assert.Equal(t, 64, len(event.StateHash))
+		assert.False(t, event.Timestamp.IsZero())
+		assert.GreaterOrEqual(t, event.Signers, 3)
+	}
+}
+
+func TestMultiplexedChains(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	chainA := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	chainB := newTestAgents(t, participants, 0, 50*time.Millisecond, 1)
+	defer func() {
+		for k := range chainA {
+			chainA[k].Close()
+			chainB[k].Close()
+		}
+	}()
+
+	// chain B shares connections of chain A
+	connectTestAgents(t, chainA)
+	numConns := 0
+	for i := range chainA {
+		chainA[i].Lock()
+		peers := chainA[i].peers
+		chainA[i].Unlock()
+		for _, p := range peers {
+			assert.True(t, p.Attach(chainB[i]))
+			assert.False(t, p.Attach(chainB[i]))
+			numConns++
+		}
+	}
+	assert.Equal(t, 12, numConns)
+
+	for i := range chainA {
+		chainA[i].Start()
+		chainB[i].Start()
+	}
+
+	// chain A advances alone
+	decideHeight(t, chainA, 1)
+	decideHeight(t, chainA, 2)
+	for i := range chainB {
+		height, _, _ := chainB[i].GetLatestState()
+		assert.Equal(t, uint64(0), height)
+	}
+
+	// chain B advances independently
+	decideHeight(t, chainB, 1)
+	for i := range chainA {
+		heightA, _, stateA := chainA[i].GetLatestState()
+		heightB, _, stateB := chainB[i].GetLatestState()
+		assert.Equal(t, uint64(2), heightA)
+		assert.Equal(t, uint64(1), heightB)
+		assert.NotEqual(t, stateA, stateB)
+	}
+}
+
+func TestAddPeerFailure(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	agents := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	agent := agents[0]
+
+	// the peer has already joined consensus core, AddPeer fails
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agent)
+	assert.True(t, agent.consensus.Join(p))
+	assert.False(t, agent.AddPeer(p))
+	agent.Lock()
+	assert.Equal(t, 0, len(agent.peers))
+	agent.Unlock()
+	p.Close()
+
+	// closed agent
+	agent.Close()
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	p = NewTCPPeer(c3, agent)
+	assert.False(t, agent.AddPeer(p))
+	agent.Lock()
+	assert.Equal(t, 0, len(agent.peers))
+	agent.Unlock()
+	p.Close()
+}
+
+func TestSendLoopAgentMessagePriority(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	agents := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	defer agents[0].Close()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agents[0])
+	defer p.Close()
+
+	// a large backlog of consensus messages, then an auth message
+	const numMessages = 1000
+	for i := 0; i < numMessages; i++ {
+		assert.Nil(t, p.Send(make([]byte, 1024)))
+	}
+	assert.Nil(t, p.InitiatePublicKeyAuthentication())
+
+	// read frames from the other side
+	msgLength := make([]byte, MessageLength)
+	for i := 0; i <= numMessages; i++ {
+		c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(c2, msgLength)
+		assert.Nil(t, err)
+		bts := make([]byte, binary.LittleEndian.Uint32(msgLength))
+		_, err = io.ReadFull(c2, bts)
+		assert.Nil(t, err)
+
+		var gossip Gossip
+		assert.Nil(t, proto.Unmarshal(bts, &gossip))
+		if gossip.Command == CommandType_KEY_AUTH_INIT {
+			// the auth message is sent before the backlog drained
+			assert.Less(t, i, 3)
+			return
+		}
+	}
+	t.Fatal("auth message not received")
+}
+
+func TestSealedAgent(t *testing.T) {
+	latency := 50 * time.Millisecond
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, latency, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	connectTestAgents(t, agents)
+
+	proposeTestStates(t, agents)
+	for _, agent := range agents {
+		agent.Update()
+	}
+
+	// no <roundchange> is sent across several round change timeouts
+	<-time.After(10 * latency)
+	for _, agent := range agents {
+		agent.Lock()
+		assert.Equal(t, 0, len(agent.consensusMessages))
+		agent.Unlock()
+		height, _, _ := agent.GetLatestState()
+		assert.Equal(t, uint64(0), height)
+	}
+
+	for _, agent := range agents {
+		agent.Start()
+		agent.Start()
+	}
+	decideHeight(t, agents, 1)
+}
+
+func TestCloseWhileProposing(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	// hammer the agents while closing them
+	var wg sync.WaitGroup
+	for _, agent := range agents {
+		wg.Add(1)
+		go func(agent *TCPAgent) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				data := make([]byte, 32)
+				io.ReadFull(rand.Reader, data)
+				err := agent.Propose(data)
+				if err != nil {
+					assert.Equal(t, ErrAgentClosed, err)
+				}
+				agent.GetLatestState()
+				agent.Voters(1, 0)
+				agent.Update()
+			}
+		}(agent)
+	}
+
+	<-time.After(20 * time.Millisecond)
+	for _, agent := range agents {
+		wg.Add(1)
+		go func(agent *TCPAgent) {
+			defer wg.Done()
+			agent.Close()
+		}(agent)
+	}
+	wg.Wait()
+
+	for _, agent := range agents {
+		assert.Equal(t, ErrAgentClosed, agent.Propose([]byte("state")))
+	}
+}
+
+func TestProposeChannel(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	agents := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	connectTestAgents(t, agents)
+
+	// a stream of states, the first one is proposed immediately for height 1,
+	// the latest one is proposed for height 2, others are superseded.
+	stream := []bdls.State{[]byte("state-1"), []byte("state-2"), []byte("state-3")}
+	for _, agent := range agents {
+		ch := agent.ProposeChannel()
+		assert.Equal(t, ch, agent.ProposeChannel())
+		for _, s := range stream {
+			ch <- s
+		}
+	}
+
+	// wait until the last state has been taken as pending
+	for _, agent := range agents {
+		for {
+			agent.Lock()
+			pending := agent.pendingProposal
+			agent.Unlock()
+			if bytes.Equal(pending, stream[2]) {
+				break
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+
+	for _, agent := range agents {
+		agent.Start()
+	}
+
+	for height, expected := range []bdls.State{stream[0], stream[2]} {
+		deadline := time.Now().Add(30 * time.Second)
+		for _, agent := range agents {
+			for {
+				newHeight, _, state := agent.GetLatestState()
+				if newHeight >= uint64(height+1) {
+					if newHeight == uint64(height+1) {
+						assert.Equal(t, expected, state)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timeout waiting for height %v", height+1)
+				}
+				<-time.After(20 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestAgentSurvivesGC(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	// agents must stay alive without runtime.KeepAlive
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+	}
+
+	for _, agent := range agents {
+		assert.False(t, agent.closed())
+	}
+	decideHeight(t, agents, 1)
+}
+
+func TestEventSinkBeforeStart(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	agents := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	connectTestAgents(t, agents)
+
+	// wire up sinks on sealed agents
+	sinks := make([]*syncBuffer, len(agents))
+	for k, agent := range agents {
+		sinks[k] = new(syncBuffer)
+		agent.SetEventSink(sinks[k])
+	}
+
+	for _, agent := range agents {
+		agent.Start()
+	}
+	decideHeight(t, agents, 1)
+
+	// the first decide must be observed by every sink
+	for _, sink := range sinks {
+		var line string
+		for i := 0; i < 100; i++ {
+			line = strings.Split(sink.String(), "\n")[0]
+			if line != "" {
+				break
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+
+		var event DecideEvent
+		assert.Nil(t, json.Unmarshal([]byte(line), &event))
+		assert.Equal(t, uint64(1), event.Height)
+	}
+}
+
+// readGossip reads a framed gossip message from conn
+func readGossip(t *testing.T, conn net.Conn) *Gossip {
+	frame := readFrame(t, conn)
+	gossip := new(Gossip)
+	assert.Nil(t, proto.Unmarshal(frame[MessageLength:], gossip))
+	return gossip
+}
+
+// readFrame reads a frame from conn as is, including the length prefix
+func readFrame(t *testing.T, conn net.Conn) []byte {
+	msgLength := make([]byte, MessageLength)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(conn, msgLength)
+	assert.Nil(t, err)
+	bts := make([]byte, binary.LittleEndian.Uint32(msgLength))
+	_, err = io.ReadFull(conn, bts)
+	assert.Nil(t, err)
+	return append(msgLength, bts...)
+}
+
+// writeGossip writes a framed gossip message to conn
+func writeGossip(t *testing.T, conn net.Conn, gossip *Gossip) {
+	bts, err := proto.Marshal(gossip)
+	assert.Nil(t, err)
+	msgLength := make([]byte, MessageLength)
+	binary.LittleEndian.PutUint32(msgLength, uint32(len(bts)))
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(append(msgLength, bts...))
+	assert.Nil(t, err)
+}
+
+// relayKeyAuth relays the key authentication of the peer at initiator's side to
+// the peer at victim's side, with the ephemeral key in KeyAuthInit replaced if
+// ephemeral is not nil, relayed is called after the authentication if not nil,
+// returns the peer at victim's side.
+func relayKeyAuth(t *testing.T, initiator *TCPAgent, victim *TCPAgent, ephemeral *ecdsa.PrivateKey,
+	relayed func(pA *TCPPeer, pV *TCPPeer, relayA net.Conn, relayV net.Conn)) *TCPPeer {
+	connA, relayA := net.Pipe()
+	connV, relayV := net.Pipe()
+	pA := NewTCPPeer(connA, initiator)
+	pV := NewTCPPeer(connV, victim)
+	assert.Nil(t, pA.InitiatePublicKeyAuthentication())
+
+	// KEY_AUTH_INIT from initiator
+	authInit := readGossip(t, relayA)
+	assert.Equal(t, CommandType_KEY_AUTH_INIT, authInit.Command)
+	if ephemeral != nil {
+		var auth KeyAuthInit
+		assert.Nil(t, proto.Unmarshal(authInit.Message, &auth))
+		auth.EphemeralX = ephemeral.PublicKey.X.Bytes()
+		auth.EphemeralY = ephemeral.PublicKey.Y.Bytes()
+		bts, err := proto.Marshal(&auth)
+		assert.Nil(t, err)
+		authInit.Message = bts
+	}
+	writeGossip(t, relayV, authInit)
+
+	// KEY_AUTH_CHALLENGE from victim
+	challenge := readGossip(t, relayV)
+	assert.Equal(t, CommandType_KEY_AUTH_CHALLENGE, challenge.Command)
+	writeGossip(t, relayA, challenge)
+
+	// KEY_AUTH_CHALLENGE_REPLY from initiator
+	reply := readGossip(t, relayA)
+	assert.Equal(t, CommandType_KEY_AUTH_CHALLENGE_REPLY, reply.Command)
+	writeGossip(t, relayV, reply)
+
+	// wait for the victim to process the reply
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pV.Lock()
+		status := pV.peerAuthStatus
+		pV.Unlock()
+		if status == peerAuthenticated || status == peerAuthenticatedFailed {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	if relayed != nil {
+		relayed(pA, pV, relayA, relayV)
+	}
+	pA.Close()
+	relayA.Close()
+	relayV.Close()
+	return pV
+}
+
+func TestKeyAuthFailed(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 50*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	connA, relayA := net.Pipe()
+	connV, relayV := net.Pipe()
+	defer relayA.Close()
+	defer relayV.Close()
+	pA := NewTCPPeer(connA, agents[0])
+	pV := NewTCPPeer(connV, agents[1])
+	defer pA.Close()
+	defer pV.Close()
+	assert.Nil(t, pA.InitiatePublicKeyAuthentication())
+
+	writeGossip(t, relayV, readGossip(t, relayA))
+	writeGossip(t, relayA, readGossip(t, relayV))
+
+	// a wrong challenge reply
+	reply := readGossip(t, relayA)
+	assert.Equal(t, CommandType_KEY_AUTH_CHALLENGE_REPLY, reply.Command)
+	bts, err := proto.Marshal(&KeyAuthChallengeReply{HMAC: make([]byte, 32)})
+	assert.Nil(t, err)
+	reply.Message = bts
+	writeGossip(t, relayV, reply)
+
+	// the challenger tells why
+	failed := readGossip(t, relayV)
+	assert.Equal(t, CommandType_KEY_AUTH_FAILED, failed.Command)
+	var m KeyAuthFailed
+	assert.Nil(t, proto.Unmarshal(failed.Message, &m))
+	assert.Equal(t, KeyAuthFailureReason_HMAC_MISMATCH, m.Reason)
+
+	// the initiator fails fast
+	writeGossip(t, relayA, failed)
+	select {
+	case <-pA.die:
+	case <-time.After(time.Second):
+		t.Fatal("the initiator has not dropped the connection")
+	}
+	assert.Equal(t, KeyAuthFailureReason_HMAC_MISMATCH, pA.KeyAuthFailure())
+	assert.Equal(t, KeyAuthFailureReason_NONE, pV.KeyAuthFailure())
+}
+
+func TestKeyAuthChannelBinding(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	agents := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	// a relay forwarding the authentication unchanged cannot derive the
+	// session key, the connection is dropped on the first frame it doesn't
+	// relay as is, here a replayed frame.
+	pV := relayKeyAuth(t, agents[0], agents[1], nil, func(pA *TCPPeer, pV *TCPPeer, relayA net.Conn, relayV net.Conn) {
+		assert.Nil(t, pA.Send([]byte("consensus")))
+		frame := readFrame(t, relayA)
+		_, err := relayV.Write(frame)
+		assert.Nil(t, err)
+		<-time.After(100 * time.Millisecond)
+		select {
+		case <-pV.die:
+			t.Fatal("the relayed frame has been rejected")
+		default:
+		}
+
+		_, err = relayV.Write(frame)
+		assert.Nil(t, err)
+		select {
+		case <-pV.die:
+		case <-time.After(time.Second):
+			t.Fatal("the replayed frame has been accepted")
+		}
+	})
+	pV.Close()
+
+	// injected frames without MAC are rejected as well
+	pV = relayKeyAuth(t, agents[0], agents[1], nil, func(pA *TCPPeer, pV *TCPPeer, relayA net.Conn, relayV net.Conn) {
+		writeGossip(t, relayV, &Gossip{Command: CommandType_CONSENSUS, Message: []byte("forged")})
+		select {
+		case <-pV.die:
+		case <-time.After(time.Second):
+			t.Fatal("the injected frame has been accepted")
+		}
+	})
+	pV.Close()
+
+	// a relay which substitutes its own ephemeral key fails
+	ephemeral, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	pV = relayKeyAuth(t, agents[0], agents[1], ephemeral, nil)
+	pV.Lock()
+	assert.Equal(t, peerAuthenticatedFailed, pV.peerAuthStatus)
+	pV.Unlock()
+	assert.Nil(t, pV.GetPublicKey())
+	pV.Close()
+}
+
+// halfOpenConn never closes the underlying connection, to emulate a lost FIN
+type halfOpenConn struct {
+	net.Conn
+}
+
+func (c *halfOpenConn) Close() error { return nil }
+
+func TestPeerGoodbye(t *testing.T) {
+	participants := createTestKeys(t, 4)
+	agents := newTestAgents(t, participants, 0, 50*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	p1 := NewTCPPeer(&halfOpenConn{c1}, agents[0])
+	p2 := NewTCPPeer(c2, agents[1])
+	assert.True(t, agents[0].AddPeer(p1))
+	assert.True(t, agents[1].AddPeer(p2))
+	assert.Nil(t, p1.InitiatePublicKeyAuthentication())
+	assert.Nil(t, p2.InitiatePublicKeyAuthentication())
+	for p2.GetPublicKey() == nil {
+		<-time.After(10 * time.Millisecond)
+	}
+
+	// the connection is still open from p2's view, only GOODBYE can remove p1
+	p1.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		agents[1].Lock()
+		numPeers := len(agents[1].peers)
+		agents[1].Unlock()
+		if numPeers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("peer has not been removed after GOODBYE")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	select {
+	case <-p2.die:
+	default:
+		t.Fatal("peer has not been closed after GOODBYE")
+	}
+}
+
+// countingWriter counts bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&w.n, int64(len(p)))
+	return len(p), nil
+}
+
+func BenchmarkSendLoop(b *testing.B) {
+	privateKey, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+	assert.Nil(b, err)
+	agent := &TCPAgent{privateKey: privateKey, die: make(chan struct{})}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agent)
+	defer p.Close()
+
+	w := new(countingWriter)
+	go io.Copy(w, c2)
+
+	msg := make([]byte, 1024)
+	frame, err := proto.Marshal(&Gossip{Command: CommandType_CONSENSUS, Message: msg})
+	assert.Nil(b, err)
+	total := int64(b.N * (MessageLength + len(frame)))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Send(msg)
+	}
+	for atomic.LoadInt64(&w.n) < total {
+		<-time.After(time.Millisecond)
+	}
+}
+
+func BenchmarkReadLoop(b *testing.B) {
+	privateKey, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
+	assert.Nil(b, err)
+	agent := &TCPAgent{privateKey: privateKey, die: make(chan struct{}), chConsensusMessages: make(chan struct{}, 1)}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agent)
+	defer p.Close()
+
+	bts, err := proto.Marshal(&Gossip{Command: CommandType_CONSENSUS, Message: make([]byte, 1024)})
+	assert.Nil(b, err)
+	frame := make([]byte, MessageLength)
+	binary.LittleEndian.PutUint32(frame, uint32(len(bts)))
+	frame = append(frame, bts...)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c2.Write(frame)
+		// drain consensus messages
+		if i%1024 == 0 {
+			agent.Lock()
+			agent.consensusMessages = nil
+			agent.Unlock()
+		}
+	}
+}
+
+func TestAgentReset(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	decideHeight(t, agents, 1)
+
+	for _, agent := range agents {
+		agent.Reset(100, []byte("genesis"))
+		height, _, _ := agent.GetLatestState()
+		assert.Equal(t, uint64(100), height)
+	}
+	decideHeight(t, agents, 101)
+}
+
+func TestUpdateWatchdog(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	stalled := make(chan time.Time, 1)
+	agent := agents[0]
+	agent.SetWatchdog(200*time.Millisecond, func(lastTick time.Time) {
+		select {
+		case stalled <- lastTick:
+		default:
+		}
+	})
+
+	// kill the update loop by invalidating its generation
+	agent.Lock()
+	agent.updateGen++
+	agent.Unlock()
+	died := time.Now()
+
+	select {
+	case lastTick := <-stalled:
+		assert.True(t, time.Since(died) < time.Second)
+		assert.False(t, lastTick.After(died))
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog has not fired")
+	}
+
+	// the update loop is running again
+	<-time.After(100 * time.Millisecond)
+	agent.Lock()
+	lastTick := agent.lastTick
+	agent.Unlock()
+	assert.True(t, lastTick.After(died))
+	decideHeight(t, agents, 1)
+}
+
+func TestUpdateWatchdogReset(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	// a long timeout is replaced by a short one without waiting for it
+	stalled := make(chan time.Time, 1)
+	agent := agents[0]
+	agent.SetWatchdog(time.Minute, nil)
+	agent.SetWatchdog(200*time.Millisecond, func(lastTick time.Time) {
+		select {
+		case stalled <- lastTick:
+		default:
+		}
+	})
+
+	agent.Lock()
+	agent.updateGen++
+	agent.Unlock()
+
+	select {
+	case <-stalled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog has not fired with the new timeout")
+	}
+}
+
+func TestUpdateWatchdogStuck(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	agent := agents[0]
+	agent.SetWatchdog(200*time.Millisecond, nil)
+	<-time.After(200 * time.Millisecond)
+	assert.True(t, agent.Alive())
+
+	// an update stuck with the lock held
+	agent.Lock()
+	select {
+	case <-agent.Stalled():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck update loop has not been detected")
+	}
+	assert.False(t, agent.Alive())
+	agent.Unlock()
+
+	// cleared once the lock is released
+	deadline := time.Now().Add(5 * time.Second)
+	for !agent.Alive() {
+		if time.Now().After(deadline) {
+			t.Fatal("stall has not been cleared")
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	select {
+	case <-agent.Stalled():
+		t.Fatal("stall has not been cleared")
+	default:
+	}
+	decideHeight(t, agents, 1)
+}
+
+func TestUpdateWatchdogTransient(t *testing.T) {
+	agent := new(TCPAgent)
+	agent.chStalled = make(chan struct{})
+
+	// a stuck lock is only reported across consecutive checks
+	for i := 0; i < stallChecks-1; i++ {
+		agent.checkStuck(true)
+	}
+	agent.checkStuck(false)
+	for i := 0; i < stallChecks-1; i++ {
+		agent.checkStuck(true)
+	}
+	select {
+	case <-agent.Stalled():
+		t.Fatal("transient stuck checks reported as a stall")
+	default:
+	}
+
+	agent.checkStuck(true)
+	select {
+	case <-agent.Stalled():
+	default:
+		t.Fatal("stall has not been reported")
+	}
+}
+
+func TestDecisionDigest(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	const stopHeight = 5
+	for height := uint64(1); height <= stopHeight; height++ {
+		decideHeight(t, agents, height)
+	}
+
+	digest := agents[0].DecisionDigest(stopHeight)
+	assert.Len(t, digest, 32)
+	assert.NotEqual(t, digest, agents[0].DecisionDigest(stopHeight-1))
+	for _, agent := range agents[1:] {
+		assert.Equal(t, digest, agent.DecisionDigest(stopHeight))
+	}
+
+	assert.Nil(t, agents[0].DecisionDigest(0))
+	height, _, _ := agents[0].GetLatestState()
+	assert.Nil(t, agents[0].DecisionDigest(height+1))
+}
+
+func TestDecisionDigestWindow(t *testing.T) {
+	agent := new(TCPAgent)
+	var hash bdls.StateHash
+	for height := uint64(1); height <= maxDigests+10; height++ {
+		agent.updateDigest(height, hash)
+	}
+	assert.Len(t, agent.digests, maxDigests)
+	assert.Nil(t, agent.DecisionDigest(10))
+	assert.NotNil(t, agent.DecisionDigest(11))
+	assert.NotNil(t, agent.DecisionDigest(maxDigests+10))
+	assert.Equal(t, uint64(0), agent.DigestRoot())
+
+	// a skipped height restarts the chain
+	agent.updateDigest(maxDigests+20, hash)
+	assert.Equal(t, uint64(maxDigests+19), agent.DigestRoot())
+	assert.Nil(t, agent.DecisionDigest(maxDigests+10))
+	assert.NotNil(t, agent.DecisionDigest(maxDigests+20))
+	agent.updateDigest(maxDigests+21, hash)
+	assert.NotNil(t, agent.DecisionDigest(maxDigests+21))
+
+	// the same history from the same root yields the same digest
+	synced := new(TCPAgent)
+	synced.updateDigest(maxDigests+20, hash)
+	synced.updateDigest(maxDigests+21, hash)
+	assert.Equal(t, agent.DecisionDigest(maxDigests+21), synced.DecisionDigest(maxDigests+21))
+}
+
+func TestAgentReload(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	decideHeight(t, agents, 1)
+
+	assert.Equal(t, ErrReloadConfig, agents[0].Reload(PartialConfig{ReadTimeout: -time.Second}))
+	assert.Equal(t, defaultReadTimeout, agents[0].getReadTimeout())
+
+	for _, agent := range agents {
+		assert.Nil(t, agent.Reload(PartialConfig{
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 20 * time.Second,
+			Heartbeat:    10 * time.Second,
+			Latency:      20 * time.Millisecond,
+		}))
+		assert.Equal(t, 30*time.Second, agent.getReadTimeout())
+		assert.Equal(t, 20*time.Second, agent.getWriteTimeout())
+		assert.Equal(t, 10*time.Second, agent.getHeartbeat())
+	}
+
+	// connections survive, and consensus continues
+	decideHeight(t, agents, 2)
+	for _, agent := range agents {
+		agent.Lock()
+		peers := append([]*TCPPeer(nil), agent.peers...)
+		agent.Unlock()
+		assert.Len(t, peers, 3)
+		for _, p := range peers {
+			select {
+			case <-p.die:
+				t.Fatal("peer closed on reload")
+			default:
+			}
+		}
+	}
+}
+
+func TestHasQuorumConnectivity(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	assert.False(t, agents[0].HasQuorumConnectivity())
+
+	// 2 of 4 connected, below quorum of 3
+	connectTestAgents(t, []*TCPAgent{agents[0], agents[1]})
+	assert.False(t, agents[0].HasQuorumConnectivity())
+	assert.False(t, agents[1].HasQuorumConnectivity())
+
+	// 3 of 4 connected for agents[0]
+	connectTestAgents(t, []*TCPAgent{agents[0], agents[2]})
+	assert.True(t, agents[0].HasQuorumConnectivity())
+	assert.False(t, agents[1].HasQuorumConnectivity())
+	assert.False(t, agents[2].HasQuorumConnectivity())
+}
+
+func TestOversizedAgentMessage(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agents[0])
+	defer p.Close()
+
+	p.Lock()
+	err := p.enqueueAgentMessage(make([]byte, MaxMessageLength+1))
+	pending := len(p.agentMessages)
+	p.Unlock()
+	assert.Equal(t, ErrMessageLengthExceed, err)
+	assert.Equal(t, 0, pending)
+
+	// nothing has been written to the connection
+	c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = c2.Read(make([]byte, MessageLength))
+	assert.NotNil(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+}
+
+func TestOversizedMessageLength(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(c1, agents[0])
+	defer p.Close()
+	go io.Copy(ioutil.Discard, c2)
+
+	// only the length prefix is sent, reading the message body would block
+	// until the read timeout
+	var length [MessageLength]byte
+	binary.LittleEndian.PutUint32(length[:], MaxMessageLength+1)
+	_, err := c2.Write(length[:])
+	assert.Nil(t, err)
+
+	select {
+	case <-p.die:
+	case <-time.After(time.Second):
+		t.Fatal("the connection has not been dropped")
+	}
+
+	logs.Lock()
+	assert.Contains(t, logs.buf.String(), ErrMessageLengthExceed.Error())
+	logs.Unlock()
+}
+
+// stuckConn is a connection whose writes block regardless of deadlines,
+// until the connection is closed
+type stuckConn struct {
+	net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *stuckConn) Write(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stuckConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestStuckWrite(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	agent := agents[0]
+	defer agent.Close()
+	assert.Nil(t, agent.Reload(PartialConfig{WriteTimeout: 50 * time.Millisecond}))
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewTCPPeer(&stuckConn{Conn: c1, closed: make(chan struct{})}, agent)
+	assert.True(t, agent.AddPeer(p))
+
+	// the write blocks past its deadline
+	start := time.Now()
+	assert.Nil(t, p.Send([]byte("consensus message")))
+	select {
+	case <-p.die:
+		assert.True(t, time.Since(start) >= writeStuckFactor*50*time.Millisecond)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the peer with a stuck write has not been closed")
+	}
+
+	// removed from the agent and consensus core
+	deadline := time.Now().Add(time.Second)
+	for {
+		agent.Lock()
+		numPeers, numConsensusPeers := len(agent.peers), len(agent.consensus.Peers())
+		agent.Unlock()
+		if numPeers == 0 && numConsensusPeers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the closed peer has not been removed")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+func TestDecidedAt(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	height, at := agents[0].DecidedAt()
+	assert.Equal(t, uint64(0), height)
+	assert.True(t, at.IsZero())
+
+	var last time.Time
+	for h := uint64(1); h <= 3; h++ {
+		decideHeight(t, agents, h)
+
+		// wait for the agent to process the decision
+		deadline := time.Now().Add(10 * time.Second)
+		height, at := agents[0].DecidedAt()
+		for height < h {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for height %v", h)
+			}
+			<-time.After(updateInterval)
+			height, at = agents[0].DecidedAt()
+		}
+		assert.Equal(t, h, height)
+		assert.True(t, at.After(last))
+
+		// set only once per height
+		<-time.After(3 * updateInterval)
+		height2, at2 := agents[0].DecidedAt()
+		assert.Equal(t, h, height2)
+		assert.Equal(t, at, at2)
+		last = at
+	}
+	assert.False(t, last.IsZero())
+}
+
+func TestMessageBeforeAddPeer(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	agents := newTestAgents(t, keys, 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	agents[0].Start()
+
+	// a valid <roundchange> from another participant
+	m := bdls.Message{Type: bdls.MessageType_RoundChange, Height: 1, Round: 0, State: []byte("state")}
+	sp := new(bdls.SignedProto)
+	sp.Sign(&m, keys[1])
+	bts, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+
+	// the remote sends as soon as it connects
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go writeGossip(t, c2, &Gossip{Command: CommandType_CONSENSUS, Message: bts})
+	p := NewTCPPeer(c1, agents[0])
+
+	// the message is processed and accounted to the peer before registration
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.Lock()
+		valid := p.score.valid
+		p.Unlock()
+		if valid == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message from unregistered peer has not been processed")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	assert.True(t, agents[0].AddPeer(p))
+	infos := agents[0].PeerInfo()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, int64(1), infos[0].ValidMessages)
+	assert.Equal(t, int64(0), infos[0].InvalidMessages)
+}
+
+func TestExternalTick(t *testing.T) {
+	latency := 10 * time.Millisecond
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, latency, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	connectTestAgents(t, agents)
+	for _, agent := range agents {
+		agent.SetExternalTick()
+		agent.Start()
+	}
+
+	for h := uint64(1); h <= 3; h++ {
+		proposeTestStates(t, agents)
+
+		// no progress without ticks
+		<-time.After(10 * latency)
+		for _, agent := range agents {
+			height, _, _ := agent.GetLatestState()
+			assert.Equal(t, h-1, height)
+		}
+
+		deadline := time.Now().Add(30 * time.Second)
+		for _, agent := range agents {
+			for {
+				newHeight, _, _ := agent.GetLatestState()
+				if newHeight >= h {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timeout waiting for height %v", h)
+				}
+				for _, agent := range agents {
+					if err := agent.Tick(h); err != nil {
+						assert.Equal(t, ErrStaleTick, err)
+					}
+				}
+				<-time.After(latency)
+			}
+		}
+		assert.Equal(t, ErrStaleTick, agents[0].Tick(h))
+	}
+}
+
+func TestKeyAuthMalformedKey(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	agents := newTestAgents(t, keys, 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	ephemeral := &keys[1].PublicKey
+	x, y := keys[0].PublicKey.X.Bytes(), keys[0].PublicKey.Y.Bytes()
+	for _, tc := range []struct {
+		x   []byte
+		err error
+	}{
+		// 33 bytes, with leading zero
+		{append([]byte{0}, x...), ErrKeyMalformed},
+		// 33 bytes, x + p
+		{new(big.Int).Add(keys[0].PublicKey.X, bdls.S256Curve.Params().P).Bytes(), ErrKeyMalformed},
+		// off curve
+		{new(big.Int).Add(keys[0].PublicKey.X, big.NewInt(1)).Bytes(), ErrKeyNotOnCurve},
+		{x, nil},
+	} {
+		c1, c2 := net.Pipe()
+		p := NewTCPPeer(c1, agents[0])
+		err := p.handleKeyAuthInit(&KeyAuthInit{X: tc.x, Y: y, EphemeralX: ephemeral.X.Bytes(), EphemeralY: ephemeral.Y.Bytes()})
+		assert.Equal(t, tc.err, err)
+		if tc.err != nil {
+			p.Lock()
+			assert.Equal(t, peerAuthenticatedFailed, p.peerAuthStatus)
+			p.localAuthState = localAuthKeySent
+			p.Unlock()
+
+			// the key in challenge is validated the same
+			err = p.handleKeyAuthChallenge(&KeyAuthChallenge{X: tc.x, Y: y, Challenge: []byte("challenge")})
+			assert.Equal(t, tc.err, err)
+		}
+
+		p.Close()
+		c2.Close()
+	}
+}
+
+func TestCloseOrdering(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	var peers []*TCPPeer
+	for _, agent := range agents {
+		agent.Lock()
+		assert.Equal(t, 3, len(agent.consensus.Peers()))
+		peers = append(peers, agent.peers...)
+		agent.Unlock()
+	}
+
+	// keep consensus busy while closing
+	var wg sync.WaitGroup
+	for _, agent := range agents {
+		wg.Add(1)
+		go func(agent *TCPAgent) {
+			defer wg.Done()
+			for !agent.closed() {
+				data := make([]byte, 1024)
+				io.ReadFull(rand.Reader, data)
+				if err := agent.Propose(data); err != nil {
+					assert.Equal(t, ErrAgentClosed, err)
+				}
+				agent.Update()
+				<-time.After(time.Millisecond)
+			}
+		}(agent)
+	}
+
+	<-time.After(100 * time.Millisecond)
+	for _, agent := range agents {
+		wg.Add(1)
+		go func(agent *TCPAgent) {
+			defer wg.Done()
+			agent.Close()
+
+			// no peers left in consensus core once Close returns
+			agent.Lock()
+			assert.Equal(t, 0, len(agent.consensus.Peers()))
+			assert.Equal(t, 0, len(agent.peers))
+			agent.Unlock()
+		}(agent)
+	}
+	wg.Wait()
+
+	// and all connections are closed
+	for _, p := range peers {
+		select {
+		case <-p.die:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer not closed")
+		}
+	}
+}
+
+func TestIdlePeerHeartbeat(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	readTimeout := 200 * time.Millisecond
+	for _, agent := range agents[:2] {
+		assert.Nil(t, agent.Reload(PartialConfig{ReadTimeout: readTimeout, Heartbeat: readTimeout}))
+	}
+	// agents[2] is alive, but never sends heartbeats in time
+	assert.Nil(t, agents[2].Reload(PartialConfig{ReadTimeout: time.Hour, Heartbeat: time.Hour}))
+
+	connectTestAgents(t, agents[:2])
+	connectTestAgents(t, []*TCPAgent{agents[0], agents[2]})
+	agents[0].Lock()
+	alive, dead := agents[0].peers[0], agents[0].peers[1]
+	agents[0].Unlock()
+
+	// the agents are sealed, no consensus messages are exchanged
+	select {
+	case <-alive.die:
+		t.Fatal("idle peer with heartbeats disconnected")
+	case <-time.After(10 * readTimeout):
+	}
+
+	select {
+	case <-dead.die:
+	default:
+		t.Fatal("peer without heartbeats stays connected")
+	}
+}
+
+// createRoundChanges signs n <roundchange> messages by the participants in turn
+func createRoundChanges(t testing.TB, keys []*ecdsa.PrivateKey, n int) [][]byte {
+	var batch [][]byte
+	for i := 0; i < n; i++ {
+		m := bdls.Message{Type: bdls.MessageType_RoundChange, Height: 1, Round: uint64(i / len(keys)), State: []byte("state")}
+		sp := new(bdls.SignedProto)
+		sp.Sign(&m, keys[i%len(keys)])
+		bts, err := proto.Marshal(sp)
+		assert.Nil(t, err)
+		batch = append(batch, bts)
+	}
+	return batch
+}
+
+func TestReceiveMessages(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	agents := newTestAgents(t, keys, 0, 10*time.Millisecond, 0)
+	agent := agents[0]
+
+	batch := append(createRoundChanges(t, keys[1:], 3), []byte("malformed"))
+	for _, err := range agent.ReceiveMessages(batch) {
+		assert.Equal(t, ErrAgentNotStarted, err)
+	}
+
+	agent.Start()
+	errs := agent.ReceiveMessages(batch)
+	assert.Len(t, errs, 4)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Nil(t, errs[2])
+	assert.NotNil(t, errs[3])
+	assert.Equal(t, uint64(3), agent.Metrics().Received[bdls.MessageType_RoundChange])
+
+	agent.Close()
+	for _, err := range agent.ReceiveMessages(batch) {
+		assert.Equal(t, ErrAgentClosed, err)
+	}
+}
+
+func benchmarkReceiveMessages(b *testing.B, batchSize int) {
+	keys := createTestKeys(b, 4)
+	agents := newTestAgents(b, keys, 0, time.Hour, 0)
+	agent := agents[0]
+	agent.Start()
+	defer agent.Close()
+
+	const numMessages = 10000
+	messages := createRoundChanges(b, keys[1:], numMessages)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k := 0; k < numMessages; k += batchSize {
+			agent.ReceiveMessages(messages[k : k+batchSize])
+		}
+	}
+}
+
+func BenchmarkReceiveMessagesOneByOne(b *testing.B) { benchmarkReceiveMessages(b, 1) }
+
+func BenchmarkReceiveMessagesBatch(b *testing.B) { benchmarkReceiveMessages(b, 10000) }
+
+func TestPersistHook(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	// persisting fails until height 3 has been decided, height 1 is retried
+	var mu sync.Mutex
+	var attempts, persisted []uint64
+	failing := true
+	agents[0].SetPersistHook(func(s ConfirmedState) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, s.Height)
+		assert.NotNil(t, s.Proof)
+		if failing {
+			return errors.New("disk full")
+		}
+		persisted = append(persisted, s.Height)
+		return nil
+	}, PersistRetry)
+
+	// halts on the first failure
+	agents[1].SetPersistHook(func(s ConfirmedState) error { return errors.New("disk full") }, PersistHalt)
+
+	connectTestAgents(t, agents)
+	for _, agent := range agents {
+		agent.Start()
+	}
+
+	for h := uint64(1); h <= 3; h++ {
+		decideHeight(t, []*TCPAgent{agents[0], agents[2], agents[3]}, h)
+	}
+	height, _ := agents[0].DecidedAt()
+	assert.Equal(t, uint64(0), height)
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		height, _ := agents[0].DecidedAt()
+		if height == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for persisted height")
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+
+	// height 1 was retried until persisted, then the latest height
+	mu.Lock()
+	for _, h := range attempts[:len(attempts)-2] {
+		assert.Equal(t, uint64(1), h)
+	}
+	assert.Equal(t, []uint64{1, 3}, persisted)
+	mu.Unlock()
+
+	// the halted agent has closed without processing any height
+	select {
+	case <-agents[1].die:
+	case <-time.After(time.Second):
+		t.Fatal("the agent did not halt")
+	}
+	height, _ = agents[1].DecidedAt()
+	assert.Equal(t, uint64(0), height)
+}
+
+func TestDecisionOrder(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	var mu sync.Mutex
+	persisted := make([][]uint64, len(agents))
+	sinks := make([]*syncBuffer, len(agents))
+	for k, agent := range agents {
+		k := k
+		agent.SetPersistHook(func(s ConfirmedState) error {
+			mu.Lock()
+			defer mu.Unlock()
+			persisted[k] = append(persisted[k], s.Height)
+			return nil
+		}, PersistRetry)
+		sinks[k] = new(syncBuffer)
+		agent.SetEventSink(sinks[k])
+	}
+
+	connectTestAgents(t, agents)
+	for _, agent := range agents {
+		agent.Start()
+	}
+
+	// advance heights rapidly
+	const heights = 8
+	for h := uint64(1); h <= heights; h++ {
+		decideHeight(t, agents, h)
+	}
+
+	// events are written asynchronously
+	events := func(sink *syncBuffer) []uint64 {
+		var heights []uint64
+		for _, line := range strings.Split(sink.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			var event DecideEvent
+			assert.Nil(t, json.Unmarshal([]byte(line), &event))
+			heights = append(heights, event.Height)
+		}
+		return heights
+	}
+
+	for k, agent := range agents {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			height, _ := agent.DecidedAt()
+			sunk := events(sinks[k])
+			if height >= heights && len(sunk) > 0 && sunk[len(sunk)-1] == height {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for decide events")
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+
+		// in sync, every height is delivered once and in order
+		mu.Lock()
+		hooked := persisted[k]
+		mu.Unlock()
+		assert.True(t, len(hooked) >= heights)
+		for i := range hooked {
+			assert.Equal(t, uint64(i+1), hooked[i])
+		}
+		assert.Equal(t, hooked[:len(events(sinks[k]))], events(sinks[k]))
+	}
+}
+
+// addrConn overrides the remote address of a connection
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// textAddr is a tcp address in any textual form
+type textAddr string
+
+func (textAddr) Network() string  { return "tcp" }
+func (a textAddr) String() string { return string(a) }
+
+func TestRemovePeerZonedAddress(t *testing.T) {
+	agents := newTestAgents(t, createTestKeys(t, 4), 0, 10*time.Millisecond, 0)
+	agent := agents[0]
+	defer agent.Close()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	zoned := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 4680, Zone: "eth0"}
+	p := NewTCPPeer(addrConn{c1, zoned}, agent)
+	assert.True(t, agent.AddPeer(p))
+	assert.Equal(t, 1, len(agent.consensus.Peers()))
+
+	// the same address in another textual form matches
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	other := NewTCPPeer(addrConn{c3, textAddr("[FE80:0:0::1%eth0]:4680")}, agent)
+	defer other.Close()
+	assert.True(t, agent.RemovePeer(other))
+	assert.Equal(t, 0, len(agent.peers))
+	assert.Equal(t, 0, len(agent.consensus.Peers()))
+
+	// another zone doesn't match
+	assert.True(t, agent.AddPeer(p))
+	c5, c6 := net.Pipe()
+	defer c6.Close()
+	otherZone := NewTCPPeer(addrConn{c5, textAddr("[fe80::1%eth1]:4680")}, agent)
+	defer otherZone.Close()
+	assert.False(t, agent.RemovePeer(otherZone))
+	assert.True(t, agent.RemovePeer(p))
+	p.Close()
+}
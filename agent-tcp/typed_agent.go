@@ -0,0 +1,69 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import "github.com/Sperax/bdls"
+
+// TypedAgent wraps a TCPAgent to propose and retrieve application defined
+// values, states are converted with the codec.
+type TypedAgent struct {
+	agent *TCPAgent
+	codec bdls.StateCodec
+}
+
+// NewTypedAgent creates a TypedAgent on the agent, the consensus config is
+// expected to use the same codec, see bdls.Config.SetCodec.
+func NewTypedAgent(agent *TCPAgent, codec bdls.StateCodec) *TypedAgent {
+	return &TypedAgent{agent: agent, codec: codec}
+}
+
+// Agent returns the underlying TCPAgent
+func (t *TypedAgent) Agent() *TCPAgent { return t.agent }
+
+// Propose encodes the value and proposes it as a state
+func (t *TypedAgent) Propose(v interface{}) error {
+	s, err := t.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return t.agent.Propose(s)
+}
+
+// GetLatestState returns the latest confirmed value, decoded with the codec
+func (t *TypedAgent) GetLatestState() (height uint64, round uint64, v interface{}, err error) {
+	height, round, s := t.agent.GetLatestState()
+	if s == nil {
+		return height, round, nil, nil
+	}
+
+	v, err = t.codec.Decode(s)
+	return height, round, v, err
+}
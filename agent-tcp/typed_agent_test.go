@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Sperax/bdls"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBlock is a small structure to be proposed via TypedAgent
+type testBlock struct {
+	Number  uint64
+	Payload string
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) (bdls.State, error) { return json.Marshal(v) }
+func (jsonCodec) Decode(s bdls.State) (interface{}, error) {
+	var b testBlock
+	err := json.Unmarshal(s, &b)
+	return b, err
+}
+
+func TestTypedAgent(t *testing.T) {
+	agents := createTestAgents(t, 4, 0, 10*time.Millisecond)
+	var typed []*TypedAgent
+	for _, agent := range agents {
+		typed = append(typed, NewTypedAgent(agent, jsonCodec{}))
+	}
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+
+	proposed := make(map[testBlock]bool)
+	for i := range typed {
+		b := testBlock{Number: 1, Payload: string(rune('a' + i))}
+		proposed[b] = true
+		assert.Nil(t, typed[i].Propose(b))
+	}
+
+	// unencodable values are rejected
+	assert.NotNil(t, typed[0].Propose(func() {}))
+
+	deadline := time.Now().Add(30 * time.Second)
+	for i := range typed {
+		for {
+			height, _, v, err := typed[i].GetLatestState()
+			if height >= 1 {
+				assert.Nil(t, err)
+				assert.True(t, proposed[v.(testBlock)])
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for height 1")
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+	}
+}
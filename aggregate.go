@@ -0,0 +1,131 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+)
+
+// AggregateScheme is a signature scheme for <commit> messages, a scheme like
+// BLS can aggregate the signatures of a CommitCertificate into one, so the
+// certificate doesn't carry a signature per participant.
+//
+// Signers are identified by the coordinate of their ECDSA public key, a scheme
+// with keys of its own maps the coordinate to the key of the participant.
+type AggregateScheme interface {
+	// Sign signs the digest as the participant of the private key
+	Sign(key *ecdsa.PrivateKey, digest []byte) ([]byte, error)
+	// Verify verifies the signature of the signer on the digest
+	Verify(signer Coordinate, digest []byte, sig []byte) bool
+	// Aggregate combines signatures into a single signature, it returns
+	// ErrAggregateUnsupported if the scheme cannot aggregate.
+	Aggregate(sigs [][]byte) ([]byte, error)
+	// VerifyAggregate verifies an aggregated signature, where signers[i]
+	// has signed digests[i].
+	VerifyAggregate(signers []Coordinate, digests [][]byte, aggregate []byte) bool
+}
+
+// ECDSAScheme is the non-aggregating AggregateScheme of ECDSA signatures,
+// a signature is encoded as |R(SizeAxis)|S(SizeAxis)|.
+type ECDSAScheme struct {
+	Curve elliptic.Curve
+}
+
+// Sign implements AggregateScheme
+func (scheme ECDSAScheme) Sign(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var R, S PubKeyAxis
+	if err := R.Unmarshal(r.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := S.Unmarshal(s.Bytes()); err != nil {
+		return nil, err
+	}
+	return append(R[:], S[:]...), nil
+}
+
+// Verify implements AggregateScheme
+func (scheme ECDSAScheme) Verify(signer Coordinate, digest []byte, sig []byte) bool {
+	if len(sig) != 2*SizeAxis {
+		return false
+	}
+
+	pubkey := new(ecdsa.PublicKey)
+	pubkey.Curve = scheme.Curve
+	pubkey.X = new(big.Int).SetBytes(signer[:SizeAxis])
+	pubkey.Y = new(big.Int).SetBytes(signer[SizeAxis:])
+	r := new(big.Int).SetBytes(sig[:SizeAxis])
+	s := new(big.Int).SetBytes(sig[SizeAxis:])
+	return ecdsa.Verify(pubkey, digest, r, s)
+}
+
+// Aggregate implements AggregateScheme, ECDSA signatures cannot be aggregated
+func (scheme ECDSAScheme) Aggregate(sigs [][]byte) ([]byte, error) {
+	return nil, ErrAggregateUnsupported
+}
+
+// VerifyAggregate implements AggregateScheme, always false for ECDSA
+func (scheme ECDSAScheme) VerifyAggregate(signers []Coordinate, digests [][]byte, aggregate []byte) bool {
+	return false
+}
+
+// signAggregate signs a <commit> message with the aggregate scheme, the
+// signature is carried in AuxData which is not covered by the ECDSA signature.
+func (c *Consensus) signAggregate(m *Message, sp *SignedProto) {
+	if c.aggregateScheme == nil || m.Type != MessageType_Commit {
+		return
+	}
+
+	sig, err := c.aggregateScheme.Sign(c.privateKey, sp.Hash())
+	if err != nil {
+		panic(err)
+	}
+	sp.AuxData = sig
+}
+
+// verifyAggregate verifies the aggregate scheme signature of a <commit> message
+func (c *Consensus) verifyAggregate(m *Message, sp *SignedProto) bool {
+	if c.aggregateScheme == nil || m.Type != MessageType_Commit {
+		return true
+	}
+
+	var signer Coordinate
+	copy(signer[:SizeAxis], sp.X[:])
+	copy(signer[SizeAxis:], sp.Y[:])
+	return c.aggregateScheme.Verify(signer, sp.Hash(), sp.AuxData)
+}
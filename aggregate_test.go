@@ -0,0 +1,124 @@
+package bdls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"testing"
+
+	"github.com/Sperax/bdls/crypto/blake2b"
+	"github.com/stretchr/testify/assert"
+)
+
+// hashScheme is an insecure aggregating scheme for testing, a signature is
+// blake2b(signer + digest), and the aggregate is blake2b of all signatures.
+type hashScheme struct{}
+
+func (hashScheme) sign(signer Coordinate, digest []byte) []byte {
+	sum := blake2b.Sum256(append(signer[:], digest...))
+	return sum[:]
+}
+
+func (scheme hashScheme) Sign(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	signer, err := PubKeyToCoordinate(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return scheme.sign(signer, digest), nil
+}
+
+func (scheme hashScheme) Verify(signer Coordinate, digest []byte, sig []byte) bool {
+	return bytes.Equal(scheme.sign(signer, digest), sig)
+}
+
+func (hashScheme) Aggregate(sigs [][]byte) ([]byte, error) {
+	sum := blake2b.Sum256(bytes.Join(sigs, nil))
+	return sum[:], nil
+}
+
+func (scheme hashScheme) VerifyAggregate(signers []Coordinate, digests [][]byte, aggregate []byte) bool {
+	var sigs [][]byte
+	for i := range signers {
+		sigs = append(sigs, scheme.sign(signers[i], digests[i]))
+	}
+	expected, _ := scheme.Aggregate(sigs)
+	return bytes.Equal(expected, aggregate)
+}
+
+func TestECDSAScheme(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	signer, err := PubKeyToCoordinate(&privateKey.PublicKey)
+	assert.Nil(t, err)
+
+	scheme := ECDSAScheme{Curve: S256Curve}
+	digest := blake2b.Sum256([]byte("commit"))
+	sig, err := scheme.Sign(privateKey, digest[:])
+	assert.Nil(t, err)
+	assert.Len(t, sig, 2*SizeAxis)
+	assert.True(t, scheme.Verify(signer, digest[:], sig))
+
+	other := blake2b.Sum256([]byte("other"))
+	assert.False(t, scheme.Verify(signer, other[:], sig))
+	assert.False(t, scheme.Verify(signer, digest[:], sig[1:]))
+
+	_, err = scheme.Aggregate([][]byte{sig, sig})
+	assert.Equal(t, ErrAggregateUnsupported, err)
+	assert.False(t, scheme.VerifyAggregate([]Coordinate{signer}, [][]byte{digest[:]}, sig))
+}
+
+func TestAggregateCommitCertificate(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	participants := createTestPublicKeys(keys)
+
+	certificate := func(scheme AggregateScheme) *CommitCertificate {
+		peers := createIPCPeers(t, keys, func(config *Config) { config.AggregateScheme = scheme })
+		defer func() {
+			for _, peer := range peers {
+				peer.Close()
+			}
+		}()
+
+		for i := range peers {
+			peers[i].Update()
+		}
+		decideIPCHeight(t, peers, 1)
+
+		peers[0].Lock()
+		defer peers[0].Unlock()
+		cert, err := peers[0].c.CommitCertificate(1)
+		assert.Nil(t, err)
+		return cert
+	}
+
+	// the default ECDSA scheme doesn't aggregate
+	plain := certificate(ECDSAScheme{Curve: S256Curve})
+	assert.Nil(t, plain.Aggregate)
+	assert.Nil(t, VerifyCommitCertificate(plain, participants, S256Curve, nil))
+
+	// an aggregating scheme
+	cert := certificate(hashScheme{})
+	assert.NotNil(t, cert.Aggregate)
+	for _, commit := range cert.Commits {
+		assert.Nil(t, commit.R)
+		assert.Nil(t, commit.S)
+	}
+	assert.Nil(t, VerifyCommitCertificateWithScheme(cert, participants, S256Curve, nil, hashScheme{}))
+	assert.Equal(t, ErrAggregateUnsupported, VerifyCommitCertificate(cert, participants, S256Curve, nil))
+
+	// encoding keeps the aggregate, and is smaller
+	bts, err := cert.MarshalBinary()
+	assert.Nil(t, err)
+	plainBts, err := plain.MarshalBinary()
+	assert.Nil(t, err)
+	assert.True(t, len(bts) < len(plainBts))
+
+	decoded := new(CommitCertificate)
+	assert.Nil(t, decoded.UnmarshalBinary(bts))
+	assert.Equal(t, cert.Aggregate, decoded.Aggregate)
+	assert.Nil(t, VerifyCommitCertificateWithScheme(decoded, participants, S256Curve, nil, hashScheme{}))
+
+	// tampered aggregate
+	decoded.Aggregate[0]++
+	assert.Equal(t, ErrMessageSignature, VerifyCommitCertificateWithScheme(decoded, participants, S256Curve, nil, hashScheme{}))
+}
@@ -0,0 +1,453 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"sort"
+
+	"github.com/Sperax/bdls/crypto/blake2b"
+)
+
+// CertificateLayoutVersion is the layout version of CommitCertificate.MarshalBinary
+const CertificateLayoutVersion = 2
+
+// CommitCertificate proves a state has been decided at a height, it consists
+// of <commit> messages signed by at least 2t+1 participants. Every commit is
+// kept as signed, so it can be verified without running consensus.
+//
+// If Aggregate is set, it's the signature of all commits aggregated by an
+// AggregateScheme, and the commits carry no signature on their own.
+type CommitCertificate struct {
+	Height    uint64
+	Round     uint64
+	StateHash StateHash
+	Commits   []*SignedProto
+	Aggregate []byte
+}
+
+// CommitCertificate returns the commit certificate of the decided height,
+// only the latest decided height is kept by consensus. The signatures are
+// aggregated if Config.AggregateScheme can aggregate.
+func (c *Consensus) CommitCertificate(height uint64) (*CommitCertificate, error) {
+	if c.latestProof == nil || height != c.latestHeight {
+		return nil, ErrCertificateUnavailable
+	}
+
+	m, err := UnmarshalMessage(c.latestProof.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := new(CommitCertificate)
+	cert.Height = m.Height
+	cert.Round = m.Round
+	cert.StateHash = c.stateHash(m.State)
+	cert.Commits = m.Proof
+	if c.aggregateScheme == nil {
+		return cert, nil
+	}
+
+	var sigs [][]byte
+	for _, commit := range cert.Commits {
+		sigs = append(sigs, commit.AuxData)
+	}
+	aggregate, err := c.aggregateScheme.Aggregate(sigs)
+	if err == ErrAggregateUnsupported {
+		return cert, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the commits are covered by the aggregated signature
+	cert.Aggregate = aggregate
+	cert.Commits = make([]*SignedProto, len(m.Proof))
+	for k := range m.Proof {
+		commit := new(SignedProto)
+		commit.Version = m.Proof[k].Version
+		commit.Height = m.Proof[k].Height
+		commit.Round = m.Proof[k].Round
+		commit.Message = m.Proof[k].Message
+		commit.X = m.Proof[k].X
+		commit.Y = m.Proof[k].Y
+		cert.Commits[k] = commit
+	}
+	return cert, nil
+}
+
+// VerifyCommitCertificate verifies the certificate against the participants
+// of the height, with the same hash function as Config.HashFunc, nil for the
+// default blake2b-256. The certificate is valid if at least 2t+1 distinct
+// participants have signed <commit> messages on the state hash.
+func VerifyCommitCertificate(cert *CommitCertificate, participants []*ecdsa.PublicKey, curve elliptic.Curve, hashFunc func(data []byte) []byte) error {
+	return VerifyCommitCertificateWithScheme(cert, participants, curve, hashFunc, nil)
+}
+
+// VerifyCommitCertificateWithScheme is like VerifyCommitCertificate, the
+// aggregated signature of the certificate is verified with the scheme.
+func VerifyCommitCertificateWithScheme(cert *CommitCertificate, participants []*ecdsa.PublicKey, curve elliptic.Curve, hashFunc func(data []byte) []byte, scheme AggregateScheme) error {
+	aggregated := len(cert.Aggregate) > 0
+	if aggregated && scheme == nil {
+		return ErrAggregateUnsupported
+	}
+
+	stateHash := defaultHash
+	if hashFunc != nil {
+		stateHash = func(s State) (h StateHash) {
+			copy(h[:], hashFunc(s))
+			return h
+		}
+	}
+
+	known := make(map[Coordinate]bool)
+	for _, pubkey := range participants {
+		coord, err := PubKeyToCoordinate(pubkey)
+		if err != nil {
+			return err
+		}
+		known[coord] = true
+	}
+
+	signers := make(map[Coordinate]bool)
+	var coords []Coordinate
+	var digests [][]byte
+	for _, commit := range cert.Commits {
+		if commit == nil {
+			return ErrCertificateInvalid
+		}
+
+		var coord Coordinate
+		copy(coord[:SizeAxis], commit.X[:])
+		copy(coord[SizeAxis:], commit.Y[:])
+		if !known[coord] {
+			return ErrMessageUnknownParticipant
+		}
+
+		m, err := UnmarshalMessageLimit(commit.Message, len(participants))
+		if err != nil {
+			return err
+		}
+
+		if m.Type != MessageType_Commit || m.Height != cert.Height || m.Round != cert.Round {
+			return ErrCertificateInvalid
+		}
+
+		if !commit.bound(m) {
+			return ErrMessageBinding
+		}
+
+		if stateHash(m.State) != cert.StateHash {
+			return ErrCertificateInvalid
+		}
+
+		if aggregated {
+			coords = append(coords, coord)
+			digests = append(digests, commit.Hash())
+		} else if !commit.Verify(curve) {
+			return ErrMessageSignature
+		}
+		signers[coord] = true
+	}
+
+	if aggregated && !scheme.VerifyAggregate(coords, digests, cert.Aggregate) {
+		return ErrMessageSignature
+	}
+
+	t := (len(participants) - 1) / 3
+	if len(signers) < 2*t+1 {
+		return ErrCertificateInsufficient
+	}
+	return nil
+}
+
+// VerifyDecision verifies a decision claimed by an untrusted source with the
+// local participants only, the proof is an encoded <decide> message as
+// Consensus.CurrentProof(). The decision is valid if the <decide> is signed
+// by a participant, and it carries valid <commit> messages of at least 2t+1
+// distinct participants on the height and state. States are hashed with the
+// default blake2b-256.
+func VerifyDecision(participants []*ecdsa.PublicKey, curve elliptic.Curve, height uint64, state State, proof []byte) error {
+	signed, err := DecodeSignedMessage(proof)
+	if err != nil {
+		return err
+	}
+
+	if signed.Version != ProtocolVersion {
+		return ErrProtocolVersionMismatch
+	}
+
+	var coord Coordinate
+	copy(coord[:SizeAxis], signed.X[:])
+	copy(coord[SizeAxis:], signed.Y[:])
+	var known bool
+	for _, pubkey := range participants {
+		if c, err := PubKeyToCoordinate(pubkey); err == nil && c == coord {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return ErrMessageUnknownParticipant
+	}
+
+	if !signed.Verify(curve) {
+		return ErrMessageSignature
+	}
+
+	m, err := UnmarshalMessageLimit(signed.Message, len(participants))
+	if err != nil {
+		return err
+	}
+
+	if !signed.bound(m) {
+		return ErrMessageBinding
+	}
+
+	if m.Type != MessageType_Decide || m.Height != height {
+		return ErrCertificateInvalid
+	}
+
+	if !bytes.Equal(m.State, state) {
+		return ErrMismatchedTargetState
+	}
+
+	// like <decide> validation, commits to other states are not counted
+	cert := new(CommitCertificate)
+	cert.Height = m.Height
+	cert.Round = m.Round
+	cert.StateHash = defaultHash(m.State)
+	for _, commit := range m.Proof {
+		if commit == nil {
+			return ErrCertificateInvalid
+		}
+		mCommit, err := UnmarshalMessageLimit(commit.Message, len(participants))
+		if err != nil {
+			return err
+		}
+		if mCommit.Type == MessageType_Commit && bytes.Equal(mCommit.State, m.State) {
+			cert.Commits = append(cert.Commits, commit)
+		}
+	}
+	return VerifyCommitCertificate(cert, participants, curve, nil)
+}
+
+// Beacon derives a 32 bytes value from the commit signatures of the
+// certificate, usable as a per-height randomness beacon:
+//
+// beacon = blake2b-256("BDLS-BEACON" + height_64bit + round_64bit + StateHash + Sig1 + Sig2 ... + Aggregate)
+// Sig = len_32bit(R) + R + len_32bit(S) + S
+// Aggregate = len_32bit(cert.Aggregate) + cert.Aggregate
+//
+// where signatures are taken once per signer in ascending order of the
+// signer's coordinate, integers are little endian. The certificate should be verified with
+// VerifyCommitCertificate before use.
+//
+// Properties to be aware of:
+//   - The value can't be computed before 2t+1 commits on the state exist, and
+//     no single participant chooses it alone.
+//   - It can be biased. ECDSA signatures are not unique, a participant may
+//     re-sign its commit to grind the value, and the last signer may withhold
+//     its commit after seeing the others.
+//   - Participants may hold different sets of commits for the same decision,
+//     so nodes only agree on the beacon of the same certificate, the
+//     application must agree on which certificate to use, ie. by
+//     distributing one along with the decided state.
+func (cert *CommitCertificate) Beacon() []byte {
+	commits := make(map[Coordinate]*SignedProto)
+	var signers []Coordinate
+	for _, commit := range cert.Commits {
+		if commit == nil {
+			continue
+		}
+		var coord Coordinate
+		copy(coord[:SizeAxis], commit.X[:])
+		copy(coord[SizeAxis:], commit.Y[:])
+		if _, ok := commits[coord]; !ok {
+			commits[coord] = commit
+			signers = append(signers, coord)
+		}
+	}
+	sort.Slice(signers, func(i, j int) bool { return bytes.Compare(signers[i][:], signers[j][:]) < 0 })
+
+	hash, _ := blake2b.New256(nil)
+	hash.Write([]byte("BDLS-BEACON"))
+	var u64 [8]byte
+	binary.LittleEndian.PutUint64(u64[:], cert.Height)
+	hash.Write(u64[:])
+	binary.LittleEndian.PutUint64(u64[:], cert.Round)
+	hash.Write(u64[:])
+	hash.Write(cert.StateHash[:])
+	for _, coord := range signers {
+		commit := commits[coord]
+		var sig []byte
+		sig = appendUint32(sig, uint32(len(commit.R)))
+		sig = append(sig, commit.R...)
+		sig = appendUint32(sig, uint32(len(commit.S)))
+		sig = append(sig, commit.S...)
+		hash.Write(sig)
+	}
+	hash.Write(appendUint32(nil, uint32(len(cert.Aggregate))))
+	hash.Write(cert.Aggregate)
+	return hash.Sum(nil)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler with a stable layout for
+// anchoring into external systems. The layout(little endian) is:
+//
+// |LayoutVersion(1byte)|Height(8bytes)|Round(8bytes)|StateHash(32bytes)|count_32bit(Commits)|
+// |len_32bit(Commit)|Commit|...|len_32bit(Aggregate)|Aggregate|
+//
+// where each Commit is encoded by SignedProto.MarshalBinary. Layout version 1
+// has no Aggregate, it's still accepted by UnmarshalBinary.
+func (cert *CommitCertificate) MarshalBinary() ([]byte, error) {
+	data := []byte{CertificateLayoutVersion}
+	var u64 [8]byte
+	binary.LittleEndian.PutUint64(u64[:], cert.Height)
+	data = append(data, u64[:]...)
+	binary.LittleEndian.PutUint64(u64[:], cert.Round)
+	data = append(data, u64[:]...)
+	data = append(data, cert.StateHash[:]...)
+	data = appendUint32(data, uint32(len(cert.Commits)))
+	for _, commit := range cert.Commits {
+		bts, err := commit.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data = appendUint32(data, uint32(len(bts)))
+		data = append(data, bts...)
+	}
+	data = appendUint32(data, uint32(len(cert.Aggregate)))
+	data = append(data, cert.Aggregate...)
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, it decodes the layout
+// generated by MarshalBinary, the commits are not verified.
+func (cert *CommitCertificate) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return ErrBinaryTruncated
+	}
+	version := data[0]
+	if version != 1 && version != CertificateLayoutVersion {
+		return ErrBinaryLayoutVersion
+	}
+	data = data[1:]
+
+	if len(data) < 8+8+len(StateHash{})+4 {
+		return ErrBinaryTruncated
+	}
+	height := binary.LittleEndian.Uint64(data)
+	round := binary.LittleEndian.Uint64(data[8:])
+	var stateHash StateHash
+	copy(stateHash[:], data[16:])
+	data = data[16+len(stateHash):]
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	var commits []*SignedProto
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 4 {
+			return ErrBinaryTruncated
+		}
+		length := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if uint64(len(data)) < uint64(length) {
+			return ErrBinaryTruncated
+		}
+
+		commit := new(SignedProto)
+		if err := commit.UnmarshalBinary(data[:length]); err != nil {
+			return err
+		}
+		commits = append(commits, commit)
+		data = data[length:]
+	}
+
+	var aggregate []byte
+	if version >= 2 {
+		if len(data) < 4 {
+			return ErrBinaryTruncated
+		}
+		length := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if uint64(len(data)) < uint64(length) {
+			return ErrBinaryTruncated
+		}
+		if length > 0 {
+			aggregate = append([]byte(nil), data[:length]...)
+		}
+	}
+
+	cert.Height = height
+	cert.Round = round
+	cert.StateHash = stateHash
+	cert.Commits = commits
+	cert.Aggregate = aggregate
+	return nil
+}
+
+// justification is the <commit> messages constituting the quorum of a decision
+type justification struct {
+	height  uint64
+	commits []*SignedProto
+}
+
+// archiveJustification retains the <commit> messages of a decided height, the
+// oldest height is discarded beyond Config.JustificationArchive heights.
+func (c *Consensus) archiveJustification(height uint64, commits []*SignedProto) {
+	if c.justificationArchive <= 0 {
+		return
+	}
+
+	c.justifications = append(c.justifications, justification{height: height, commits: commits})
+	if n := len(c.justifications) - c.justificationArchive; n > 0 {
+		for k := 0; k < n; k++ {
+			c.justifications[k] = justification{}
+		}
+		c.justifications = c.justifications[n:]
+	}
+}
+
+// Justification returns the signed <commit> messages constituting the quorum
+// of a decided height, false if the height is not retained, see
+// Config.JustificationArchive. Heights synced by <decide> messages are
+// retained as well, with the <commit> messages carried by them.
+func (c *Consensus) Justification(height uint64) ([]*SignedProto, bool) {
+	for k := range c.justifications {
+		if c.justifications[k].height == height {
+			return c.justifications[k].commits, true
+		}
+	}
+	return nil, false
+}
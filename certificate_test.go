@@ -0,0 +1,217 @@
+package bdls
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+
+	proto "github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitCertificate(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	participants := createTestPublicKeys(keys)
+
+	peers := createIPCPeers(t, keys, nil)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	decideIPCHeight(t, peers, 1)
+
+	peers[0].Lock()
+	_, err := peers[0].c.CommitCertificate(2)
+	assert.Equal(t, ErrCertificateUnavailable, err)
+	cert, err := peers[0].c.CommitCertificate(1)
+	peers[0].Unlock()
+	assert.Nil(t, err)
+
+	_, _, state := peers[0].GetLatestState()
+	assert.Equal(t, uint64(1), cert.Height)
+	assert.Equal(t, defaultHash(state), cert.StateHash)
+
+	// verified externally from the binary encoding
+	bts, err := cert.MarshalBinary()
+	assert.Nil(t, err)
+	decoded := new(CommitCertificate)
+	assert.Nil(t, decoded.UnmarshalBinary(bts))
+	assert.Nil(t, VerifyCommitCertificate(decoded, participants, S256Curve, nil))
+
+	// truncated
+	assert.Equal(t, ErrBinaryTruncated, new(CommitCertificate).UnmarshalBinary(bts[:len(bts)-1]))
+
+	// mismatched height
+	decoded.Height++
+	assert.Equal(t, ErrCertificateInvalid, VerifyCommitCertificate(decoded, participants, S256Curve, nil))
+	decoded.Height--
+
+	// mismatched state hash
+	decoded.StateHash[0]++
+	assert.Equal(t, ErrCertificateInvalid, VerifyCommitCertificate(decoded, participants, S256Curve, nil))
+	decoded.StateHash[0]--
+
+	// unknown participants
+	others := createTestPublicKeys(createTestKeys(t, 4))
+	assert.Equal(t, ErrMessageUnknownParticipant, VerifyCommitCertificate(decoded, others, S256Curve, nil))
+
+	// forged signature
+	forged := *decoded.Commits[0]
+	forged.R = append([]byte(nil), forged.R...)
+	forged.R[0]++
+	tampered := *decoded
+	tampered.Commits = append([]*SignedProto{&forged}, decoded.Commits[1:]...)
+	assert.Equal(t, ErrMessageSignature, VerifyCommitCertificate(&tampered, participants, S256Curve, nil))
+
+	// duplicated commits don't count
+	tampered.Commits = []*SignedProto{decoded.Commits[0], decoded.Commits[0], decoded.Commits[0]}
+	assert.Equal(t, ErrCertificateInsufficient, VerifyCommitCertificate(&tampered, participants, S256Curve, nil))
+}
+
+func TestCommitCertificateBeacon(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	participants := createTestPublicKeys(keys)
+
+	peers := createIPCPeers(t, keys, nil)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	decideIPCHeight(t, peers, 1)
+
+	peers[0].Lock()
+	cert, err := peers[0].c.CommitCertificate(1)
+	peers[0].Unlock()
+	assert.Nil(t, err)
+	bts, err := cert.MarshalBinary()
+	assert.Nil(t, err)
+	beacon := cert.Beacon()
+	assert.Len(t, beacon, 32)
+
+	// every node derives the same value from the distributed certificate,
+	// regardless of commit order
+	for range peers {
+		decoded := new(CommitCertificate)
+		assert.Nil(t, decoded.UnmarshalBinary(bts))
+		assert.Nil(t, VerifyCommitCertificate(decoded, participants, S256Curve, nil))
+		for i, j := 0, len(decoded.Commits)-1; i < j; i, j = i+1, j-1 {
+			decoded.Commits[i], decoded.Commits[j] = decoded.Commits[j], decoded.Commits[i]
+		}
+		assert.Equal(t, beacon, decoded.Beacon())
+	}
+
+	// duplicated commits don't change the value
+	duplicated := *cert
+	duplicated.Commits = append(append([]*SignedProto(nil), cert.Commits...), cert.Commits[0])
+	assert.Equal(t, beacon, duplicated.Beacon())
+
+	// any signature changes the value
+	resigned := *cert.Commits[0]
+	resigned.S = append([]byte(nil), resigned.S...)
+	resigned.S[0]++
+	tampered := *cert
+	tampered.Commits = append([]*SignedProto{&resigned}, cert.Commits[1:]...)
+	assert.NotEqual(t, beacon, tampered.Beacon())
+
+	// the next beacon is unavailable until the height has been decided
+	peers[0].Lock()
+	_, err = peers[0].c.CommitCertificate(2)
+	peers[0].Unlock()
+	assert.Equal(t, ErrCertificateUnavailable, err)
+
+	decideIPCHeight(t, peers, 2)
+	peers[0].Lock()
+	next, err := peers[0].c.CommitCertificate(2)
+	peers[0].Unlock()
+	assert.Nil(t, err)
+	assert.NotEqual(t, beacon, next.Beacon())
+}
+
+func TestVerifyDecision(t *testing.T) {
+	m, sp, privateKey, participants := createDecideMessage(t, 4, 1, 0, 1, 0)
+
+	// valid proof
+	proof, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyDecision(participants, S256Curve, 1, m.State, proof))
+	assert.Equal(t, ErrCertificateInvalid, VerifyDecision(participants, S256Curve, 2, m.State, proof))
+	assert.Equal(t, ErrMismatchedTargetState, VerifyDecision(participants, S256Curve, 1, []byte("other"), proof))
+	assert.Equal(t, ErrMessageUnknownParticipant, VerifyDecision(participants[1:], S256Curve, 1, m.State, proof))
+
+	// under-threshold proof
+	underThreshold := *m
+	underThreshold.Proof = append([]*SignedProto{}, m.Proof[1:]...)
+	signed := new(SignedProto)
+	signed.Sign(&underThreshold, privateKey)
+	proof, err = proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrCertificateInsufficient, VerifyDecision(participants, S256Curve, 1, m.State, proof))
+
+	// forged commit signature
+	forged := *m.Proof[1]
+	forged.R = make([]byte, len(m.Proof[1].R))
+	forged.S = make([]byte, len(m.Proof[1].S))
+	_, _ = io.ReadFull(rand.Reader, forged.R)
+	_, _ = io.ReadFull(rand.Reader, forged.S)
+	forgedDecide := *m
+	forgedDecide.Proof = append([]*SignedProto{}, m.Proof[:3]...)
+	forgedDecide.Proof[1] = &forged
+	signed.Sign(&forgedDecide, privateKey)
+	proof, err = proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMessageSignature, VerifyDecision(participants, S256Curve, 1, m.State, proof))
+}
+
+func TestJustification(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	participants := createTestPublicKeys(keys)
+
+	peers := createIPCPeers(t, keys, func(config *Config) { config.JustificationArchive = 2 })
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	for height := uint64(1); height <= 3; height++ {
+		decideIPCHeight(t, peers, height)
+	}
+
+	for _, peer := range peers {
+		peer.Lock()
+		latest, _, state := peer.c.CurrentState()
+		_, ok := peer.c.Justification(latest - 2)
+		assert.False(t, ok)
+		_, ok = peer.c.Justification(latest + 1)
+		assert.False(t, ok)
+
+		for height := latest - 1; height <= latest; height++ {
+			commits, ok := peer.c.Justification(height)
+			assert.True(t, ok)
+			assert.True(t, 3*len(commits) > 2*len(participants))
+
+			// the commits verify as a certificate by more than 2/3 participants
+			m, err := DecodeMessage(commits[0].Message)
+			assert.Nil(t, err)
+			cert := &CommitCertificate{Height: height, Round: m.Round, StateHash: defaultHash(m.State), Commits: commits}
+			assert.Nil(t, VerifyCommitCertificate(cert, participants, S256Curve, nil))
+			if height == latest {
+				assert.Equal(t, defaultHash(state), cert.StateHash)
+			}
+		}
+		peer.Unlock()
+	}
+}
@@ -0,0 +1,184 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sperax/bdls"
+	"github.com/Sperax/bdls/agent-tcp"
+	"github.com/Sperax/bdls/crypto/blake2b"
+)
+
+// maximum number of recent decisions kept for the admin socket
+const adminMaxDecisions = 128
+
+// a decided height kept for the admin socket
+type adminDecision struct {
+	Height uint64
+	Round  uint64
+	Hash   [32]byte
+	At     time.Time
+}
+
+// admin serves a line based protocol for live introspection and control of
+// a running node, every command is replied with lines terminated by an
+// empty line:
+//
+//	status        height, round, number of peers, quorum connectivity and draining
+//	peers         one line per peer, ordered by score
+//	decisions N   the N most recent decisions, oldest first
+//	drain         stop proposing new states, the node still votes
+//	undrain       resume proposing
+type admin struct {
+	agent *agent.TCPAgent
+
+	mu        sync.Mutex
+	decisions []adminDecision
+	draining  bool
+}
+
+// newAdmin creates the admin of an agent
+func newAdmin(agent *agent.TCPAgent) *admin {
+	return &admin{agent: agent}
+}
+
+// record keeps a decision, the oldest one is discarded beyond adminMaxDecisions
+func (a *admin) record(height uint64, round uint64, state bdls.State, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.decisions = append(a.decisions, adminDecision{Height: height, Round: round, Hash: blake2b.Sum256(state), At: at})
+	if len(a.decisions) > adminMaxDecisions {
+		a.decisions = append(a.decisions[:0], a.decisions[1:]...)
+	}
+}
+
+// isDraining returns true if the node should not propose
+func (a *admin) isDraining() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.draining
+}
+
+// listenAdmin listens on a unix socket if addr is a path, otherwise on a tcp
+// address
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.Contains(addr, "/") {
+		return net.Listen("unix", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve accepts admin connections until the listener closes
+func (a *admin) serve(l net.Listener) {
+	acceptLoop(l, func(conn net.Conn) {
+		go a.handle(conn)
+	})
+}
+
+// handle replies the commands from a connection until it closes
+func (a *admin) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := a.exec(w, fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(w, "error:", err)
+		}
+		fmt.Fprintln(w)
+		if err := w.Flush(); err != nil {
+			log.Println("admin:", err)
+			return
+		}
+	}
+}
+
+// exec writes the reply of a command
+func (a *admin) exec(w io.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "status":
+		height, round, _ := a.agent.GetLatestState()
+		fmt.Fprintf(w, "height=%v round=%v peers=%v quorum=%v draining=%v\n",
+			height, round, len(a.agent.PeerInfo()), a.agent.HasQuorumConnectivity(), a.isDraining())
+	case "peers":
+		for _, info := range a.agent.PeerInfo() {
+			key := "unknown"
+			if info.PublicKey != nil {
+				key = fingerprint(info.PublicKey)
+			}
+			fmt.Fprintf(w, "addr=%v key=%v score=%.2f valid=%v invalid=%v\n",
+				info.RemoteAddr, key, info.Score, info.ValidMessages, info.InvalidMessages)
+		}
+	case "decisions":
+		n := adminMaxDecisions
+		if len(args) > 0 {
+			var err error
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid count %q", args[0])
+			}
+		}
+
+		a.mu.Lock()
+		decisions := a.decisions
+		if n < len(decisions) {
+			decisions = decisions[len(decisions)-n:]
+		}
+		for _, d := range decisions {
+			fmt.Fprintf(w, "height=%v round=%v hash=%v at=%v\n",
+				d.Height, d.Round, hex.EncodeToString(d.Hash[:]), d.At.UTC().Format(time.RFC3339Nano))
+		}
+		a.mu.Unlock()
+	case "drain", "undrain":
+		a.mu.Lock()
+		a.draining = cmd == "drain"
+		a.mu.Unlock()
+		log.Println("admin:", cmd)
+		fmt.Fprintln(w, "ok")
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
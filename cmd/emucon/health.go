@@ -0,0 +1,152 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/Sperax/bdls"
+	"github.com/Sperax/bdls/agent-tcp"
+)
+
+// health serves the http endpoints for orchestrators and monitoring:
+//
+//	/healthz   200 if the agent is alive, ie. not closed and the update loop ticks
+//	/readyz    200 if the agent has quorum connectivity
+//	/status    height, round, liveness and readiness in json
+//	/metrics   message counters in prometheus text format
+type health struct {
+	agent *agent.TCPAgent
+}
+
+// healthStatus is the json object replied by /status
+type healthStatus struct {
+	Height uint64 `json:"height"`
+	Round  uint64 `json:"round"`
+	Alive  bool   `json:"alive"`
+	Ready  bool   `json:"ready"`
+	Peers  int    `json:"peers"`
+}
+
+// newHealthHandler creates the http handler of health endpoints of an agent
+func newHealthHandler(agent *agent.TCPAgent) http.Handler {
+	h := &health{agent: agent}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/status", h.status)
+	mux.HandleFunc("/metrics", h.metrics)
+	return mux
+}
+
+// serveHealth serves the health endpoints until the listener closes
+func serveHealth(l net.Listener, agent *agent.TCPAgent) error {
+	return http.Serve(l, newHealthHandler(agent))
+}
+
+// probe replies ok, or 503 with the reason
+func probe(w http.ResponseWriter, ok bool, reason string) {
+	if !ok {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	probe(w, h.agent.Alive(), "agent closed or update loop stalled")
+}
+
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	probe(w, h.agent.HasQuorumConnectivity(), "no quorum connectivity")
+}
+
+func (h *health) status(w http.ResponseWriter, r *http.Request) {
+	var s healthStatus
+	s.Height, s.Round, _ = h.agent.GetLatestState()
+	s.Alive = h.agent.Alive()
+	s.Ready = h.agent.HasQuorumConnectivity()
+	s.Peers = len(h.agent.PeerInfo())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func (h *health) metrics(w http.ResponseWriter, r *http.Request) {
+	height, round, _ := h.agent.GetLatestState()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, height, round, len(h.agent.PeerInfo()), h.agent.Metrics())
+}
+
+// writeMetrics writes the gauges and message counters in prometheus text
+// exposition format, the counters are ordered by message type.
+func writeMetrics(w io.Writer, height uint64, round uint64, peers int, metrics bdls.Metrics) {
+	gauge := func(name string, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", name, help, name, name, v)
+	}
+	gauge("bdls_height", "The latest decided height.", height)
+	gauge("bdls_round", "The round of the latest decided height.", round)
+	gauge("bdls_peers", "The number of connected peers.", peers)
+
+	counter := func(name string, help string, counts map[bdls.MessageType]uint64) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", name, help, name)
+		var types []int
+		for t := range counts {
+			types = append(types, int(t))
+		}
+		sort.Ints(types)
+		for _, t := range types {
+			fmt.Fprintf(w, "%v{type=%q} %v\n", name, bdls.MessageType(t).String(), counts[bdls.MessageType(t)])
+		}
+	}
+	counter("bdls_messages_sent_total", "Consensus messages signed and sent.", metrics.Sent)
+	counter("bdls_messages_received_total", "Consensus messages accepted.", metrics.Received)
+
+	// cumulative histogram of messages accepted per decided height
+	name := "bdls_messages_per_height"
+	fmt.Fprintf(w, "# HELP %v Consensus messages accepted per decided height.\n# TYPE %v histogram\n", name, name)
+	var cumulative uint64
+	for k, count := range metrics.MessagesPerHeight {
+		cumulative += count
+		le := "+Inf"
+		if k < len(bdls.MessageHistogramBounds) {
+			le = fmt.Sprint(bdls.MessageHistogramBounds[k])
+		}
+		fmt.Fprintf(w, "%v_bucket{le=%q} %v\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%v_sum %v\n", name, metrics.MessagesPerHeightSum)
+	fmt.Fprintf(w, "%v_count %v\n", name, cumulative)
+}
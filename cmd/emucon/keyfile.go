@@ -0,0 +1,214 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/Sperax/bdls"
+	"github.com/Sperax/bdls/crypto/btcec"
+)
+
+// object identifiers of ECDSA keys on secp256k1
+var (
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidSecp256k1      = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+)
+
+// ecPrivateKey is the SEC 1 (RFC 5915) layout of an EC private key
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+// pkcs8 is the PKCS #8 (RFC 5208) layout of a private key
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// loadKeyFile loads a secp256k1 private key from a PEM or DER file, both
+// SEC 1 "EC PRIVATE KEY" and PKCS #8 "PRIVATE KEY" are accepted.
+func loadKeyFile(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return key, nil
+}
+
+// parseKey parses a PEM or DER encoded private key
+func parseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			return parseECPrivateKey(block.Bytes, nil)
+		case "PRIVATE KEY":
+			return parsePKCS8PrivateKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+	}
+
+	// DER
+	if key, err := parsePKCS8PrivateKey(data); err == nil {
+		return key, nil
+	}
+	return parseECPrivateKey(data, nil)
+}
+
+// parsePKCS8PrivateKey parses a PKCS #8 wrapped EC private key
+func parsePKCS8PrivateKey(der []byte) (*ecdsa.PrivateKey, error) {
+	var privKey pkcs8
+	if rest, err := asn1.Unmarshal(der, &privKey); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after PKCS #8 key")
+	}
+
+	if !privKey.Algo.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil, fmt.Errorf("unsupported key algorithm %v", privKey.Algo.Algorithm)
+	}
+
+	var namedCurveOID asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(privKey.Algo.Parameters.FullBytes, &namedCurveOID); err != nil {
+		return nil, err
+	}
+	return parseECPrivateKey(privKey.PrivateKey, namedCurveOID)
+}
+
+// parseECPrivateKey parses a SEC 1 EC private key, the curve is given by
+// namedCurveOID or by the key itself.
+func parseECPrivateKey(der []byte, namedCurveOID asn1.ObjectIdentifier) (*ecdsa.PrivateKey, error) {
+	var privKey ecPrivateKey
+	if rest, err := asn1.Unmarshal(der, &privKey); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after EC private key")
+	}
+
+	if privKey.Version != 1 {
+		return nil, fmt.Errorf("unsupported EC private key version %v", privKey.Version)
+	}
+
+	if namedCurveOID == nil {
+		namedCurveOID = privKey.NamedCurveOID
+	}
+	if namedCurveOID != nil && !namedCurveOID.Equal(oidSecp256k1) {
+		return nil, fmt.Errorf("unsupported curve %v, expecting %q", namedCurveOID, quorumCurve)
+	}
+
+	d := new(big.Int).SetBytes(privKey.PrivateKey)
+	if d.Sign() <= 0 || d.Cmp(bdls.S256Curve.Params().N) >= 0 {
+		return nil, errors.New("invalid private key")
+	}
+
+	priv := new(ecdsa.PrivateKey)
+	priv.PublicKey.Curve = bdls.S256Curve
+	priv.D = d
+	priv.PublicKey.X, priv.PublicKey.Y = bdls.S256Curve.ScalarBaseMult(privKey.PrivateKey)
+	return priv, nil
+}
+
+// participantIndex returns the index of the participant with the public key
+// in quorum, participants listed by public key only are matched too.
+func (quorum *Quorum) participantIndex(pubkey *ecdsa.PublicKey) (int, error) {
+	participants, err := quorum.participants()
+	if err != nil {
+		return -1, err
+	}
+
+	identity := bdls.DefaultPubKeyToIdentity(pubkey)
+	for k := range participants {
+		if bdls.DefaultPubKeyToIdentity(participants[k]) == identity {
+			return k, nil
+		}
+	}
+	return -1, fmt.Errorf("key %v is not a participant of the quorum", fingerprint(pubkey))
+}
+
+// size returns the number of participants in quorum
+func (quorum *Quorum) size() int {
+	if len(quorum.PubKeys) > len(quorum.Keys) {
+		return len(quorum.PubKeys)
+	}
+	return len(quorum.Keys)
+}
+
+// hasPrivateKey returns true if the private key of the idx-th participant is
+// in quorum
+func (quorum *Quorum) hasPrivateKey(idx int) bool {
+	return idx >= 0 && idx < len(quorum.Keys) && quorum.Keys[idx] != nil
+}
+
+// participants returns the public keys of all participants in quorum, the
+// idx-th participant is derived from keys, or parsed from pubkeys if it has
+// no private key in keys.
+func (quorum *Quorum) participants() ([]*ecdsa.PublicKey, error) {
+	var participants []*ecdsa.PublicKey
+	for i := 0; i < quorum.size(); i++ {
+		if quorum.hasPrivateKey(i) {
+			participants = append(participants, &quorum.privateKey(i).PublicKey)
+			continue
+		}
+
+		if i >= len(quorum.PubKeys) || quorum.PubKeys[i] == "" {
+			return nil, fmt.Errorf("participant %v has neither a private key nor a public key", i)
+		}
+
+		bts, err := hex.DecodeString(quorum.PubKeys[i])
+		if err != nil {
+			return nil, fmt.Errorf("participant %v: %v", i, err)
+		}
+		pubkey, err := btcec.ParsePubKey(bts, btcec.S256())
+		if err != nil {
+			return nil, fmt.Errorf("participant %v: %v", i, err)
+		}
+		participants = append(participants, pubkey.ToECDSA())
+	}
+	return participants, nil
+}
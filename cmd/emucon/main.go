@@ -41,8 +41,11 @@ import (
 	"io"
 	"log"
 	"math/big"
+	mrand "math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/Sperax/bdls"
@@ -51,9 +54,49 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// maximum time to wait for peers to connect before starting consensus
+const startTimeout = 10 * time.Second
+
+// sampling of messages dropped by consensus, and the interval of their summary
+const (
+	dropLogEvery    = 100
+	dropLogInterval = time.Minute
+)
+
+// delays between dial attempts to a peer
+const (
+	dialBackoffBase = 500 * time.Millisecond
+	dialBackoffMax  = 30 * time.Second
+)
+
+// delays between accept retries on temporary errors
+const (
+	acceptBackoffBase = 5 * time.Millisecond
+	acceptBackoffMax  = time.Second
+)
+
+// default file names in a config directory
+const (
+	quorumFile = "quorum.json"
+	peersFile  = "peers.json"
+)
+
+// the layout of quorum.json
+const (
+	// the version written by genkeys, files without a version are version 0
+	quorumVersion = 1
+	// the curve of keys, the only one supported
+	quorumCurve = "secp256k1"
+)
+
 // A quorum set for consenus
 type Quorum struct {
-	Keys []*big.Int `json:"keys"` // pem formatted keys
+	Version   int        `json:"version,omitempty"`   // layout version, 0 for legacy files
+	Curve     string     `json:"curve,omitempty"`     // curve of keys, secp256k1 if empty
+	Keys      []*big.Int `json:"keys"`                // pem formatted keys
+	PubKeys   []string   `json:"pubkeys,omitempty"`   // hex encoded SEC 1 public keys of participants without a private key in keys
+	Peers     []string   `json:"peers,omitempty"`     // optional peers list in a merged config
+	Addresses []string   `json:"addresses,omitempty"` // optional address of the participant with the same index in keys
 }
 
 func main() {
@@ -76,33 +119,94 @@ func main() {
 						Value: "./quorum.json",
 						Usage: "output quorum file",
 					},
+					&cli.Int64Flag{
+						Name:  "seed",
+						Usage: "derive keys from a deterministic stream seeded by this value, FOR TESTING ONLY",
+					},
 				},
 				Action: func(c *cli.Context) error {
-					count := c.Int("count")
-					quorum := &Quorum{}
-					// generate private keys
-					for i := 0; i < count; i++ {
-						privateKey, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
-						if err != nil {
-							return err
-						}
+					var entropy io.Reader = rand.Reader
+					if c.IsSet("seed") {
+						log.Println("WARNING: keys derived from --seed are predictable, use them for testing only")
+						entropy = mrand.New(mrand.NewSource(c.Int64("seed")))
+					}
 
-						quorum.Keys = append(quorum.Keys, privateKey.D)
+					quorum, err := genQuorum(c.Int("count"), entropy)
+					if err != nil {
+						return err
+					}
+
+					if err := saveJSON(c.String("config"), quorum); err != nil {
+						return err
 					}
 
-					file, err := os.Create(c.String("config"))
+					log.Println("generate", c.Int("count"), "keys")
+					return nil
+				},
+			},
+			{
+				Name:  "rotate-key",
+				Usage: "generate a new key for a participant and write a new quorum",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Value: "./quorum.json",
+						Usage: "the shared quorum config file",
+					},
+					&cli.IntFlag{
+						Name:  "id",
+						Value: 0,
+						Usage: "the node id to rotate key",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Value: "./new-quorum.json",
+						Usage: "output quorum file with the rotated key",
+					},
+					&cli.StringFlag{
+						Name:  "key",
+						Value: "./new-key.json",
+						Usage: "output file of the new private key",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					quorum, err := loadQuorum(c.String("config"))
 					if err != nil {
 						return err
 					}
-					enc := json.NewEncoder(file)
-					enc.SetIndent("", "\t")
-					err = enc.Encode(quorum)
+
+					id := c.Int("id")
+					if !quorum.hasPrivateKey(id) {
+						return errors.New(fmt.Sprint("cannot locate private key for id:", id))
+					}
+
+					if quorum.size() < bdls.ConfigMinimumParticipants {
+						return errors.New(fmt.Sprint("quorum must contain at least ", bdls.ConfigMinimumParticipants, " participants"))
+					}
+
+					oldKey := quorum.privateKey(id)
+					newKey, err := ecdsa.GenerateKey(bdls.S256Curve, rand.Reader)
 					if err != nil {
 						return err
 					}
-					file.Close()
 
-					log.Println("generate", c.Int("count"), "keys")
+					// refuse to create duplicated participants
+					if _, err := quorum.participantIndex(&newKey.PublicKey); err == nil {
+						return errors.New("duplicated key generated")
+					}
+					quorum.Keys[id] = newKey.D
+
+					if err := saveJSON(c.String("out"), quorum); err != nil {
+						return err
+					}
+
+					if err := saveJSON(c.String("key"), &Quorum{Keys: []*big.Int{newKey.D}}); err != nil {
+						return err
+					}
+
+					log.Println("rotated key for id:", id)
+					log.Println("old fingerprint:", fingerprint(&oldKey.PublicKey))
+					log.Println("new fingerprint:", fingerprint(&newKey.PublicKey))
 					return nil
 				},
 			},
@@ -123,56 +227,115 @@ func main() {
 					&cli.StringFlag{
 						Name:  "config",
 						Value: "./quorum.json",
-						Usage: "the shared quorum config file",
+						Usage: "the shared quorum config file, a merged file with peers, or a directory containing quorum.json and peers.json",
 					},
 					&cli.StringFlag{
 						Name:  "peers",
 						Value: "./peers.json",
-						Usage: "all peers's ip:port list to connect, as a json array",
+						Usage: "all peers's ip:port list to connect, as a json array, ignored if --config contains peers",
+					},
+					&cli.IntFlag{
+						Name:  "dial-attempts",
+						Value: 0,
+						Usage: "give up connecting to a peer after this many failed dials, 0 to retry forever",
+					},
+					&cli.StringFlag{
+						Name:  "peers-srv",
+						Usage: "resolve peers from the DNS SRV record of this name, overrides --peers and the addresses in --config",
+					},
+					&cli.DurationFlag{
+						Name:  "peers-srv-interval",
+						Value: srvRefreshInterval,
+						Usage: "re-resolve --peers-srv at this interval, new peers will be connected",
+					},
+					&cli.BoolFlag{
+						Name:  "commit-unicast",
+						Value: false,
+						Usage: "send <commit> messages to the round leader only, instead of broadcasting",
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "load the private key from a PEM or DER file instead of quorum.json, the node id is located by the key",
+					},
+					&cli.StringFlag{
+						Name:  "admin-addr",
+						Usage: "serve the admin socket on this unix socket path or tcp address, commands: status, peers, decisions N, drain, undrain",
+					},
+					&cli.StringFlag{
+						Name:  "http",
+						Usage: "serve /healthz, /readyz, /status and prometheus /metrics on this http address",
+					},
+					&cli.StringFlag{
+						Name:  "grpc-addr",
+						Usage: "serve the agent gRPC service on this tcp address, requires emucon built with -tags grpc",
 					},
 				},
 				Action: func(c *cli.Context) error {
 					// open quorum config
-					file, err := os.Open(c.String("config"))
+					quorum, peers, err := loadConfig(c.String("config"), c.String("peers"))
 					if err != nil {
 						return err
 					}
-					defer file.Close()
 
-					quorum := new(Quorum)
-					err = json.NewDecoder(file).Decode(quorum)
-					if err != nil {
-						return err
+					id := c.Int("id")
+					var privateKey *ecdsa.PrivateKey
+					if path := c.String("keyfile"); path != "" {
+						privateKey, err = loadKeyFile(path)
+						if err != nil {
+							return err
+						}
+
+						// the key must be one of the participants
+						id, err = quorum.participantIndex(&privateKey.PublicKey)
+						if err != nil {
+							return err
+						}
 					}
 
-					id := c.Int("id")
-					if id >= len(quorum.Keys) {
+					if privateKey == nil && !quorum.hasPrivateKey(id) {
 						return errors.New(fmt.Sprint("cannot locate private key for id:", id))
 					}
 					log.Println("identity:", id)
 
+					// addresses of participants, myself excluded
+					if len(quorum.Addresses) > 0 {
+						peers = quorum.peerAddresses(id)
+					}
+
+					if name := c.String("peers-srv"); name != "" {
+						peers, err = lookupPeersSRV(net.DefaultResolver, name, c.String("listen"))
+						if err != nil {
+							return err
+						}
+						log.Println("peers resolved from", name, ":", peers)
+					}
+
 					// create configuration
 					config := new(bdls.Config)
 					config.Epoch = time.Now()
 					config.CurrentHeight = 0
 					config.StateCompare = func(a bdls.State, b bdls.State) int { return bytes.Compare(a, b) }
 					config.StateValidate = func(bdls.State) bool { return true }
+					config.EnableCommitUnicast = c.Bool("commit-unicast")
 
-					for k := range quorum.Keys {
-						priv := new(ecdsa.PrivateKey)
-						priv.PublicKey.Curve = bdls.S256Curve
-						priv.D = quorum.Keys[k]
-						priv.PublicKey.X, priv.PublicKey.Y = bdls.S256Curve.ScalarBaseMult(priv.D.Bytes())
+					participants, err := quorum.participants()
+					if err != nil {
+						return err
+					}
+					for k := range participants {
 						// myself
 						if id == k {
-							config.PrivateKey = priv
+							config.PrivateKey = privateKey
+							if privateKey == nil {
+								config.PrivateKey = quorum.privateKey(k)
+							}
 						}
 
 						// set validator sequence
-						config.Participants = append(config.Participants, bdls.DefaultPubKeyToIdentity(&priv.PublicKey))
+						config.Participants = append(config.Participants, bdls.DefaultPubKeyToIdentity(participants[k]))
 					}
 
-					if err := startConsensus(c, config); err != nil {
+					if err := startConsensus(c, config, peers); err != nil {
 						return err
 					}
 					return nil
@@ -193,27 +356,213 @@ func main() {
 
 }
 
-// consensus for one round with full procedure
-func startConsensus(c *cli.Context, config *bdls.Config) error {
-	// create consensus
-	consensus, err := bdls.NewConsensus(config)
+// privateKey returns the idx-th private key in quorum
+func (quorum *Quorum) privateKey(idx int) *ecdsa.PrivateKey {
+	priv := new(ecdsa.PrivateKey)
+	priv.PublicKey.Curve = bdls.S256Curve
+	priv.D = quorum.Keys[idx]
+	priv.PublicKey.X, priv.PublicKey.Y = bdls.S256Curve.ScalarBaseMult(priv.D.Bytes())
+	return priv
+}
+
+// verifyAddresses checks every address maps to a participant without
+// duplication, and warns about participants without an address.
+func (quorum *Quorum) verifyAddresses() error {
+	if len(quorum.Addresses) > quorum.size() {
+		return fmt.Errorf("address %q has no participant in keys", quorum.Addresses[quorum.size()])
+	}
+
+	participants, err := quorum.participants()
 	if err != nil {
 		return err
 	}
-	consensus.SetLatency(200 * time.Millisecond)
 
-	// load endpoints
-	file, err := os.Open(c.String("peers"))
+	seen := make(map[string]int)
+	for i := range participants {
+		if i >= len(quorum.Addresses) || quorum.Addresses[i] == "" {
+			log.Printf("WARNING: participant %v[%v] has no address", i, fingerprint(participants[i]))
+			continue
+		}
+
+		addr := quorum.Addresses[i]
+		if j, ok := seen[addr]; ok {
+			return fmt.Errorf("address %q is shared by participant %v and %v", addr, j, i)
+		}
+		seen[addr] = i
+	}
+	return nil
+}
+
+// peerAddresses returns the addresses of participants except self
+func (quorum *Quorum) peerAddresses(self int) []string {
+	var peers []string
+	for i, addr := range quorum.Addresses {
+		if i != self && addr != "" {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// loadQuorum loads quorum from a json file
+func loadQuorum(path string) (*Quorum, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer file.Close()
+
+	quorum := new(Quorum)
+	err = json.NewDecoder(file).Decode(quorum)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := quorum.verifyLayout(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	if _, err := quorum.participants(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return quorum, nil
+}
+
+// verifyLayout checks the version and curve of a loaded quorum, both legacy
+// files without version, and versioned files are accepted.
+func (quorum *Quorum) verifyLayout() error {
+	if quorum.Version < 0 || quorum.Version > quorumVersion {
+		return fmt.Errorf("unsupported quorum version %v, expecting %v or below", quorum.Version, quorumVersion)
+	}
+
+	if quorum.Curve != "" && quorum.Curve != quorumCurve {
+		return fmt.Errorf("unsupported curve %q, expecting %q", quorum.Curve, quorumCurve)
+	}
+	return nil
+}
+
+// loadConfig loads the quorum and peers for run command, path can be:
+//  1. a directory containing quorum.json and peers.json, or a merged quorum.json.
+//  2. a merged file containing both "keys" and "peers", or "keys" with "addresses".
+//  3. a quorum file, the peers will be loaded from peersPath.
+func loadConfig(path string, peersPath string) (*Quorum, []string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info.IsDir() {
+		path = filepath.Join(path, quorumFile)
+		peersPath = filepath.Join(filepath.Dir(path), peersFile)
+	}
+
+	quorum, err := loadQuorum(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// participants' addresses
+	if len(quorum.Addresses) > 0 {
+		if err := quorum.verifyAddresses(); err != nil {
+			return nil, nil, err
+		}
+		return quorum, quorum.peerAddresses(-1), nil
+	}
+
+	// merged config
+	if len(quorum.Peers) > 0 {
+		return quorum, quorum.Peers, nil
+	}
+
+	peers, err := loadPeers(peersPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return quorum, peers, nil
+}
+
+// loadPeers loads peers' addresses from a json array file
+func loadPeers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
 	defer file.Close()
 
 	var peers []string
 	err = json.NewDecoder(file).Decode(&peers)
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// genQuorum generates a quorum of count private keys from entropy, keys
+// generated from the same stream are identical.
+func genQuorum(count int, entropy io.Reader) (*Quorum, error) {
+	quorum := &Quorum{Version: quorumVersion, Curve: quorumCurve}
+	for i := 0; i < count; i++ {
+		privateKey, err := bdls.GenerateKey(bdls.S256Curve, entropy)
+		if err != nil {
+			return nil, err
+		}
+
+		quorum.Keys = append(quorum.Keys, privateKey.D)
+	}
+	return quorum, nil
+}
+
+// saveJSON writes v as indented json to a file
+func saveJSON(path string, v interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// fingerprint returns the first 8 bytes of the hashed identity of a public key in hex
+func fingerprint(pubkey *ecdsa.PublicKey) string {
+	identity := bdls.DefaultPubKeyToIdentity(pubkey)
+	h := blake2b.Sum256(identity[:])
+	return hex.EncodeToString(h[:8])
+}
+
+// acceptLoop accepts connections until the listener closes, it backs off and
+// retries on temporary errors
+func acceptLoop(l net.Listener, handle func(net.Conn)) {
+	b := backoff{base: acceptBackoffBase, max: acceptBackoffMax}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// retry on temporary errors like running out of file descriptors,
+			// other errors mean the listener has closed.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay := b.next()
+				log.Println("accept:", err, "retry in", delay)
+				<-time.After(delay)
+				continue
+			}
+			log.Println("accept:", err)
+			return
+		}
+		b.reset()
+		handle(conn)
+	}
+}
+
+// consensus for one round with full procedure
+func startConsensus(c *cli.Context, config *bdls.Config, peers []string) error {
+	// create consensus
+	consensus, err := bdls.NewConsensus(config)
 	if err != nil {
 		return err
 	}
+	consensus.SetLatency(200 * time.Millisecond)
 
 	// start listener
 	tcpaddr, err := net.ResolveTCPAddr("tcp", c.String("listen"))
@@ -228,63 +577,137 @@ func startConsensus(c *cli.Context, config *bdls.Config) error {
 	defer l.Close()
 	log.Println("listening on:", c.String("listen"))
 
-	// initiate tcp agent
-	tagent := agent.NewTCPAgent(consensus, config.PrivateKey)
-	if err != nil {
-		return err
+	// initiate a sealed tcp agent, it starts after peers connected
+	tagent := agent.NewSealedTCPAgent(consensus, config.PrivateKey)
+	tagent.SetDropLog(dropLogEvery, dropLogInterval, nil)
+
+	// optional admin socket
+	adm := newAdmin(tagent)
+	if addr := c.String("admin-addr"); addr != "" {
+		al, err := listenAdmin(addr)
+		if err != nil {
+			return err
+		}
+		defer al.Close()
+		log.Println("admin listening on:", addr)
+		go adm.serve(al)
+	}
+
+	// optional health and metrics endpoints
+	if addr := c.String("http"); addr != "" {
+		hl, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer hl.Close()
+		log.Println("http listening on:", addr)
+		go func() { log.Println("http:", serveHealth(hl, tagent)) }()
 	}
 
-	// start updater
-	tagent.Update()
+	// optional grpc service
+	if addr := c.String("grpc-addr"); addr != "" {
+		if !grpcEnabled {
+			return errors.New("--grpc-addr requires emucon built with -tags grpc")
+		}
+		gl, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer gl.Close()
+		log.Println("grpc listening on:", addr)
+		go func() { log.Println("grpc:", serveGRPC(gl, tagent)) }()
+	}
 
 	// passive connection from peers
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				return
-			}
-			log.Println("peer connected from:", conn.RemoteAddr())
-			// peer endpoint created
-			p := agent.NewTCPPeer(conn, tagent)
-			tagent.AddPeer(p)
-			// prove my identity to this peer
-			p.InitiatePublicKeyAuthentication()
+	go acceptLoop(l, func(conn net.Conn) {
+		log.Println("peer connected from:", conn.RemoteAddr())
+		// peer endpoint created
+		p := agent.NewTCPPeer(conn, tagent)
+		if !tagent.AddPeer(p) {
+			log.Println("failed to add peer:", conn.RemoteAddr())
+			p.Close()
+			return
 		}
-	}()
+		// prove my identity to this peer
+		p.InitiatePublicKeyAuthentication()
+	})
 
 	// active connections to peers
-	for k := range peers {
-		go func(raddr string) {
-			for {
-				conn, err := net.Dial("tcp", raddr)
-				if err == nil {
-					log.Println("connected to peer:", conn.RemoteAddr())
-					// peer endpoint created
-					p := agent.NewTCPPeer(conn, tagent)
-					tagent.AddPeer(p)
-					// prove my identity to this peer
-					p.InitiatePublicKeyAuthentication()
+	dial := func(raddr string, done func()) {
+		defer done()
+		b := backoff{base: dialBackoffBase, max: dialBackoffMax}
+		for attempt := 1; ; attempt++ {
+			conn, err := net.Dial("tcp", raddr)
+			if err == nil {
+				log.Println("connected to peer:", conn.RemoteAddr())
+				// peer endpoint created
+				p := agent.NewTCPPeer(conn, tagent)
+				if !tagent.AddPeer(p) {
+					log.Println("failed to add peer:", conn.RemoteAddr())
+					p.Close()
 					return
 				}
-				<-time.After(time.Second)
+				// prove my identity to this peer
+				p.InitiatePublicKeyAuthentication()
+				return
+			}
+
+			if maxAttempts := c.Int("dial-attempts"); maxAttempts > 0 && attempt >= maxAttempts {
+				log.Printf("GIVING UP on peer %v after %v attempts: %v", raddr, attempt, err)
+				return
 			}
-		}(peers[k])
+			delay := b.next()
+			log.Printf("dial %v failed(attempt %v): %v, retry in %v", raddr, attempt, err, delay)
+			<-time.After(delay)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for k := range peers {
+		go dial(peers[k], wg.Done)
+	}
+
+	// connect to peers discovered later
+	if name := c.String("peers-srv"); name != "" {
+		die := make(chan struct{})
+		defer close(die)
+		go watchPeersSRV(net.DefaultResolver, name, c.String("listen"), c.Duration("peers-srv-interval"), peers, func(raddr string) {
+			go dial(raddr, func() {})
+		}, die)
 	}
 
+	// start the agent after all peers connected, or timeout
+	connected := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(connected)
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(startTimeout):
+		log.Println("not all peers connected, starting anyway")
+	}
+	tagent.Start()
+
 	lastHeight := uint64(0)
 
 NEXTHEIGHT:
 	for {
-		data := make([]byte, 1024)
-		io.ReadFull(rand.Reader, data)
-		tagent.Propose(data)
+		// a draining node votes without proposing
+		if !adm.isDraining() {
+			data := make([]byte, 1024)
+			io.ReadFull(rand.Reader, data)
+			tagent.Propose(data)
+		}
 
 		for {
 			newHeight, newRound, newState := tagent.GetLatestState()
 			if newHeight > lastHeight {
 				h := blake2b.Sum256(newState)
 				log.Printf("<decide> at height:%v round:%v hash:%v", newHeight, newRound, hex.EncodeToString(h[:]))
+				adm.record(newHeight, newRound, newState, time.Now())
 				lastHeight = newHeight
 				continue NEXTHEIGHT
 			}
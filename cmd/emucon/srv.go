@@ -0,0 +1,177 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	srvLookupTimeout   = 10 * time.Second
+	srvRefreshInterval = time.Minute
+)
+
+// srvResolver looks up SRV records and hosts, it's implemented by *net.Resolver
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// lookupPeersSRV resolves the SRV record to a sorted list of host:port,
+// the address of myself, ie. resolved to the listening address self, is
+// excluded.
+func lookupPeersSRV(r srvResolver, name string, self string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	_, records, err := r.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	local := localAddrs(ctx, r, self)
+	seen := make(map[string]bool)
+	var peers []string
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		addr := net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		if seen[addr] || isSelf(ctx, r, host, int(srv.Port), self, local) {
+			continue
+		}
+		seen[addr] = true
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+// localAddrs returns the IPs the listening address self accepts connections
+// on, all local interface addresses if the host is empty or unspecified.
+func localAddrs(ctx context.Context, r srvResolver, self string) []net.IP {
+	host, _, err := net.SplitHostPort(self)
+	if err != nil {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil
+		}
+		return parseIPs(addrs)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// isSelf returns true if host:port is the listening address self, ie. the
+// port matches and host resolves to any of the local IPs.
+func isSelf(ctx context.Context, r srvResolver, host string, port int, self string, local []net.IP) bool {
+	selfHost, selfPort, err := net.SplitHostPort(self)
+	if err != nil || selfPort != strconv.Itoa(port) {
+		return false
+	}
+	if host == selfHost {
+		return true
+	}
+
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range parseIPs(addrs) {
+		for _, l := range local {
+			if ip.Equal(l) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseIPs parses the IP addresses, invalid ones are skipped
+func parseIPs(addrs []string) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// watchPeersSRV re-resolves the SRV record every interval, and calls dial for
+// the addresses not seen before, until die is closed. Peers disappeared from
+// the record are not disconnected.
+func watchPeersSRV(r srvResolver, name string, self string, interval time.Duration, known []string, dial func(addr string), die <-chan struct{}) {
+	seen := make(map[string]bool)
+	for _, addr := range known {
+		seen[addr] = true
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			peers, err := lookupPeersSRV(r, name, self)
+			if err != nil {
+				log.Printf("resolve %v: %v", name, err)
+				continue
+			}
+
+			for _, addr := range peers {
+				if !seen[addr] {
+					seen[addr] = true
+					log.Println("discovered peer:", addr)
+					dial(addr)
+				}
+			}
+		case <-die:
+			return
+		}
+	}
+}
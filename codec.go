@@ -0,0 +1,65 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import "bytes"
+
+// StateCodec converts between application defined values and States, it
+// allows applications to propose and confirm their own structures instead
+// of hand-marshalled bytes.
+type StateCodec interface {
+	// Encode marshals the value into a state
+	Encode(v interface{}) (State, error)
+	// Decode unmarshals the state into a value
+	Decode(s State) (interface{}, error)
+}
+
+// SetCodec sets StateCompare and StateValidate of the config to operate on
+// values decoded by the codec. States which cannot be decoded are invalid,
+// and they are compared in bytes.
+func (c *Config) SetCodec(codec StateCodec, compare func(a interface{}, b interface{}) int, validate func(v interface{}) bool) {
+	c.StateCompare = func(a State, b State) int {
+		va, erra := codec.Decode(a)
+		vb, errb := codec.Decode(b)
+		if erra != nil || errb != nil {
+			return bytes.Compare(a, b)
+		}
+		return compare(va, vb)
+	}
+
+	c.StateValidate = func(s State) bool {
+		v, err := codec.Decode(s)
+		if err != nil {
+			return false
+		}
+		return validate(v)
+	}
+}
@@ -0,0 +1,54 @@
+package bdls
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testBlock is a small structure to be encoded as state
+type testBlock struct {
+	Number  uint64
+	Payload string
+}
+
+// jsonCodec encodes testBlock in json
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) (State, error) { return json.Marshal(v) }
+func (jsonCodec) Decode(s State) (interface{}, error) {
+	var b testBlock
+	err := json.Unmarshal(s, &b)
+	return b, err
+}
+
+func TestConfigSetCodec(t *testing.T) {
+	config := new(Config)
+	config.SetCodec(jsonCodec{},
+		func(a interface{}, b interface{}) int {
+			na, nb := a.(testBlock).Number, b.(testBlock).Number
+			switch {
+			case na < nb:
+				return -1
+			case na > nb:
+				return 1
+			}
+			return 0
+		},
+		func(v interface{}) bool { return v.(testBlock).Payload != "" })
+
+	// compared by decoded Number, not by bytes
+	s9, err := jsonCodec{}.Encode(testBlock{Number: 9, Payload: "a"})
+	assert.Nil(t, err)
+	s10, err := jsonCodec{}.Encode(testBlock{Number: 10, Payload: "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, -1, config.StateCompare(s9, s10))
+	assert.Equal(t, 1, config.StateCompare(s10, s9))
+
+	assert.True(t, config.StateValidate(s9))
+	empty, err := jsonCodec{}.Encode(testBlock{Number: 1})
+	assert.Nil(t, err)
+	assert.False(t, config.StateValidate(empty))
+	assert.False(t, config.StateValidate(State("not json")))
+}
@@ -0,0 +1,86 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import "time"
+
+// pendingCommit is a unicast <commit> waiting for <commit-ack> from the leader
+type pendingCommit struct {
+	out    []byte   // the signed <commit>
+	leader Identity // the leader it's sent to
+	height uint64
+	round  uint64
+	left   int       // retransmissions left
+	sentAt time.Time // time of the first transmission
+	next   time.Time // time of the next retransmission
+}
+
+// ackCommit acknowledges a <commit> received by the leader with <commit-ack>
+// to the signer, if retransmission is enabled.
+func (c *Consensus) ackCommit(mCommit *Message, signed *SignedProto) {
+	if c.commitRetransmits <= 0 {
+		return
+	}
+
+	signer := c.pubKeyToIdentity(signed.PublicKey(c.curve))
+	if signer == c.identity {
+		return
+	}
+
+	var m Message
+	m.Type = MessageType_CommitAck
+	m.Height = mCommit.Height
+	m.Round = mCommit.Round
+	c.sendTo(&m, signer)
+}
+
+// retransmitCommit retransmits the unacknowledged <commit> to the leader
+// every 2*latency, until the retransmissions are used up or the round
+// has moved on.
+func (c *Consensus) retransmitCommit(now time.Time) {
+	p := c.pendingCommit
+	if p == nil {
+		return
+	}
+
+	if p.left <= 0 || p.height != c.latestHeight+1 || p.round != c.currentRound.RoundNumber {
+		c.pendingCommit = nil
+		return
+	}
+
+	if now.Before(p.next) {
+		return
+	}
+
+	c.transmit(p.out, p.leader)
+	p.left--
+	p.next = now.Add(2 * c.latency)
+}
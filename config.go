@@ -32,20 +32,37 @@ package bdls
 
 import (
 	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"time"
+
+	"github.com/Sperax/bdls/crypto/blake2b"
 )
 
 const (
 	// ConfigMinimumParticipants is the minimum number of participant allow in consensus protocol
 	ConfigMinimumParticipants = 4
+	// DefaultEpochTolerance is the default maximum duration the epoch can be ahead of now
+	DefaultEpochTolerance = 24 * time.Hour
 )
 
 // Config is to config the parameters of BDLS consensus protocol
 type Config struct {
 	// the starting time point for consensus
 	Epoch time.Time
+	// EpochTolerance is the maximum duration the Epoch can be ahead of the
+	// time of VerifyConfig, past epochs are always valid.
+	// (optional). Default to DefaultEpochTolerance.
+	EpochTolerance time.Duration
 	// CurrentHeight
 	CurrentHeight uint64
+	// View is the configuration generation of Participants, messages are
+	// bound to it, it increments on every change by ChangeParticipants, so
+	// nodes restarted after changes must restore it from Consensus.View().
+	// (optional). Default to 0.
+	View uint64
 	// PrivateKey
 	PrivateKey *ecdsa.PrivateKey
 	// Consensus Group
@@ -53,6 +70,20 @@ type Config struct {
 	// EnableCommitUnicast sets to true to enable <commit> message to be delivered via unicast
 	// if not(by default), <commit> message will be broadcasted
 	EnableCommitUnicast bool
+	// CommitRetransmits is the maximum times a unicast <commit> is retransmitted
+	// to the leader until it's acknowledged, the leader acknowledges <commit>
+	// messages with <commit-ack> if set. Retransmissions are 2*latency apart.
+	// It requires EnableCommitUnicast, default to 0 as disabled.
+	CommitRetransmits int
+
+	// EnableQuorumReadiness sets to true to suppress <roundchange> messages and
+	// round switching while connected participants(including myself) are less
+	// than 2t+1, a partitioned minority cannot reach a decision anyway.
+	EnableQuorumReadiness bool
+
+	// OnReadyChange will be called if not nil when the readiness changes, with
+	// the number of connected participants including myself.
+	OnReadyChange func(ready bool, connected int)
 
 	// StateCompare is a function from user to compare states,
 	// The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
@@ -60,19 +91,156 @@ type Config struct {
 	// users should check fields in block header to make comparison.
 	StateCompare func(a State, b State) int
 
+	// StateCompareBudget is the soft time budget of a StateCompare call, a
+	// call exceeding it is abandoned, so a pathological comparison can't
+	// stall consensus. A <select> message whose maximality can't be checked
+	// in budget is rejected, and the leader keeps its current choice of
+	// state. StateCompare should be O(small) regardless, as the abandoned
+	// call keeps running in its own goroutine, and comparisons fail fast
+	// while a few abandoned calls are still running.
+	// (optional). Default to 0, StateCompare is called inline.
+	StateCompareBudget time.Duration
+
+	// OnStateCompareTimeout will be called if not nil when a StateCompare
+	// call has exceeded StateCompareBudget.
+	OnStateCompareTimeout func(a State, b State)
+
 	// StateValidate is a function from user to validate the integrity of
 	// state data.
 	StateValidate func(State) bool
 
+	// OnInvalidState will be called if not nil when a state from a participant
+	// has been rejected by StateValidate, the identity is the signer of the message
+	// carrying the state, users can count the rejections to penalize participants.
+	OnInvalidState func(from Identity, state State)
+
+	// ProposalPolicy is an application policy on valid states, it's called
+	// before voting <commit> for the state locked by the leader(proposer) of
+	// a round, returning false abstains from voting for it in the round,
+	// and the state is neither locked nor re-proposed in later rounds.
+	// A state abstained by more than t participants can't be decided in
+	// the round, and the rounds time out until a leader locks an acceptable
+	// state, so the chain stalls if the policies reject every state. Nil
+	// accepts all states.
+	ProposalPolicy func(height uint64, proposer Identity, s State) bool
+
+	// OnProposalExpired will be called if not nil when a state proposed by
+	// Consensus.ProposeWithDeadline is abandoned at the deadline.
+	OnProposalExpired func(s State)
+
+	// StateDiff encodes next as a diff against prev, the latest decided state,
+	// to broadcast proposals in <roundchange> messages with less bandwidth.
+	// StateApply must reconstruct next from prev and the diff, diffs are
+	// verified against the StateHash of the proposal. StateDiff returns nil to
+	// broadcast the full state. Diffs are only used in round 0, a participant
+	// a height behind applies the diff once it decides that height, and the
+	// full state is broadcasted in later rounds. Both must be set or unset.
+	// (optional). Default to nil, full states are broadcasted.
+	StateDiff  func(prev, next State) []byte
+	StateApply func(prev State, diff []byte) (State, error)
+
+	// OnProtocolVersionMismatch will be called if not nil when ReceiveMessage
+	// gets a message of another ProtocolVersion, ie. from a peer not upgraded
+	// yet. The message has not been verified, the signer may be forged.
+	OnProtocolVersionMismatch func(version uint32, signed *SignedProto)
+
 	// MessageValidator is an external validator to be called when a message inputs into ReceiveMessage
 	MessageValidator func(c *Consensus, m *Message, signed *SignedProto) bool
 
 	// MessageOutCallback will be called if not nil before a message send out
 	MessageOutCallback func(m *Message, signed *SignedProto)
 
+	// OnClockBackward will be called if not nil when the time passed to Update
+	// or ReceiveMessage is earlier than the latest one, the backward time will
+	// be clamped to the latest time.
+	OnClockBackward func(last time.Time, now time.Time)
+
+	// MaxTimeStep limits how far the time passed to Update or ReceiveMessage
+	// can advance from the latest one in a call, a larger forward jump(like
+	// a process resumed from suspension) is clamped, and the time catches up
+	// by at most MaxTimeStep per call. It keeps a suspension from expiring
+	// all timeouts and proposal deadlines at once, and should be larger than
+	// the interval of Update calls. Default to 0 as unlimited.
+	MaxTimeStep time.Duration
+
+	// MaxClockSkew is the tolerated skew between local time and the timing
+	// implied by a received message. Messages carry no timestamps, a message
+	// of round r implies its signer has spent at least the round change
+	// timeouts of rounds 0..r-1 on the height, messages implying more than
+	// the local elapsed time plus MaxClockSkew are rejected with ErrClockSkew.
+	// Messages proven by a quorum, like <decide>, are not checked.
+	// (optional). Default to 0, no skew check.
+	MaxClockSkew time.Duration
+
+	// OnClockSkew will be called if not nil when a message is rejected with
+	// ErrClockSkew, skew is how far the implied timing is ahead of local time.
+	OnClockSkew func(from Identity, m *Message, skew time.Duration)
+
 	// Identity derviation from ecdsa.PublicKey
 	// (optional). Default to DefaultPubKeyToIdentity
 	PubKeyToIdentity func(pubkey *ecdsa.PublicKey) (ret Identity)
+
+	// HashFunc computes the hash to identify a state, the output must have
+	// the same size as StateHash(32 bytes), the hash for message signing
+	// is not affected.
+	// (optional). Default to blake2b-256.
+	HashFunc func(data []byte) []byte
+
+	// AggregateScheme signs <commit> messages additionally, the signature is
+	// carried in SignedProto.AuxData, and CommitCertificate aggregates them
+	// if the scheme can. All participants must use the same scheme.
+	// (optional). Default to nil, commits are signed by ECDSA only.
+	AggregateScheme AggregateScheme
+
+	// QuorumFunc decides whether <commit> messages on the same state from the
+	// distinct signers make a decision, for exotic rules like geographic
+	// diversity. Only decisions are affected, <lock> and <select> still need
+	// 2t+1 participants. For safety, any two signer sets accepted must share
+	// an honest participant, and all participants must use the same rule.
+	// (optional). Default to nil, at least 2t+1 signers make a decision.
+	QuorumFunc func(signers []Identity) bool
+
+	// MaxStateSize limits the size of a single state in bytes, oversized states
+	// will be rejected in Propose, and in incoming messages before verification.
+	// (optional). Default to 0, which means no limit.
+	MaxStateSize int
+
+	// VerifyConcurrency is the number of goroutines verifying the signatures
+	// of a batch in Consensus.ReceiveMessages and Consensus.Preverify, set to
+	// 1 to verify in the calling goroutine only, the results are the same
+	// regardless.
+	// (optional). Default to runtime.NumCPU().
+	VerifyConcurrency int
+
+	// EmptyProposalAfter is the duration after a height opens, when EmptyState
+	// will be proposed automatically if no state has been proposed, so heights
+	// keep advancing without proposals from application.
+	// (optional). Default to 0, which never proposes automatically.
+	EmptyProposalAfter time.Duration
+	// EmptyState is the state to propose by EmptyProposalAfter, it must not
+	// be empty, and it must pass StateValidate.
+	EmptyState State
+
+	// StrictInvariants checks safety invariants on every decision, for
+	// development builds: no conflicting decisions at the same height among
+	// recent decisions, monotonic height, and the decide proof verifies
+	// against the participants. It's costly, and off by default.
+	StrictInvariants bool
+
+	// JustificationArchive is the number of recent heights whose
+	// justifications, the <commit> messages of the <decide> proof, are
+	// retained for Consensus.Justification. Default to 0 as disabled.
+	JustificationArchive int
+
+	// OnInvariantViolation is called on a broken invariant with the context,
+	// it's expected to be fatal, the consensus panics if it's not set.
+	OnInvariantViolation func(v *InvariantViolation)
+
+	// Rand is the entropy source for message signing, signatures are fully
+	// determined by its stream. FOR TESTING ONLY, to produce reproducible
+	// fixtures, a predictable source leaks the private key.
+	// (optional). Default to nil, which uses crypto/rand.
+	Rand io.Reader
 }
 
 // VerifyConfig verifies the integrity of this config when creating new consensus object
@@ -81,6 +249,14 @@ func VerifyConfig(c *Config) error {
 		return ErrConfigEpoch
 	}
 
+	tolerance := c.EpochTolerance
+	if tolerance <= 0 {
+		tolerance = DefaultEpochTolerance
+	}
+	if c.Epoch.After(time.Now().Add(tolerance)) {
+		return ErrConfigEpochFuture
+	}
+
 	if c.StateCompare == nil {
 		return ErrConfigStateCompare
 	}
@@ -97,5 +273,143 @@ func VerifyConfig(c *Config) error {
 		return ErrConfigParticipants
 	}
 
+	if c.HashFunc != nil && len(c.HashFunc(nil)) != len(StateHash{}) {
+		return ErrConfigHashFunc
+	}
+
+	if (c.StateDiff == nil) != (c.StateApply == nil) {
+		return ErrConfigStateDiff
+	}
+
+	if c.EmptyProposalAfter > 0 && len(c.EmptyState) == 0 {
+		return ErrConfigEmptyState
+	}
+
+	// participants' public keys can only be validated with the default
+	// identity derivation, which keeps the X & Y axis in identity.
+	if c.PubKeyToIdentity == nil {
+		if err := verifyParticipantKeys(c); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// ParticipantKeyError records the index of an invalid participant in Config.Participants
+type ParticipantKeyError struct {
+	Index int
+	Err   error
+}
+
+func (e *ParticipantKeyError) Error() string {
+	return fmt.Sprintf("Config.Participants[%d]: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ParticipantKeyError) Unwrap() error { return e.Err }
+
+// verifyParticipantKeys checks each participant is a distinct point on the curve
+func verifyParticipantKeys(c *Config) error {
+	curve := c.PrivateKey.Curve
+	if curve == nil {
+		curve = S256Curve
+	}
+
+	seen := make(map[Identity]bool)
+	for k := range c.Participants {
+		if _, err := IdentityToPubKey(c.Participants[k], curve); err != nil {
+			return &ParticipantKeyError{Index: k, Err: ErrConfigInvalidParticipantKey}
+		}
+
+		if seen[c.Participants[k]] {
+			return &ParticipantKeyError{Index: k, Err: ErrConfigDuplicateParticipant}
+		}
+		seen[c.Participants[k]] = true
+	}
+	return nil
+}
+
+const (
+	// configExportVersion is the layout version of Config.Export
+	configExportVersion = 1
+	// configExportCurve is the only curve supported by Config.Export
+	configExportCurve = "secp256k1"
+)
+
+// exportedConfig is the canonical layout of an exported config
+type exportedConfig struct {
+	Version      int       `json:"version"`
+	Curve        string    `json:"curve"`
+	Epoch        time.Time `json:"epoch"`
+	Height       uint64    `json:"height"`
+	View         uint64    `json:"view"`
+	Participants []string  `json:"participants"` // hex encoded identities
+}
+
+// Export serializes the fields of the config shared by all nodes, ie. epoch,
+// height, view and participants, along with the curve of keys, in a
+// canonical and versioned JSON layout. The private key and callbacks are
+// not included, they're set separately after ImportConfig.
+func (c *Config) Export() ([]byte, error) {
+	if c.PrivateKey != nil && c.PrivateKey.Curve != nil && c.PrivateKey.Curve != S256Curve {
+		return nil, ErrConfigExportCurve
+	}
+
+	exported := exportedConfig{
+		Version:      configExportVersion,
+		Curve:        configExportCurve,
+		Epoch:        c.Epoch.UTC(),
+		Height:       c.CurrentHeight,
+		View:         c.View,
+		Participants: make([]string, 0, len(c.Participants)),
+	}
+	for k := range c.Participants {
+		exported.Participants = append(exported.Participants, hex.EncodeToString(c.Participants[k][:]))
+	}
+	return json.Marshal(&exported)
+}
+
+// ImportConfig creates a config from the output of Config.Export, the
+// returned config must be completed with PrivateKey, StateCompare and
+// StateValidate before creating consensus.
+func ImportConfig(bts []byte) (*Config, error) {
+	var exported exportedConfig
+	if err := json.Unmarshal(bts, &exported); err != nil {
+		return nil, err
+	}
+
+	if exported.Version != configExportVersion {
+		return nil, ErrConfigExportVersion
+	}
+
+	if exported.Curve != configExportCurve {
+		return nil, ErrConfigExportCurve
+	}
+
+	config := new(Config)
+	config.Epoch = exported.Epoch
+	config.CurrentHeight = exported.Height
+	config.View = exported.View
+	for _, participant := range exported.Participants {
+		var identity Identity
+		decoded, err := hex.DecodeString(participant)
+		if err != nil || len(decoded) != len(identity) {
+			return nil, ErrConfigExportParticipant
+		}
+		copy(identity[:], decoded)
+		config.Participants = append(config.Participants, identity)
+	}
+	return config, nil
+}
+
+// ConfigFingerprint returns the blake2b-256 hash of Export, nodes loading
+// the same configuration have the same fingerprint, so drifts can be
+// detected by comparing fingerprints.
+func (c *Config) ConfigFingerprint() ([blake2b.Size256]byte, error) {
+	bts, err := c.Export()
+	if err != nil {
+		return [blake2b.Size256]byte{}, err
+	}
+	return blake2b.Sum256(bts), nil
+}
@@ -3,6 +3,9 @@ package bdls
 import (
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
 	"testing"
 	"time"
 
@@ -43,3 +46,188 @@ func TestVerifyConfig(t *testing.T) {
 	err = VerifyConfig(config)
 	assert.Nil(t, err)
 }
+
+func TestVerifyConfigParticipantKeys(t *testing.T) {
+	randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+
+	config := new(Config)
+	config.Epoch = time.Now()
+	config.StateCompare = func(State, State) int { return 0 }
+	config.StateValidate = func(State) bool { return true }
+	config.PrivateKey = randKey
+
+	for i := 0; i < ConfigMinimumParticipants; i++ {
+		randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(&randKey.PublicKey))
+	}
+	assert.Nil(t, VerifyConfig(config))
+
+	// off-curve participant
+	offCurve := config.Participants[2]
+	offCurve[2*SizeAxis-1] ^= 0x1
+	config.Participants[2] = offCurve
+	err = VerifyConfig(config)
+	assert.True(t, errors.Is(err, ErrConfigInvalidParticipantKey))
+	var keyErr *ParticipantKeyError
+	assert.True(t, errors.As(err, &keyErr))
+	assert.Equal(t, 2, keyErr.Index)
+
+	// duplicated participant
+	config.Participants[2] = config.Participants[1]
+	err = VerifyConfig(config)
+	assert.True(t, errors.Is(err, ErrConfigDuplicateParticipant))
+	assert.True(t, errors.As(err, &keyErr))
+	assert.Equal(t, 2, keyErr.Index)
+
+	// custom identity derivation is not validated
+	config.PubKeyToIdentity = DefaultPubKeyToIdentity
+	assert.Nil(t, VerifyConfig(config))
+}
+
+func TestVerifyConfigEpochFuture(t *testing.T) {
+	randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+
+	config := new(Config)
+	config.StateCompare = func(State, State) int { return 0 }
+	config.StateValidate = func(State) bool { return true }
+	config.PrivateKey = randKey
+	for i := 0; i < ConfigMinimumParticipants; i++ {
+		randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(&randKey.PublicKey))
+	}
+
+	// far future
+	config.Epoch = time.Now().AddDate(100, 0, 0)
+	assert.Equal(t, ErrConfigEpochFuture, VerifyConfig(config))
+
+	// past epochs are valid
+	config.Epoch = time.Now().AddDate(-100, 0, 0)
+	assert.Nil(t, VerifyConfig(config))
+
+	// within default tolerance
+	config.Epoch = time.Now().Add(time.Hour)
+	assert.Nil(t, VerifyConfig(config))
+
+	// custom tolerance
+	config.EpochTolerance = time.Minute
+	assert.Equal(t, ErrConfigEpochFuture, VerifyConfig(config))
+	config.Epoch = time.Now().Add(30 * time.Second)
+	assert.Nil(t, VerifyConfig(config))
+}
+
+func TestVerifyConfigHashFunc(t *testing.T) {
+	randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+
+	config := new(Config)
+	config.Epoch = time.Now()
+	config.StateCompare = func(State, State) int { return 0 }
+	config.StateValidate = func(State) bool { return true }
+	config.PrivateKey = randKey
+	for i := 0; i < ConfigMinimumParticipants; i++ {
+		randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(&randKey.PublicKey))
+	}
+
+	config.HashFunc = func(data []byte) []byte { h := sha512.Sum512(data); return h[:] }
+	assert.Equal(t, ErrConfigHashFunc, VerifyConfig(config))
+
+	config.HashFunc = func(data []byte) []byte { h := sha256.Sum256(data); return h[:] }
+	assert.Nil(t, VerifyConfig(config))
+}
+
+func TestVerifyConfigStateDiff(t *testing.T) {
+	randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+
+	config := new(Config)
+	config.Epoch = time.Now()
+	config.StateCompare = func(State, State) int { return 0 }
+	config.StateValidate = func(State) bool { return true }
+	config.PrivateKey = randKey
+	for i := 0; i < ConfigMinimumParticipants; i++ {
+		randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(&randKey.PublicKey))
+	}
+
+	config.StateDiff = func(prev, next State) []byte { return nil }
+	assert.Equal(t, ErrConfigStateDiff, VerifyConfig(config))
+
+	config.StateApply = func(prev State, diff []byte) (State, error) { return prev, nil }
+	assert.Nil(t, VerifyConfig(config))
+}
+
+func TestVerifyConfigEmptyState(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	config := createConfig(t, keys[0], 0, []*ecdsa.PublicKey{&keys[1].PublicKey, &keys[2].PublicKey, &keys[3].PublicKey})
+	assert.Nil(t, VerifyConfig(config))
+
+	config.EmptyProposalAfter = time.Second
+	assert.Equal(t, ErrConfigEmptyState, VerifyConfig(config))
+
+	config.EmptyState = State("empty")
+	assert.Nil(t, VerifyConfig(config))
+}
+
+func TestConfigExport(t *testing.T) {
+	randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+
+	config := new(Config)
+	config.Epoch = time.Now()
+	config.CurrentHeight = 10
+	config.View = 2
+	config.PrivateKey = randKey
+	for i := 0; i < ConfigMinimumParticipants; i++ {
+		randKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(&randKey.PublicKey))
+	}
+
+	bts, err := config.Export()
+	assert.Nil(t, err)
+	fingerprint, err := config.ConfigFingerprint()
+	assert.Nil(t, err)
+
+	// two nodes importing the same config
+	config1, err := ImportConfig(bts)
+	assert.Nil(t, err)
+	config2, err := ImportConfig(bts)
+	assert.Nil(t, err)
+	assert.True(t, config.Epoch.Equal(config1.Epoch))
+	assert.Equal(t, config.CurrentHeight, config1.CurrentHeight)
+	assert.Equal(t, config.View, config1.View)
+	assert.Equal(t, config.Participants, config1.Participants)
+
+	fingerprint1, err := config1.ConfigFingerprint()
+	assert.Nil(t, err)
+	fingerprint2, err := config2.ConfigFingerprint()
+	assert.Nil(t, err)
+	assert.Equal(t, fingerprint, fingerprint1)
+	assert.Equal(t, fingerprint1, fingerprint2)
+
+	// a drifted config
+	config2.CurrentHeight++
+	fingerprint2, err = config2.ConfigFingerprint()
+	assert.Nil(t, err)
+	assert.NotEqual(t, fingerprint1, fingerprint2)
+
+	// the imported config verifies with the private key
+	config1.PrivateKey = randKey
+	config1.StateCompare = func(State, State) int { return 0 }
+	config1.StateValidate = func(State) bool { return true }
+	assert.Nil(t, VerifyConfig(config1))
+
+	_, err = ImportConfig([]byte(`{"version":2,"curve":"secp256k1"}`))
+	assert.Equal(t, ErrConfigExportVersion, err)
+	_, err = ImportConfig([]byte(`{"version":1,"curve":"P-256"}`))
+	assert.Equal(t, ErrConfigExportCurve, err)
+	_, err = ImportConfig([]byte(`{"version":1,"curve":"secp256k1","participants":["00"]}`))
+	assert.Equal(t, ErrConfigExportParticipant, err)
+}
@@ -35,8 +35,12 @@ import (
 	"container/list"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"io"
 	"net"
+	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sperax/bdls/crypto/blake2b"
@@ -46,11 +50,19 @@ import (
 const (
 	// ProtocolVersion is the current BDLS protocol implementation version,
 	// version wil be sent along with messages for protocol upgrading.
-	ProtocolVersion = 1
+	ProtocolVersion = 2
 	// DefaultConsensusLatency is the default propagation latency setting for
 	// consensus protocol, user can adjust consensus object's latency setting
 	// via Consensus.SetLatency()
 	DefaultConsensusLatency = 300 * time.Millisecond
+
+	// maximum number of abandoned StateCompare calls left running
+	maxAbandonedCompares = 4
+
+	// messages are buffered for replay only up to this many rounds ahead
+	reorderRoundWindow = 2
+	// maximum number of messages buffered for replay from a signer
+	reorderPerSigner = 2
 )
 
 type (
@@ -83,6 +95,13 @@ type messageTuple struct {
 	StateHash StateHash    // computed while adding
 	Message   *Message     // the decoded message
 	Signed    *SignedProto // the encoded message with signature
+	Identity  Identity     // the signer's identity, set for round messages
+}
+
+// bufferedMessage is a message kept for replay with it's signer's identity
+type bufferedMessage struct {
+	bts    []byte
+	signer Identity
 }
 
 // a sorter for messageTuple slice
@@ -133,21 +152,20 @@ func newConsensusRound(round uint64, c *Consensus) *consensusRound {
 // checks to accept only one <roundchange> message from one participant,
 // to prevent multiple proposals attack.
 func (r *consensusRound) AddRoundChange(sp *SignedProto, m *Message) bool {
-	for k := range r.roundChanges {
-		if r.roundChanges[k].Signed.X == sp.X && r.roundChanges[k].Signed.Y == sp.Y {
-			return false
-		}
+	identity := r.c.pubKeyToIdentity(sp.PublicKey(r.c.curve))
+	if r.FindRoundChange(identity) != -1 {
+		return false
 	}
 
-	r.roundChanges = append(r.roundChanges, messageTuple{StateHash: r.c.stateHash(m.State), Message: m, Signed: sp})
+	r.roundChanges = append(r.roundChanges, messageTuple{StateHash: r.c.stateHash(m.State), Message: m, Signed: sp, Identity: identity})
 	return true
 }
 
 // FindRoundChange will try to find a <roundchange> from a given participant,
 // and returns index, -1 if not found
-func (r *consensusRound) FindRoundChange(X PubKeyAxis, Y PubKeyAxis) int {
+func (r *consensusRound) FindRoundChange(identity Identity) int {
 	for k := range r.roundChanges {
-		if r.roundChanges[k].Signed.X == X && r.roundChanges[k].Signed.Y == Y {
+		if r.roundChanges[k].Identity == identity {
 			return k
 		}
 	}
@@ -189,24 +207,26 @@ func (r *consensusRound) RoundChangeStates() []State {
 // AddCommit adds decoded messages along with its original signed message unchanged,
 // also, messages will be de-duplicated to prevent multiple proposals attack.
 func (r *consensusRound) AddCommit(sp *SignedProto, m *Message) bool {
+	identity := r.c.pubKeyToIdentity(sp.PublicKey(r.c.curve))
 	for k := range r.commits {
-		if r.commits[k].Signed.X == sp.X && r.commits[k].Signed.Y == sp.Y {
+		if r.commits[k].Identity == identity {
 			return false
 		}
 	}
-	r.commits = append(r.commits, messageTuple{StateHash: r.c.stateHash(m.State), Message: m, Signed: sp})
+	r.commits = append(r.commits, messageTuple{StateHash: r.c.stateHash(m.State), Message: m, Signed: sp, Identity: identity})
 	return true
 }
 
-// NumCommitted counts <commit> messages which points to what the leader has locked.
-func (r *consensusRound) NumCommitted() int {
-	var count int
+// CommittedSigners returns the signers of <commit> messages which points to
+// what the leader has locked.
+func (r *consensusRound) CommittedSigners() []Identity {
+	var signers []Identity
 	for k := range r.commits {
 		if r.commits[k].StateHash == r.LockedStateHash {
-			count++
+			signers = append(signers, r.commits[k].Identity)
 		}
 	}
-	return count
+	return signers
 }
 
 // SignedCommits converts and returns []*SignedProto
@@ -276,6 +296,15 @@ type Consensus struct {
 	latestProof  *SignedProto // latest <decide> message to prove the state
 
 	unconfirmed []State // data awaiting to be confirmed at next height
+	// deadlines of unconfirmed data proposed by ProposeWithDeadline
+	deadlines map[StateHash]time.Time
+	// callback on unconfirmed data abandoned at deadline
+	onProposalExpired func(s State)
+
+	// automatic empty proposal
+	emptyProposalAfter time.Duration
+	emptyState         State
+	heightStart        time.Time // the time current height opened, zero before the first Update
 
 	rounds       list.List       // all rounds at next height(consensus round in progress)
 	currentRound *consensusRound // current round which has collected >=2t+1 <roundchange>
@@ -290,21 +319,63 @@ type Consensus struct {
 	locks []messageTuple
 
 	// the StateCompare function from config
-	stateCompare func(State, State) int
+	stateCompare func(State, State) (int, error)
 	// the StateValidate function from config
 	stateValidate func(State) bool
+	// invalid state callback
+	onInvalidState func(from Identity, state State)
+	// application policy on voting for a proposal
+	proposalPolicy func(height uint64, proposer Identity, s State) bool
+	// clock backward callback
+	onClockBackward func(last time.Time, now time.Time)
+	// maximum forward step of time in a call
+	maxTimeStep time.Duration
+	// the configuration generation of participants
+	view uint64
+	// custom decision quorum rule
+	quorumFunc func(signers []Identity) bool
+	// protocol version mismatch callback
+	onProtocolVersionMismatch func(version uint32, signed *SignedProto)
+	// goroutines verifying signatures of a batch
+	verifyConcurrency int
+	// signatures verified ahead in a batch, see preverify
+	verifiedSignatures map[string]bool
+	// clock skew tolerance & callback
+	maxClockSkew time.Duration
+	onClockSkew  func(from Identity, m *Message, skew time.Duration)
+
+	// the latest time fed into the state machine
+	lastNow time.Time
+	// message counters, see Metrics
+	sentMessages     map[MessageType]uint64
+	receivedMessages map[MessageType]uint64
+	heightMessages   int      // messages accepted at the current height
+	messageHistogram []uint64 // messages accepted per height
+	messageSum       uint64   // messages accepted at all decided heights
+
 	// message in callback
 	messageValidator func(c *Consensus, m *Message, sp *SignedProto) bool
 	// message out callback
 	messageOutCallback func(m *Message, sp *SignedProto)
 	// public key to identity function
 	pubKeyToIdentity func(pubkey *ecdsa.PublicKey) Identity
+	// identities are derived by Config.PubKeyToIdentity, not encoded public keys
+	customIdentity bool
 
 	// the StateHash function to identify a state
 	stateHash func(State) StateHash
+	// maximum size of a state, 0 for unlimited
+	maxStateSize int
+	// diff encoding of proposals, nil to broadcast full states
+	stateDiff  func(prev, next State) []byte
+	stateApply func(prev State, diff []byte) (State, error)
 
 	// private key
 	privateKey *ecdsa.PrivateKey
+	// private key staged by RotateKey, applied at next height
+	pendingKey *ecdsa.PrivateKey
+	// entropy source for signing, nil for crypto/rand
+	rand io.Reader
 	// my publickey coodinate
 	identity Identity
 	// curve retrieved from private key
@@ -312,21 +383,67 @@ type Consensus struct {
 
 	// transmission delay
 	latency time.Duration
+	// latency estimated from observed round-trips
+	rtt latencyEstimator
+	// the time my <lock> was broadcast as the leader of current round
+	lockSentAt time.Time
 
 	// all connected peers
 	peers []PeerInterface
 
 	// participants is the consensus group, current leader is r % quorum
 	participants []Identity
+	// public keys of participants parsed and validated on the curve, by coordinate
+	participantKeys map[Coordinate]*ecdsa.PublicKey
+	// participants change staged by ChangeParticipants, applied at next height
+	pendingParticipants []Identity
+	// the last time a verified signature of each participant was observed
+	participantActivity map[Identity]time.Time
 
 	// set to true to enable <commit> message unicast
 	enableCommitUnicast bool
+	// maximum retransmissions of an unacknowledged unicast <commit>
+	commitRetransmits int
+	// the unicast <commit> waiting for <commit-ack>
+	pendingCommit *pendingCommit
+
+	// additional signature scheme of <commit> messages
+	aggregateScheme AggregateScheme
+
+	// invariants checking on decisions
+	strictInvariants     bool
+	onInvariantViolation func(v *InvariantViolation)
+	decisions            map[uint64]StateHash // recent decisions
+
+	// the <commit> messages justifying recent decisions, in ascending heights
+	justifications       []justification
+	justificationArchive int
+
+	// participants which have handshaked the genesis set by Reset, nil if
+	// all participants have handshaked
+	resetHandshake map[Identity]bool
+	resetHeight    uint64
+
+	// set to true to suppress proposing while connected participants are less than 2t+1
+	enableQuorumReadiness bool
+	// false if quorum readiness is enabled and not enough participants are connected
+	ready bool
+	// readiness change callback
+	onReadyChange func(ready bool, connected int)
 
 	// NOTE: fixed leader for testing purpose
 	fixedLeader *Identity
 
 	// broadcasting messages being sent to myself
 	loopback [][]byte
+
+	// messages of current height arrived before their preconditions are met,
+	// they will be replayed once the consensus has progressed.
+	reorderBuffer []bufferedMessage
+
+	// messages of next height carrying a state diff against the state of
+	// current height, they will be replayed once current height is decided.
+	diffBuffer []bufferedMessage
 }
 
 // NewConsensus creates a BDLS consensus object to participant in consensus procedure,
@@ -349,24 +466,68 @@ func (c *Consensus) init(config *Config) {
 	// setting current state & height
 	c.latestHeight = config.CurrentHeight
 	c.participants = config.Participants
-	c.stateCompare = config.StateCompare
+	c.view = config.View
+	c.stateCompare = unbudgetedCompare(config.StateCompare)
+	if config.StateCompareBudget > 0 {
+		c.stateCompare = budgetedCompare(config.StateCompare, config.StateCompareBudget, config.OnStateCompareTimeout)
+	}
 	c.stateValidate = config.StateValidate
+	c.onInvalidState = config.OnInvalidState
+	c.proposalPolicy = config.ProposalPolicy
+	c.onProposalExpired = config.OnProposalExpired
+	c.onClockBackward = config.OnClockBackward
+	c.maxTimeStep = config.MaxTimeStep
+	c.onProtocolVersionMismatch = config.OnProtocolVersionMismatch
+	c.maxClockSkew = config.MaxClockSkew
+	c.onClockSkew = config.OnClockSkew
+	c.quorumFunc = config.QuorumFunc
 	c.messageValidator = config.MessageValidator
 	c.messageOutCallback = config.MessageOutCallback
 	c.privateKey = config.PrivateKey
+	c.rand = config.Rand
 	c.pubKeyToIdentity = config.PubKeyToIdentity
 	c.enableCommitUnicast = config.EnableCommitUnicast
+	if c.enableCommitUnicast {
+		c.commitRetransmits = config.CommitRetransmits
+	}
+	c.aggregateScheme = config.AggregateScheme
+	c.strictInvariants = config.StrictInvariants
+	c.justificationArchive = config.JustificationArchive
+	c.onInvariantViolation = config.OnInvariantViolation
+	c.enableQuorumReadiness = config.EnableQuorumReadiness
+	c.onReadyChange = config.OnReadyChange
+	c.ready = true
+	c.maxStateSize = config.MaxStateSize
+	c.verifyConcurrency = config.VerifyConcurrency
+	if c.verifyConcurrency <= 0 {
+		c.verifyConcurrency = runtime.NumCPU()
+	}
+	c.stateDiff = config.StateDiff
+	c.emptyProposalAfter = config.EmptyProposalAfter
+	c.emptyState = config.EmptyState
+	c.stateApply = config.StateApply
+	c.participantActivity = make(map[Identity]time.Time)
 
 	// if config has not set hash function, use the default
+	if config.HashFunc != nil {
+		hashFunc := config.HashFunc
+		c.stateHash = func(s State) (h StateHash) {
+			copy(h[:], hashFunc(s))
+			return h
+		}
+	}
 	if c.stateHash == nil {
 		c.stateHash = defaultHash
 	}
 	// if config has not set public key to identity function, use the default
 	if c.pubKeyToIdentity == nil {
 		c.pubKeyToIdentity = DefaultPubKeyToIdentity
+	} else {
+		c.customIdentity = true
 	}
 	c.identity = c.pubKeyToIdentity(&c.privateKey.PublicKey)
 	c.curve = c.privateKey.Curve
+	c.cacheParticipantKeys()
 
 	// initial default parameters settings
 	c.latency = DefaultConsensusLatency
@@ -404,13 +565,51 @@ func (c *Consensus) lockReleaseDuration(round uint64) time.Duration {
 	return 2 * c.latency * time.Duration(1+round)
 }
 
+// unbudgetedCompare wraps compare which never fails
+func unbudgetedCompare(compare func(State, State) int) func(State, State) (int, error) {
+	return func(a State, b State) (int, error) { return compare(a, b), nil }
+}
+
+// budgetedCompare wraps compare to be abandoned after budget with
+// ErrStateCompareBudget, and onTimeout is called if not nil. At most
+// maxAbandonedCompares abandoned comparisons may keep running, further
+// comparisons fail immediately until they return.
+func budgetedCompare(compare func(State, State) int, budget time.Duration, onTimeout func(State, State)) func(State, State) (int, error) {
+	var running int32
+	return func(a State, b State) (int, error) {
+		if atomic.LoadInt32(&running) >= maxAbandonedCompares {
+			return 0, ErrStateCompareBudget
+		}
+
+		atomic.AddInt32(&running, 1)
+		result := make(chan int, 1)
+		go func() {
+			defer atomic.AddInt32(&running, -1)
+			result <- compare(a, b)
+		}()
+
+		timer := time.NewTimer(budget)
+		defer timer.Stop()
+		select {
+		case r := <-result:
+			return r, nil
+		case <-timer.C:
+			if onTimeout != nil {
+				onTimeout(a, b)
+			}
+			return 0, ErrStateCompareBudget
+		}
+	}
+}
+
 // maximalLocked finds the maximum locked data in this round,
 // with regard to StateCompare function in config.
 func (c *Consensus) maximalLocked() State {
 	if len(c.locks) > 0 {
 		maxState := c.locks[0].Message.State
 		for i := 1; i < len(c.locks); i++ {
-			if c.stateCompare(maxState, c.locks[i].Message.State) < 0 {
+			// an abandoned comparison keeps the current choice
+			if r, err := c.stateCompare(maxState, c.locks[i].Message.State); err == nil && r < 0 {
 				maxState = c.locks[i].Message.State
 			}
 		}
@@ -419,13 +618,22 @@ func (c *Consensus) maximalLocked() State {
 	return nil
 }
 
+// acceptedByPolicy checks a locked state against the application policy,
+// the signer of the <lock> is the proposer of the state.
+func (c *Consensus) acceptedByPolicy(m *Message, signed *SignedProto) bool {
+	if c.proposalPolicy == nil {
+		return true
+	}
+	return c.proposalPolicy(m.Height, c.pubKeyToIdentity(signed.PublicKey(c.curve)), m.State)
+}
+
 // maximalUnconfirmed finds the maximal unconfirmed data with,
 // regard to the StateCompare function in config.
 func (c *Consensus) maximalUnconfirmed() State {
 	if len(c.unconfirmed) > 0 {
 		maxState := c.unconfirmed[0]
 		for i := 1; i < len(c.unconfirmed); i++ {
-			if c.stateCompare(maxState, c.unconfirmed[i]) < 0 {
+			if r, err := c.stateCompare(maxState, c.unconfirmed[i]); err == nil && r < 0 {
 				maxState = c.unconfirmed[i]
 			}
 		}
@@ -470,22 +678,104 @@ func (c *Consensus) verifyMessage(signed *SignedProto) (*Message, error) {
 		}
 	*/
 
+	// decode message, a valid message never carries more proofs than participants
+	m, err := UnmarshalMessageLimit(signed.Message, len(c.participants))
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is bound to the height & round
+	if !signed.bound(m) {
+		return nil, ErrMessageBinding
+	}
+
+	// messages signed under another participants set can't be replayed
+	if m.View != c.view {
+		return nil, ErrMessageView
+	}
+
+	// messages of decided heights will be rejected anyway, they're dropped
+	// before the expensive signature verification, ie. backlogs after pause.
+	// <lock-release> is checked by the embedded <lock>.
+	switch m.Type {
+	case MessageType_RoundChange, MessageType_Lock, MessageType_Select, MessageType_Commit, MessageType_Decide, MessageType_CommitAck:
+		if m.Height <= c.latestHeight {
+			return nil, ErrMessageStale
+		}
+	}
+
+	// oversized state will be rejected before the expensive signature verification
+	if c.maxStateSize > 0 && (len(m.State) > c.maxStateSize || len(m.StateDiff) > c.maxStateSize) {
+		return nil, ErrStateTooLarge
+	}
+
 	// as public key is proven , we don't have to verify the public key
-	if !signed.Verify(c.curve) {
+	if !c.verifySignature(signed) {
 		return nil, ErrMessageSignature
 	}
 
-	// decode message
-	m := new(Message)
-	err := proto.Unmarshal(signed.Message, m)
-	if err != nil {
-		return nil, err
+	if !c.verifyAggregate(m, signed) {
+		return nil, ErrMessageSignature
+	}
+
+	// reconstruct the proposed state from diff
+	if m.StateDiffHash != nil {
+		if err := c.applyStateDiff(m); err != nil {
+			return nil, err
+		}
+	}
+
+	// record participant's activity
+	if c.lastNow.After(c.participantActivity[coord]) {
+		c.participantActivity[coord] = c.lastNow
 	}
 	return m, nil
 }
 
+// applyStateDiff reconstructs m.State from m.StateDiff against the latest
+// state, the diff is only valid for the next height, a diff of later heights
+// is against a state not decided yet.
+func (c *Consensus) applyStateDiff(m *Message) error {
+	if c.stateApply == nil {
+		return ErrStateDiff
+	}
+
+	if m.Height > c.latestHeight+1 {
+		return ErrStateDiffGap
+	}
+
+	s, err := c.stateApply(c.latestState, m.StateDiff)
+	if err != nil {
+		return ErrStateDiff
+	}
+
+	if c.maxStateSize > 0 && len(s) > c.maxStateSize {
+		return ErrStateTooLarge
+	}
+
+	h := c.stateHash(s)
+	if !bytes.Equal(h[:], m.StateDiffHash) {
+		return ErrStateDiff
+	}
+	m.State = s
+	return nil
+}
+
+// validateState validates the state with StateValidate function from config,
+// and reports the signer of the message to OnInvalidState if it's rejected.
+func (c *Consensus) validateState(signed *SignedProto, s State) bool {
+	if c.stateValidate(s) {
+		return true
+	}
+
+	if c.onInvalidState != nil {
+		c.onInvalidState(c.pubKeyToIdentity(signed.PublicKey(c.curve)), s)
+	}
+	return false
+}
+
 // verify <roundchange> message
-func (c *Consensus) verifyRoundChangeMessage(m *Message) error {
+func (c *Consensus) verifyRoundChangeMessage(m *Message, signed *SignedProto) error {
 	// check message height
 	if m.Height != c.latestHeight+1 {
 		return ErrRoundChangeHeightMismatch
@@ -498,7 +788,7 @@ func (c *Consensus) verifyRoundChangeMessage(m *Message) error {
 
 	// state data validation for non-null <roundchange>
 	if m.State != nil {
-		if !c.stateValidate(m.State) {
+		if !c.validateState(signed, m.State) {
 			return ErrRoundChangeStateValidation
 		}
 	}
@@ -526,7 +816,7 @@ func (c *Consensus) verifyLockMessage(m *Message, signed *SignedProto) error {
 	}
 
 	// state data validation
-	if !c.stateValidate(m.State) {
+	if !c.validateState(signed, m.State) {
 		return ErrLockStateValidation
 	}
 
@@ -565,7 +855,7 @@ func (c *Consensus) verifyLockMessage(m *Message, signed *SignedProto) error {
 
 		// state data validation in proofs
 		if mProof.State != nil {
-			if !c.stateValidate(mProof.State) {
+			if !c.validateState(proof, mProof.State) {
 				return ErrLockProofStateValidation
 			}
 		}
@@ -630,7 +920,7 @@ func (c *Consensus) verifySelectMessage(m *Message, signed *SignedProto) error {
 
 	// state data validation for non-null <select>
 	if m.State != nil {
-		if !c.stateValidate(m.State) {
+		if !c.validateState(signed, m.State) {
 			return ErrSelectStateValidation
 		}
 	}
@@ -665,7 +955,7 @@ func (c *Consensus) verifySelectMessage(m *Message, signed *SignedProto) error {
 
 		// state data validation in proofs
 		if mProof.State != nil {
-			if !c.stateValidate(mProof.State) {
+			if !c.validateState(proof, mProof.State) {
 				return ErrSelectProofStateValidation
 			}
 		}
@@ -673,7 +963,11 @@ func (c *Consensus) verifySelectMessage(m *Message, signed *SignedProto) error {
 		// we also need to check the B'' selected by leader is the maximal one,
 		// if data has been proposed.
 		if mProof.State != nil && m.State != nil {
-			if c.stateCompare(m.State, mProof.State) < 0 {
+			r, err := c.stateCompare(m.State, mProof.State)
+			if err != nil {
+				return err
+			}
+			if r < 0 {
 				return ErrSelectProofNotTheMaximal
 			}
 		}
@@ -720,7 +1014,7 @@ func (c *Consensus) verifySelectMessage(m *Message, signed *SignedProto) error {
 }
 
 // verifyCommitMessage will check if this message is acceptable to consensus
-func (c *Consensus) verifyCommitMessage(m *Message) error {
+func (c *Consensus) verifyCommitMessage(m *Message, signed *SignedProto) error {
 	// the leader has to be in COMMIT status to process this message
 	if c.currentRound.Stage != stageCommit {
 		return ErrCommitStatus
@@ -732,7 +1026,7 @@ func (c *Consensus) verifyCommitMessage(m *Message) error {
 	}
 
 	// state data validation
-	if !c.stateValidate(m.State) {
+	if !c.validateState(signed, m.State) {
 		return ErrCommitStateValidation
 	}
 
@@ -767,31 +1061,17 @@ func (c *Consensus) ValidateDecideMessage(bts []byte, targetState []byte) error
 }
 
 // DecodeSignedMessage decodes a binary representation of signed consensus message.
-func DecodeSignedMessage(bts []byte) (*SignedProto, error) {
-	signed := new(SignedProto)
-	err := proto.Unmarshal(bts, signed)
-	if err != nil {
-		return nil, err
-	}
-	return signed, nil
-}
+func DecodeSignedMessage(bts []byte) (*SignedProto, error) { return UnmarshalSignedProto(bts) }
 
 // DecodeMessage decodes a binary representation of consensus message.
-func DecodeMessage(bts []byte) (*Message, error) {
-	msg := new(Message)
-	err := proto.Unmarshal(bts, msg)
-	if err != nil {
-		return nil, err
-	}
-	return msg, nil
-}
+func DecodeMessage(bts []byte) (*Message, error) { return UnmarshalMessage(bts) }
 
 // validateDecideMessage validates a decoded <decide> message for non-participants,
 // the consensus core must be correctly initialized to validate.
 func (c *Consensus) validateDecideMessage(signed *SignedProto, targetState []byte) error {
 	// check message version
 	if signed.Version != ProtocolVersion {
-		return ErrMessageVersion
+		return ErrProtocolVersionMismatch
 	}
 
 	// check message signature & qualifications
@@ -825,7 +1105,7 @@ func (c *Consensus) verifyDecideMessage(m *Message, signed *SignedProto) error {
 	}
 
 	// state data validation
-	if !c.stateValidate(m.State) {
+	if !c.validateState(signed, m.State) {
 		return ErrDecideStateValidation
 	}
 
@@ -862,13 +1142,13 @@ func (c *Consensus) verifyDecideMessage(m *Message, signed *SignedProto) error {
 			return ErrDecideProofRoundMismatch
 		}
 
-		if !c.stateValidate(mProof.State) {
+		if !c.validateState(proof, mProof.State) {
 			return ErrDecideProofStateValidation
 		}
 
 		// state data validation in proofs
 		if mProof.State != nil {
-			if !c.stateValidate(mProof.State) {
+			if !c.validateState(proof, mProof.State) {
 				return ErrSelectProofStateValidation
 			}
 		}
@@ -876,18 +1156,18 @@ func (c *Consensus) verifyDecideMessage(m *Message, signed *SignedProto) error {
 		commits[c.pubKeyToIdentity(proof.PublicKey(c.curve))] = mProof.State
 	}
 
-	// count proofs to m.State
-	var numValidateProofs int
+	// collect signers of proofs to m.State
+	var signers []Identity
 	mHash := c.stateHash(m.State)
-	for _, v := range commits {
+	for identity, v := range commits {
 		if c.stateHash(v) == mHash {
-			numValidateProofs++
+			signers = append(signers, identity)
 		}
 	}
 
-	// check to see if the message has at least 2*t+1 <commit> valid proofs,
-	// if not, the leader may cheat.
-	if numValidateProofs < 2*c.t()+1 {
+	// check to see if the message has a quorum of <commit> valid proofs,
+	// at least 2*t+1 by default, if not, the leader may cheat.
+	if !c.isDecideQuorum(signers) {
 		return ErrDecideProofInsufficient
 	}
 	return nil
@@ -896,6 +1176,11 @@ func (c *Consensus) verifyDecideMessage(m *Message, signed *SignedProto) error {
 // broadcastRoundChange will broadcast <roundchange> messages on
 // current round, taking the maximal B' from unconfirmed data.
 func (c *Consensus) broadcastRoundChange() {
+	// proposing into a network without quorum is futile
+	if !c.ready {
+		return
+	}
+
 	// if <roundchange> has sent in this round,
 	// then just ignore. But if we are in roundchanging state,
 	// we should send repeatedly, for boostrap process.
@@ -920,6 +1205,18 @@ func (c *Consensus) broadcastRoundChange() {
 	m.Height = c.latestHeight + 1
 	m.Round = c.currentRound.RoundNumber
 	m.State = data
+
+	// encode the proposal as a diff if it's smaller, in round 0 only, the
+	// participants lagging more than a height behind can't apply the diff,
+	// they validate the full state of later rounds after syncing.
+	if c.stateDiff != nil && c.latestState != nil && m.Round == 0 {
+		if diff := c.stateDiff(c.latestState, data); diff != nil && len(diff) < len(data) {
+			h := c.stateHash(data)
+			m.State = nil
+			m.StateDiff = diff
+			m.StateDiffHash = h[:]
+		}
+	}
 	c.broadcast(&m)
 	c.currentRound.RoundChangeSent = true
 	//log.Println("broadcast:<roundchange>")
@@ -935,6 +1232,7 @@ func (c *Consensus) broadcastLock() {
 	m.State = c.currentRound.LockedState
 	m.Proof = c.currentRound.SignedRoundChanges()
 	c.broadcast(&m)
+	c.lockSentAt = c.lastNow
 	//log.Println("broadcast:<lock>")
 }
 
@@ -988,7 +1286,20 @@ func (c *Consensus) sendCommit(msgLock *Message) {
 	m.Round = msgLock.Round   // r
 	m.State = msgLock.State   // B'j
 	if c.enableCommitUnicast {
-		c.sendTo(&m, c.roundLeader(m.Round))
+		leader := c.roundLeader(m.Round)
+		out := c.sendTo(&m, leader)
+		// keep it for retransmission until acknowledged
+		if c.commitRetransmits > 0 && leader != c.identity {
+			c.pendingCommit = &pendingCommit{
+				out:    out,
+				leader: leader,
+				height: m.Height,
+				round:  m.Round,
+				left:   c.commitRetransmits,
+				sentAt: c.lastNow,
+				next:   c.lastNow.Add(2 * c.latency),
+			}
+		}
 	} else {
 		c.broadcast(&m)
 	}
@@ -1001,7 +1312,10 @@ func (c *Consensus) broadcast(m *Message) *SignedProto {
 	// sign
 	sp := new(SignedProto)
 	sp.Version = ProtocolVersion
-	sp.Sign(m, c.privateKey)
+	m.View = c.view
+	sp.SignWithRand(m, c.privateKey, c.rand)
+	c.signAggregate(m, sp)
+	c.countSent(m)
 
 	// message callback
 	if c.messageOutCallback != nil {
@@ -1014,7 +1328,7 @@ func (c *Consensus) broadcast(m *Message) *SignedProto {
 	}
 
 	// send to peers one by one
-	for _, peer := range c.peers {
+	for _, peer := range c.sendOrder() {
 		_ = peer.Send(out)
 	}
 
@@ -1023,12 +1337,16 @@ func (c *Consensus) broadcast(m *Message) *SignedProto {
 	return sp
 }
 
-// sendTo signs the message with private key before transmitting to the peer.
-func (c *Consensus) sendTo(m *Message, leader Identity) {
+// sendTo signs the message with private key before transmitting to the peer,
+// returns the bytes sent.
+func (c *Consensus) sendTo(m *Message, leader Identity) []byte {
 	// sign
 	sp := new(SignedProto)
 	sp.Version = ProtocolVersion
-	sp.Sign(m, c.privateKey)
+	m.View = c.view
+	sp.SignWithRand(m, c.privateKey, c.rand)
+	c.signAggregate(m, sp)
+	c.countSent(m)
 
 	// message callback
 	if c.messageOutCallback != nil {
@@ -1044,14 +1362,20 @@ func (c *Consensus) sendTo(m *Message, leader Identity) {
 	// we need to send this message to myself (via loopback) if i'm the leader
 	if leader == c.identity {
 		c.loopback = append(c.loopback, out)
-		return
+		return out
 	}
 
 	// otherwise, find and transmit to the leader
+	c.transmit(out, leader)
+	return out
+}
+
+// transmit sends signed message UNCHANGED to the peers of the identity.
+func (c *Consensus) transmit(out []byte, to Identity) {
 	for _, peer := range c.peers {
 		if pk := peer.GetPublicKey(); pk != nil {
 			coord := c.pubKeyToIdentity(pk)
-			if coord == leader {
+			if coord == to {
 				// we do not return here to avoid missing re-connected peer.
 				peer.Send(out)
 			}
@@ -1062,11 +1386,40 @@ func (c *Consensus) sendTo(m *Message, leader Identity) {
 // propagate broadcasts signed message UNCHANGED to peers.
 func (c *Consensus) propagate(bts []byte) {
 	// send to peers one by one
-	for _, peer := range c.peers {
+	for _, peer := range c.sendOrder() {
 		_ = peer.Send(bts)
 	}
 }
 
+// sendOrder returns peers ordered by score descending if peers implement
+// PeerScorer, otherwise in the order they joined.
+func (c *Consensus) sendOrder() []PeerInterface {
+	scores := make([]float64, len(c.peers))
+	scored := false
+	for k := range c.peers {
+		if scorer, ok := c.peers[k].(PeerScorer); ok {
+			scores[k] = scorer.Score()
+			scored = true
+		}
+	}
+
+	if !scored {
+		return c.peers
+	}
+
+	idx := make([]int, len(c.peers))
+	for k := range idx {
+		idx[k] = k
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return scores[idx[i]] > scores[idx[j]] })
+
+	peers := make([]PeerInterface, len(c.peers))
+	for k := range idx {
+		peers[k] = c.peers[idx[k]]
+	}
+	return peers
+}
+
 // getRound returns the consensus round with given idx, create one if not exists
 // if purgeLower has set, all lower rounds will be cleared
 func (c *Consensus) getRound(idx uint64, purgeLower bool) *consensusRound {
@@ -1119,7 +1472,13 @@ func (c *Consensus) lockRelease() {
 // switchRound sets currentRound to the given idx, and creates new a consensusRound
 // if it's not been initialized.
 // and all lower rounds will be cleared while switching.
-func (c *Consensus) switchRound(round uint64) { c.currentRound = c.getRound(round, true) }
+// A <commit> of another round or height doesn't reply to my <lock> anymore.
+func (c *Consensus) switchRound(round uint64) {
+	if c.currentRound == nil || c.currentRound.RoundNumber != round {
+		c.lockSentAt = time.Time{}
+	}
+	c.currentRound = c.getRound(round, true)
+}
 
 // roundLeader returns leader's identity for a given round
 func (c *Consensus) roundLeader(round uint64) Identity {
@@ -1127,9 +1486,20 @@ func (c *Consensus) roundLeader(round uint64) Identity {
 	if c.fixedLeader != nil {
 		return *c.fixedLeader
 	}
-	return c.participants[int(round)%len(c.participants)]
+	return RoundLeader(c.participants, round)
 }
 
+// RoundLeader returns the leader(proposer) of a round among participants,
+// which is participants[round % len(participants)], the same at every
+// height. It's the selection of consensus core, and lets tests predict the
+// leader of any (height, round) without a running consensus.
+func RoundLeader(participants []Identity, round uint64) Identity {
+	return participants[round%uint64(len(participants))]
+}
+
+// Leader returns the leader of the given round at the current height
+func (c *Consensus) Leader(round uint64) Identity { return c.roundLeader(round) }
+
 // heightSync changes current height to the given height with state
 // resets all fields to this new height.
 func (c *Consensus) heightSync(height uint64, round uint64, s State, now time.Time) {
@@ -1141,32 +1511,443 @@ func (c *Consensus) heightSync(height uint64, round uint64, s State, now time.Ti
 	c.rounds.Init()      // clean all round
 	c.locks = nil        // clean locks
 	c.unconfirmed = nil  // clean all unconfirmed states from previous heights
-	c.switchRound(0)     // start new round at new height
+	c.deadlines = nil    // clean deadlines of unconfirmed states
+	c.heightStart = now  // the new height opens
+
+	// state diffs against the decided state are applicable now
+	c.reorderBuffer = c.diffBuffer
+	c.diffBuffer = nil
+
+	// apply staged participants change, in a new view
+	if c.pendingParticipants != nil {
+		c.participants = c.pendingParticipants
+		c.pendingParticipants = nil
+		c.view++
+		c.cacheParticipantKeys()
+	}
+
+	// apply staged private key
+	if c.pendingKey != nil {
+		c.privateKey = c.pendingKey
+		c.identity = c.pubKeyToIdentity(&c.privateKey.PublicKey)
+		c.curve = c.privateKey.Curve
+		c.pendingKey = nil
+		c.cacheParticipantKeys()
+	}
+
+	c.switchRound(0) // start new round at new height
 	c.currentRound.Stage = stageRoundChanging
 }
 
+// proposeEmpty proposes EmptyState if nothing has been proposed for
+// EmptyProposalAfter since the height opened.
+func (c *Consensus) proposeEmpty(now time.Time) {
+	if c.emptyProposalAfter <= 0 || len(c.unconfirmed) > 0 {
+		return
+	}
+
+	if now.Sub(c.heightStart) >= c.emptyProposalAfter {
+		c.unconfirmed = append(c.unconfirmed, c.emptyState)
+	}
+}
+
 // t calculates (n-1)/3
 func (c *Consensus) t() int { return (len(c.participants) - 1) / 3 }
 
+// isDecideQuorum returns true if <commit> messages from the distinct signers
+// make a decision, by Config.QuorumFunc or at least 2t+1 signers.
+func (c *Consensus) isDecideQuorum(signers []Identity) bool {
+	if c.quorumFunc != nil {
+		return c.quorumFunc(signers)
+	}
+	return len(signers) >= 2*c.t()+1
+}
+
+// connectedParticipants returns the number of distinct participants connected
+// as authenticated peers, including myself.
+func (c *Consensus) connectedParticipants() int {
+	connected := make(map[Identity]bool)
+	for k := range c.participants {
+		if c.participants[k] == c.identity {
+			connected[c.identity] = true
+		}
+	}
+
+	for k := range c.peers {
+		pubkey := c.peers[k].GetPublicKey()
+		if pubkey == nil {
+			continue
+		}
+		id := c.pubKeyToIdentity(pubkey)
+		for i := range c.participants {
+			if c.participants[i] == id {
+				connected[id] = true
+				break
+			}
+		}
+	}
+	return len(connected)
+}
+
+// updateReadiness re-evaluates quorum readiness, and resumes proposing
+// immediately once connectivity has recovered.
+func (c *Consensus) updateReadiness() {
+	if !c.enableQuorumReadiness {
+		return
+	}
+
+	connected := c.connectedParticipants()
+	ready := connected >= 2*c.t()+1
+	if ready == c.ready {
+		return
+	}
+
+	c.ready = ready
+	if c.onReadyChange != nil {
+		c.onReadyChange(ready, connected)
+	}
+
+	if ready && c.currentRound.Stage == stageRoundChanging {
+		c.broadcastRoundChange()
+	}
+}
+
+// Ready returns false if quorum readiness is enabled, and the connected
+// participants are less than 2t+1 at the last Update.
+func (c *Consensus) Ready() bool { return c.ready }
+
+// HasQuorumConnectivity returns true if the connected authenticated
+// participants, including myself, reach 2t+1, regardless of quorum readiness.
+func (c *Consensus) HasQuorumConnectivity() bool {
+	return c.connectedParticipants() >= 2*c.t()+1
+}
+
+// Reset reinitializes the consensus to a new genesis at the given height and
+// state, all in-flight rounds, locks, unconfirmed states, staged changes and
+// justifications of previous heights are discarded, connected peers are kept.
+//
+// Reset is not a consensus operation, it's only safe when all participants
+// reset to the same height and state before proposing, otherwise the network
+// may split. Each participant must re-handshake the new genesis by a message
+// of height+1, messages of other heights from a participant which has not
+// handshaked are rejected with ErrMessageResetHandshake.
+func (c *Consensus) Reset(height uint64, state State) {
+	c.pendingParticipants = nil
+	c.pendingKey = nil
+	c.diffBuffer = nil
+	c.heightSync(height, 0, state, c.lastNow)
+	c.latestProof = nil
+	c.decisions = nil
+	c.justifications = nil
+	c.pendingCommit = nil
+	c.heightMessages = 0
+	c.rcTimeout = c.lastNow.Add(c.roundchangeDuration(0))
+
+	c.resetHeight = height
+	c.resetHandshake = map[Identity]bool{c.identity: true}
+}
+
+// checkResetHandshake checks the signer of a message has handshaked the
+// genesis set by Reset, a message of the genesis height handshakes it.
+func (c *Consensus) checkResetHandshake(m *Message, signed *SignedProto) error {
+	if c.resetHandshake == nil {
+		return nil
+	}
+
+	identity := c.pubKeyToIdentity(signed.PublicKey(c.curve))
+	if m.Height == c.resetHeight+1 {
+		c.resetHandshake[identity] = true
+		if len(c.resetHandshake) >= len(c.participants) {
+			c.resetHandshake = nil
+		}
+		return nil
+	}
+
+	if !c.resetHandshake[identity] {
+		return ErrMessageResetHandshake
+	}
+	return nil
+}
+
+// verifyStaleHandshake handshakes a participant by a verified message of the
+// genesis height, which may have been decided before the participant reset.
+func (c *Consensus) verifyStaleHandshake(signed *SignedProto) {
+	if c.resetHandshake == nil || c.latestHeight <= c.resetHeight {
+		return
+	}
+
+	m, err := UnmarshalMessageLimit(signed.Message, len(c.participants))
+	if err != nil || m.Height != c.resetHeight+1 || !signed.bound(m) || !c.verifySignature(signed) {
+		return
+	}
+	_ = c.checkResetHandshake(m, signed)
+}
+
+// ChangeParticipants stages a new consensus group which takes effect from
+// the next height, all participants must stage the same change at the same
+// height. A participant lagging behind the change syncs by the <decide>
+// messages of the new group, as long as the change is staged.
+//
+// To keep the safety across the change boundary, the retained participants
+// must be at least 2t+1 of the current group(with t=(n-1)/3 of the current
+// group), and at least 2t'+1 of the new group(with t'=(n'-1)/3 of the new
+// group), so that any quorum of the new group intersects with a quorum of
+// the current group in at least one honest participant.
+// ErrUnsafeSetChange will be returned if the change adds or replaces more,
+// such changes must be split across multiple heights.
+func (c *Consensus) ChangeParticipants(participants []Identity) error {
+	if len(participants) < ConfigMinimumParticipants {
+		return ErrConfigParticipants
+	}
+
+	current := make(map[Identity]bool)
+	for k := range c.participants {
+		current[c.participants[k]] = true
+	}
+
+	retained := 0
+	seen := make(map[Identity]bool)
+	for k := range participants {
+		// public keys can only be validated with the default identity
+		// derivation, as VerifyConfig does
+		if !c.customIdentity {
+			if _, err := IdentityToPubKey(participants[k], c.curve); err != nil {
+				return ErrConfigInvalidParticipantKey
+			}
+		}
+
+		if seen[participants[k]] {
+			return ErrConfigDuplicateParticipant
+		}
+		seen[participants[k]] = true
+
+		if current[participants[k]] {
+			retained++
+		}
+	}
+
+	newT := (len(participants) - 1) / 3
+	if retained < 2*c.t()+1 || retained < 2*newT+1 {
+		return ErrUnsafeSetChange
+	}
+
+	c.pendingParticipants = make([]Identity, len(participants))
+	copy(c.pendingParticipants, participants)
+	return nil
+}
+
+// RotateKey stages a new private key to sign messages from the next height,
+// the switch happens at the height boundary, so messages in a height are
+// always signed by the same key.
+//
+// The identity of the new key must be in the consensus group of the next
+// height, so the rotation must be coordinated with ChangeParticipants on all
+// participants, which maps the old identity to the new one at the same height,
+// ChangeParticipants must be called before RotateKey on the rotating node.
+// ErrRotateKeyNotParticipant will be returned if the new identity is not
+// in the next consensus group.
+//
+// NOTE: peers authenticated with the old key should re-authenticate with the
+// new key to deliver messages based on the new identity.
+func (c *Consensus) RotateKey(newKey *ecdsa.PrivateKey) error {
+	if newKey == nil {
+		return ErrConfigPrivateKey
+	}
+
+	next := c.participants
+	if c.pendingParticipants != nil {
+		next = c.pendingParticipants
+	}
+
+	identity := c.pubKeyToIdentity(&newKey.PublicKey)
+	for k := range next {
+		if next[k] == identity {
+			c.pendingKey = newKey
+			return nil
+		}
+	}
+	return ErrRotateKeyNotParticipant
+}
+
 // Propose adds a new state to unconfirmed queue to particpate in
-// consensus at next height.
-func (c *Consensus) Propose(s State) {
+// consensus at next height, ErrStateTooLarge will be returned if
+// the state exceeded Config.MaxStateSize.
+func (c *Consensus) Propose(s State) error {
 	if s == nil {
-		return
+		return nil
+	}
+
+	if c.maxStateSize > 0 && len(s) > c.maxStateSize {
+		return ErrStateTooLarge
 	}
 
 	sHash := c.stateHash(s)
 	for k := range c.unconfirmed {
 		if c.stateHash(c.unconfirmed[k]) == sHash {
-			return
+			return nil
 		}
 	}
 	c.unconfirmed = append(c.unconfirmed, s)
+	return nil
+}
+
+// ProposeWithDeadline is like Propose, but the state will be abandoned by
+// Update after the deadline if it has not been decided, it won't be proposed
+// in later rounds, and Config.OnProposalExpired will be called.
+//
+// A state which has been locked by other participants may still be decided
+// after the deadline, as locks cannot be withdrawn safely.
+func (c *Consensus) ProposeWithDeadline(s State, deadline time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	if err := c.Propose(s); err != nil {
+		return err
+	}
+
+	if c.deadlines == nil {
+		c.deadlines = make(map[StateHash]time.Time)
+	}
+	c.deadlines[c.stateHash(s)] = deadline
+	return nil
+}
+
+// expireProposals removes unconfirmed states whose deadline has passed
+func (c *Consensus) expireProposals(now time.Time) {
+	if len(c.deadlines) == 0 {
+		return
+	}
+
+	var expired []State
+	remaining := c.unconfirmed[:0]
+	for _, s := range c.unconfirmed {
+		hash := c.stateHash(s)
+		if deadline, ok := c.deadlines[hash]; ok && !now.Before(deadline) {
+			delete(c.deadlines, hash)
+			expired = append(expired, s)
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	c.unconfirmed = remaining
+
+	if c.onProposalExpired != nil {
+		for _, s := range expired {
+			c.onProposalExpired(s)
+		}
+	}
+}
+
+// ReceiveMessages processes a batch of incoming consensus messages in order
+// with the same time, errors are returned per message. Consensus is not safe
+// for concurrent use, a batch can be processed with the caller's lock held
+// once, ie. for replaying traces.
+func (c *Consensus) ReceiveMessages(batch [][]byte, now time.Time) []error {
+	c.Preverify(batch)
+	defer c.Preverify(nil)
+
+	errs := make([]error, len(batch))
+	for k := range batch {
+		errs[k] = c.ReceiveMessage(batch[k], now)
+	}
+	return errs
+}
+
+// Preverify verifies the signatures of a batch of messages ahead in
+// VerifyConcurrency goroutines, the following ReceiveMessage calls look up the
+// valid signatures until Preverify is called with nil batch, ie. for callers
+// checking the state after each message.
+func (c *Consensus) Preverify(batch [][]byte) {
+	if c.verifyConcurrency <= 1 || len(batch) <= 1 {
+		c.verifiedSignatures = nil
+		return
+	}
+	c.preverify(batch)
+}
+
+// preverify verifies the signatures of messages in batch, along with their
+// proofs, in verifyConcurrency goroutines, valid signatures are cached for
+// verifyMessage until the batch has been processed.
+func (c *Consensus) preverify(batch [][]byte) {
+	var signed []*SignedProto
+	for k := range batch {
+		sp := new(SignedProto)
+		if err := proto.Unmarshal(batch[k], sp); err != nil {
+			continue
+		}
+		signed = append(signed, sp)
+		if m, err := UnmarshalMessageLimit(sp.Message, len(c.participants)); err == nil {
+			signed = append(signed, m.Proof...)
+		}
+	}
+
+	valid := make([]bool, len(signed))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < c.verifyConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				valid[k] = c.verifyParticipantSignature(signed[k])
+			}
+		}()
+	}
+	for k := range signed {
+		jobs <- k
+	}
+	close(jobs)
+	wg.Wait()
+
+	c.verifiedSignatures = make(map[string]bool)
+	for k := range signed {
+		if valid[k] {
+			c.verifiedSignatures[signatureKey(signed[k])] = true
+		}
+	}
+}
+
+// signatureKey identifies a signature along with the signed content
+func signatureKey(signed *SignedProto) string {
+	return string(signed.Hash()) + string(signed.R) + string(signed.S)
+}
+
+// verifySignature verifies the signature of a message, or looks it up from
+// the signatures verified ahead by preverify.
+func (c *Consensus) verifySignature(signed *SignedProto) bool {
+	if c.verifiedSignatures != nil && c.verifiedSignatures[signatureKey(signed)] {
+		return true
+	}
+	return c.verifyParticipantSignature(signed)
+}
+
+// verifyParticipantSignature verifies the signature of a message against the
+// cached public key of the signer, the key is rebuilt from the message if the
+// signer is not a participant.
+func (c *Consensus) verifyParticipantSignature(signed *SignedProto) bool {
+	if pubkey, ok := c.participantKeys[signed.coordinate()]; ok {
+		return signed.verifyKey(pubkey)
+	}
+	return signed.Verify(c.curve)
+}
+
+// cacheParticipantKeys parses and validates the public keys of participants
+// once, instead of on each signature verification.
+func (c *Consensus) cacheParticipantKeys() {
+	c.participantKeys = make(map[Coordinate]*ecdsa.PublicKey, len(c.participants))
+	for _, identity := range c.participants {
+		if pubkey, err := IdentityToPubKey(identity, c.curve); err == nil {
+			c.participantKeys[IdentityToCoordinate(identity)] = pubkey
+		}
+	}
 }
 
 // ReceiveMessage processes incoming consensus messages, and returns error
 // if message cannot be processed for some reason.
-func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
+func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) (err error) {
+	now = c.clampTime(now)
+	height, round, stage := c.latestHeight, c.currentRound, c.currentRound.Stage
 	defer func() {
 		// broadcasting messages to myself may be queued recursively, and
 		// we only process these messages in defer to avoid side effects
@@ -1177,26 +1958,71 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 			// NOTE: message directed to myself ignores error.
 			_ = c.ReceiveMessage(bts, now)
 		}
+
+		// replay reordered messages if consensus has progressed
+		if c.latestHeight != height || c.currentRound != round || c.currentRound.Stage != stage {
+			c.replayReorderBuffer(now)
+		}
 	}()
 
 	// unmarshal signed message
 	signed := new(SignedProto)
-	err := proto.Unmarshal(bts, signed)
+	err = proto.Unmarshal(bts, signed)
 	if err != nil {
 		return err
 	}
 
-	// check message version
+	// check message version before verifying, the signature covers the
+	// version, a message of another version would fail as a bad signature
 	if signed.Version != ProtocolVersion {
-		return ErrMessageVersion
+		if c.onProtocolVersionMismatch != nil {
+			c.onProtocolVersionMismatch(signed.Version, signed)
+		}
+		return ErrProtocolVersionMismatch
 	}
 
 	// check message signature & qualifications
 	m, err := c.verifyMessage(signed)
 	if err != nil {
+		// a diff against the state of current height is applied once
+		// current height is decided
+		if err == ErrStateDiffGap {
+			c.bufferStateDiff(bts, signed)
+		}
+
+		// a participant reset late handshakes by a decided height
+		if err == ErrMessageStale {
+			c.verifyStaleHandshake(signed)
+		}
+
+		// a <decide> of the next view syncs a node lagging behind the
+		// participants change, its signer may be a new participant
+		if err == ErrMessageView || (err == ErrMessageUnknownParticipant && c.pendingParticipants != nil) {
+			if m, err := c.verifyNextViewDecide(signed); err == nil {
+				c.syncDecide(bts, m, signed, now)
+				return nil
+			}
+		}
+		return err
+	}
+
+	// check the timing implied by the message round
+	if err := c.checkClockSkew(m, signed, now); err != nil {
 		return err
 	}
 
+	// participants must handshake the genesis after Reset
+	if err := c.checkResetHandshake(m, signed); err != nil {
+		return err
+	}
+
+	// count the message if it's accepted
+	defer func() {
+		if err == nil {
+			c.countReceived(m)
+		}
+	}()
+
 	// callback for incoming message
 	if c.messageValidator != nil {
 		if !c.messageValidator(c, m, signed) {
@@ -1210,7 +2036,7 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 		// nop does nothing
 		return nil
 	case MessageType_RoundChange:
-		err := c.verifyRoundChangeMessage(m)
+		err := c.verifyRoundChangeMessage(m, signed)
 		if err != nil {
 			return err
 		}
@@ -1223,10 +2049,11 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 		// NOTE: the total messages are bounded to max 2*participants
 		// at any time, so the loop has O(n) time complexity
 		var next *list.Element
+		identity := c.pubKeyToIdentity(signed.PublicKey(c.curve))
 		for elem := c.rounds.Front(); elem != nil; elem = next {
 			next = elem.Next()
 			cr := elem.Value.(*consensusRound)
-			if idx := cr.FindRoundChange(signed.X, signed.Y); idx != -1 { // located!
+			if idx := cr.FindRoundChange(identity); idx != -1 { // located!
 				if m.Round == c.currentRound.RoundNumber { // don't remove now!
 					continue
 				} else if cr.RoundNumber > m.Round {
@@ -1334,6 +2161,10 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 			c.switchRound(m.Round)
 		}
 
+		// a state rejected by the application policy is neither locked
+		// nor voted, so it won't be re-proposed in later rounds
+		accepted := c.acceptedByPolicy(m, signed)
+
 		// for rounds r' >= r, we must check to enter commit status
 		// only once to prevent resetting commitTimeout or shifting c.cstage
 		if c.currentRound.Stage < stageCommit {
@@ -1352,7 +2183,13 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 			}
 			c.locks = c.locks[:o]
 			// append the new element
-			c.locks = append(c.locks, messageTuple{StateHash: mHash, Message: m, Signed: signed})
+			if accepted {
+				c.locks = append(c.locks, messageTuple{StateHash: mHash, Message: m, Signed: signed})
+			}
+		}
+
+		if !accepted {
+			return nil
 		}
 
 		// for any incoming <lock,h,r,B'> message with r=r', sendCommit will send
@@ -1363,9 +2200,18 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 		// verifies the LockRelease field in message.
 		lockmsg, err := c.verifyLockReleaseMessage(m.LockRelease)
 		if err != nil {
+			// <lock-release> may arrive before we enter lock-release stage
+			if err == ErrLockReleaseStatus {
+				c.bufferMessage(bts, m, signed)
+			}
 			return err
 		}
 
+		// never lock a state rejected by the application policy
+		if !c.acceptedByPolicy(lockmsg, m.LockRelease) {
+			return nil
+		}
+
 		// length of locks is 0, append and return.
 		if len(c.locks) == 0 {
 			c.locks = append(c.locks, messageTuple{StateHash: c.stateHash(lockmsg.State), Message: lockmsg, Signed: m.LockRelease})
@@ -1397,18 +2243,31 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 		if leaderKey == c.identity {
 			// verify commit message.
 			// NOTE: leader only accept commits for current height & round.
-			err := c.verifyCommitMessage(m)
+			err := c.verifyCommitMessage(m, signed)
 			if err != nil {
+				// <commit> may arrive before the leader enters commit stage
+				if err == ErrCommitStatus || err == ErrCommitRoundMismatch {
+					c.bufferMessage(bts, m, signed)
+				}
 				return err
 			}
 
+			// acknowledge the unicast <commit>, duplicates included, as the
+			// previous <commit-ack> may have been lost
+			c.ackCommit(m, signed)
+
 			// verifyCommitMessage can guarantee that the message is to currentRound,
 			// so we're safe to process in current round.
 			if c.currentRound.AddCommit(signed, m) {
+				// a <commit> replies my <lock> of this round
+				if c.pubKeyToIdentity(signed.PublicKey(c.curve)) != c.identity && !c.lockSentAt.IsZero() {
+					c.rtt.observe(now.Sub(c.lockSentAt))
+				}
+
 				// NOTE: we proceed the following only when AddCommit returns true.
-				// NumCommitted will only return commits with locked B'
+				// CommittedSigners will only return commits with locked B'
 				// and ignore non-B' commits.
-				if c.currentRound.NumCommitted() >= 2*c.t()+1 {
+				if c.isDecideQuorum(c.currentRound.CommittedSigners()) {
 					/*
 						log.Println("======= LEADER'S DECIDE=====")
 						log.Println("Height:", c.currentHeight+1)
@@ -1418,6 +2277,9 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 
 					// broadcast decide will return what it has sent
 					c.latestProof = c.broadcastDecide()
+					c.checkDecision(c.latestHeight+1, c.currentRound.RoundNumber, c.currentRound.LockedState, c.latestProof)
+					c.archiveJustification(c.latestHeight+1, c.currentRound.SignedCommits())
+					c.observeHeightMessages()
 					c.heightSync(c.latestHeight+1, c.currentRound.RoundNumber, c.currentRound.LockedState, now)
 					// leader should wait for 1 more latency
 					c.rcTimeout = now.Add(c.roundchangeDuration(0) + c.latency)
@@ -1427,33 +2289,218 @@ func (c *Consensus) ReceiveMessage(bts []byte, now time.Time) error {
 			}
 		}
 
+	case MessageType_CommitAck:
+		// only the leader we're waiting for can acknowledge
+		p := c.pendingCommit
+		if p != nil && p.height == m.Height && p.round == m.Round && c.pubKeyToIdentity(signed.PublicKey(c.curve)) == p.leader {
+			// the round-trip is ambiguous once retransmitted
+			if p.left == c.commitRetransmits {
+				c.rtt.observe(now.Sub(p.sentAt))
+			}
+			c.pendingCommit = nil
+		}
+
 	case MessageType_Decide:
 		err := c.verifyDecideMessage(m, signed)
 		if err != nil {
 			return err
 		}
-
-		// record this proof for chaining
-		c.latestProof = signed
-
-		// propagate this <decide> message to my neighbour.
-		// NOTE: verifyDecideMessage() can stop broadcast storm.
-		c.propagate(bts)
-		// passive confirmation from the leader.
-		c.heightSync(m.Height, m.Round, m.State, now)
-		// non-leader starts waiting for rcTimeout
-		c.rcTimeout = now.Add(c.roundchangeDuration(0))
-		// we sync our height and broadcast new <roundchange>.
-		c.broadcastRoundChange()
+		c.syncDecide(bts, m, signed, now)
 	default:
 		return ErrMessageUnknownMessageType
 	}
 	return nil
 }
 
+// syncDecide syncs to the height of a verified <decide> message
+func (c *Consensus) syncDecide(bts []byte, m *Message, signed *SignedProto, now time.Time) {
+	// record this proof for chaining
+	c.latestProof = signed
+
+	// propagate this <decide> message to my neighbour.
+	// NOTE: verifyDecideMessage() can stop broadcast storm.
+	c.propagate(bts)
+	// passive confirmation from the leader.
+	c.checkDecision(m.Height, m.Round, m.State, signed)
+	c.archiveJustification(m.Height, m.Proof)
+	c.observeHeightMessages()
+	c.heightSync(m.Height, m.Round, m.State, now)
+	// non-leader starts waiting for rcTimeout
+	c.rcTimeout = now.Add(c.roundchangeDuration(0))
+	// we sync our height and broadcast new <roundchange>.
+	c.broadcastRoundChange()
+}
+
+// verifyNextViewDecide verifies a <decide> message of the next view against
+// the staged participants, the change has taken effect on the other
+// participants while I'm lagging behind.
+func (c *Consensus) verifyNextViewDecide(signed *SignedProto) (*Message, error) {
+	if c.pendingParticipants == nil {
+		return nil, ErrMessageView
+	}
+
+	participants, keys := c.participants, c.participantKeys
+	c.participants = c.pendingParticipants
+	c.view++
+	c.cacheParticipantKeys()
+	defer func() {
+		c.participants, c.participantKeys = participants, keys
+		c.view--
+	}()
+
+	m, err := c.verifyMessage(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Type != MessageType_Decide {
+		return nil, ErrMessageView
+	}
+
+	if err := c.verifyDecideMessage(m, signed); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// bufferMessage keeps a message of current height whose preconditions are not
+// met yet, only messages within reorderRoundWindow rounds are kept, and at most
+// reorderPerSigner messages from a signer.
+func (c *Consensus) bufferMessage(bts []byte, m *Message, signed *SignedProto) {
+	if m.Height != c.latestHeight+1 || m.Round < c.currentRound.RoundNumber {
+		return
+	}
+
+	if m.Round > c.currentRound.RoundNumber+reorderRoundWindow {
+		return
+	}
+
+	c.reorderBuffer = c.appendBuffered(c.reorderBuffer, bts, signed)
+}
+
+// bufferStateDiff keeps a message of next height whose state diff is against
+// the state of current height, at most reorderPerSigner messages from a signer.
+// Diffs of later heights are dropped, the proposers fall back to full states
+// after round 0.
+func (c *Consensus) bufferStateDiff(bts []byte, signed *SignedProto) {
+	var m Message
+	if err := proto.Unmarshal(signed.Message, &m); err != nil {
+		return
+	}
+
+	if m.Height != c.latestHeight+2 {
+		return
+	}
+	c.diffBuffer = c.appendBuffered(c.diffBuffer, bts, signed)
+}
+
+// appendBuffered appends a message to buf unless it's buffered already or
+// its signer has reorderPerSigner messages in buf.
+func (c *Consensus) appendBuffered(buf []bufferedMessage, bts []byte, signed *SignedProto) []bufferedMessage {
+	signer := c.pubKeyToIdentity(signed.PublicKey(c.curve))
+	count := 0
+	for k := range buf {
+		if bytes.Equal(buf[k].bts, bts) {
+			return buf
+		}
+		if buf[k].signer == signer {
+			count++
+		}
+	}
+
+	if count >= reorderPerSigner {
+		return buf
+	}
+	return append(buf, bufferedMessage{bts, signer})
+}
+
+// replayReorderBuffer feeds buffered messages into consensus again, messages
+// still not applicable will be buffered again.
+func (c *Consensus) replayReorderBuffer(now time.Time) {
+	msgs := c.reorderBuffer
+	c.reorderBuffer = nil
+	for k := range msgs {
+		_ = c.ReceiveMessage(msgs[k].bts, now)
+	}
+}
+
+// clampTime keeps the time fed into the state machine non-decreasing, a backward
+// step(like NTP correction) is clamped to the latest time seen and reported
+// to OnClockBackward. A forward step is clamped to maxTimeStep if set.
+// Comparisons use the monotonic clock reading if both times have one, as
+// time.Now() does.
+func (c *Consensus) clampTime(now time.Time) time.Time {
+	if now.Before(c.lastNow) {
+		if c.onClockBackward != nil {
+			c.onClockBackward(c.lastNow, now)
+		}
+		return c.lastNow
+	}
+
+	if c.maxTimeStep > 0 && !c.lastNow.IsZero() && now.Sub(c.lastNow) > c.maxTimeStep {
+		now = c.lastNow.Add(c.maxTimeStep)
+	}
+	c.lastNow = now
+	return now
+}
+
+// minRoundElapsed returns the minimum time to reach round r from round 0 of
+// a height, ie. the sum of roundchangeDuration of rounds 0..r-1, capped to
+// the maximum duration.
+func (c *Consensus) minRoundElapsed(r uint64) time.Duration {
+	const maxDuration = time.Duration(1<<63 - 1)
+	// latency * r * (r+1)
+	if r >= 1<<31 {
+		return maxDuration
+	}
+	n := time.Duration(r * (r + 1))
+	if c.latency > 0 && n > maxDuration/c.latency {
+		return maxDuration
+	}
+	return c.latency * n
+}
+
+// checkClockSkew rejects messages of the next height whose round implies
+// the signer has spent more time on the height than the local window plus
+// maxClockSkew, the local window is the larger of the elapsed time and the
+// time implied by the current round. Messages proven by a quorum, ie. <decide>,
+// and <lock>, <select>, <lock-release> carrying <roundchange> proofs, are
+// exempted, as a lagging node must be able to catch up.
+func (c *Consensus) checkClockSkew(m *Message, signed *SignedProto, now time.Time) error {
+	if c.maxClockSkew <= 0 || c.heightStart.IsZero() || m.Height != c.latestHeight+1 {
+		return nil
+	}
+
+	switch m.Type {
+	case MessageType_Decide, MessageType_Lock, MessageType_Select, MessageType_LockRelease:
+		return nil
+	}
+
+	elapsed := now.Sub(c.heightStart)
+	if c.currentRound != nil {
+		if implied := c.minRoundElapsed(c.currentRound.RoundNumber); implied > elapsed {
+			elapsed = implied
+		}
+	}
+
+	skew := c.minRoundElapsed(m.Round) - elapsed
+	if skew > c.maxClockSkew {
+		if c.onClockSkew != nil {
+			c.onClockSkew(c.pubKeyToIdentity(signed.PublicKey(c.curve)), m, skew)
+		}
+		return ErrClockSkew
+	}
+	return nil
+}
+
 // Update will process timing event for the state machine, callers
 // from outside MUST call this function periodically(like 20ms).
 func (c *Consensus) Update(now time.Time) error {
+	now = c.clampTime(now)
+	if c.heightStart.IsZero() {
+		c.heightStart = now // the first height opens
+	}
+	height, round, stage := c.latestHeight, c.currentRound, c.currentRound.Stage
 	// as in ReceiveMessage, we also need to handle broadcasting messages
 	// directed to myself.
 	defer func() {
@@ -1462,8 +2509,18 @@ func (c *Consensus) Update(now time.Time) error {
 			c.loopback = c.loopback[1:]
 			_ = c.ReceiveMessage(bts, now)
 		}
+
+		// replay reordered messages if consensus has progressed
+		if c.latestHeight != height || c.currentRound != round || c.currentRound.Stage != stage {
+			c.replayReorderBuffer(now)
+		}
 	}()
 
+	c.updateReadiness()
+	c.expireProposals(now)
+	c.proposeEmpty(now)
+	c.retransmitCommit(now)
+
 	// stage switch
 	switch c.currentRound.Stage {
 	case stageRoundChanging:
@@ -1536,6 +2593,11 @@ func (c *Consensus) Update(now time.Time) error {
 			panic("lockRelease stage entered, but lockReleaseTimout not set")
 		}
 		if now.After(c.lockReleaseTimeout) {
+			// don't burn rounds while not ready
+			if !c.ready {
+				c.lockReleaseTimeout = now.Add(c.lockReleaseDuration(c.currentRound.RoundNumber))
+				return nil
+			}
 			c.currentRound.Stage = stageRoundChanging
 			// move to round +1 when lock release has timeout
 			c.switchRound(c.currentRound.RoundNumber + 1)
@@ -1553,12 +2615,19 @@ func (c *Consensus) CurrentState() (height uint64, round uint64, data State) {
 	return c.latestHeight, c.latestRound, c.latestState
 }
 
+// StateHash returns the hash identifying a state, computed by Config.HashFunc
+func (c *Consensus) StateHash(s State) StateHash { return c.stateHash(s) }
+
 // CurrentProof returns current <decide> message for current height
 func (c *Consensus) CurrentProof() *SignedProto { return c.latestProof }
 
 // SetLatency sets participants expected latency for consensus core
 func (c *Consensus) SetLatency(latency time.Duration) { c.latency = latency }
 
+// Latency returns the latency set by SetLatency, see Stats for the latency
+// estimated from observed round-trips.
+func (c *Consensus) Latency() time.Duration { return c.latency }
+
 // HasProposed checks whether some state has been proposed via <roundchange>
 func (c *Consensus) HasProposed(state State) bool {
 	stateHash := c.stateHash(state)
@@ -1573,6 +2642,55 @@ func (c *Consensus) HasProposed(state State) bool {
 	return false
 }
 
+// CurrentParticipants returns a copy of the participants in consensus group
+func (c *Consensus) CurrentParticipants() []Identity {
+	participants := make([]Identity, len(c.participants))
+	copy(participants, c.participants)
+	return participants
+}
+
+// Voters returns a copy of the identities which have contributed a <roundchange>
+// or <commit> message at the given height & round, the round will not be created
+// if it does not exist. Only the height in progress(latest height + 1) is tracked.
+func (c *Consensus) Voters(height uint64, round uint64) []Identity {
+	if height != c.latestHeight+1 {
+		return nil
+	}
+
+	var voters []Identity
+	seen := make(map[Identity]bool)
+	addVoters := func(tuples []messageTuple) {
+		for k := range tuples {
+			id := tuples[k].Identity
+			if !seen[id] {
+				seen[id] = true
+				voters = append(voters, id)
+			}
+		}
+	}
+
+	for elem := c.rounds.Front(); elem != nil; elem = elem.Next() {
+		cr := elem.Value.(*consensusRound)
+		if cr.RoundNumber == round {
+			addVoters(cr.roundChanges)
+			addVoters(cr.commits)
+			break
+		}
+	}
+	return voters
+}
+
+// ParticipantActivity returns the last time a verified signature of each
+// participant was observed, including the signatures in proofs. Participants
+// never observed are absent from the map.
+func (c *Consensus) ParticipantActivity() map[Identity]time.Time {
+	activity := make(map[Identity]time.Time, len(c.participantActivity))
+	for k, v := range c.participantActivity {
+		activity[k] = v
+	}
+	return activity
+}
+
 // Join adds a peer to consensus for message delivery, a peer is
 // identified by its address.
 func (c *Consensus) Join(p PeerInterface) bool {
@@ -1586,6 +2704,15 @@ func (c *Consensus) Join(p PeerInterface) bool {
 	return true
 }
 
+// View returns the configuration generation of the current participants, it
+// starts from Config.View and increments on every participants change.
+func (c *Consensus) View() uint64 { return c.view }
+
+// Peers returns the peers joined to consensus
+func (c *Consensus) Peers() []PeerInterface {
+	return append([]PeerInterface(nil), c.peers...)
+}
+
 // Leave removes a peer from consensus, identified by its address
 func (c *Consensus) Leave(addr net.Addr) bool {
 	for k := range c.peers {
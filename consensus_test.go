@@ -4,21 +4,26 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	fmt "fmt"
 	"io"
 	"log"
 	math "math"
 	mrand "math/rand"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/Sperax/bdls/crypto/blake2b"
@@ -37,13 +42,13 @@ func init() {
 
 // (testing augumented function) SetLeader sets a fixed leader for consensus
 func (c *Consensus) SetLeader(key *ecdsa.PublicKey) {
-	coord := DefaultPubKeyToIdentity(key)
+	coord := c.pubKeyToIdentity(key)
 	c.fixedLeader = &coord
 }
 
 // (testing augumented function) AddParticipant add a new participant in the quorum
 func (c *Consensus) AddParticipant(key *ecdsa.PublicKey) {
-	coord := DefaultPubKeyToIdentity(key)
+	coord := c.pubKeyToIdentity(key)
 	for k := range c.participants {
 		if c.participants[k] == coord {
 			return
@@ -54,7 +59,7 @@ func (c *Consensus) AddParticipant(key *ecdsa.PublicKey) {
 
 // createConsensus creates a valid consensus object with given height & round and random state
 // the c.particpants[0] will always be the consensus's publickey
-func createConsensus(t *testing.T, height uint64, round uint64, quorum []*ecdsa.PublicKey) *Consensus {
+func createConsensus(t testing.TB, height uint64, round uint64, quorum []*ecdsa.PublicKey) *Consensus {
 	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
 	assert.Nil(t, err)
 
@@ -63,6 +68,16 @@ func createConsensus(t *testing.T, height uint64, round uint64, quorum []*ecdsa.
 	_, err = io.ReadFull(rand.Reader, initialData)
 	assert.Nil(t, err)
 
+	consensus := new(Consensus)
+	consensus.init(createConfig(t, privateKey, height, quorum))
+	consensus.switchRound(round)
+
+	return consensus
+}
+
+// createConfig creates a valid config for privateKey at the given height, with
+// privateKey and quorum as participants
+func createConfig(t testing.TB, privateKey *ecdsa.PrivateKey, height uint64, quorum []*ecdsa.PublicKey) *Config {
 	// mock config
 	config := new(Config)
 	config.Epoch = time.Now()
@@ -78,12 +93,27 @@ func createConsensus(t *testing.T, height uint64, round uint64, quorum []*ecdsa.
 	for _, pubkey := range quorum {
 		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(pubkey))
 	}
+	return config
+}
 
-	consensus := new(Consensus)
-	consensus.init(config)
-	consensus.switchRound(round)
+// createTestKeys generates n private keys for participants
+func createTestKeys(t testing.TB, n int) []*ecdsa.PrivateKey {
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < n; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+	return keys
+}
 
-	return consensus
+// createTestPublicKeys returns the public keys of the participants
+func createTestPublicKeys(keys []*ecdsa.PrivateKey) []*ecdsa.PublicKey {
+	var publicKeys []*ecdsa.PublicKey
+	for _, key := range keys {
+		publicKeys = append(publicKeys, &key.PublicKey)
+	}
+	return publicKeys
 }
 
 // TestProposeMultipleRoundChanges for OOM attack
@@ -181,7 +211,9 @@ func TestMaximalLocked(t *testing.T) {
 
 	maximal := consensus.maximalLocked()
 	for k := range consensus.locks {
-		assert.True(t, consensus.stateCompare(maximal, consensus.locks[k].Message.State) >= 0)
+		r, err := consensus.stateCompare(maximal, consensus.locks[k].Message.State)
+		assert.Nil(t, err)
+		assert.True(t, r >= 0)
 	}
 }
 
@@ -372,6 +404,1667 @@ func TestCommitTimeout(t *testing.T) {
 	assert.Equal(t, 1, len(consensus.locks))
 }
 
+func TestProposeMaxStateSize(t *testing.T) {
+	consensus := createConsensus(t, 0, 0, nil)
+	consensus.maxStateSize = 1024
+
+	// at boundary
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.Propose(state))
+	assert.Equal(t, 1, len(consensus.unconfirmed))
+
+	// exceeded by 1 byte
+	state = make([]byte, 1025)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrStateTooLarge, consensus.Propose(state))
+	assert.Equal(t, 1, len(consensus.unconfirmed))
+}
+
+func TestReceiveMaxStateSize(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+	consensus.maxStateSize = 1024
+
+	// at boundary
+	state := make([]byte, 1024)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, state, privateKey)
+	bts, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+
+	// exceeded by 1 byte, rejected even if the signature is broken
+	state = make([]byte, 1025)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	_, signed, _ = createRoundChangeMessageSigner(t, 1, 0, state, privateKey)
+	signed.R = nil
+	bts, err = proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrStateTooLarge, consensus.ReceiveMessage(bts, time.Now()))
+}
+
+func TestReceiveTooManyProofs(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+
+	// a 200KB <lock> message declaring 100000 empty proofs
+	m := &Message{Type: MessageType_Lock, Height: 1, State: []byte("state")}
+	bts, err := MarshalMessage(m)
+	assert.Nil(t, err)
+	for i := 0; i < 100000; i++ {
+		bts = append(bts, 5<<3|2, 0)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		_, err := UnmarshalMessageLimit(bts, len(consensus.participants))
+		assert.Equal(t, ErrMessageTooManyProofs, err)
+	})
+	assert.True(t, allocs < 10)
+
+	// the proofs must be rejected before signature verification
+	signed := new(SignedProto)
+	signed.Sign(m, privateKey)
+	signed.Message = bts
+	out, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMessageTooManyProofs, consensus.ReceiveMessage(out, time.Now()))
+}
+
+func TestDuplicateVotesAcrossPeers(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+
+	// two connections authenticated as the same participant
+	assert.True(t, consensus.Join(&countingPeer{pubkey: &keys[0].PublicKey}))
+	assert.True(t, consensus.Join(&countingPeer{pubkey: &keys[0].PublicKey}))
+
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	// the same <roundchange> delivered by both connections counts once
+	_, rc, _ := createRoundChangeMessageSigner(t, 1, 0, state, keys[0])
+	bts, err := proto.Marshal(rc)
+	assert.Nil(t, err)
+	now := time.Now()
+	assert.Nil(t, consensus.ReceiveMessage(bts, now))
+	assert.Nil(t, consensus.ReceiveMessage(bts, now))
+	assert.Equal(t, 1, consensus.currentRound.NumRoundChanges())
+
+	// a re-signed <roundchange> of the same participant counts once too
+	_, rc2, _ := createRoundChangeMessageSigner(t, 1, 0, state, keys[0])
+	bts, err = proto.Marshal(rc2)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, now))
+	assert.Equal(t, 1, consensus.currentRound.NumRoundChanges())
+
+	// duplicated proofs in a <lock> don't make up 2t+1
+	consensus.SetLeader(&keys[3].PublicKey)
+	m := &Message{Type: MessageType_Lock, Height: 1, Round: 0, State: state, Proof: []*SignedProto{rc, rc2, rc}}
+	sp := new(SignedProto)
+	sp.Sign(m, keys[3])
+	assert.Equal(t, ErrLockProofInsufficient, consensus.verifyLockMessage(m, sp))
+}
+
+func TestParticipantActivity(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	silent := DefaultPubKeyToIdentity(&keys[3].PublicKey)
+
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	// keys[3] never signs anything
+	start := time.Now()
+	for round := uint64(0); round < 2; round++ {
+		now := start.Add(time.Duration(round) * time.Second)
+		for i := 0; i < 3; i++ {
+			_, signed, _ := createRoundChangeMessageSigner(t, 1, round, state, keys[i])
+			bts, err := proto.Marshal(signed)
+			assert.Nil(t, err)
+			assert.Nil(t, consensus.ReceiveMessage(bts, now))
+		}
+	}
+
+	activity := consensus.ParticipantActivity()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, start.Add(time.Second), activity[DefaultPubKeyToIdentity(&keys[i].PublicKey)])
+	}
+	assert.True(t, activity[silent].Before(start))
+
+	// messages with invalid signatures are not counted
+	_, signed, _ := createRoundChangeMessageSigner(t, 1, 2, state, keys[3])
+	signed.R = nil
+	bts, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMessageSignature, consensus.ReceiveMessage(bts, start.Add(2*time.Second)))
+	_, ok := consensus.ParticipantActivity()[silent]
+	assert.False(t, ok)
+}
+
+// createIPCPeers creates fully connected IPC peers for the given participants,
+// setup will be called on each config if not nil.
+func createIPCPeers(t *testing.T, keys []*ecdsa.PrivateKey, setup func(*Config)) []*IPCPeer {
+	pubKeyToIdentity := DefaultPubKeyToIdentity
+	if setup != nil {
+		template := new(Config)
+		setup(template)
+		if template.PubKeyToIdentity != nil {
+			pubKeyToIdentity = template.PubKeyToIdentity
+		}
+	}
+
+	var participants []Identity
+	for i := range keys {
+		participants = append(participants, pubKeyToIdentity(&keys[i].PublicKey))
+	}
+
+	var peers []*IPCPeer
+	epoch := time.Now()
+	for i := range keys {
+		config := new(Config)
+		config.Epoch = epoch
+		config.PrivateKey = keys[i]
+		config.Participants = participants
+		config.StateCompare = func(a State, b State) int { return bytes.Compare(a, b) }
+		config.StateValidate = func(a State) bool { return true }
+		if setup != nil {
+			setup(config)
+		}
+
+		consensus, err := NewConsensus(config)
+		assert.Nil(t, err)
+		consensus.SetLatency(50 * time.Millisecond)
+		peers = append(peers, NewIPCPeer(consensus, 10*time.Millisecond))
+	}
+
+	for i := range peers {
+		for j := range peers {
+			if i != j {
+				assert.True(t, peers[i].c.Join(peers[j]))
+			}
+		}
+	}
+	return peers
+}
+
+// decideIPCHeight proposes random states on all peers, and waits until all
+// of them have confirmed the given height
+func decideIPCHeight(t *testing.T, peers []*IPCPeer, height uint64) {
+	for i := range peers {
+		data := make([]byte, 1024)
+		io.ReadFull(rand.Reader, data)
+		assert.Nil(t, peers[i].Propose(data))
+	}
+	waitIPCHeight(t, peers, height)
+}
+
+// waitIPCHeight waits until all peers have confirmed the given height
+func waitIPCHeight(t *testing.T, peers []*IPCPeer, height uint64) {
+	deadline := time.Now().Add(30 * time.Second)
+	for _, peer := range peers {
+		for {
+			newHeight, _, _ := peer.GetLatestState()
+			if newHeight >= height {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for height %v", height)
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestStateDiff(t *testing.T) {
+	// diff is a list of 4 bytes offset followed by the new byte
+	stateDiff := func(prev, next State) []byte {
+		if len(prev) != len(next) {
+			return nil
+		}
+		var diff []byte
+		for i := range next {
+			if prev[i] != next[i] {
+				var b [5]byte
+				binary.LittleEndian.PutUint32(b[:], uint32(i))
+				b[4] = next[i]
+				diff = append(diff, b[:]...)
+			}
+		}
+		return diff
+	}
+
+	stateApply := func(prev State, diff []byte) (State, error) {
+		if len(diff)%5 != 0 {
+			return nil, errors.New("malformed diff")
+		}
+		next := make(State, len(prev))
+		copy(next, prev)
+		for ; len(diff) > 0; diff = diff[5:] {
+			off := binary.LittleEndian.Uint32(diff)
+			if int(off) >= len(next) {
+				return nil, errors.New("offset out of range")
+			}
+			next[off] = diff[4]
+		}
+		return next, nil
+	}
+
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+
+	// record the size of <roundchange> messages on the wire at height 2
+	var mu sync.Mutex
+	var rcSizes []int
+	peers := createIPCPeers(t, keys, func(config *Config) {
+		config.StateDiff = stateDiff
+		config.StateApply = stateApply
+		config.MessageOutCallback = func(m *Message, signed *SignedProto) {
+			if m.Type == MessageType_RoundChange && m.Height == 2 && m.Round == 0 {
+				mu.Lock()
+				rcSizes = append(rcSizes, signed.Size())
+				mu.Unlock()
+			}
+		}
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	decideIPCHeight(t, peers, 1)
+
+	// propose states differ by one byte from the decided state
+	_, _, latest := peers[0].GetLatestState()
+	for i := range peers {
+		next := make(State, len(latest))
+		copy(next, latest)
+		next[i]++
+		assert.Nil(t, peers[i].Propose(next))
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, peer := range peers {
+		for {
+			height, _, state := peer.GetLatestState()
+			if height >= 2 {
+				// the decided state is reconstructed in full
+				assert.Equal(t, len(latest), len(state))
+				diff := stateDiff(latest, state)
+				assert.Equal(t, 5, len(diff))
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for height 2")
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, rcSizes)
+	for _, size := range rcSizes {
+		// a full <roundchange> carries the 1024 bytes state
+		assert.True(t, size < 256, "<roundchange> of %v bytes", size)
+	}
+}
+
+func TestStateDiffGap(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+	consensus.stateDiff = func(prev, next State) []byte { return []byte{0} }
+	consensus.stateApply = func(prev State, diff []byte) (State, error) { return State("next"), nil }
+
+	diffMessage := func(height uint64) []byte {
+		h := consensus.stateHash(State("next"))
+		m := Message{Type: MessageType_RoundChange, Height: height, StateDiff: []byte{0}, StateDiffHash: h[:]}
+		sp := new(SignedProto)
+		sp.Sign(&m, privateKey)
+		bts, err := proto.Marshal(sp)
+		assert.Nil(t, err)
+		return bts
+	}
+
+	// diffs against height 1 are kept until height 1 is decided
+	assert.Equal(t, ErrStateDiffGap, consensus.ReceiveMessage(diffMessage(2), time.Now()))
+	assert.Equal(t, ErrStateDiffGap, consensus.ReceiveMessage(diffMessage(3), time.Now()))
+	assert.Equal(t, 1, len(consensus.diffBuffer))
+
+	consensus.heightSync(1, 0, State("state"), time.Now())
+	assert.Equal(t, 0, len(consensus.diffBuffer))
+	assert.Equal(t, 1, len(consensus.reorderBuffer))
+	assert.Nil(t, consensus.ReceiveMessage(diffMessage(2), time.Now()))
+
+	// proposals carry full states after round 0
+	var sent []*Message
+	consensus.messageOutCallback = func(m *Message, sp *SignedProto) { sent = append(sent, m) }
+	assert.Nil(t, consensus.Propose(State("proposal")))
+	consensus.broadcastRoundChange()
+	consensus.switchRound(1)
+	consensus.broadcastRoundChange()
+	assert.Equal(t, 2, len(sent))
+	assert.NotNil(t, sent[0].StateDiff)
+	assert.Nil(t, sent[0].State)
+	assert.Nil(t, sent[1].StateDiff)
+	assert.Equal(t, []byte("proposal"), sent[1].State)
+}
+
+func TestEmptyProposalAfter(t *testing.T) {
+	empty := State("empty")
+	peers := createIPCPeers(t, createTestKeys(t, 4), func(config *Config) {
+		config.EmptyProposalAfter = 100 * time.Millisecond
+		config.EmptyState = empty
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	// no proposals from application at all
+	for i := range peers {
+		peers[i].Update()
+	}
+	waitIPCHeight(t, peers, 3)
+	for _, peer := range peers {
+		_, _, state := peer.GetLatestState()
+		assert.Equal(t, empty, state)
+	}
+}
+
+func TestCommitUnicast(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+
+	// number of <commit> messages received by all participants
+	countCommits := func(unicast bool) int64 {
+		var commits int64
+		peers := createIPCPeers(t, keys, func(config *Config) {
+			config.EnableCommitUnicast = unicast
+			config.MessageValidator = func(c *Consensus, m *Message, signed *SignedProto) bool {
+				if m.Type == MessageType_Commit {
+					atomic.AddInt64(&commits, 1)
+				}
+				return true
+			}
+		})
+		defer func() {
+			for _, peer := range peers {
+				peer.Close()
+			}
+		}()
+
+		for i := range peers {
+			peers[i].Update()
+		}
+		for height := uint64(1); height <= 3; height++ {
+			decideIPCHeight(t, peers, height)
+		}
+		return atomic.LoadInt64(&commits)
+	}
+
+	broadcast := countCommits(false)
+	unicast := countCommits(true)
+	t.Log("<commit> messages received, broadcast:", broadcast, "unicast:", unicast)
+	assert.True(t, unicast < broadcast)
+}
+
+func TestCommitRetransmits(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+
+	// decide returns the round of the first <commit> dropped and the round
+	// decided, while the first <commit> of every other participant to the
+	// leader is dropped
+	decide := func(retransmits int) (droppedRound uint64, decidedRound uint64) {
+		var mu sync.Mutex
+		dropped := make(map[Identity]bool)
+		droppedRound = ^uint64(0)
+		peers := createIPCPeers(t, keys, func(config *Config) {
+			config.EnableCommitUnicast = true
+			config.CommitRetransmits = retransmits
+			config.MessageValidator = func(c *Consensus, m *Message, signed *SignedProto) bool {
+				if m.Type != MessageType_Commit {
+					return true
+				}
+				signer := c.pubKeyToIdentity(signed.PublicKey(c.curve))
+				if signer == c.identity {
+					return true
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if !dropped[signer] {
+					dropped[signer] = true
+					if m.Round < droppedRound {
+						droppedRound = m.Round
+					}
+					return false
+				}
+				return true
+			}
+		})
+		defer func() {
+			for _, peer := range peers {
+				peer.Close()
+			}
+		}()
+
+		for i := range peers {
+			peers[i].Update()
+		}
+		decideIPCHeight(t, peers, 1)
+		_, decidedRound, _ = peers[0].GetLatestState()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return droppedRound, decidedRound
+	}
+
+	// the dropped commits are retransmitted, and decided in the same round
+	droppedRound, decidedRound := decide(3)
+	assert.Equal(t, droppedRound, decidedRound)
+
+	// otherwise the round times out
+	droppedRound, decidedRound = decide(0)
+	assert.True(t, decidedRound > droppedRound)
+}
+
+func TestRoundLeader(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var participants []Identity
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		participants = append(participants, DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+
+	// the formula
+	for round := uint64(0); round < 12; round++ {
+		assert.Equal(t, participants[round%4], RoundLeader(participants, round))
+	}
+	assert.Equal(t, participants[3], RoundLeader(participants, ^uint64(0)))
+
+	// the leaders of a running consensus, observed by the signers of <lock>
+	// and <select> messages
+	var mu sync.Mutex
+	leaders := make(map[[2]uint64]Identity)
+	peers := createIPCPeers(t, keys, func(config *Config) {
+		config.MessageValidator = func(c *Consensus, m *Message, signed *SignedProto) bool {
+			if m.Type == MessageType_Lock || m.Type == MessageType_Select {
+				mu.Lock()
+				leaders[[2]uint64{m.Height, m.Round}] = c.pubKeyToIdentity(signed.PublicKey(c.curve))
+				mu.Unlock()
+			}
+			return true
+		}
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Lock()
+		for round := uint64(0); round < 8; round++ {
+			assert.Equal(t, RoundLeader(participants, round), peers[i].c.Leader(round))
+		}
+		peers[i].Unlock()
+		peers[i].Update()
+	}
+	for height := uint64(1); height <= 3; height++ {
+		decideIPCHeight(t, peers, height)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, len(leaders) >= 3)
+	for hr, leader := range leaders {
+		assert.Equal(t, RoundLeader(participants, hr[1]), leader, "height %v round %v", hr[0], hr[1])
+	}
+}
+
+func TestProposalPolicy(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var participants []Identity
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		participants = append(participants, DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+
+	// every participant abstains from the states proposed by the first
+	// leader to lock a state
+	var mu sync.Mutex
+	var banned *Identity
+	var rejected int
+	peers := createIPCPeers(t, keys, func(config *Config) {
+		config.ProposalPolicy = func(height uint64, proposer Identity, s State) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if banned == nil {
+				banned = &proposer
+			}
+			if proposer == *banned {
+				rejected++
+				return false
+			}
+			return true
+		}
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	for height := uint64(1); height <= 3; height++ {
+		decideIPCHeight(t, peers, height)
+
+		// decided in a round led by others
+		_, round, _ := peers[0].GetLatestState()
+		mu.Lock()
+		assert.NotEqual(t, *banned, RoundLeader(participants, round))
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, rejected >= len(peers))
+}
+
+func TestProposalPolicyLock(t *testing.T) {
+	m, sp, privateKey, proofKeys := createLockMessage(t, 20, 1, 10, 1, 10)
+	consensus := createConsensus(t, 0, 1, proofKeys)
+	consensus.SetLeader(&privateKey.PublicKey)
+	consensus.AddParticipant(&privateKey.PublicKey)
+	consensus.proposalPolicy = func(height uint64, proposer Identity, s State) bool {
+		return !bytes.Equal(s, m.State)
+	}
+
+	var sent []*Message
+	consensus.messageOutCallback = func(m *Message, sp *SignedProto) { sent = append(sent, m) }
+
+	// a rejected <lock> is neither locked nor voted
+	bts, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, 0, len(consensus.locks))
+	assert.Equal(t, 0, len(sent))
+
+	// nor locked through a <lock-release>
+	lockrelease := &Message{Type: MessageType_LockRelease, LockRelease: sp}
+	signed := new(SignedProto)
+	signed.Sign(lockrelease, privateKey)
+	bts, err = proto.Marshal(signed)
+	assert.Nil(t, err)
+	consensus.currentRound.Stage = stageLockRelease
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, 0, len(consensus.locks))
+
+	// the next <roundchange> proposes my own state instead
+	state := make([]byte, 1024)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	consensus.Propose(state)
+	consensus.currentRound.Stage = stageRoundChanging
+	consensus.broadcastRoundChange()
+	if assert.NotEqual(t, 0, len(sent)) {
+		last := sent[len(sent)-1]
+		assert.Equal(t, MessageType_RoundChange, last.Type)
+		assert.Equal(t, state, last.State)
+	}
+}
+
+func TestProposeWithDeadline(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+
+	// a state which will never be accepted
+	rejected := State("rejected")
+	empty := State("empty")
+	var mu sync.Mutex
+	var expired []State
+	peers := createIPCPeers(t, keys, func(config *Config) {
+		config.StateValidate = func(s State) bool { return !bytes.Equal(s, rejected) }
+		config.EmptyProposalAfter = 500 * time.Millisecond
+		config.EmptyState = empty
+		config.OnProposalExpired = func(s State) {
+			mu.Lock()
+			expired = append(expired, s)
+			mu.Unlock()
+		}
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	peers[0].Lock()
+	assert.Nil(t, peers[0].c.ProposeWithDeadline(rejected, time.Now().Add(200*time.Millisecond)))
+	peers[0].Unlock()
+	for i := range peers {
+		peers[i].Update()
+	}
+
+	// consensus proceeds with the empty state
+	deadline := time.Now().Add(30 * time.Second)
+	for _, peer := range peers {
+		for {
+			height, _, state := peer.GetLatestState()
+			if height >= 1 {
+				assert.Equal(t, empty, state)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("consensus has not proceeded after the deadline")
+			}
+			<-time.After(20 * time.Millisecond)
+		}
+	}
+
+	mu.Lock()
+	assert.Equal(t, []State{rejected}, expired)
+	mu.Unlock()
+}
+
+func TestQuorumFunc(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+
+	// 2t+1 signers, and the last participant must be one of them
+	required := DefaultPubKeyToIdentity(&keys[3].PublicKey)
+	quorum := func(signers []Identity) bool {
+		for _, signer := range signers {
+			if signer == required {
+				return len(signers) >= 3
+			}
+		}
+		return false
+	}
+
+	peers := createIPCPeers(t, keys, func(config *Config) { config.QuorumFunc = quorum })
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+	for _, peer := range peers {
+		peer.Update()
+	}
+	decideIPCHeight(t, peers, 1)
+
+	// every decision carries the required signature
+	for _, peer := range peers {
+		peer.Lock()
+		m, err := DecodeMessage(peer.c.CurrentProof().Message)
+		peer.Unlock()
+		assert.Nil(t, err)
+
+		var signed bool
+		for _, proof := range m.Proof {
+			if DefaultPubKeyToIdentity(proof.PublicKey(S256Curve)) == required {
+				signed = true
+			}
+		}
+		assert.True(t, signed)
+	}
+
+	// <decide> without the required signature is rejected, though it has 2t+1 commits
+	m, sp, privateKey, proofKeys := createDecideMessage(t, 4, 1, 0, 1, 0)
+	consensus := createConsensus(t, 0, 0, proofKeys)
+	consensus.SetLeader(&privateKey.PublicKey)
+	assert.Nil(t, consensus.verifyDecideMessage(m, sp))
+
+	required = DefaultPubKeyToIdentity(proofKeys[3]) // committed to another state
+	consensus.quorumFunc = quorum
+	assert.Equal(t, ErrDecideProofInsufficient, consensus.verifyDecideMessage(m, sp))
+
+	required = DefaultPubKeyToIdentity(proofKeys[1])
+	assert.Nil(t, consensus.verifyDecideMessage(m, sp))
+}
+
+func TestStateCompareBudget(t *testing.T) {
+	consensus := createConsensus(t, 0, 0, nil)
+	release := make(chan struct{})
+	defer close(release)
+	slow := func(a State, b State) int {
+		<-release
+		return bytes.Compare(a, b)
+	}
+
+	var timeouts int32
+	onTimeout := func(a State, b State) { atomic.AddInt32(&timeouts, 1) }
+	consensus.stateCompare = budgetedCompare(slow, 10*time.Millisecond, onTimeout)
+	assert.Nil(t, consensus.Propose(State("a")))
+	assert.Nil(t, consensus.Propose(State("b")))
+
+	// the slow comparison is abandoned, keeping the first state
+	start := time.Now()
+	assert.Equal(t, State("a"), consensus.maximalUnconfirmed())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&timeouts))
+
+	// a <select> message can't pass the maximality check by a slow comparison
+	m, sp, privateKey, proofKeys := createSelectMessage(t, 20, 1, 0, 1, 0)
+	selector := createConsensus(t, 0, 0, proofKeys)
+	selector.SetLeader(&privateKey.PublicKey)
+	selector.stateCompare = budgetedCompare(slow, 10*time.Millisecond, onTimeout)
+	assert.Equal(t, ErrStateCompareBudget, selector.verifySelectMessage(m, sp))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&timeouts))
+
+	// abandoned comparisons are bounded, further comparisons fail fast
+	for i := 1; i < maxAbandonedCompares; i++ {
+		_, err := consensus.stateCompare(State("a"), State("b"))
+		assert.Equal(t, ErrStateCompareBudget, err)
+	}
+	start = time.Now()
+	_, err := consensus.stateCompare(State("a"), State("b"))
+	assert.Equal(t, ErrStateCompareBudget, err)
+	assert.True(t, time.Since(start) < 10*time.Millisecond)
+	assert.Equal(t, int32(maxAbandonedCompares+1), atomic.LoadInt32(&timeouts))
+
+	// a fast comparison within the budget
+	consensus.stateCompare = budgetedCompare(func(a State, b State) int { return bytes.Compare(a, b) }, time.Second, onTimeout)
+	assert.Equal(t, State("b"), consensus.maximalUnconfirmed())
+	assert.Equal(t, int32(maxAbandonedCompares+1), atomic.LoadInt32(&timeouts))
+}
+
+// createSignedRoundChanges signs n <roundchange> messages by keys in turn
+func createSignedRoundChanges(t testing.TB, keys []*ecdsa.PrivateKey, n int) [][]byte {
+	var batch [][]byte
+	for i := 0; i < n; i++ {
+		m := Message{Type: MessageType_RoundChange, Height: 1, Round: uint64(i / len(keys)), State: State("state")}
+		sp := new(SignedProto)
+		sp.Sign(&m, keys[i%len(keys)])
+		bts, err := proto.Marshal(sp)
+		assert.Nil(t, err)
+		batch = append(batch, bts)
+	}
+	return batch
+}
+
+func TestVerifyConcurrency(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+
+	batch := createSignedRoundChanges(t, keys, 20)
+
+	// a forged signature, reusing the signature of another message
+	forged := new(SignedProto)
+	assert.Nil(t, proto.Unmarshal(batch[0], forged))
+	m := Message{Type: MessageType_RoundChange, Height: 1, Round: 0, State: State("forged")}
+	forged.Message, _ = proto.Marshal(&m)
+	bts, err := proto.Marshal(forged)
+	assert.Nil(t, err)
+	batch = append(batch, bts, []byte("malformed"))
+
+	var results [][]error
+	for _, concurrency := range []int{1, 4} {
+		consensus := createConsensus(t, 0, 0, quorum)
+		consensus.verifyConcurrency = concurrency
+		errs := consensus.ReceiveMessages(batch, time.Now())
+		assert.Nil(t, consensus.verifiedSignatures)
+		results = append(results, errs)
+	}
+
+	assert.Equal(t, results[0], results[1])
+	for k := 0; k < 20; k++ {
+		assert.Nil(t, results[1][k])
+	}
+	assert.Equal(t, ErrMessageSignature, results[1][20])
+	assert.NotNil(t, results[1][21])
+
+	// signatures verified ahead are kept until cleared
+	consensus := createConsensus(t, 0, 0, quorum)
+	consensus.verifyConcurrency = 4
+	consensus.Preverify(batch)
+	assert.Len(t, consensus.verifiedSignatures, 20)
+	for k := range batch {
+		assert.Equal(t, results[0][k], consensus.ReceiveMessage(batch[k], time.Now()))
+	}
+	consensus.Preverify(nil)
+	assert.Nil(t, consensus.verifiedSignatures)
+}
+
+func BenchmarkVerifyConcurrency(b *testing.B) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(b, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	batch := createSignedRoundChanges(b, keys, 1000)
+
+	for _, concurrency := range []int{1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprint(concurrency), func(b *testing.B) {
+			consensus := createConsensus(b, 0, 0, quorum)
+			consensus.verifyConcurrency = concurrency
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				consensus.ReceiveMessages(batch, time.Now())
+			}
+		})
+	}
+}
+
+func TestCustomPubKeyToIdentity(t *testing.T) {
+	// identities are prefixed, and never equal to the default ones
+	prefixed := func(pubkey *ecdsa.PublicKey) (ret Identity) {
+		id := DefaultPubKeyToIdentity(pubkey)
+		ret[0] = 0xAB
+		copy(ret[1:], id[:])
+		return ret
+	}
+
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+	}
+
+	// leader selection & vote accounting must use the prefixed identities
+	// to reach a decision
+	peers := createIPCPeers(t, keys, func(config *Config) { config.PubKeyToIdentity = prefixed })
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	decideIPCHeight(t, peers, 1)
+
+	peers[0].Lock()
+	for id := range peers[0].c.ParticipantActivity() {
+		assert.Equal(t, byte(0xAB), id[0])
+	}
+	peers[0].Unlock()
+}
+
+func TestReset(t *testing.T) {
+	peers := createIPCPeers(t, createTestKeys(t, 4), func(config *Config) { config.JustificationArchive = 2 })
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	decideIPCHeight(t, peers, 1)
+
+	// reset all participants to a new genesis
+	genesis := State("genesis")
+	for i := range peers {
+		peers[i].Lock()
+		assert.NotEqual(t, 0, len(peers[i].c.justifications))
+		peers[i].c.pendingCommit = &pendingCommit{}
+		peers[i].c.Reset(100, genesis)
+		peers[i].Unlock()
+
+		height, round, state := peers[i].GetLatestState()
+		assert.Equal(t, uint64(100), height)
+		assert.Equal(t, uint64(0), round)
+		assert.Equal(t, genesis, state)
+		peers[i].Lock()
+		assert.Nil(t, peers[i].c.CurrentProof())
+		assert.Nil(t, peers[i].c.pendingCommit)
+		assert.Equal(t, 0, len(peers[i].c.justifications))
+		_, ok := peers[i].c.Justification(1)
+		assert.False(t, ok)
+		peers[i].Unlock()
+	}
+
+	// consensus continues from the new genesis
+	decideIPCHeight(t, peers, 101)
+	for i := range peers {
+		height, _, _ := peers[i].GetLatestState()
+		assert.Equal(t, uint64(101), height)
+	}
+}
+
+func TestResetHandshake(t *testing.T) {
+	keys := createTestKeys(t, 3)
+	consensus := createConsensus(t, 0, 0, createTestPublicKeys(keys))
+	consensus.Reset(10, State("genesis"))
+
+	receive := func(height uint64, signer *ecdsa.PrivateKey) error {
+		_, signed, _ := createRoundChangeMessageSigner(t, height, 0, State("state"), signer)
+		bts, err := proto.Marshal(signed)
+		assert.Nil(t, err)
+		return consensus.ReceiveMessage(bts, time.Now())
+	}
+
+	// a participant which has not reset is rejected
+	assert.Equal(t, ErrMessageResetHandshake, receive(12, keys[0]))
+
+	// handshaked by a message of the genesis height
+	assert.Nil(t, receive(11, keys[0]))
+	assert.NotEqual(t, ErrMessageResetHandshake, receive(12, keys[0]))
+	assert.Equal(t, ErrMessageResetHandshake, receive(12, keys[1]))
+
+	// the guard is lifted once all participants have handshaked
+	assert.Nil(t, receive(11, keys[1]))
+	assert.Nil(t, receive(11, keys[2]))
+	assert.Nil(t, consensus.resetHandshake)
+}
+
+func TestHashFunc(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var participants []Identity
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		participants = append(participants, DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+
+	config := new(Config)
+	config.Epoch = time.Now()
+	config.PrivateKey = keys[0]
+	config.Participants = participants
+	config.StateCompare = func(a State, b State) int { return bytes.Compare(a, b) }
+	config.StateValidate = func(a State) bool { return true }
+	config.HashFunc = func(data []byte) []byte { h := sha256.Sum256(data); return h[:] }
+	consensus, err := NewConsensus(config)
+	assert.Nil(t, err)
+
+	state := make([]byte, 1024)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	assert.Equal(t, StateHash(sha256.Sum256(state)), consensus.stateHash(state))
+
+	// states in <roundchange> messages are identified by sha256
+	_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, state, keys[1])
+	bts, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+
+	round := consensus.getRound(0, false)
+	idx := round.FindRoundChange(participants[1])
+	assert.NotEqual(t, -1, idx)
+	assert.Equal(t, StateHash(sha256.Sum256(state)), round.roundChanges[idx].StateHash)
+}
+
+// countingPeer is a peer which counts messages sent to it, and keeps the last
+type countingPeer struct {
+	pubkey *ecdsa.PublicKey
+	sent   int64        // accessed atomically
+	last   atomic.Value // []byte
+}
+
+func (p *countingPeer) GetPublicKey() *ecdsa.PublicKey { return p.pubkey }
+func (p *countingPeer) RemoteAddr() net.Addr {
+	return fakeAddress(fmt.Sprint(unsafe.Pointer(p)))
+}
+func (p *countingPeer) Send(msg []byte) error {
+	atomic.AddInt64(&p.sent, 1)
+	p.last.Store(msg)
+	return nil
+}
+
+// scoredPeer records the order of sends into a shared log
+type scoredPeer struct {
+	countingPeer
+	score float64
+	log   *[]float64
+}
+
+func (p *scoredPeer) Score() float64 { return p.score }
+func (p *scoredPeer) Send(msg []byte) error {
+	*p.log = append(*p.log, p.score)
+	return nil
+}
+
+func TestSendOrderByScore(t *testing.T) {
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+
+	var sent []float64
+	for _, score := range []float64{0.2, 0.9, 0.5} {
+		assert.True(t, consensus.Join(&scoredPeer{score: score, log: &sent}))
+	}
+
+	consensus.propagate([]byte("message"))
+	assert.Equal(t, []float64{0.9, 0.5, 0.2}, sent)
+}
+
+func TestQuorumReadiness(t *testing.T) {
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 3; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	consensus.enableQuorumReadiness = true
+
+	var changes []bool
+	consensus.onReadyChange = func(ready bool, connected int) {
+		changes = append(changes, ready)
+		if ready {
+			assert.Equal(t, 3, connected)
+		} else {
+			assert.Equal(t, 2, connected)
+		}
+	}
+
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.Propose(state))
+
+	// partitioned, only 2 of 4 participants connected
+	p1 := &countingPeer{pubkey: quorum[0]}
+	assert.True(t, consensus.Join(p1))
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		now = now.Add(10 * time.Second)
+		assert.Nil(t, consensus.Update(now))
+	}
+	assert.Equal(t, []bool{false}, changes)
+	assert.False(t, consensus.Ready())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&p1.sent))
+	assert.Equal(t, uint64(0), consensus.currentRound.RoundNumber)
+
+	// unauthenticated peers are not counted
+	assert.True(t, consensus.Join(&countingPeer{}))
+	assert.Nil(t, consensus.Update(now))
+	assert.False(t, consensus.Ready())
+
+	// healed, proposing resumes immediately
+	p2 := &countingPeer{pubkey: quorum[1]}
+	assert.True(t, consensus.Join(p2))
+	assert.Nil(t, consensus.Update(now))
+	assert.Equal(t, []bool{false, true}, changes)
+	assert.True(t, consensus.Ready())
+	assert.Equal(t, int64(1), atomic.LoadInt64(&p1.sent))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&p2.sent))
+
+	signed, err := DecodeSignedMessage(p1.last.Load().([]byte))
+	assert.Nil(t, err)
+	m, err := DecodeMessage(signed.Message)
+	assert.Nil(t, err)
+	assert.Equal(t, MessageType_RoundChange, m.Type)
+	assert.True(t, bytes.Equal(consensus.maximalUnconfirmed(), m.State))
+}
+
+func TestVoters(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 3; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	assert.Equal(t, 0, len(consensus.Voters(1, 0)))
+
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	// voters grow as <roundchange> messages arrive
+	for i := 0; i < 2; i++ {
+		_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, state, keys[i])
+		bts, err := proto.Marshal(signed)
+		assert.Nil(t, err)
+		assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+
+		voters := consensus.Voters(1, 0)
+		assert.Equal(t, i+1, len(voters))
+		assert.Equal(t, DefaultPubKeyToIdentity(&keys[i].PublicKey), voters[i])
+	}
+
+	// duplicated message does not count
+	_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, state, keys[0])
+	bts, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, 2, len(consensus.Voters(1, 0)))
+
+	// returns a copy
+	voters := consensus.Voters(1, 0)
+	voters[0] = Identity{}
+	assert.Equal(t, DefaultPubKeyToIdentity(&keys[0].PublicKey), consensus.Voters(1, 0)[0])
+
+	// other heights are not tracked
+	assert.Nil(t, consensus.Voters(2, 0))
+
+	// resets on round change
+	consensus.switchRound(1)
+	assert.Equal(t, 0, len(consensus.Voters(1, 0)))
+	assert.Equal(t, 0, len(consensus.Voters(1, 1)))
+}
+
+func TestChangeParticipants(t *testing.T) {
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 3; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	current := consensus.CurrentParticipants()
+
+	randomParticipants := func(n int) []Identity {
+		var participants []Identity
+		for i := 0; i < n; i++ {
+			privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+			assert.Nil(t, err)
+			participants = append(participants, DefaultPubKeyToIdentity(&privateKey.PublicKey))
+		}
+		return participants
+	}
+
+	// replace the entire set in one height
+	assert.Equal(t, ErrUnsafeSetChange, consensus.ChangeParticipants(randomParticipants(4)))
+	// replace 2 of 4
+	assert.Equal(t, ErrUnsafeSetChange, consensus.ChangeParticipants(append(current[:2:2], randomParticipants(2)...)))
+	// retain 3 of 4, but add 6, the new group of 9 needs 5 retained
+	assert.Equal(t, ErrUnsafeSetChange, consensus.ChangeParticipants(append(current[:3:3], randomParticipants(6)...)))
+	// retain all 4, but add 4, the new group of 8 needs 5 retained
+	assert.Equal(t, ErrUnsafeSetChange, consensus.ChangeParticipants(append(current[:4:4], randomParticipants(4)...)))
+	// retain all 4, and add 2, the new group of 6 needs 3 retained
+	assert.Nil(t, consensus.ChangeParticipants(append(current[:4:4], randomParticipants(2)...)))
+	// duplicated
+	assert.Equal(t, ErrConfigDuplicateParticipant, consensus.ChangeParticipants(append(current, current[0])))
+	// insufficient
+	assert.Equal(t, ErrConfigParticipants, consensus.ChangeParticipants(current[:3]))
+	// off-curve
+	offCurve := randomParticipants(1)[0]
+	offCurve[2*SizeAxis-1] ^= 0x1
+	assert.Equal(t, ErrConfigInvalidParticipantKey, consensus.ChangeParticipants(append(current[:3:3], offCurve)))
+
+	// replace 1 of 4, staged until next height
+	next := append(current[:3:3], randomParticipants(1)...)
+	assert.Nil(t, consensus.ChangeParticipants(next))
+	assert.Equal(t, current, consensus.CurrentParticipants())
+
+	consensus.heightSync(1, 0, []byte("state"), time.Now())
+	assert.Equal(t, next, consensus.CurrentParticipants())
+
+	// the keys of new participants are cached
+	assert.Equal(t, len(next), len(consensus.participantKeys))
+	assert.NotNil(t, consensus.participantKeys[IdentityToCoordinate(next[3])])
+	assert.Nil(t, consensus.participantKeys[IdentityToCoordinate(current[3])])
+}
+
+func TestChangeParticipantsCustomIdentity(t *testing.T) {
+	// identities are not encoded public keys
+	prefixed := func(pubkey *ecdsa.PublicKey) (ret Identity) {
+		id := DefaultPubKeyToIdentity(pubkey)
+		ret[0] = 0xAB
+		copy(ret[1:], id[:])
+		return ret
+	}
+
+	keys := createTestKeys(t, 5)
+	config := createConfig(t, keys[0], 0, nil)
+	config.PubKeyToIdentity = prefixed
+	config.Participants = nil
+	for _, key := range keys[:4] {
+		config.Participants = append(config.Participants, prefixed(&key.PublicKey))
+	}
+	consensus, err := NewConsensus(config)
+	assert.Nil(t, err)
+
+	next := append(consensus.CurrentParticipants()[:3:3], prefixed(&keys[4].PublicKey))
+	assert.Nil(t, consensus.ChangeParticipants(next))
+	consensus.heightSync(1, 0, State("state"), time.Now())
+	assert.Equal(t, next, consensus.CurrentParticipants())
+}
+
+func TestParticipantKeys(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	config := new(Config)
+	config.Epoch = time.Now()
+	config.StateCompare = func(a State, b State) int { return bytes.Compare(a, b) }
+	config.StateValidate = func(State) bool { return true }
+	for i := 0; i < ConfigMinimumParticipants; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		config.Participants = append(config.Participants, DefaultPubKeyToIdentity(&privateKey.PublicKey))
+	}
+	config.PrivateKey = keys[0]
+
+	// an off-curve participant is rejected at startup
+	valid := config.Participants[2]
+	offCurve := valid
+	offCurve[2*SizeAxis-1] ^= 0x1
+	config.Participants[2] = offCurve
+	_, err := NewConsensus(config)
+	assert.True(t, errors.Is(err, ErrConfigInvalidParticipantKey))
+
+	config.Participants[2] = valid
+	consensus, err := NewConsensus(config)
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys), len(consensus.participantKeys))
+	for k := range keys {
+		pubkey := consensus.participantKeys[IdentityToCoordinate(config.Participants[k])]
+		assert.Equal(t, 0, keys[k].PublicKey.X.Cmp(pubkey.X))
+		assert.Equal(t, 0, keys[k].PublicKey.Y.Cmp(pubkey.Y))
+	}
+
+	// signatures are verified by the cached keys
+	_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, []byte("state"), keys[1])
+	assert.True(t, consensus.verifySignature(signed))
+	signed.Height++
+	assert.False(t, consensus.verifySignature(signed))
+
+	// non-participants are verified by the key in message
+	outsider, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	_, signed, _ = createRoundChangeMessageSigner(t, 1, 0, []byte("state"), outsider)
+	assert.True(t, consensus.verifySignature(signed))
+}
+
+func TestParticipantsView(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 3; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	assert.Equal(t, uint64(0), consensus.View())
+
+	roundChange := func(height uint64, view uint64) []byte {
+		m := Message{Type: MessageType_RoundChange, Height: height, View: view, State: State("state")}
+		sp := new(SignedProto)
+		sp.Sign(&m, keys[0])
+		bts, err := proto.Marshal(sp)
+		assert.Nil(t, err)
+		return bts
+	}
+
+	assert.Nil(t, consensus.ReceiveMessage(roundChange(1, 0), time.Now()))
+	assert.Equal(t, ErrMessageView, consensus.ReceiveMessage(roundChange(1, 1), time.Now()))
+
+	// keys[0] stays in the new set
+	newKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	current := consensus.CurrentParticipants()
+	assert.Nil(t, consensus.ChangeParticipants(append(current[:3:3], DefaultPubKeyToIdentity(&newKey.PublicKey))))
+	assert.Equal(t, uint64(0), consensus.View())
+	consensus.heightSync(1, 0, State("state"), time.Now())
+	assert.Equal(t, uint64(1), consensus.View())
+
+	// messages signed under the old set are rejected
+	assert.Equal(t, ErrMessageView, consensus.ReceiveMessage(roundChange(2, 0), time.Now()))
+	assert.Nil(t, consensus.ReceiveMessage(roundChange(2, 1), time.Now()))
+
+	// the messages of myself are in the new view
+	var views []uint64
+	consensus.messageOutCallback = func(m *Message, sp *SignedProto) { views = append(views, m.View) }
+	assert.Nil(t, consensus.Propose(State("proposal")))
+	consensus.broadcastRoundChange()
+	assert.Equal(t, []uint64{1}, views)
+}
+
+func TestNextViewDecide(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	newConsensus := func() *Consensus {
+		return createConsensus(t, 0, 0, []*ecdsa.PublicKey{&keys[0].PublicKey, &keys[1].PublicKey, &keys[2].PublicKey})
+	}
+	consensus := newConsensus()
+
+	// keys[2] is replaced by keys[3] in view 1, keys[0] leads round 1, and
+	// keys[3] leads round 3
+	current := consensus.CurrentParticipants()
+	next := append(current[:3:3], DefaultPubKeyToIdentity(&keys[3].PublicKey))
+
+	decide := func(height uint64, round uint64, leader *ecdsa.PrivateKey) []byte {
+		m := Message{Type: MessageType_Decide, Height: height, Round: round, View: 1, State: State("state")}
+		for _, key := range []*ecdsa.PrivateKey{keys[0], keys[1], keys[3]} {
+			commit := Message{Type: MessageType_Commit, Height: height, Round: round, View: 1, State: State("state")}
+			sp := new(SignedProto)
+			sp.Sign(&commit, key)
+			m.Proof = append(m.Proof, sp)
+		}
+		sp := new(SignedProto)
+		sp.Sign(&m, leader)
+		bts, err := proto.Marshal(sp)
+		assert.Nil(t, err)
+		return bts
+	}
+
+	// the new view is unknown without the change staged
+	assert.Equal(t, ErrMessageView, consensus.ReceiveMessage(decide(2, 1, keys[0]), time.Now()))
+	assert.Equal(t, ErrMessageUnknownParticipant, consensus.ReceiveMessage(decide(2, 3, keys[3]), time.Now()))
+
+	assert.Nil(t, consensus.ChangeParticipants(next))
+	assert.Nil(t, consensus.ReceiveMessage(decide(2, 1, keys[0]), time.Now()))
+	height, _, _ := consensus.CurrentState()
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, uint64(1), consensus.View())
+	assert.Equal(t, next, consensus.CurrentParticipants())
+
+	// led by the new participant
+	consensus = newConsensus()
+	next[0] = consensus.CurrentParticipants()[0]
+	assert.Nil(t, consensus.ChangeParticipants(next))
+	assert.Nil(t, consensus.ReceiveMessage(decide(2, 3, keys[3]), time.Now()))
+	height, _, _ = consensus.CurrentState()
+	assert.Equal(t, uint64(2), height)
+	assert.Equal(t, uint64(1), consensus.View())
+}
+
+func TestOnInvalidState(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+
+	// reject states begin with 0xff
+	consensus.stateValidate = func(s State) bool { return len(s) == 0 || s[0] != 0xff }
+	var rejected []Identity
+	var rejectedStates []State
+	consensus.onInvalidState = func(from Identity, s State) {
+		rejected = append(rejected, from)
+		rejectedStates = append(rejectedStates, s)
+	}
+
+	state := make([]byte, 1024)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	// valid state
+	state[0] = 0
+	_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, state, privateKey)
+	bts, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, 0, len(rejected))
+
+	// invalid state
+	state[0] = 0xff
+	_, signed, _ = createRoundChangeMessageSigner(t, 1, 0, state, privateKey)
+	bts, err = proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrRoundChangeStateValidation, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, []Identity{DefaultPubKeyToIdentity(&privateKey.PublicKey)}, rejected)
+	assert.Equal(t, State(state), rejectedStates[0])
+}
+
+func TestRotateKey(t *testing.T) {
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 2; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+
+	// the rotating node & an observer with the same consensus group
+	rotating := createConsensus(t, 0, 0, quorum)
+	observer := createConsensus(t, 0, 0, append(quorum, &rotating.privateKey.PublicKey))
+	rotating.participants = observer.CurrentParticipants()
+	oldKey := rotating.privateKey
+
+	newKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	newIdentity := DefaultPubKeyToIdentity(&newKey.PublicKey)
+
+	// the new key must be a participant
+	assert.Equal(t, ErrRotateKeyNotParticipant, rotating.RotateKey(newKey))
+
+	// map old identity to new identity
+	next := observer.CurrentParticipants()
+	next[len(next)-1] = newIdentity
+	assert.Nil(t, rotating.ChangeParticipants(next))
+	assert.Nil(t, observer.ChangeParticipants(next))
+	assert.Nil(t, rotating.RotateKey(newKey))
+	assert.Equal(t, DefaultPubKeyToIdentity(&oldKey.PublicKey), rotating.identity)
+
+	// switch at height boundary
+	rotating.heightSync(1, 0, []byte("state"), time.Now())
+	observer.heightSync(1, 0, []byte("state"), time.Now())
+	assert.Equal(t, newIdentity, rotating.identity)
+
+	// messages from the rotating node are signed with new key, and accepted
+	var signed *SignedProto
+	rotating.messageOutCallback = func(m *Message, sp *SignedProto) { signed = sp }
+	state := make([]byte, 1024)
+	_, err = io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+	assert.Nil(t, rotating.Propose(state))
+	rotating.broadcastRoundChange()
+	assert.NotNil(t, signed)
+	assert.Equal(t, newIdentity, DefaultPubKeyToIdentity(signed.PublicKey(S256Curve)))
+
+	bts, err := proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Nil(t, observer.ReceiveMessage(bts, time.Now()))
+
+	// messages signed by old key are rejected
+	_, signed, _ = createRoundChangeMessageSigner(t, 2, 0, state, oldKey)
+	bts, err = proto.Marshal(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMessageUnknownParticipant, observer.ReceiveMessage(bts, time.Now()))
+}
+
+func TestUpdateClockBackward(t *testing.T) {
+	consensus := createConsensus(t, 0, 0, nil)
+	var backwards int
+	consensus.onClockBackward = func(last time.Time, now time.Time) {
+		assert.True(t, now.Before(last))
+		backwards++
+	}
+
+	// wall clock only, as monotonic reading is stripped
+	base := time.Now().Round(0)
+	consensus.rcTimeout = base.Add(time.Second)
+	assert.Nil(t, consensus.Update(base.Add(500*time.Millisecond)))
+
+	// decreasing time sequence
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, consensus.Update(base.Add(500*time.Millisecond-time.Duration(i)*time.Hour)))
+	}
+	assert.Equal(t, 10, backwards)
+	assert.Equal(t, uint64(0), consensus.currentRound.RoundNumber)
+	assert.Equal(t, stageRoundChanging, consensus.currentRound.Stage)
+	assert.Equal(t, base.Add(time.Second), consensus.rcTimeout)
+	assert.Equal(t, base.Add(500*time.Millisecond), consensus.lastNow)
+
+	// time moves forward again
+	assert.Nil(t, consensus.Update(base.Add(600*time.Millisecond)))
+	assert.Equal(t, 10, backwards)
+	assert.Equal(t, base.Add(600*time.Millisecond), consensus.lastNow)
+}
+
+func TestUpdateMaxTimeStep(t *testing.T) {
+	consensus := createConsensus(t, 0, 0, nil)
+	consensus.maxTimeStep = 20 * time.Millisecond
+
+	base := time.Now().Round(0)
+	consensus.rcTimeout = base.Add(time.Second)
+	assert.Nil(t, consensus.Update(base))
+
+	// resumed from suspension, time catches up by maxTimeStep per update
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, consensus.Update(base.Add(time.Hour)))
+		assert.Equal(t, base.Add(time.Duration(i)*20*time.Millisecond), consensus.lastNow)
+	}
+	assert.Equal(t, uint64(0), consensus.currentRound.RoundNumber)
+	assert.Equal(t, stageRoundChanging, consensus.currentRound.Stage)
+	assert.Equal(t, base.Add(time.Second), consensus.rcTimeout)
+
+	// steps within the limit are not clamped
+	assert.Nil(t, consensus.Update(base.Add(210*time.Millisecond)))
+	assert.Equal(t, base.Add(210*time.Millisecond), consensus.lastNow)
+}
+
+func TestReorderBuffer(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 3; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	consensus.SetLeader(&consensus.privateKey.PublicKey)
+
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	// deliver in reverse order, <commit> before <roundchange>
+	for i := range keys {
+		_, signed, _ := createCommitMessageSigner(t, 1, 0, state, keys[i])
+		bts, err := proto.Marshal(signed)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrCommitStatus, consensus.ReceiveMessage(bts, time.Now()))
+
+		// duplicated messages are buffered once
+		assert.Equal(t, ErrCommitStatus, consensus.ReceiveMessage(bts, time.Now()))
+	}
+	assert.Equal(t, len(keys), len(consensus.reorderBuffer))
+
+	for i := range keys {
+		_, signed, _ := createRoundChangeMessageSigner(t, 1, 0, state, keys[i])
+		bts, err := proto.Marshal(signed)
+		assert.Nil(t, err)
+		assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+	}
+	assert.Equal(t, stageLock, consensus.currentRound.Stage)
+
+	// leader locks, and the buffered <commit> messages are replayed
+	assert.Nil(t, consensus.Update(time.Now()))
+	height, round, decided := consensus.CurrentState()
+	assert.Equal(t, uint64(1), height)
+	assert.Equal(t, uint64(0), round)
+	assert.Equal(t, State(state), decided)
+	assert.Equal(t, 0, len(consensus.reorderBuffer))
+}
+
+func TestReorderBufferBounded(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	var quorum []*ecdsa.PublicKey
+	for i := 0; i < 4; i++ {
+		privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		keys = append(keys, privateKey)
+		quorum = append(quorum, &privateKey.PublicKey)
+	}
+	consensus := createConsensus(t, 0, 0, quorum)
+	consensus.SetLeader(&consensus.privateKey.PublicKey)
+
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	receive := func(height uint64, round uint64, key *ecdsa.PrivateKey) {
+		_, signed, _ := createCommitMessageSigner(t, height, round, state, key)
+		bts, err := proto.Marshal(signed)
+		assert.Nil(t, err)
+		consensus.ReceiveMessage(bts, time.Now())
+	}
+
+	// bounded per signer
+	for i := 0; i < 10; i++ {
+		receive(1, uint64(i), keys[0])
+	}
+	assert.Equal(t, reorderPerSigner, len(consensus.reorderBuffer))
+
+	// other signers have their own share
+	for _, key := range keys[1:] {
+		for i := 0; i <= reorderRoundWindow; i++ {
+			receive(1, uint64(i), key)
+		}
+	}
+	assert.Equal(t, reorderPerSigner*len(keys), len(consensus.reorderBuffer))
+
+	// messages beyond the round window are not buffered
+	consensus.reorderBuffer = nil
+	receive(1, reorderRoundWindow+1, keys[0])
+	assert.Equal(t, 0, len(consensus.reorderBuffer))
+	receive(1, reorderRoundWindow, keys[0])
+	assert.Equal(t, 1, len(consensus.reorderBuffer))
+
+	// messages of other heights are not buffered
+	consensus.reorderBuffer = nil
+	receive(2, 0, keys[0])
+	assert.Equal(t, 0, len(consensus.reorderBuffer))
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 //
 // consensus functional tests via IPC
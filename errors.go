@@ -35,20 +35,60 @@ import "errors"
 var (
 	// Config Related
 	ErrConfigEpoch              = errors.New("Config.Epoch is nil")
+	ErrConfigEpochFuture        = errors.New("Config.Epoch is too far in the future")
 	ErrConfigStateNil           = errors.New("Config.CurrentState is nil")
 	ErrConfigStateCompare       = errors.New("Config.StateCompare function has not set")
 	ErrConfigStateValidate      = errors.New("Config.StateValidate function has not set")
 	ErrConfigPrivateKey         = errors.New("Config.PrivateKey has not set")
 	ErrConfigParticipants       = errors.New("Config.Participants must contain at least 4 participants")
 	ErrConfigPubKeyToCoordinate = errors.New("Config.must contain at least 4 participants")
+	ErrConfigHashFunc           = errors.New("Config.HashFunc must produce a 32 bytes hash")
+	ErrConfigStateDiff          = errors.New("Config.StateDiff and Config.StateApply must be set together")
+	ErrConfigEmptyState         = errors.New("Config.EmptyState must not be empty with Config.EmptyProposalAfter")
+
+	ErrConfigInvalidParticipantKey = errors.New("Config.Participants contains a public key not on the curve")
+	ErrConfigDuplicateParticipant  = errors.New("Config.Participants contains duplicated participants")
+	ErrConfigExportVersion         = errors.New("the exported config has an unsupported version")
+	ErrConfigExportCurve           = errors.New("the exported config has an unsupported curve")
+	ErrConfigExportParticipant     = errors.New("the exported config contains a malformed participant")
 
 	// common errors related to every message
-	ErrMessageVersion            = errors.New("the message has different version")
+	ErrProtocolVersionMismatch   = errors.New("the message is from another protocol version")
+	ErrMessageVersion            = ErrProtocolVersionMismatch // Deprecated: use ErrProtocolVersionMismatch
 	ErrMessageValidator          = errors.New("the message has been rejected by external validator")
 	ErrMessageIsEmpty            = errors.New("the message being verified is empty")
 	ErrMessageUnknownMessageType = errors.New("unrecognized message type")
 	ErrMessageSignature          = errors.New("cannot verify the signature of this message")
 	ErrMessageUnknownParticipant = errors.New("the message is from unknown partcipants")
+	ErrMessageTooManyProofs      = errors.New("the message contains more proofs than participants")
+	ErrMessageView               = errors.New("the message is from another view of participants")
+	ErrMessageBinding            = errors.New("the message has another height or round than signed")
+	ErrMessageStale              = errors.New("the message is for a decided height")
+	ErrMessageResetHandshake     = errors.New("the message is from a participant which has not handshaked the reset genesis")
+	ErrClockSkew                 = errors.New("the message round implies a clock skew beyond MaxClockSkew")
+
+	// participants change related
+	ErrUnsafeSetChange = errors.New("the participants change does not retain 2t+1 participants of both the current and the new group")
+
+	// key rotation related
+	ErrRotateKeyNotParticipant = errors.New("the rotated key is not a participant at next height")
+
+	// peer related
+	ErrPeerBufferFull = errors.New("the buffer of the peer is full")
+	ErrPeerPublicKey  = errors.New("the public key of the peer is nil")
+	ErrPeerBufferSize = errors.New("the buffer size of the peer is negative")
+
+	// state related
+	ErrStateTooLarge      = errors.New("the state size exceeded Config.MaxStateSize")
+	ErrStateCompareBudget = errors.New("the state comparison exceeded Config.StateCompareBudget")
+	ErrStateDiff          = errors.New("the state diff cannot be applied to the latest state")
+	ErrStateDiffGap       = errors.New("the state diff is against a state not decided yet")
+
+	// commit certificate related
+	ErrCertificateUnavailable  = errors.New("the commit certificate of the height is unavailable")
+	ErrCertificateInvalid      = errors.New("the commit certificate contains an invalid commit")
+	ErrCertificateInsufficient = errors.New("the commit certificate has insufficient commits")
+	ErrAggregateUnsupported    = errors.New("the signature scheme cannot aggregate signatures")
 
 	// <roundchange> related
 	ErrRoundChangeHeightMismatch  = errors.New("the <roundchange> message has another height than expected")
@@ -0,0 +1,151 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import "fmt"
+
+// the number of recent decisions remembered for invariant checking
+const invariantHistory = 1024
+
+// invariants checked on every decision with Config.StrictInvariants
+const (
+	// two decisions at the same height with different states
+	InvariantConflictingDecision = "conflicting decision"
+	// a decision at or below the latest decided height
+	InvariantHeightMonotonic = "height monotonic"
+	// the decide proof doesn't verify against the participants
+	InvariantDecideProof = "decide proof"
+)
+
+// InvariantViolation describes a broken invariant found by strict invariants
+// checking, with the context of the decision.
+type InvariantViolation struct {
+	Invariant    string       // the broken invariant
+	Height       uint64       // height of the decision
+	Round        uint64       // round of the decision
+	State        State        // the decided state
+	Proof        *SignedProto // the decide proof
+	LatestHeight uint64       // the latest decided height before this decision
+	Previous     *StateHash   // hash of the state decided earlier at the same height, if any
+	Err          error        // the error of proof verification, if any
+}
+
+func (v *InvariantViolation) Error() string {
+	return fmt.Sprintf("bdls invariant violated: %v, height: %v, round: %v, latest height: %v, err: %v",
+		v.Invariant, v.Height, v.Round, v.LatestHeight, v.Err)
+}
+
+// checkDecision verifies invariants on a decision before it takes effect,
+// it's a no-op unless strict invariants checking is enabled.
+func (c *Consensus) checkDecision(height uint64, round uint64, s State, proof *SignedProto) {
+	if !c.strictInvariants {
+		return
+	}
+
+	v := &InvariantViolation{Height: height, Round: round, State: s, Proof: proof, LatestHeight: c.latestHeight}
+	hash := c.stateHash(s)
+	if prev, ok := c.decisions[height]; ok && prev != hash {
+		v.Invariant = InvariantConflictingDecision
+		v.Previous = &prev
+		c.invariantViolated(v)
+		return
+	}
+
+	if height <= c.latestHeight {
+		v.Invariant = InvariantHeightMonotonic
+		c.invariantViolated(v)
+		return
+	}
+
+	if err := c.verifyDecideProof(height, round, hash, proof); err != nil {
+		v.Invariant = InvariantDecideProof
+		v.Err = err
+		c.invariantViolated(v)
+		return
+	}
+
+	// remember recent decisions
+	if c.decisions == nil {
+		c.decisions = make(map[uint64]StateHash)
+	}
+	c.decisions[height] = hash
+	if height > invariantHistory {
+		delete(c.decisions, height-invariantHistory)
+	}
+}
+
+// verifyDecideProof verifies a <decide> message carries a quorum of distinct
+// participants' <commit> on the decided height, round and state.
+func (c *Consensus) verifyDecideProof(height uint64, round uint64, hash StateHash, proof *SignedProto) error {
+	m, err := c.verifyMessage(proof)
+	if err != nil {
+		// a proof of a decided height is not of this height
+		if err == ErrMessageStale {
+			return ErrCertificateInvalid
+		}
+		return err
+	}
+
+	if m.Type != MessageType_Decide || m.Height != height || m.Round != round || c.stateHash(m.State) != hash {
+		return ErrCertificateInvalid
+	}
+
+	signers := make(map[Identity]bool)
+	for _, commit := range m.Proof {
+		mCommit, err := c.verifyMessage(commit)
+		if err != nil {
+			return err
+		}
+
+		if mCommit.Type != MessageType_Commit || mCommit.Height != height || mCommit.Round != round || c.stateHash(mCommit.State) != hash {
+			return ErrCertificateInvalid
+		}
+		signers[c.pubKeyToIdentity(commit.PublicKey(c.curve))] = true
+	}
+
+	var identities []Identity
+	for identity := range signers {
+		identities = append(identities, identity)
+	}
+	if !c.isDecideQuorum(identities) {
+		return ErrCertificateInsufficient
+	}
+	return nil
+}
+
+// invariantViolated reports a violation to the callback, or panics if
+// no callback is set.
+func (c *Consensus) invariantViolated(v *InvariantViolation) {
+	if c.onInvariantViolation == nil {
+		panic(v)
+	}
+	c.onInvariantViolation(v)
+}
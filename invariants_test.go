@@ -0,0 +1,77 @@
+package bdls
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrictInvariants(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	var mu sync.Mutex
+	var violations []*InvariantViolation
+	peers := createIPCPeers(t, keys, func(config *Config) {
+		config.StrictInvariants = true
+		config.OnInvariantViolation = func(v *InvariantViolation) {
+			mu.Lock()
+			violations = append(violations, v)
+			mu.Unlock()
+		}
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Update()
+	}
+	decideIPCHeight(t, peers, 1)
+	decideIPCHeight(t, peers, 2)
+
+	// no violations in normal operation
+	mu.Lock()
+	assert.Len(t, violations, 0)
+	mu.Unlock()
+
+	// inject faults into a participant which has stopped updating
+	peer := peers[0]
+	peer.Close()
+	c := peer.c
+	height, round, state := c.CurrentState()
+	proof := c.CurrentProof()
+	var injected []*InvariantViolation
+	c.onInvariantViolation = func(v *InvariantViolation) { injected = append(injected, v) }
+
+	// a different state decided at the same height
+	c.checkDecision(height, round, State("conflict"), proof)
+	// the same state decided again
+	c.checkDecision(height, round, state, proof)
+	// a proof of another height
+	c.checkDecision(height+1, round, state, proof)
+	// a proof without commits
+	forged := *proof
+	m, err := UnmarshalMessage(proof.Message)
+	assert.Nil(t, err)
+	m.Height = height + 1
+	m.Proof = nil
+	forged.Sign(m, keys[0])
+	c.checkDecision(height+1, round, m.State, &forged)
+
+	assert.Len(t, injected, 4)
+	assert.Equal(t, InvariantConflictingDecision, injected[0].Invariant)
+	assert.Equal(t, height, injected[0].Height)
+	assert.Equal(t, c.stateHash(state), *injected[0].Previous)
+	assert.Equal(t, InvariantHeightMonotonic, injected[1].Invariant)
+	assert.Equal(t, height, injected[1].LatestHeight)
+	assert.Equal(t, InvariantDecideProof, injected[2].Invariant)
+	assert.Equal(t, ErrCertificateInvalid, injected[2].Err)
+	assert.Equal(t, InvariantDecideProof, injected[3].Invariant)
+	assert.Equal(t, ErrCertificateInsufficient, injected[3].Err)
+
+	// fatal without a callback
+	c.onInvariantViolation = nil
+	assert.Panics(t, func() { c.checkDecision(height, round, State("conflict"), proof) })
+}
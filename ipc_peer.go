@@ -98,10 +98,10 @@ func (p *IPCPeer) GetBytesCount() int64 {
 }
 
 // Propose a state, awaiting to be finalized at next height.
-func (p *IPCPeer) Propose(s State) {
+func (p *IPCPeer) Propose(s State) error {
 	p.Lock()
 	defer p.Unlock()
-	p.c.Propose(s)
+	return p.c.Propose(s)
 }
 
 // GetLatestState returns latest state
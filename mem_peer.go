@@ -0,0 +1,87 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import (
+	"crypto/ecdsa"
+	"net"
+)
+
+// MemPeer is an in-memory peer for testing consensus core in isolation,
+// messages sent to it are buffered in a channel, the test decides when and
+// where to deliver them, ie. by calling ReceiveMessage on another consensus.
+type MemPeer struct {
+	publicKey *ecdsa.PublicKey
+	addr      net.Addr
+	messages  chan []byte
+}
+
+// NewMemPeer creates an in-memory peer of the public key and remote address,
+// which buffers at most size messages. A nil addr defaults to an address
+// derived from the public key.
+func NewMemPeer(publicKey *ecdsa.PublicKey, addr net.Addr, size int) (*MemPeer, error) {
+	if publicKey == nil {
+		return nil, ErrPeerPublicKey
+	}
+
+	if size < 0 {
+		return nil, ErrPeerBufferSize
+	}
+
+	p := new(MemPeer)
+	p.publicKey = publicKey
+	p.addr = addr
+	if p.addr == nil {
+		p.addr = fakeAddress("mem:" + publicKey.X.Text(16))
+	}
+	p.messages = make(chan []byte, size)
+	return p, nil
+}
+
+// GetPublicKey implements PeerInterface.GetPublicKey
+func (p *MemPeer) GetPublicKey() *ecdsa.PublicKey { return p.publicKey }
+
+// RemoteAddr implements PeerInterface.RemoteAddr
+func (p *MemPeer) RemoteAddr() net.Addr { return p.addr }
+
+// Send implements PeerInterface.Send, the message is copied to the buffer,
+// ErrPeerBufferFull will be returned if the buffer is full.
+func (p *MemPeer) Send(msg []byte) error {
+	select {
+	case p.messages <- append([]byte(nil), msg...):
+		return nil
+	default:
+		return ErrPeerBufferFull
+	}
+}
+
+// Messages returns the channel of buffered messages
+func (p *MemPeer) Messages() <-chan []byte { return p.messages }
@@ -0,0 +1,78 @@
+package bdls
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemPeer(t *testing.T) {
+	keys := createTestKeys(t, 4)
+	var participants []Identity
+	for _, key := range keys {
+		participants = append(participants, DefaultPubKeyToIdentity(&key.PublicKey))
+	}
+
+	epoch := time.Now()
+	var consensus []*Consensus
+	for i := 0; i < 2; i++ {
+		config := new(Config)
+		config.Epoch = epoch
+		config.PrivateKey = keys[i]
+		config.Participants = participants
+		config.StateCompare = func(a State, b State) int { return bytes.Compare(a, b) }
+		config.StateValidate = func(a State) bool { return true }
+		c, err := NewConsensus(config)
+		assert.Nil(t, err)
+		consensus = append(consensus, c)
+	}
+
+	// peers[i] buffers messages sent to consensus[i]
+	var peers []*MemPeer
+	for i := 0; i < 2; i++ {
+		peer, err := NewMemPeer(&keys[i].PublicKey, nil, 16)
+		assert.Nil(t, err)
+		peers = append(peers, peer)
+	}
+	assert.NotEqual(t, peers[0].RemoteAddr().String(), peers[1].RemoteAddr().String())
+	assert.True(t, consensus[0].Join(peers[1]))
+	assert.True(t, consensus[1].Join(peers[0]))
+
+	// <roundchange> from consensus[0] is delivered to consensus[1] by the test
+	now := epoch.Add(time.Minute)
+	assert.Nil(t, consensus[0].Propose(State("state")))
+	assert.Nil(t, consensus[0].Update(now))
+
+	var delivered int
+	for len(peers[1].Messages()) > 0 {
+		assert.Nil(t, consensus[1].ReceiveMessage(<-peers[1].Messages(), now))
+		delivered++
+	}
+	assert.NotZero(t, delivered)
+	assert.NotEqual(t, -1, consensus[1].currentRound.FindRoundChange(participants[0]))
+	assert.Equal(t, -1, consensus[1].currentRound.FindRoundChange(participants[2]))
+
+	// and the other way round
+	assert.Nil(t, consensus[1].Propose(State("another state")))
+	assert.Nil(t, consensus[1].Update(now))
+	assert.NotZero(t, len(peers[0].Messages()))
+	for len(peers[0].Messages()) > 0 {
+		assert.Nil(t, consensus[0].ReceiveMessage(<-peers[0].Messages(), now))
+	}
+	assert.NotEqual(t, -1, consensus[0].currentRound.FindRoundChange(participants[1]))
+
+	// full buffer
+	peer, err := NewMemPeer(&keys[2].PublicKey, nil, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.Send([]byte("a")))
+	assert.Equal(t, ErrPeerBufferFull, peer.Send([]byte("b")))
+	assert.Equal(t, []byte("a"), <-peer.Messages())
+
+	// invalid arguments
+	_, err = NewMemPeer(nil, nil, 1)
+	assert.Equal(t, ErrPeerPublicKey, err)
+	_, err = NewMemPeer(&keys[2].PublicKey, nil, -1)
+	assert.Equal(t, ErrPeerBufferSize, err)
+}
@@ -33,9 +33,10 @@ package bdls
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
+	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
+	"io"
 	"math/big"
 
 	"github.com/Sperax/bdls/crypto/blake2b"
@@ -46,6 +47,19 @@ import (
 // ErrPubKey will be returned if error found while decoding message's public key
 var ErrPubKey = errors.New("incorrect pubkey format")
 
+// ErrPubKeyNotOnCurve will be returned if a coordinate is not a point on the curve
+var ErrPubKeyNotOnCurve = errors.New("the public key is not on the curve")
+
+var (
+	// ErrBinaryLayoutVersion will be returned if the binary layout version is unknown
+	ErrBinaryLayoutVersion = errors.New("unknown binary layout version of SignedProto")
+	// ErrBinaryLayoutObsolete will be returned for the layout version 1 of SignedProto,
+	// its signature doesn't bind height and round, and can't be verified anymore
+	ErrBinaryLayoutObsolete = errors.New("obsolete binary layout version of SignedProto")
+	// ErrBinaryTruncated will be returned if the binary encoded SignedProto is incomplete
+	ErrBinaryTruncated = errors.New("truncated binary encoding of SignedProto")
+)
+
 // secp256k1 elliptic curve
 var S256Curve elliptic.Curve = btcec.S256()
 
@@ -54,6 +68,8 @@ const (
 	SizeAxis = 32
 	// SignaturePrefix is the prefix for signing a consensus message
 	SignaturePrefix = "BDLS_CONSENSUS_SIGNATURE"
+	// BinaryLayoutVersion is the layout version of SignedProto.MarshalBinary
+	BinaryLayoutVersion = 2
 )
 
 // PubKeyAxis defines X-axis or Y-axis in a public key
@@ -89,28 +105,81 @@ func (t *PubKeyAxis) Size() int { return SizeAxis }
 // Identity is a user-defined struct to encode X-axis and Y-axis for a publickey in an array
 type Identity [2 * SizeAxis]byte
 
-// default method to derive coordinate from public key
-func DefaultPubKeyToIdentity(pubkey *ecdsa.PublicKey) (ret Identity) {
+// Coordinate is the X-axis and Y-axis of a public key in fixed width big-endian
+// bytes, with leading zeros kept.
+type Coordinate [2 * SizeAxis]byte
+
+// PubKeyToCoordinate converts a public key to coordinate, ErrPubKey will be
+// returned if the public key is nil or any axis exceeds SizeAxis bytes.
+func PubKeyToCoordinate(pubkey *ecdsa.PublicKey) (coord Coordinate, err error) {
+	if pubkey == nil || pubkey.X == nil || pubkey.Y == nil {
+		return coord, ErrPubKey
+	}
+
 	var X PubKeyAxis
 	var Y PubKeyAxis
+	if err := X.Unmarshal(pubkey.X.Bytes()); err != nil {
+		return coord, err
+	}
+	if err := Y.Unmarshal(pubkey.Y.Bytes()); err != nil {
+		return coord, err
+	}
+
+	copy(coord[:SizeAxis], X[:])
+	copy(coord[SizeAxis:], Y[:])
+	return coord, nil
+}
+
+// CoordinateToPubKey converts a coordinate to public key on the given curve,
+// ErrPubKeyNotOnCurve will be returned if the point is not on the curve.
+func CoordinateToPubKey(coord Coordinate, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
+	pubkey := new(ecdsa.PublicKey)
+	pubkey.Curve = curve
+	pubkey.X = new(big.Int).SetBytes(coord[:SizeAxis])
+	pubkey.Y = new(big.Int).SetBytes(coord[SizeAxis:])
+
+	p := curve.Params().P
+	if pubkey.X.Cmp(p) >= 0 || pubkey.Y.Cmp(p) >= 0 || !curve.IsOnCurve(pubkey.X, pubkey.Y) {
+		return nil, ErrPubKeyNotOnCurve
+	}
+	return pubkey, nil
+}
 
-	err := X.Unmarshal(pubkey.X.Bytes())
+// CoordinateToIdentity converts a coordinate to identity by default derivation
+func CoordinateToIdentity(coord Coordinate) Identity { return Identity(coord) }
+
+// IdentityToCoordinate converts an identity to coordinate, only defined for
+// identities derived by DefaultPubKeyToIdentity.
+func IdentityToCoordinate(identity Identity) Coordinate { return Coordinate(identity) }
+
+// PubKeyToIdentity converts a public key to identity by default derivation,
+// the error is the same as PubKeyToCoordinate.
+func PubKeyToIdentity(pubkey *ecdsa.PublicKey) (Identity, error) {
+	coord, err := PubKeyToCoordinate(pubkey)
 	if err != nil {
-		panic(err)
+		return Identity{}, err
 	}
+	return CoordinateToIdentity(coord), nil
+}
+
+// IdentityToPubKey converts an identity derived by DefaultPubKeyToIdentity
+// to public key on the given curve.
+func IdentityToPubKey(identity Identity, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
+	return CoordinateToPubKey(IdentityToCoordinate(identity), curve)
+}
 
-	err = Y.Unmarshal(pubkey.Y.Bytes())
+// default method to derive coordinate from public key, it panics on malformed
+// public key, use PubKeyToIdentity for the non-panicking version.
+func DefaultPubKeyToIdentity(pubkey *ecdsa.PublicKey) (ret Identity) {
+	ret, err := PubKeyToIdentity(pubkey)
 	if err != nil {
 		panic(err)
 	}
-
-	copy(ret[:SizeAxis], X[:])
-	copy(ret[SizeAxis:], Y[:])
-	return
+	return ret
 }
 
 // Hash concats and hash as follows:
-// blake2b(signPrefix + version + pubkey.X + pubkey.Y+len_32bit(msg) + message)
+// blake2b(signPrefix + version + height_64bit + round_64bit + pubkey.X + pubkey.Y+len_32bit(msg) + message)
 func (sp *SignedProto) Hash() []byte {
 	hash, err := blake2b.New256(nil)
 	if err != nil {
@@ -128,6 +197,17 @@ func (sp *SignedProto) Hash() []byte {
 		panic(err)
 	}
 
+	// write height & round
+	err = binary.Write(hash, binary.LittleEndian, sp.Height)
+	if err != nil {
+		panic(err)
+	}
+
+	err = binary.Write(hash, binary.LittleEndian, sp.Round)
+	if err != nil {
+		panic(err)
+	}
+
 	// write X & Y
 	_, err = hash.Write(sp.X[:])
 	if err != nil {
@@ -156,6 +236,15 @@ func (sp *SignedProto) Hash() []byte {
 
 // Sign the message with a private key
 func (sp *SignedProto) Sign(m *Message, privateKey *ecdsa.PrivateKey) {
+	sp.SignWithRand(m, privateKey, nil)
+}
+
+// SignWithRand is like Sign, but draws the signature nonce from the given
+// reader, so the signature is fully determined by the reader's stream.
+//
+// It exists to build reproducible test fixtures only, a predictable reader
+// leaks the private key from two signatures. A nil reader uses crypto/rand.
+func (sp *SignedProto) SignWithRand(m *Message, privateKey *ecdsa.PrivateKey, rand io.Reader) {
 	bts, err := proto.Marshal(m)
 	if err != nil {
 		panic(err)
@@ -163,6 +252,8 @@ func (sp *SignedProto) Sign(m *Message, privateKey *ecdsa.PrivateKey) {
 	// hash message
 	sp.Version = ProtocolVersion
 	sp.Message = bts
+	sp.Height = m.Height
+	sp.Round = m.Round
 
 	err = sp.X.Unmarshal(privateKey.PublicKey.X.Bytes())
 	if err != nil {
@@ -175,7 +266,12 @@ func (sp *SignedProto) Sign(m *Message, privateKey *ecdsa.PrivateKey) {
 	hash := sp.Hash()
 
 	// sign the message
-	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash)
+	var r, s *big.Int
+	if rand == nil {
+		r, s, err = ecdsa.Sign(crand.Reader, privateKey, hash)
+	} else {
+		r, s, err = signDeterministic(rand, privateKey, hash)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -183,10 +279,69 @@ func (sp *SignedProto) Sign(m *Message, privateKey *ecdsa.PrivateKey) {
 	sp.S = s.Bytes()
 }
 
+// randScalar reads a scalar in [1, N-1] from rand, the result only depends on
+// the bytes read, unlike ecdsa.GenerateKey which may consume extra randomness.
+func randScalar(curve elliptic.Curve, rand io.Reader) (*big.Int, error) {
+	params := curve.Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return nil, err
+	}
+
+	k := new(big.Int).SetBytes(b)
+	n := new(big.Int).Sub(params.N, big.NewInt(1))
+	k.Mod(k, n)
+	k.Add(k, big.NewInt(1))
+	return k, nil
+}
+
+// signDeterministic computes an ECDSA signature with nonces read from rand.
+func signDeterministic(rand io.Reader, priv *ecdsa.PrivateKey, hash []byte) (r, s *big.Int, err error) {
+	N := priv.Curve.Params().N
+	e := new(big.Int).SetBytes(hash)
+	for {
+		k, err := randScalar(priv.Curve, rand)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r, _ = priv.Curve.ScalarBaseMult(k.Bytes())
+		r.Mod(r, N)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		s = new(big.Int).Mul(priv.D, r)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, N))
+		s.Mod(s, N)
+		if s.Sign() != 0 {
+			return r, s, nil
+		}
+	}
+}
+
+// GenerateKey generates a private key on the curve from the given reader,
+// the same stream always derives the same key.
+//
+// It's meant for reproducible test fixtures, production keys should be
+// generated with crypto/rand.Reader.
+func GenerateKey(curve elliptic.Curve, rand io.Reader) (*ecdsa.PrivateKey, error) {
+	d, err := randScalar(curve, rand)
+	if err != nil {
+		return nil, err
+	}
+
+	priv := new(ecdsa.PrivateKey)
+	priv.Curve = curve
+	priv.D = d
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+	return priv, nil
+}
+
 // Verify the signature of this signed message
 func (sp *SignedProto) Verify(curve elliptic.Curve) bool {
-	var X, Y, R, S big.Int
-	hash := sp.Hash()
+	var X, Y big.Int
 	// verify against public key and r, s
 	pubkey := ecdsa.PublicKey{}
 	pubkey.Curve = curve
@@ -194,10 +349,28 @@ func (sp *SignedProto) Verify(curve elliptic.Curve) bool {
 	pubkey.Y = &Y
 	X.SetBytes(sp.X[:])
 	Y.SetBytes(sp.Y[:])
+	return sp.verifyKey(&pubkey)
+}
+
+// verifyKey verifies the signature against a public key of the signer, ie.
+// a participant key parsed ahead.
+func (sp *SignedProto) verifyKey(pubkey *ecdsa.PublicKey) bool {
+	var R, S big.Int
 	R.SetBytes(sp.R[:])
 	S.SetBytes(sp.S[:])
+	return ecdsa.Verify(pubkey, sp.Hash(), &R, &S)
+}
 
-	return ecdsa.Verify(&pubkey, hash, &R, &S)
+// coordinate returns the coordinate of the signer's public key
+func (sp *SignedProto) coordinate() (coord Coordinate) {
+	copy(coord[:SizeAxis], sp.X[:])
+	copy(coord[SizeAxis:], sp.Y[:])
+	return coord
+}
+
+// bound checks the message decoded from sp has the height & round signed
+func (sp *SignedProto) bound(m *Message) bool {
+	return sp.Height == m.Height && sp.Round == m.Round
 }
 
 // PublicKey returns the public key of this signed message
@@ -208,3 +381,197 @@ func (sp *SignedProto) PublicKey(curve elliptic.Curve) *ecdsa.PublicKey {
 	pubkey.Y = big.NewInt(0).SetBytes(sp.Y[:])
 	return pubkey
 }
+
+// MarshalSignedProto encodes a signed message into protobuf wire format, which
+// is the format of consensus messages exchanged between participants. The
+// encoding is deterministic, the same message always produces the same bytes.
+func MarshalSignedProto(sp *SignedProto) ([]byte, error) {
+	if sp == nil {
+		return nil, ErrMessageIsEmpty
+	}
+	return proto.Marshal(sp)
+}
+
+// UnmarshalSignedProto decodes a signed message from protobuf wire format,
+// the signature is not verified.
+func UnmarshalSignedProto(bts []byte) (*SignedProto, error) {
+	sp := new(SignedProto)
+	err := proto.Unmarshal(bts, sp)
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// MarshalMessage encodes a consensus message into protobuf wire format, which
+// is the format enclosed in SignedProto.Message for signing. The encoding is
+// deterministic, the same message always produces the same bytes.
+func MarshalMessage(m *Message) ([]byte, error) {
+	if m == nil {
+		return nil, ErrMessageIsEmpty
+	}
+	return proto.Marshal(m)
+}
+
+// UnmarshalMessage decodes a consensus message from protobuf wire format,
+// no validation against the protocol is performed.
+func UnmarshalMessage(bts []byte) (*Message, error) { return UnmarshalMessageLimit(bts, 0) }
+
+// UnmarshalMessageLimit decodes a consensus message like UnmarshalMessage, and
+// rejects messages carrying more than maxProofs proofs before any allocation,
+// maxProofs <= 0 means unlimited.
+//
+// Byte fields are always bounded by len(bts), while every proof costs only 2
+// bytes on wire but a whole SignedProto in memory, the limit prevents a crafted
+// message from amplifying its length into a huge allocation.
+func UnmarshalMessageLimit(bts []byte, maxProofs int) (*Message, error) {
+	if maxProofs > 0 && countProofs(bts, maxProofs) > maxProofs {
+		return nil, ErrMessageTooManyProofs
+	}
+
+	m := new(Message)
+	err := proto.Unmarshal(bts, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// countProofs walks the protobuf wire format of a Message and counts the
+// Proof fields, it stops as soon as the count exceeds limit. Malformed input
+// stops the walk, leaving the error to proto.Unmarshal.
+func countProofs(bts []byte, limit int) (count int) {
+	const fieldProof = 5
+	for len(bts) > 0 && count <= limit {
+		key, n := binary.Uvarint(bts)
+		if n <= 0 {
+			return
+		}
+		bts = bts[n:]
+
+		switch key & 0x7 {
+		case 0: // varint
+			_, n = binary.Uvarint(bts)
+			if n <= 0 {
+				return
+			}
+			bts = bts[n:]
+		case 1: // 64-bit
+			if len(bts) < 8 {
+				return
+			}
+			bts = bts[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(bts)
+			if n <= 0 || length > uint64(len(bts)-n) {
+				return
+			}
+			bts = bts[n+int(length):]
+			if key>>3 == fieldProof {
+				count++
+			}
+		case 5: // 32-bit
+			if len(bts) < 4 {
+				return
+			}
+			bts = bts[4:]
+		default:
+			return
+		}
+	}
+	return
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler with a stable layout which
+// is independent of the protobuf definition, for external storage of proofs.
+// The layout(little endian) is:
+//
+// |LayoutVersion(1byte)|Version(4bytes)|Height(8bytes)|Round(8bytes)|X(32bytes)|Y(32bytes)|
+// |len_32bit(R)|R|len_32bit(S)|S|len_32bit(Message)|Message|len_32bit(AuxData)|AuxData|
+//
+// Layout version 1 has no Height and Round, its signature can't be verified
+// since the signed hash binds them, UnmarshalBinary rejects it with
+// ErrBinaryLayoutObsolete.
+func (sp *SignedProto) MarshalBinary() ([]byte, error) {
+	size := 1 + 4 + 8 + 8 + 2*SizeAxis + 4*4 + len(sp.R) + len(sp.S) + len(sp.Message) + len(sp.AuxData)
+	data := make([]byte, 0, size)
+
+	data = append(data, BinaryLayoutVersion)
+	data = appendUint32(data, sp.Version)
+	var u64 [8]byte
+	binary.LittleEndian.PutUint64(u64[:], sp.Height)
+	data = append(data, u64[:]...)
+	binary.LittleEndian.PutUint64(u64[:], sp.Round)
+	data = append(data, u64[:]...)
+	data = append(data, sp.X[:]...)
+	data = append(data, sp.Y[:]...)
+	for _, field := range [][]byte{sp.R, sp.S, sp.Message, sp.AuxData} {
+		data = appendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, it decodes the layout
+// generated by MarshalBinary.
+func (sp *SignedProto) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return ErrBinaryTruncated
+	}
+	switch data[0] {
+	case BinaryLayoutVersion:
+	case 1:
+		return ErrBinaryLayoutObsolete
+	default:
+		return ErrBinaryLayoutVersion
+	}
+	data = data[1:]
+
+	if len(data) < 4+8+8+2*SizeAxis {
+		return ErrBinaryTruncated
+	}
+	version := binary.LittleEndian.Uint32(data)
+	height := binary.LittleEndian.Uint64(data[4:])
+	round := binary.LittleEndian.Uint64(data[12:])
+	data = data[20:]
+
+	var X, Y PubKeyAxis
+	copy(X[:], data[:SizeAxis])
+	copy(Y[:], data[SizeAxis:2*SizeAxis])
+	data = data[2*SizeAxis:]
+
+	var fields [4][]byte
+	for k := range fields {
+		if len(data) < 4 {
+			return ErrBinaryTruncated
+		}
+		length := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if uint64(len(data)) < uint64(length) {
+			return ErrBinaryTruncated
+		}
+		if length > 0 {
+			fields[k] = make([]byte, length)
+			copy(fields[k], data[:length])
+		}
+		data = data[length:]
+	}
+
+	sp.Version = version
+	sp.Height = height
+	sp.Round = round
+	sp.X = X
+	sp.Y = Y
+	sp.R = fields[0]
+	sp.S = fields[1]
+	sp.Message = fields[2]
+	sp.AuxData = fields[3]
+	return nil
+}
+
+// appendUint32 appends a little endian uint32 to data
+func appendUint32(data []byte, v uint32) []byte {
+	var bts [4]byte
+	binary.LittleEndian.PutUint32(bts[:], v)
+	return append(data, bts[:]...)
+}
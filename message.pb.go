@@ -41,6 +41,9 @@ const (
 	MessageType_LockRelease MessageType = 5
 	// MessageDecide = <decide> message
 	MessageType_Decide MessageType = 6
+	// MessageCommitAck = <commit-ack> message, the leader acknowledges a
+	// unicast <commit> if Config.CommitRetransmits is set
+	MessageType_CommitAck MessageType = 7
 )
 
 var MessageType_name = map[int32]string{
@@ -51,6 +54,7 @@ var MessageType_name = map[int32]string{
 	4: "Commit",
 	5: "LockRelease",
 	6: "Decide",
+	7: "CommitAck",
 }
 
 var MessageType_value = map[string]int32{
@@ -61,6 +65,7 @@ var MessageType_value = map[string]int32{
 	"Commit":      4,
 	"LockRelease": 5,
 	"Decide":      6,
+	"CommitAck":   7,
 }
 
 func (x MessageType) String() string {
@@ -79,11 +84,15 @@ type SignedProto struct {
 	// signer's public key
 	X PubKeyAxis `protobuf:"bytes,3,opt,name=x,proto3,customtype=PubKeyAxis" json:"x"`
 	Y PubKeyAxis `protobuf:"bytes,4,opt,name=y,proto3,customtype=PubKeyAxis" json:"y"`
-	// signature r,s for prefix+messages+version+x+y above
+	// signature r,s for prefix+version+height+round+x+y+message
 	R []byte `protobuf:"bytes,5,opt,name=r,proto3" json:"r,omitempty"`
 	S []byte `protobuf:"bytes,6,opt,name=s,proto3" json:"s,omitempty"`
 	// Auxcilliary Data set by user, and send along the signedproto
-	AuxData              []byte   `protobuf:"bytes,7,opt,name=AuxData,proto3" json:"AuxData,omitempty"`
+	AuxData []byte `protobuf:"bytes,7,opt,name=AuxData,proto3" json:"AuxData,omitempty"`
+	// the height & round of Message, signed as dedicated fields to bind the
+	// signature to them, regardless of the message body
+	Height               uint64   `protobuf:"varint,8,opt,name=Height,proto3" json:"Height,omitempty"`
+	Round                uint64   `protobuf:"varint,9,opt,name=Round,proto3" json:"Round,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -157,6 +166,20 @@ func (m *SignedProto) GetAuxData() []byte {
 	return nil
 }
 
+func (m *SignedProto) GetHeight() uint64 {
+	if m != nil {
+		return m.Height
+	}
+	return 0
+}
+
+func (m *SignedProto) GetRound() uint64 {
+	if m != nil {
+		return m.Round
+	}
+	return 0
+}
+
 // Message defines a consensus message
 type Message struct {
 	// Type of this message
@@ -170,10 +193,18 @@ type Message struct {
 	// Proofs related
 	Proof []*SignedProto `protobuf:"bytes,5,rep,name=Proof,proto3" json:"Proof,omitempty"`
 	// for lock-release, it's an embeded <lock> message
-	LockRelease          *SignedProto `protobuf:"bytes,6,opt,name=LockRelease,proto3" json:"LockRelease,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
-	XXX_unrecognized     []byte       `json:"-"`
-	XXX_sizecache        int32        `json:"-"`
+	LockRelease *SignedProto `protobuf:"bytes,6,opt,name=LockRelease,proto3" json:"LockRelease,omitempty"`
+	// Proposed state encoded as a diff against the latest decided state,
+	// replaces State in <roundchange> when Config.StateDiff is set (optional)
+	StateDiff []byte `protobuf:"bytes,7,opt,name=StateDiff,proto3" json:"StateDiff,omitempty"`
+	// the StateHash of the state expected after applying StateDiff
+	StateDiffHash []byte `protobuf:"bytes,8,opt,name=StateDiffHash,proto3" json:"StateDiffHash,omitempty"`
+	// the configuration generation of participants, increments on every
+	// participants change
+	View                 uint64   `protobuf:"varint,9,opt,name=View,proto3" json:"View,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -251,6 +282,27 @@ func (m *Message) GetLockRelease() *SignedProto {
 	return nil
 }
 
+func (m *Message) GetStateDiff() []byte {
+	if m != nil {
+		return m.StateDiff
+	}
+	return nil
+}
+
+func (m *Message) GetStateDiffHash() []byte {
+	if m != nil {
+		return m.StateDiffHash
+	}
+	return nil
+}
+
+func (m *Message) GetView() uint64 {
+	if m != nil {
+		return m.View
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("bdls.MessageType", MessageType_name, MessageType_value)
 	proto.RegisterType((*SignedProto)(nil), "bdls.SignedProto")
@@ -260,32 +312,35 @@ func init() {
 func init() { proto.RegisterFile("message.proto", fileDescriptor_33c57e4bae7b9afd) }
 
 var fileDescriptor_33c57e4bae7b9afd = []byte{
-	// 387 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x92, 0xcb, 0x8a, 0xdb, 0x30,
-	0x14, 0x86, 0x47, 0xe3, 0x4b, 0xca, 0x71, 0xa6, 0x75, 0x45, 0x29, 0xa2, 0x8b, 0x8c, 0x19, 0x28,
-	0x0d, 0x85, 0x7a, 0xa0, 0xf3, 0x04, 0xb9, 0x2c, 0x0a, 0xbd, 0x10, 0x94, 0xbe, 0x80, 0x2f, 0x27,
-	0x8e, 0x69, 0x6c, 0x05, 0x4b, 0x2e, 0xf6, 0xb3, 0xf5, 0x05, 0xb2, 0x2c, 0x5d, 0x76, 0x11, 0x4a,
-	0x9e, 0xa4, 0x48, 0x4a, 0x8a, 0x17, 0x9d, 0x9d, 0x3e, 0xfd, 0xe7, 0x9c, 0xff, 0x3f, 0x42, 0x70,
-	0x53, 0xa1, 0x94, 0x49, 0x81, 0xf1, 0xbe, 0x11, 0x4a, 0x50, 0x37, 0xcd, 0x77, 0xf2, 0xd5, 0xbb,
-	0xa2, 0x54, 0xdb, 0x36, 0x8d, 0x33, 0x51, 0xdd, 0x17, 0xa2, 0x10, 0xf7, 0x46, 0x4c, 0xdb, 0x8d,
-	0x21, 0x03, 0xe6, 0x64, 0x9b, 0xee, 0x7e, 0x10, 0x08, 0xd6, 0x65, 0x51, 0x63, 0xbe, 0x32, 0x43,
-	0x18, 0x8c, 0xbe, 0x63, 0x23, 0x4b, 0x51, 0x33, 0x12, 0x91, 0xe9, 0x0d, 0xbf, 0xa0, 0x56, 0x3e,
-	0x5b, 0x3f, 0x76, 0x1d, 0x91, 0xe9, 0x98, 0x5f, 0x90, 0x46, 0x40, 0x3a, 0xe6, 0xe8, 0xbb, 0x39,
-	0x3d, 0x1c, 0x6f, 0xaf, 0x7e, 0x1f, 0x6f, 0x61, 0xd5, 0xa6, 0x1f, 0xb1, 0x9f, 0x75, 0xa5, 0xe4,
-	0xa4, 0xd3, 0x15, 0x3d, 0x73, 0x1f, 0xaf, 0xe8, 0xe9, 0x18, 0x48, 0xc3, 0x3c, 0x33, 0x97, 0x34,
-	0x9a, 0x24, 0xf3, 0x2d, 0x49, 0xed, 0x3c, 0x6b, 0xbb, 0x65, 0xa2, 0x12, 0x36, 0xb2, 0xce, 0x67,
-	0xbc, 0xfb, 0x45, 0xfe, 0x85, 0xa2, 0xaf, 0xc1, 0xfd, 0xda, 0xef, 0xd1, 0xc4, 0x7e, 0xfa, 0xfe,
-	0x79, 0xac, 0x5f, 0x23, 0x3e, 0x8b, 0x5a, 0xe0, 0x46, 0xa6, 0x2f, 0xc1, 0xff, 0x80, 0x65, 0xb1,
-	0x55, 0x66, 0x0b, 0x97, 0x9f, 0x89, 0xbe, 0x00, 0x8f, 0x8b, 0xb6, 0xce, 0xcd, 0x22, 0x2e, 0xb7,
-	0xa0, 0x6f, 0xd7, 0x2a, 0x51, 0x68, 0xc3, 0x73, 0x0b, 0xf4, 0x0d, 0x78, 0xab, 0x46, 0x88, 0x0d,
-	0xf3, 0x22, 0x67, 0x1a, 0x5c, 0xbc, 0x06, 0xcf, 0xc8, 0xad, 0x4e, 0x1f, 0x20, 0xf8, 0x24, 0xb2,
-	0x6f, 0x1c, 0x77, 0x98, 0x48, 0x34, 0x1b, 0xfd, 0xb7, 0x7c, 0x58, 0xf5, 0x76, 0x03, 0xc1, 0x20,
-	0x36, 0x1d, 0x81, 0xf3, 0x45, 0xec, 0xc3, 0x2b, 0xfa, 0x0c, 0x02, 0x13, 0x6a, 0xb1, 0x4d, 0xea,
-	0x02, 0x43, 0x42, 0x9f, 0x80, 0xab, 0xfb, 0xc2, 0x6b, 0x0a, 0xe0, 0xaf, 0x71, 0x87, 0x99, 0x0a,
-	0x1d, 0x7d, 0x5e, 0x88, 0xaa, 0x2a, 0x55, 0xe8, 0xea, 0x96, 0xc1, 0xe4, 0xd0, 0xd3, 0xe2, 0x12,
-	0xb3, 0x32, 0xc7, 0xd0, 0x9f, 0x8f, 0x0f, 0xa7, 0x09, 0xf9, 0x79, 0x9a, 0x90, 0x3f, 0xa7, 0x09,
-	0x49, 0x7d, 0xf3, 0x1f, 0x1e, 0xfe, 0x06, 0x00, 0x00, 0xff, 0xff, 0xc7, 0x70, 0xbc, 0x34, 0x55,
-	0x02, 0x00, 0x00,
+	// 441 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x92, 0xdf, 0x8a, 0xd3, 0x40,
+	0x14, 0xc6, 0x77, 0x9a, 0x3f, 0xdd, 0x9e, 0xb4, 0x1a, 0x0f, 0x22, 0x83, 0x48, 0x37, 0x2c, 0x8a,
+	0x45, 0xb0, 0x0b, 0xee, 0x13, 0x74, 0xb7, 0x17, 0x0b, 0xfe, 0xa1, 0x4c, 0xc5, 0xfb, 0x24, 0x3d,
+	0x4d, 0xc3, 0xb6, 0x9d, 0x92, 0x49, 0xb4, 0x7d, 0x25, 0x9f, 0x64, 0x2f, 0xbd, 0xf6, 0x62, 0x91,
+	0xde, 0xf9, 0x16, 0x32, 0x33, 0xe9, 0x1a, 0xa1, 0xde, 0x9d, 0xdf, 0xf9, 0xce, 0xcc, 0x37, 0xe7,
+	0x63, 0xa0, 0xb7, 0x22, 0xa5, 0xe2, 0x8c, 0x86, 0x9b, 0x42, 0x96, 0x12, 0xdd, 0x64, 0xb6, 0x54,
+	0xcf, 0xdf, 0x66, 0x79, 0xb9, 0xa8, 0x92, 0x61, 0x2a, 0x57, 0x17, 0x99, 0xcc, 0xe4, 0x85, 0x11,
+	0x93, 0x6a, 0x6e, 0xc8, 0x80, 0xa9, 0xec, 0xa1, 0xf3, 0xdf, 0x0c, 0x82, 0x69, 0x9e, 0xad, 0x69,
+	0x36, 0x31, 0x97, 0x70, 0x68, 0x7f, 0xa5, 0x42, 0xe5, 0x72, 0xcd, 0x59, 0xc4, 0x06, 0x3d, 0x71,
+	0x40, 0xad, 0x7c, 0xb4, 0x7e, 0xbc, 0x15, 0xb1, 0x41, 0x57, 0x1c, 0x10, 0x23, 0x60, 0x5b, 0xee,
+	0xe8, 0xde, 0x15, 0xde, 0xdd, 0x9f, 0x9d, 0xfc, 0xbc, 0x3f, 0x83, 0x49, 0x95, 0xbc, 0xa7, 0xdd,
+	0x68, 0x9b, 0x2b, 0xc1, 0xb6, 0x7a, 0x62, 0xc7, 0xdd, 0xff, 0x4f, 0xec, 0xb0, 0x0b, 0xac, 0xe0,
+	0x9e, 0xb9, 0x97, 0x15, 0x9a, 0x14, 0xf7, 0x2d, 0x29, 0xed, 0x3c, 0xaa, 0xb6, 0xe3, 0xb8, 0x8c,
+	0x79, 0xdb, 0x3a, 0xd7, 0x88, 0xcf, 0xc0, 0xbf, 0xa1, 0x3c, 0x5b, 0x94, 0xfc, 0x34, 0x62, 0x03,
+	0x57, 0xd4, 0x84, 0x4f, 0xc1, 0x13, 0xb2, 0x5a, 0xcf, 0x78, 0xc7, 0xb4, 0x2d, 0x9c, 0x7f, 0x6f,
+	0x3d, 0xac, 0x80, 0xaf, 0xc0, 0xfd, 0xbc, 0xdb, 0x90, 0x59, 0xf2, 0xd1, 0xbb, 0x27, 0x43, 0x9d,
+	0xdd, 0xb0, 0x16, 0xb5, 0x20, 0x8c, 0xdc, 0x30, 0x68, 0x1d, 0x37, 0x70, 0x1a, 0x06, 0xba, 0x3b,
+	0x2d, 0xe3, 0x92, 0xec, 0xaa, 0xc2, 0x02, 0xbe, 0x06, 0x6f, 0x52, 0x48, 0x39, 0xe7, 0x5e, 0xe4,
+	0x0c, 0x82, 0x83, 0x57, 0x23, 0x74, 0x61, 0x75, 0xbc, 0x84, 0xe0, 0x83, 0x4c, 0x6f, 0x05, 0x2d,
+	0x29, 0x56, 0x64, 0xf6, 0x3f, 0x3a, 0xde, 0x9c, 0xc2, 0x17, 0xd0, 0x31, 0x36, 0xe3, 0x7c, 0x3e,
+	0xaf, 0xe3, 0xf9, 0xdb, 0xc0, 0x97, 0xd0, 0x7b, 0x80, 0x9b, 0x58, 0x2d, 0x4c, 0x4e, 0x5d, 0xf1,
+	0x6f, 0x13, 0x11, 0xdc, 0x2f, 0x39, 0x7d, 0xab, 0xd3, 0x32, 0xf5, 0x9b, 0x0a, 0x82, 0x46, 0x1c,
+	0xd8, 0x06, 0xe7, 0x93, 0xdc, 0x84, 0x27, 0xf8, 0x18, 0x02, 0xb3, 0xec, 0xf5, 0x22, 0x5e, 0x67,
+	0x14, 0x32, 0x3c, 0x05, 0x57, 0xbf, 0x27, 0x6c, 0x21, 0x80, 0x3f, 0xa5, 0x25, 0xa5, 0x65, 0xe8,
+	0xe8, 0xfa, 0x5a, 0xae, 0x56, 0x79, 0x19, 0xba, 0xfa, 0x48, 0xe3, 0xc5, 0xa1, 0xa7, 0xc5, 0x31,
+	0xa5, 0xf9, 0x8c, 0x42, 0x1f, 0x7b, 0xd0, 0xb1, 0x83, 0xa3, 0xf4, 0x36, 0x6c, 0x5f, 0x75, 0xef,
+	0xf6, 0x7d, 0xf6, 0x63, 0xdf, 0x67, 0xbf, 0xf6, 0x7d, 0x96, 0xf8, 0xe6, 0x93, 0x5e, 0xfe, 0x19,
+	0x00, 0xf1, 0x16, 0xc4, 0xcc, 0xea, 0x02, 0x00, 0x00,
 }
 
 func (m *SignedProto) Marshal() (dAtA []byte, err error) {
@@ -312,6 +367,16 @@ func (m *SignedProto) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Round != 0 {
+		i = encodeVarintMessage(dAtA, i, uint64(m.Round))
+		i--
+		dAtA[i] = 0x48
+	}
+	if m.Height != 0 {
+		i = encodeVarintMessage(dAtA, i, uint64(m.Height))
+		i--
+		dAtA[i] = 0x40
+	}
 	if len(m.AuxData) > 0 {
 		i -= len(m.AuxData)
 		copy(dAtA[i:], m.AuxData)
@@ -392,6 +457,25 @@ func (m *Message) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.View != 0 {
+		i = encodeVarintMessage(dAtA, i, uint64(m.View))
+		i--
+		dAtA[i] = 0x48
+	}
+	if len(m.StateDiffHash) > 0 {
+		i -= len(m.StateDiffHash)
+		copy(dAtA[i:], m.StateDiffHash)
+		i = encodeVarintMessage(dAtA, i, uint64(len(m.StateDiffHash)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if len(m.StateDiff) > 0 {
+		i -= len(m.StateDiff)
+		copy(dAtA[i:], m.StateDiff)
+		i = encodeVarintMessage(dAtA, i, uint64(len(m.StateDiff)))
+		i--
+		dAtA[i] = 0x3a
+	}
 	if m.LockRelease != nil {
 		{
 			size, err := m.LockRelease.MarshalToSizedBuffer(dAtA[:i])
@@ -483,6 +567,12 @@ func (m *SignedProto) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovMessage(uint64(l))
 	}
+	if m.Height != 0 {
+		n += 1 + sovMessage(uint64(m.Height))
+	}
+	if m.Round != 0 {
+		n += 1 + sovMessage(uint64(m.Round))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -518,6 +608,17 @@ func (m *Message) Size() (n int) {
 		l = m.LockRelease.Size()
 		n += 1 + l + sovMessage(uint64(l))
 	}
+	l = len(m.StateDiff)
+	if l > 0 {
+		n += 1 + l + sovMessage(uint64(l))
+	}
+	l = len(m.StateDiffHash)
+	if l > 0 {
+		n += 1 + l + sovMessage(uint64(l))
+	}
+	if m.View != 0 {
+		n += 1 + sovMessage(uint64(m.View))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -780,6 +881,44 @@ func (m *SignedProto) Unmarshal(dAtA []byte) error {
 				m.AuxData = []byte{}
 			}
 			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Height", wireType)
+			}
+			m.Height = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Height |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Round", wireType)
+			}
+			m.Round = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Round |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -995,6 +1134,93 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StateDiff", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthMessage
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.StateDiff = append(m.StateDiff[:0], dAtA[iNdEx:postIndex]...)
+			if m.StateDiff == nil {
+				m.StateDiff = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StateDiffHash", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthMessage
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.StateDiffHash = append(m.StateDiffHash[:0], dAtA[iNdEx:postIndex]...)
+			if m.StateDiffHash == nil {
+				m.StateDiffHash = []byte{}
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field View", wireType)
+			}
+			m.View = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.View |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
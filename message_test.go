@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"io"
+	"math/big"
 	mrand "math/rand"
 	"testing"
 	"time"
@@ -312,6 +313,169 @@ func TestVerifyMessageUnknownVersion(t *testing.T) {
 	assert.Equal(t, ErrMessageVersion, err)
 }
 
+func TestProtocolVersionMismatch(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+	var mismatched []uint32
+	consensus.onProtocolVersionMismatch = func(version uint32, signed *SignedProto) {
+		mismatched = append(mismatched, version)
+	}
+
+	// a correctly signed message from a peer on the next protocol version
+	m := Message{Type: MessageType_RoundChange, Height: 1, State: State("state")}
+	sp := new(SignedProto)
+	sp.Sign(&m, privateKey)
+	sp.Version = ProtocolVersion + 1
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, sp.Hash())
+	assert.Nil(t, err)
+	sp.R = r.Bytes()
+	sp.S = s.Bytes()
+	assert.True(t, sp.Verify(S256Curve))
+
+	bts, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrProtocolVersionMismatch, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, []uint32{ProtocolVersion + 1}, mismatched)
+
+	// the same message on the current version is accepted
+	sp.Sign(&m, privateKey)
+	bts, err = proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+	assert.Equal(t, 1, len(mismatched))
+}
+
+func TestStaleMessageDropped(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 5, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+	identity := DefaultPubKeyToIdentity(&privateKey.PublicKey)
+
+	// messages of decided heights with broken signatures, they're dropped
+	// before verifying
+	for _, height := range []uint64{1, 5} {
+		for _, mtype := range []MessageType{MessageType_RoundChange, MessageType_Lock, MessageType_Select, MessageType_Commit, MessageType_Decide} {
+			m := Message{Type: mtype, Height: height, State: State("state")}
+			sp := new(SignedProto)
+			sp.Sign(&m, privateKey)
+			_, _ = io.ReadFull(rand.Reader, sp.R)
+			bts, err := proto.Marshal(sp)
+			assert.Nil(t, err)
+			assert.Equal(t, ErrMessageStale, consensus.ReceiveMessage(bts, time.Now()))
+		}
+	}
+	assert.True(t, consensus.ParticipantActivity()[identity].IsZero())
+
+	// the next height is verified
+	m := Message{Type: MessageType_RoundChange, Height: 6, State: State("state")}
+	sp := new(SignedProto)
+	sp.Sign(&m, privateKey)
+	_, _ = io.ReadFull(rand.Reader, sp.R)
+	bts, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMessageSignature, consensus.ReceiveMessage(bts, time.Now()))
+}
+
+func TestSignatureHeightBinding(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+
+	m := Message{Type: MessageType_RoundChange, Height: 1, Round: 0, State: State("state")}
+	sp := new(SignedProto)
+	sp.Sign(&m, privateKey)
+	assert.Equal(t, uint64(1), sp.Height)
+	assert.True(t, sp.Verify(S256Curve))
+
+	// the signed height is covered by the signature
+	replayed := *sp
+	replayed.Height = 2
+	assert.False(t, replayed.Verify(S256Curve))
+	replayed = *sp
+	replayed.Round = 1
+	assert.False(t, replayed.Verify(S256Curve))
+
+	// the vote replayed at another height keeps a valid signature, but
+	// doesn't match the signed height
+	for _, other := range []Message{
+		{Type: MessageType_RoundChange, Height: 2, Round: 0, State: State("state")},
+		{Type: MessageType_RoundChange, Height: 1, Round: 1, State: State("state")},
+	} {
+		replayed = *sp
+		replayed.Message, err = proto.Marshal(&other)
+		assert.Nil(t, err)
+		bts, err := proto.Marshal(&replayed)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrMessageBinding, consensus.ReceiveMessage(bts, time.Now()))
+	}
+
+	// the original vote is accepted
+	bts, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.Nil(t, consensus.ReceiveMessage(bts, time.Now()))
+
+	// binary encoding keeps the height and round
+	bin, err := sp.MarshalBinary()
+	assert.Nil(t, err)
+	decoded := new(SignedProto)
+	assert.Nil(t, decoded.UnmarshalBinary(bin))
+	assert.Equal(t, sp.Height, decoded.Height)
+	assert.Equal(t, sp.Round, decoded.Round)
+	assert.True(t, decoded.Verify(S256Curve))
+}
+
+func TestClockSkewRejected(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+	assert.Nil(t, err)
+	consensus := createConsensus(t, 0, 0, []*ecdsa.PublicKey{&privateKey.PublicKey})
+	consensus.maxClockSkew = time.Minute
+	identity := DefaultPubKeyToIdentity(&privateKey.PublicKey)
+
+	var skewed []Identity
+	consensus.onClockSkew = func(from Identity, m *Message, skew time.Duration) {
+		assert.True(t, skew > time.Minute)
+		skewed = append(skewed, from)
+	}
+
+	now := time.Now()
+	assert.Nil(t, consensus.Update(now))
+
+	receive := func(round uint64) error {
+		m := Message{Type: MessageType_RoundChange, Height: 1, Round: round, State: State("state")}
+		sp := new(SignedProto)
+		sp.Sign(&m, privateKey)
+		bts, err := proto.Marshal(sp)
+		assert.Nil(t, err)
+		return consensus.ReceiveMessage(bts, now)
+	}
+
+	// a round reachable within the tolerance is accepted
+	assert.Nil(t, receive(1))
+	assert.Equal(t, 0, len(skewed))
+
+	// a round implying hours on the height is rejected
+	assert.Equal(t, ErrClockSkew, receive(1000))
+	assert.Equal(t, []Identity{identity}, skewed)
+	assert.Equal(t, ErrClockSkew, receive(1<<40))
+	assert.Equal(t, 2, len(skewed))
+
+	// <decide> is proven by a quorum of <commit>
+	m := Message{Type: MessageType_Decide, Height: 1, Round: 1000, State: State("state")}
+	sp := new(SignedProto)
+	sp.Sign(&m, privateKey)
+	bts, err := proto.Marshal(sp)
+	assert.Nil(t, err)
+	assert.NotEqual(t, ErrClockSkew, consensus.ReceiveMessage(bts, now))
+	assert.Equal(t, 2, len(skewed))
+
+	// rounds within the window of the local round are accepted
+	consensus.switchRound(1000)
+	assert.Nil(t, receive(1000))
+	assert.Equal(t, 2, len(skewed))
+}
+
 func TestVerifyMessageUnknownType(t *testing.T) {
 	// signer
 	privateKey, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
@@ -352,23 +516,23 @@ func TestVerifyMessageUnknownParticipant(t *testing.T) {
 //
 ///////////////////////////////////////////////////////////////////////////////
 func TestVerifyRoundChangeMessageCorrect(t *testing.T) {
-	m, _, privateKey := createRoundChangeMessage(t, 10, 10)
+	m, signed, privateKey := createRoundChangeMessage(t, 10, 10)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
-	err := consensus.verifyRoundChangeMessage(m)
+	err := consensus.verifyRoundChangeMessage(m, signed)
 	assert.Nil(t, err)
 }
 
 func TestVerifyRoundChangeMessageHeight(t *testing.T) {
-	m, _, privateKey := createRoundChangeMessage(t, 20, 10)
+	m, signed, privateKey := createRoundChangeMessage(t, 20, 10)
 	consensus := createConsensus(t, 10, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
-	err := consensus.verifyRoundChangeMessage(m)
+	err := consensus.verifyRoundChangeMessage(m, signed)
 	assert.Equal(t, ErrRoundChangeHeightMismatch, err)
 }
 
 func TestVerifyRoundChangeMessageRound(t *testing.T) {
-	m, _, privateKey := createRoundChangeMessage(t, 20, 9)
+	m, signed, privateKey := createRoundChangeMessage(t, 20, 9)
 	consensus := createConsensus(t, 19, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
-	err := consensus.verifyRoundChangeMessage(m)
+	err := consensus.verifyRoundChangeMessage(m, signed)
 	assert.Equal(t, ErrRoundChangeRoundLower, err)
 }
 
@@ -813,7 +977,7 @@ func TestVerifyCommitMessageCorrect(t *testing.T) {
 	_, err := io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	m, _, privateKey := createCommitMessage(t, 10, 10, state)
+	m, signed, privateKey := createCommitMessage(t, 10, 10, state)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
 
 	// set stage & locked state for verify incoming <commit>
@@ -821,7 +985,7 @@ func TestVerifyCommitMessageCorrect(t *testing.T) {
 	consensus.currentRound.LockedState = state
 	consensus.currentRound.LockedStateHash = consensus.stateHash(state)
 
-	err = consensus.verifyCommitMessage(m)
+	err = consensus.verifyCommitMessage(m, signed)
 	assert.Nil(t, err)
 }
 
@@ -830,13 +994,13 @@ func TestVerifyCommitMessageState(t *testing.T) {
 	_, err := io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	m, _, privateKey := createCommitMessage(t, 10, 10, nil)
+	m, signed, privateKey := createCommitMessage(t, 10, 10, nil)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
 
 	// set stage
 	consensus.currentRound.Stage = stageCommit
 
-	err = consensus.verifyCommitMessage(m)
+	err = consensus.verifyCommitMessage(m, signed)
 	assert.Equal(t, ErrCommitEmptyState, err)
 }
 
@@ -845,13 +1009,13 @@ func TestVerifyCommitMessageHeight(t *testing.T) {
 	_, err := io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	m, _, privateKey := createCommitMessage(t, 1, 10, state)
+	m, signed, privateKey := createCommitMessage(t, 1, 10, state)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
 
 	// set stage
 	consensus.currentRound.Stage = stageCommit
 
-	err = consensus.verifyCommitMessage(m)
+	err = consensus.verifyCommitMessage(m, signed)
 	assert.Equal(t, ErrCommitHeightMismatch, err)
 }
 
@@ -860,13 +1024,13 @@ func TestVerifyCommitMessageRound(t *testing.T) {
 	_, err := io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	m, _, privateKey := createCommitMessage(t, 10, 1, state)
+	m, signed, privateKey := createCommitMessage(t, 10, 1, state)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
 
 	// set stage
 	consensus.currentRound.Stage = stageCommit
 
-	err = consensus.verifyCommitMessage(m)
+	err = consensus.verifyCommitMessage(m, signed)
 	assert.Equal(t, ErrCommitRoundMismatch, err)
 }
 
@@ -875,7 +1039,7 @@ func TestVerifyCommitMessageStateMismatch(t *testing.T) {
 	_, err := io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	m, _, privateKey := createCommitMessage(t, 10, 10, state)
+	m, signed, privateKey := createCommitMessage(t, 10, 10, state)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
 
 	// set stage & random locked state
@@ -884,7 +1048,7 @@ func TestVerifyCommitMessageStateMismatch(t *testing.T) {
 	_, err = io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	err = consensus.verifyCommitMessage(m)
+	err = consensus.verifyCommitMessage(m, signed)
 	assert.Equal(t, ErrCommitStateMismatch, err)
 }
 
@@ -893,13 +1057,13 @@ func TestVerifyCommitMessageStatusInValid(t *testing.T) {
 	_, err := io.ReadFull(rand.Reader, state)
 	assert.Nil(t, err)
 
-	m, _, privateKey := createCommitMessage(t, 10, 10, state)
+	m, signed, privateKey := createCommitMessage(t, 10, 10, state)
 	consensus := createConsensus(t, 9, 10, []*ecdsa.PublicKey{&privateKey.PublicKey})
 
 	// incorrect stage
 	consensus.currentRound.Stage = stageRoundChanging
 
-	err = consensus.verifyCommitMessage(m)
+	err = consensus.verifyCommitMessage(m, signed)
 	assert.Equal(t, ErrCommitStatus, err)
 }
 
@@ -1113,3 +1277,233 @@ func TestMessageMarshalJson(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, sp, sp2)
 }
+
+func TestMessageMarshalBinary(t *testing.T) {
+	_, sp, _, _ := createDecideMessage(t, 10, 1, 0, 1, 0)
+	sp.AuxData = []byte("auxdata")
+	bts, err := sp.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(BinaryLayoutVersion), bts[0])
+
+	sp2 := &SignedProto{}
+	err = sp2.UnmarshalBinary(bts)
+	assert.Nil(t, err)
+	assert.Equal(t, sp, sp2)
+	assert.True(t, sp2.Verify(S256Curve))
+
+	// empty fields
+	sp3 := &SignedProto{}
+	bts, err = sp3.MarshalBinary()
+	assert.Nil(t, err)
+	sp4 := &SignedProto{}
+	assert.Nil(t, sp4.UnmarshalBinary(bts))
+	assert.Equal(t, sp3, sp4)
+
+	// truncated
+	bts, err = sp.MarshalBinary()
+	assert.Nil(t, err)
+	for _, n := range []int{0, 1, 10, 1 + 4 + 2*SizeAxis, len(bts) - 1} {
+		assert.Equal(t, ErrBinaryTruncated, new(SignedProto).UnmarshalBinary(bts[:n]))
+	}
+
+	// unknown layout
+	bts[0] = BinaryLayoutVersion + 1
+	assert.Equal(t, ErrBinaryLayoutVersion, new(SignedProto).UnmarshalBinary(bts))
+
+	// layout version 1 without height and round can't be verified
+	v1 := append([]byte{1}, bts[1:5]...)
+	v1 = append(v1, bts[1+4+8+8:]...)
+	assert.Equal(t, ErrBinaryLayoutObsolete, new(SignedProto).UnmarshalBinary(v1))
+}
+
+func TestMarshalUnmarshalMessages(t *testing.T) {
+	state := make([]byte, 1024)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	var messages []*Message
+	var signed []*SignedProto
+	add := func(m *Message, sp *SignedProto) {
+		messages = append(messages, m)
+		signed = append(signed, sp)
+	}
+
+	m, sp, _ := createRoundChangeMessage(t, 10, 1)
+	add(m, sp)
+	m, sp, _ = createCommitMessage(t, 10, 1, state)
+	add(m, sp)
+	m, sp, _, _ = createLockMessage(t, 10, 10, 1, 10, 1)
+	add(m, sp)
+	m, sp, _, _ = createSelectMessage(t, 10, 10, 1, 10, 1)
+	add(m, sp)
+	m, sp, _, _ = createLockReleaseMessage(t, 10, 10, 1, 10, 1)
+	add(m, sp)
+	m, sp, _, _ = createDecideMessage(t, 10, 10, 1, 10, 1)
+	add(m, sp)
+
+	for k := range messages {
+		// message round trip
+		bts, err := MarshalMessage(messages[k])
+		assert.Nil(t, err)
+		m, err := UnmarshalMessage(bts)
+		assert.Nil(t, err)
+		assert.Equal(t, messages[k].Type, m.Type)
+		assert.Equal(t, messages[k].Height, m.Height)
+		assert.Equal(t, messages[k].Round, m.Round)
+		assert.Equal(t, messages[k].State, m.State)
+		assert.Equal(t, len(messages[k].Proof), len(m.Proof))
+
+		// byte-stability, the signed bytes are reproduced
+		assert.Equal(t, signed[k].Message, bts)
+		bts2, err := MarshalMessage(m)
+		assert.Nil(t, err)
+		assert.Equal(t, bts, bts2)
+
+		// signed message round trip
+		bts, err = MarshalSignedProto(signed[k])
+		assert.Nil(t, err)
+		sp, err := UnmarshalSignedProto(bts)
+		assert.Nil(t, err)
+		assert.Equal(t, signed[k], sp)
+		assert.True(t, sp.Verify(S256Curve))
+
+		bts2, err = MarshalSignedProto(sp)
+		assert.Nil(t, err)
+		assert.Equal(t, bts, bts2)
+	}
+
+	// nil messages
+	_, err = MarshalMessage(nil)
+	assert.Equal(t, ErrMessageIsEmpty, err)
+	_, err = MarshalSignedProto(nil)
+	assert.Equal(t, ErrMessageIsEmpty, err)
+
+	// malformed input
+	_, err = UnmarshalSignedProto([]byte{0xff, 0xff, 0xff})
+	assert.NotNil(t, err)
+	_, err = UnmarshalMessage([]byte{0xff, 0xff, 0xff})
+	assert.NotNil(t, err)
+}
+
+func TestKeyConversions(t *testing.T) {
+	// find a key with leading zeros in X-axis
+	var privateKey *ecdsa.PrivateKey
+	for {
+		key, err := ecdsa.GenerateKey(S256Curve, rand.Reader)
+		assert.Nil(t, err)
+		if len(key.PublicKey.X.Bytes()) < SizeAxis {
+			privateKey = key
+			break
+		}
+	}
+	pubkey := &privateKey.PublicKey
+
+	// public key -> coordinate -> public key
+	coord, err := PubKeyToCoordinate(pubkey)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0), coord[0])
+	pubkey2, err := CoordinateToPubKey(coord, S256Curve)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pubkey.X.Cmp(pubkey2.X))
+	assert.Equal(t, 0, pubkey.Y.Cmp(pubkey2.Y))
+
+	// coordinate -> identity -> coordinate
+	identity := CoordinateToIdentity(coord)
+	assert.Equal(t, DefaultPubKeyToIdentity(pubkey), identity)
+	assert.Equal(t, coord, IdentityToCoordinate(identity))
+
+	// public key -> identity -> public key
+	identity2, err := PubKeyToIdentity(pubkey)
+	assert.Nil(t, err)
+	assert.Equal(t, identity, identity2)
+	pubkey3, err := IdentityToPubKey(identity, S256Curve)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pubkey.X.Cmp(pubkey3.X))
+	assert.Equal(t, 0, pubkey.Y.Cmp(pubkey3.Y))
+
+	// malformed public keys
+	_, err = PubKeyToCoordinate(nil)
+	assert.Equal(t, ErrPubKey, err)
+	_, err = PubKeyToIdentity(&ecdsa.PublicKey{Curve: S256Curve})
+	assert.Equal(t, ErrPubKey, err)
+	oversized := &ecdsa.PublicKey{Curve: S256Curve, X: new(big.Int).Lsh(big.NewInt(1), 8*SizeAxis), Y: pubkey.Y}
+	_, err = PubKeyToCoordinate(oversized)
+	assert.Equal(t, ErrPubKey, err)
+	assert.Panics(t, func() { DefaultPubKeyToIdentity(oversized) })
+
+	// off-curve coordinate
+	coord[2*SizeAxis-1] ^= 0x1
+	_, err = CoordinateToPubKey(coord, S256Curve)
+	assert.Equal(t, ErrPubKeyNotOnCurve, err)
+	_, err = IdentityToPubKey(CoordinateToIdentity(coord), S256Curve)
+	assert.Equal(t, ErrPubKeyNotOnCurve, err)
+}
+
+func TestUnmarshalMessageLimit(t *testing.T) {
+	m := &Message{Type: MessageType_Decide, Height: 1, State: []byte("state")}
+	for i := 0; i < 4; i++ {
+		m.Proof = append(m.Proof, &SignedProto{Message: []byte{byte(i)}})
+	}
+	bts, err := MarshalMessage(m)
+	assert.Nil(t, err)
+
+	decoded, err := UnmarshalMessageLimit(bts, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(decoded.Proof))
+
+	_, err = UnmarshalMessageLimit(bts, 3)
+	assert.Equal(t, ErrMessageTooManyProofs, err)
+
+	decoded, err = UnmarshalMessage(bts)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(decoded.Proof))
+
+	// truncated input is left to protobuf
+	_, err = UnmarshalMessageLimit(bts[:len(bts)-1], 4)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrMessageTooManyProofs, err)
+}
+
+func TestGenerateKeyDeterministic(t *testing.T) {
+	gen := func(seed int64) []*ecdsa.PrivateKey {
+		r := mrand.New(mrand.NewSource(seed))
+		var keys []*ecdsa.PrivateKey
+		for i := 0; i < 4; i++ {
+			key, err := GenerateKey(S256Curve, r)
+			assert.Nil(t, err)
+			assert.True(t, S256Curve.IsOnCurve(key.PublicKey.X, key.PublicKey.Y))
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	a, b, c := gen(1), gen(1), gen(2)
+	for i := range a {
+		assert.Equal(t, a[i].D, b[i].D)
+		assert.Equal(t, a[i].PublicKey.X, b[i].PublicKey.X)
+		assert.NotEqual(t, a[i].D, c[i].D)
+	}
+}
+
+func TestSignWithRandDeterministic(t *testing.T) {
+	key, err := GenerateKey(S256Curve, mrand.New(mrand.NewSource(1)))
+	assert.Nil(t, err)
+
+	m := &Message{Type: MessageType_RoundChange, Height: 1, Round: 1, State: []byte("fixture")}
+	sign := func(seed int64) *SignedProto {
+		sp := new(SignedProto)
+		sp.SignWithRand(m, key, mrand.New(mrand.NewSource(seed)))
+		assert.True(t, sp.Verify(S256Curve))
+		return sp
+	}
+
+	a, b := sign(1), sign(1)
+	assert.Equal(t, a.R, b.R)
+	assert.Equal(t, a.S, b.S)
+	assert.NotEqual(t, a.R, sign(2).R)
+
+	// nil reader falls back to crypto/rand
+	sp := new(SignedProto)
+	sp.SignWithRand(m, key, nil)
+	assert.True(t, sp.Verify(S256Curve))
+}
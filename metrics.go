@@ -0,0 +1,98 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+// MessageHistogramBounds are the inclusive upper bounds of the buckets of
+// Metrics.MessagesPerHeight, the last bucket counts the heights above them.
+var MessageHistogramBounds = []int{16, 64, 256, 1024, 4096}
+
+// Metrics counts consensus messages by type since the consensus was created
+type Metrics struct {
+	Sent     map[MessageType]uint64 // messages signed and sent by myself
+	Received map[MessageType]uint64 // messages accepted by ReceiveMessage, including my own
+	// MessagesPerHeight is the histogram of messages accepted per decided
+	// height, a round change storm shows up in the higher buckets.
+	MessagesPerHeight []uint64
+	// MessagesPerHeightSum is the sum of messages observed in MessagesPerHeight
+	MessagesPerHeightSum uint64
+}
+
+// Metrics returns a snapshot of message counters
+func (c *Consensus) Metrics() Metrics {
+	var metrics Metrics
+	metrics.Sent = make(map[MessageType]uint64)
+	for k, v := range c.sentMessages {
+		metrics.Sent[k] = v
+	}
+	metrics.Received = make(map[MessageType]uint64)
+	for k, v := range c.receivedMessages {
+		metrics.Received[k] = v
+	}
+	metrics.MessagesPerHeight = make([]uint64, len(MessageHistogramBounds)+1)
+	copy(metrics.MessagesPerHeight, c.messageHistogram)
+	metrics.MessagesPerHeightSum = c.messageSum
+	return metrics
+}
+
+// countSent counts a message signed by myself
+func (c *Consensus) countSent(m *Message) {
+	if c.sentMessages == nil {
+		c.sentMessages = make(map[MessageType]uint64)
+	}
+	c.sentMessages[m.Type]++
+}
+
+// countReceived counts a message accepted by ReceiveMessage
+func (c *Consensus) countReceived(m *Message) {
+	if c.receivedMessages == nil {
+		c.receivedMessages = make(map[MessageType]uint64)
+	}
+	c.receivedMessages[m.Type]++
+	c.heightMessages++
+}
+
+// observeHeightMessages puts the messages accepted at the height just closed
+// into the histogram.
+func (c *Consensus) observeHeightMessages() {
+	if c.messageHistogram == nil {
+		c.messageHistogram = make([]uint64, len(MessageHistogramBounds)+1)
+	}
+	bucket := len(MessageHistogramBounds)
+	for k, bound := range MessageHistogramBounds {
+		if c.heightMessages <= bound {
+			bucket = k
+			break
+		}
+	}
+	c.messageHistogram[bucket]++
+	c.messageSum += uint64(c.heightMessages)
+	c.heightMessages = 0
+}
@@ -44,3 +44,9 @@ type PeerInterface interface {
 	// Send a msg to this peer
 	Send(msg []byte) error
 }
+
+// PeerScorer is an optional interface of peers to report how reliable they
+// are, messages are sent to peers with higher score first.
+type PeerScorer interface {
+	Score() float64
+}
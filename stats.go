@@ -0,0 +1,151 @@
+// BSD 3-Clause License
+//
+// Copyright (c) 2020, Sperax
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bdls
+
+import "time"
+
+// Stats is a snapshot of the consensus internals for introspection
+type Stats struct {
+	Height      uint64 // latest decided height
+	Round       uint64 // current round of the next height
+	Rounds      int    // rounds in progress of the next height
+	Unconfirmed int    // states awaiting to be decided
+	MemoryUsage int64  // approximate bytes retained, see ApproxMemoryUsage
+
+	Latency         time.Duration // latency set by SetLatency
+	LatencyEstimate time.Duration // latency estimated from observed round-trips, 0 before any
+	LatencySamples  int           // round-trips observed for LatencyEstimate
+}
+
+// Stats returns a snapshot of the consensus internals
+func (c *Consensus) Stats() Stats {
+	var stats Stats
+	stats.Height = c.latestHeight
+	stats.Round = c.currentRound.RoundNumber
+	stats.Rounds = c.rounds.Len()
+	stats.Unconfirmed = len(c.unconfirmed)
+	stats.MemoryUsage = c.ApproxMemoryUsage()
+	stats.Latency = c.latency
+	stats.LatencyEstimate = c.rtt.estimate()
+	stats.LatencySamples = c.rtt.samples
+	return stats
+}
+
+// latencyEstimator smooths the observed round-trips like the SRTT of TCP
+// (RFC 6298) with alpha = 1/8. The round-trips are measured by the leader
+// from its <lock> to the <commit> of each participant, and by participants
+// from a unicast <commit> to its <commit-ack>.
+type latencyEstimator struct {
+	srtt    time.Duration
+	samples int
+}
+
+// observe adds a round-trip sample, non-positive samples are ignored
+func (e *latencyEstimator) observe(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+
+	if e.samples == 0 {
+		e.srtt = rtt
+	} else {
+		e.srtt += (rtt - e.srtt) / 8
+	}
+	e.samples++
+}
+
+// estimate returns the one-way latency, ie. half of the smoothed round-trip
+func (e *latencyEstimator) estimate() time.Duration { return e.srtt / 2 }
+
+// ApproxMemoryUsage returns the approximate payload bytes retained by consensus
+func (c *Consensus) ApproxMemoryUsage() int64 {
+	size := int64(len(c.latestState)) + signedSize(c.latestProof)
+	for _, s := range c.unconfirmed {
+		size += int64(len(s))
+	}
+
+	for elem := c.rounds.Front(); elem != nil; elem = elem.Next() {
+		cr := elem.Value.(*consensusRound)
+		for k := range cr.roundChanges {
+			size += tupleSize(&cr.roundChanges[k])
+		}
+		for k := range cr.commits {
+			size += tupleSize(&cr.commits[k])
+		}
+	}
+
+	for k := range c.locks {
+		size += tupleSize(&c.locks[k])
+	}
+
+	for _, bts := range c.loopback {
+		size += int64(len(bts))
+	}
+	for k := range c.reorderBuffer {
+		size += int64(len(c.reorderBuffer[k].bts))
+	}
+	for k := range c.diffBuffer {
+		size += int64(len(c.diffBuffer[k].bts))
+	}
+
+	for k := range c.justifications {
+		for _, commit := range c.justifications[k].commits {
+			size += signedSize(commit)
+		}
+	}
+	return size
+}
+
+// tupleSize returns the payload size of a message tuple
+func tupleSize(t *messageTuple) int64 {
+	return messageSize(t.Message) + signedSize(t.Signed)
+}
+
+// messageSize returns the payload size of a decoded message
+func messageSize(m *Message) int64 {
+	if m == nil {
+		return 0
+	}
+
+	size := int64(len(m.State) + len(m.StateDiff) + len(m.StateDiffHash))
+	for _, proof := range m.Proof {
+		size += signedSize(proof)
+	}
+	return size + signedSize(m.LockRelease)
+}
+
+// signedSize returns the payload size of a signed message
+func signedSize(sp *SignedProto) int64 {
+	if sp == nil {
+		return 0
+	}
+	return int64(len(sp.Message) + 2*SizeAxis + len(sp.R) + len(sp.S) + len(sp.AuxData))
+}
@@ -0,0 +1,159 @@
+package bdls
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApproxMemoryUsage(t *testing.T) {
+	peers := createIPCPeers(t, createTestKeys(t, 4), nil)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	const stateSize = 1024 * 1024
+	state := make([]byte, stateSize)
+	_, err := io.ReadFull(rand.Reader, state)
+	assert.Nil(t, err)
+
+	peers[0].Lock()
+	defer peers[0].Unlock()
+	c := peers[0].c
+	initial := c.ApproxMemoryUsage()
+	assert.True(t, initial < stateSize)
+
+	// unconfirmed state
+	assert.Nil(t, c.Propose(state))
+	proposed := c.ApproxMemoryUsage()
+	assert.True(t, proposed >= initial+stateSize)
+
+	// <roundchange> of myself is kept in round data once the timeout passes
+	assert.Nil(t, c.Update(time.Now().Add(time.Minute)))
+	inflight := c.ApproxMemoryUsage()
+	assert.True(t, inflight >= proposed+stateSize)
+
+	stats := c.Stats()
+	assert.Equal(t, inflight, stats.MemoryUsage)
+	assert.Equal(t, 1, stats.Unconfirmed)
+	assert.Equal(t, uint64(0), stats.Height)
+
+	// released by opening a new height
+	c.Reset(1, State("small"))
+	assert.True(t, c.ApproxMemoryUsage() < stateSize)
+	assert.Equal(t, uint64(1), c.Stats().Height)
+}
+
+func TestMetrics(t *testing.T) {
+	peers := createIPCPeers(t, createTestKeys(t, 4), nil)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	metrics := peers[0].c.Metrics()
+	assert.Zero(t, len(metrics.Sent))
+	assert.Zero(t, len(metrics.Received))
+	assert.Equal(t, len(MessageHistogramBounds)+1, len(metrics.MessagesPerHeight))
+
+	for _, peer := range peers {
+		peer.Update()
+	}
+
+	const heights = 3
+	for h := uint64(1); h <= heights; h++ {
+		decideIPCHeight(t, peers, h)
+	}
+
+	var decided uint64
+	for _, peer := range peers {
+		peer.Lock()
+		metrics := peer.c.Metrics()
+		height := peer.c.latestHeight
+		peer.Unlock()
+
+		// a height is decided either by my own <decide> as the leader, or by
+		// accepting the leader's
+		assert.Equal(t, height, metrics.Sent[MessageType_Decide]+metrics.Received[MessageType_Decide])
+		assert.NotZero(t, metrics.Sent[MessageType_RoundChange])
+		assert.NotZero(t, metrics.Received[MessageType_RoundChange])
+
+		var observed uint64
+		for _, count := range metrics.MessagesPerHeight {
+			observed += count
+		}
+		assert.Equal(t, height, observed)
+		assert.True(t, metrics.MessagesPerHeightSum >= height)
+		decided += metrics.Sent[MessageType_Decide]
+	}
+	assert.NotZero(t, decided)
+}
+
+func TestLatencyEstimate(t *testing.T) {
+	// the estimator converges to the new round-trip
+	var e latencyEstimator
+	assert.Equal(t, time.Duration(0), e.estimate())
+	e.observe(0)
+	assert.Equal(t, 0, e.samples)
+	e.observe(200 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, e.estimate())
+	for i := 0; i < 64; i++ {
+		e.observe(20 * time.Millisecond)
+	}
+	assert.InDelta(t, float64(10*time.Millisecond), float64(e.estimate()), float64(time.Millisecond))
+
+	keys := createTestKeys(t, 4)
+
+	// IPC peers deliver messages in 10ms
+	peers := createIPCPeers(t, keys, func(config *Config) {
+		config.EnableCommitUnicast = true
+		config.CommitRetransmits = 3
+	})
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for i := range peers {
+		peers[i].Lock()
+		assert.Equal(t, 50*time.Millisecond, peers[i].c.Latency())
+		assert.Equal(t, 50*time.Millisecond, peers[i].c.Stats().Latency)
+		peers[i].Unlock()
+		peers[i].Update()
+	}
+	for height := uint64(1); height <= 3; height++ {
+		decideIPCHeight(t, peers, height)
+	}
+
+	// leaders measure <lock> to <commit>, participants <commit> to <commit-ack>
+	samples := 0
+	for i := range peers {
+		peers[i].Lock()
+		stats := peers[i].c.Stats()
+		peers[i].Unlock()
+		samples += stats.LatencySamples
+		if stats.LatencySamples > 0 {
+			assert.True(t, stats.LatencyEstimate >= 5*time.Millisecond, stats.LatencyEstimate)
+			assert.True(t, stats.LatencyEstimate <= 40*time.Millisecond, stats.LatencyEstimate)
+		}
+	}
+	assert.True(t, samples > 0)
+
+	// a <lock> is not timed across rounds and heights
+	c := createConsensus(t, 0, 0, createTestPublicKeys(keys[:3]))
+	c.lockSentAt = time.Now()
+	c.switchRound(0)
+	assert.False(t, c.lockSentAt.IsZero())
+	c.switchRound(1)
+	assert.True(t, c.lockSentAt.IsZero())
+	c.lockSentAt = time.Now()
+	c.heightSync(1, 1, State("state"), time.Now())
+	assert.True(t, c.lockSentAt.IsZero())
+}